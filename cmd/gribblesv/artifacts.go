@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"go.spiff.io/gribble/internal/artifact"
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+	"go.spiff.io/gribble/internal/proc"
+	"go.uber.org/zap"
+)
+
+var (
+	errArtifactTooLarge = errors.New("artifact exceeds maximum size")
+
+	validArtifactType = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+)
+
+// sizeLimitReader reads from a reader until more than max bytes have been read, at which point it
+// returns errArtifactTooLarge.
+type sizeLimitReader struct {
+	r   io.Reader
+	max int64
+	n   int64
+}
+
+func (s *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	if s.max > 0 && s.n > s.max {
+		return n, errArtifactTooLarge
+	}
+	return n, err
+}
+
+// artifactKey returns the artifact store key for a job's artifact of the given type.
+func artifactKey(job int64, typ string) string {
+	return "jobs/" + strconv.FormatInt(job, 10) + "/" + typ
+}
+
+// nextFilePart returns the next part of a multipart upload with the form name "file".
+func nextFilePart(mr *multipart.Reader) (*multipart.Part, error) {
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+		_ = part.Close()
+	}
+}
+
+func (s *Server) UploadArtifacts(w http.ResponseWriter, req *http.Request, params httprouter.Params) (code int, msg interface{}) {
+	ctx := req.Context()
+	id, ok := jobID(params)
+	if !ok {
+		return http.StatusNotFound, nil
+	}
+
+	job, err := s.getJobByToken(ctx, id, req.Header.Get("JOB-TOKEN"))
+	if code := jobFetchErrorCode(err); err != nil {
+		if code == http.StatusInternalServerError {
+			proc.Error(ctx, "Error fetching job", zap.Int64("job_id", id), zap.Error(err))
+		}
+		return code, nil
+	}
+	if job.State != gciwire.Running {
+		return http.StatusForbidden, nil
+	}
+
+	query := req.URL.Query()
+	meta := &com.Artifact{
+		Job:      job.ID,
+		Type:     query.Get("artifact_type"),
+		Format:   gciwire.ArtifactFormat(query.Get("artifact_format")),
+		ExpireIn: query.Get("expire_in"),
+	}
+	if meta.Type == "" {
+		meta.Type = com.ArtifactArchive
+	}
+	if meta.Format == gciwire.ArtifactFormatDefault {
+		meta.Format = gciwire.ArtifactFormatZip
+	}
+	switch meta.Format {
+	case gciwire.ArtifactFormatZip, gciwire.ArtifactFormatGzip, gciwire.ArtifactFormatRaw:
+	default:
+		return http.StatusBadRequest, errBadRequest
+	}
+	if !validArtifactType.MatchString(meta.Type) {
+		return http.StatusBadRequest, errBadRequest
+	}
+
+	if meta.ExpireIn == "" {
+		if s.artifactExpiry > 0 {
+			meta.Expires = proc.Now(ctx).Add(s.artifactExpiry)
+		}
+	} else if expireIn, never, err := artifact.ParseExpireIn(meta.ExpireIn); err != nil {
+		proc.Warn(ctx, "Invalid artifact expiry", zap.Int64("job_id", id), zap.Error(err))
+		return http.StatusBadRequest, errBadRequest
+	} else if !never {
+		meta.Expires = proc.Now(ctx).Add(expireIn)
+	}
+
+	// The content length includes multipart overhead, so this only rejects uploads that are
+	// definitely too large. Uploads are also limited while reading them.
+	if s.artifactMaxSize > 0 && req.ContentLength > s.artifactMaxSize+megabyte {
+		return http.StatusRequestEntityTooLarge, nil
+	}
+
+	mr, err := req.MultipartReader()
+	if err != nil {
+		return http.StatusBadRequest, errBadRequest
+	}
+	part, err := nextFilePart(mr)
+	if err != nil {
+		proc.Warn(ctx, "No file in artifact upload", zap.Int64("job_id", id), zap.Error(err))
+		return http.StatusBadRequest, errBadRequest
+	}
+	defer part.Close()
+
+	meta.Filename = part.FileName()
+	meta.Key = artifactKey(job.ID, meta.Type)
+
+	hash := sha256.New()
+	body := io.TeeReader(&sizeLimitReader{r: part, max: s.artifactMaxSize}, hash)
+	size, err := s.artifacts.Put(ctx, meta.Key, body)
+	if err == errArtifactTooLarge {
+		proc.Warn(ctx, "Artifact exceeds maximum size",
+			zap.Int64("job_id", id),
+			zap.String("artifact_type", meta.Type),
+			zap.Int64("max_size", s.artifactMaxSize),
+		)
+		return http.StatusRequestEntityTooLarge, nil
+	} else if err != nil {
+		proc.Error(ctx, "Error storing artifact", zap.Int64("job_id", id), zap.Error(err))
+		return http.StatusInternalServerError, nil
+	}
+
+	meta.Size = size
+	meta.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	if err := s.db.CreateArtifact(ctx, meta); err != nil {
+		proc.Error(ctx, "Error recording artifact", zap.Int64("job_id", id), zap.Error(err))
+		return http.StatusInternalServerError, nil
+	}
+
+	proc.Info(ctx, "Artifact uploaded",
+		zap.Int64("job_id", id),
+		zap.String("artifact_type", meta.Type),
+		zap.Int64("size", meta.Size),
+	)
+
+	return http.StatusCreated, nil
+}
+
+// DownloadArtifacts writes a job's artifact archive in response to a request from a job that
+// depends on it. The request's JOB-TOKEN must be the token of the dependent job.
+func (s *Server) DownloadArtifacts(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	ctx := req.Context()
+	id, ok := jobID(params)
+	if !ok {
+		writeRep(w, http.StatusNotFound, nil, req)
+		return
+	}
+
+	allowed, err := s.db.CanFetchArtifacts(ctx, id, hashToken(req.Header.Get("JOB-TOKEN")))
+	if err != nil {
+		proc.Error(ctx, "Error authorizing artifact download", zap.Int64("job_id", id), zap.Error(err))
+		writeRep(w, http.StatusInternalServerError, nil, req)
+		return
+	} else if !allowed {
+		writeRep(w, http.StatusForbidden, nil, req)
+		return
+	}
+
+	meta, err := s.db.GetArtifact(ctx, id, com.ArtifactArchive)
+	if err == com.ErrNotFound {
+		writeRep(w, http.StatusNotFound, nil, req)
+		return
+	} else if err != nil {
+		proc.Error(ctx, "Error fetching artifact", zap.Int64("job_id", id), zap.Error(err))
+		writeRep(w, http.StatusInternalServerError, nil, req)
+		return
+	}
+
+	blob, err := s.artifacts.Open(ctx, meta.Key)
+	if os.IsNotExist(err) {
+		proc.Warn(ctx, "Artifact blob is missing", zap.Int64("job_id", id), zap.String("key", meta.Key))
+		writeRep(w, http.StatusNotFound, nil, req)
+		return
+	} else if err != nil {
+		proc.Error(ctx, "Error opening artifact", zap.Int64("job_id", id), zap.Error(err))
+		writeRep(w, http.StatusInternalServerError, nil, req)
+		return
+	}
+	defer blob.Close()
+
+	header := w.Header()
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+	if meta.Filename != "" {
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": meta.Filename,
+		}))
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, blob); err != nil {
+		proc.Warn(ctx, "Error writing artifact", zap.Int64("job_id", id), zap.Error(err))
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+	"go.spiff.io/gribble/internal/proc"
+	"go.uber.org/zap"
+)
+
+// Bitbucket Cloud and Bitbucket Server send webhooks to the same endpoint. Bitbucket Server
+// signs its webhooks, and they are validated using an X-Hub-Signature header. Bitbucket Cloud
+// cannot sign webhooks, so its webhook URLs must include a secret query parameter instead.
+//
+// Only the fields gribble uses are declared in the payloads below.
+
+type bitbucketLink struct {
+	Href string `json:"href"`
+	Name string `json:"name"`
+}
+
+// Bitbucket Cloud payloads
+
+type bitbucketCloudRepository struct {
+	UUID     string `json:"uuid"`
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+	Links    struct {
+		HTML bitbucketLink `json:"html"`
+	} `json:"links"`
+}
+
+type bitbucketCloudRef struct {
+	Type   string `json:"type"` // branch or tag
+	Name   string `json:"name"`
+	Target struct {
+		Hash string `json:"hash"`
+	} `json:"target"`
+}
+
+type bitbucketCloudPushEvent struct {
+	Repository *bitbucketCloudRepository `json:"repository"`
+	Push       struct {
+		Changes []struct {
+			Old *bitbucketCloudRef `json:"old"`
+			New *bitbucketCloudRef `json:"new"`
+		} `json:"changes"`
+	} `json:"push"`
+}
+
+type bitbucketCloudEndpoint struct {
+	Branch struct {
+		Name string `json:"name"`
+	} `json:"branch"`
+	Commit struct {
+		Hash string `json:"hash"`
+	} `json:"commit"`
+	Repository *bitbucketCloudRepository `json:"repository"`
+}
+
+type bitbucketCloudPullRequestEvent struct {
+	Repository  *bitbucketCloudRepository `json:"repository"`
+	PullRequest *struct {
+		ID    int64  `json:"id"`
+		Title string `json:"title"`
+		Links struct {
+			HTML bitbucketLink `json:"html"`
+		} `json:"links"`
+		Source      bitbucketCloudEndpoint `json:"source"`
+		Destination bitbucketCloudEndpoint `json:"destination"`
+	} `json:"pullrequest"`
+}
+
+// Bitbucket Server payloads
+
+type bitbucketServerRepository struct {
+	ID      int64  `json:"id"`
+	Slug    string `json:"slug"`
+	Name    string `json:"name"`
+	Project struct {
+		Key string `json:"key"`
+	} `json:"project"`
+	Links struct {
+		Clone []bitbucketLink `json:"clone"`
+		Self  []bitbucketLink `json:"self"`
+	} `json:"links"`
+}
+
+type bitbucketServerRef struct {
+	ID           string                     `json:"id"` // A full ref
+	DisplayID    string                     `json:"displayId"`
+	LatestCommit string                     `json:"latestCommit"`
+	Repository   *bitbucketServerRepository `json:"repository"`
+}
+
+type bitbucketServerPushEvent struct {
+	Repository *bitbucketServerRepository `json:"repository"`
+	Changes    []struct {
+		Ref      bitbucketServerRef `json:"ref"`
+		FromHash string             `json:"fromHash"`
+		ToHash   string             `json:"toHash"`
+		Type     string             `json:"type"` // ADD, UPDATE or DELETE
+	} `json:"changes"`
+}
+
+type bitbucketServerPullRequestEvent struct {
+	PullRequest *struct {
+		ID    int64  `json:"id"`
+		Title string `json:"title"`
+		Links struct {
+			Self []bitbucketLink `json:"self"`
+		} `json:"links"`
+		FromRef bitbucketServerRef `json:"fromRef"`
+		ToRef   bitbucketServerRef `json:"toRef"`
+	} `json:"pullRequest"`
+}
+
+func (s *Server) BitbucketEvent(w http.ResponseWriter, req *http.Request, params httprouter.Params) (code int, msg interface{}) {
+	ctx := req.Context()
+	body, err := readWebhook(req)
+	if err == errWebhookTooLarge {
+		return http.StatusRequestEntityTooLarge, nil
+	} else if err != nil {
+		return http.StatusBadRequest, errBadRequest
+	}
+
+	if !s.validBitbucketRequest(req, body) {
+		return http.StatusForbidden, nil
+	}
+	authenticated(ctx)
+
+	typ := req.Header.Get("X-Event-Key")
+	switch typ {
+	case "repo:push", "pullrequest:created", "pullrequest:updated": // Cloud
+	case "repo:refs_changed", "pr:opened", "pr:from_ref_updated": // Server
+	case "diagnostics:ping":
+		return http.StatusOK, nil
+	default:
+		return http.StatusNotFound, nil
+	}
+
+	evs, err := bitbucketEvents(typ, body)
+	if err != nil {
+		proc.Warn(ctx, "Invalid Bitbucket webhook payload", zap.String("type", typ), zap.Error(err))
+		return http.StatusBadRequest, errBadRequest
+	}
+	if typ == "pullrequest:updated" {
+		if evs, err = s.newPullRequestCommits(ctx, evs); err != nil {
+			proc.Error(ctx, "Error checking pull request commit", zap.Error(err))
+			return http.StatusInternalServerError, nil
+		}
+	}
+	return s.eventsResponse(ctx, "bitbucket", typ, evs)
+}
+
+// newPullRequestCommits returns the pull request events whose head commit differs from the newest
+// pipeline of their pull request. Bitbucket Cloud sends pullrequest:updated for any change to a
+// pull request, such as its title, so only updates with new commits create pipelines.
+func (s *Server) newPullRequestCommits(ctx context.Context, evs []*com.Event) ([]*com.Event, error) {
+	var changed []*com.Event
+	for _, ev := range evs {
+		sha, err := s.db.GetPullRequestSHA(ctx, &ev.Project, ev.PullRequest.Number)
+		if err != nil && err != com.ErrNotFound {
+			return nil, err
+		} else if sha == ev.After {
+			proc.Debug(ctx, "Ignoring pull request update without new commits",
+				zap.String("project", ev.Project.Path),
+				zap.Int64("pull_request", ev.PullRequest.Number),
+				zap.String("sha", ev.After),
+			)
+			continue
+		}
+		changed = append(changed, ev)
+	}
+	return changed, nil
+}
+
+// validBitbucketRequest returns true if the request is signed with the Bitbucket Server secret
+// or has the Bitbucket Cloud secret as its secret query parameter.
+func (s *Server) validBitbucketRequest(req *http.Request, body []byte) bool {
+	if sig := req.Header.Get("X-Hub-Signature"); sig != "" {
+		return len(s.bitbucketServerSecret) > 0 &&
+			strings.HasPrefix(sig, "sha256=") &&
+			validHMACSHA256(s.bitbucketServerSecret, body, strings.TrimPrefix(sig, "sha256="))
+	}
+	secret := []byte(req.URL.Query().Get("secret"))
+	return len(s.bitbucketCloudSecret) > 0 &&
+		subtle.ConstantTimeCompare(secret, s.bitbucketCloudSecret) == 1
+}
+
+// bitbucketEvents parses a Bitbucket webhook payload of the given type and returns its events.
+// A single push may update several refs, so it may have several events.
+func bitbucketEvents(typ string, body []byte) ([]*com.Event, error) {
+	var evs []*com.Event
+	var err error
+	switch typ {
+	case "repo:push":
+		var push bitbucketCloudPushEvent
+		if err = json.Unmarshal(body, &push); err == nil {
+			evs = bitbucketCloudPushEvents(&push)
+		}
+	case "pullrequest:created", "pullrequest:updated":
+		var pr bitbucketCloudPullRequestEvent
+		if err = json.Unmarshal(body, &pr); err == nil {
+			evs = appendEvent(evs, bitbucketCloudPullRequestPipelineEvent(&pr))
+		}
+	case "repo:refs_changed":
+		var push bitbucketServerPushEvent
+		if err = json.Unmarshal(body, &push); err == nil {
+			evs = bitbucketServerPushEvents(&push)
+		}
+	case "pr:opened", "pr:from_ref_updated":
+		var pr bitbucketServerPullRequestEvent
+		if err = json.Unmarshal(body, &pr); err == nil {
+			evs = appendEvent(evs, bitbucketServerPullRequestPipelineEvent(&pr))
+		}
+	}
+	return evs, err
+}
+
+func appendEvent(evs []*com.Event, ev *com.Event) []*com.Event {
+	if ev == nil {
+		return evs
+	}
+	return append(evs, ev)
+}
+
+func bitbucketCloudProject(repo *bitbucketCloudRepository) com.Project {
+	return com.Project{
+		Source:   "bitbucket",
+		SourceID: repo.UUID,
+		Name:     repo.Name,
+		Path:     repo.FullName,
+		URL:      repo.Links.HTML.Href,
+		CloneURL: "https://bitbucket.org/" + repo.FullName + ".git",
+	}
+}
+
+func bitbucketCloudPushEvents(push *bitbucketCloudPushEvent) (evs []*com.Event) {
+	if push.Repository == nil {
+		return nil
+	}
+	for _, change := range push.Push.Changes {
+		ref := change.New
+		if ref == nil || ref.Target.Hash == "" {
+			// The ref was deleted.
+			continue
+		}
+		refType := gciwire.RefTypeBranch
+		switch ref.Type {
+		case "branch":
+		case "tag", "annotated_tag":
+			refType = gciwire.RefTypeTag
+		default:
+			continue
+		}
+		before := com.ZeroSHA
+		if change.Old != nil {
+			before = change.Old.Target.Hash
+		}
+		evs = append(evs, &com.Event{
+			Kind:    com.EventPush,
+			Project: bitbucketCloudProject(push.Repository),
+			Ref:     ref.Name,
+			RefType: refType,
+			Before:  before,
+			After:   ref.Target.Hash,
+		})
+	}
+	return evs
+}
+
+// bitbucketCloudPullRequestPipelineEvent returns the event for a Bitbucket Cloud pull request.
+// Bitbucket Cloud has no refs for pull requests, so the runner fetches the source branch. This
+// means pull requests from forks can't be fetched from the target repository.
+func bitbucketCloudPullRequestPipelineEvent(event *bitbucketCloudPullRequestEvent) *com.Event {
+	pr := event.PullRequest
+	if pr == nil || event.Repository == nil || pr.Source.Commit.Hash == "" {
+		return nil
+	}
+	src, dest := &pr.Source, &pr.Destination
+
+	var sourcePath, sourceURL string
+	fork := false
+	if src.Repository != nil {
+		sourcePath, sourceURL = src.Repository.FullName, src.Repository.Links.HTML.Href
+		fork = src.Repository.UUID != event.Repository.UUID
+	}
+	return &com.Event{
+		Kind:    com.EventPullRequest,
+		Project: bitbucketCloudProject(event.Repository),
+		Ref:     src.Branch.Name,
+		RefType: gciwire.RefTypeBranch,
+		Before:  com.ZeroSHA,
+		After:   src.Commit.Hash,
+		PullRequest: &com.PullRequest{
+			Number:       pr.ID,
+			Title:        pr.Title,
+			URL:          pr.Links.HTML.Href,
+			HeadRef:      "refs/heads/" + src.Branch.Name,
+			SourceBranch: src.Branch.Name,
+			SourcePath:   sourcePath,
+			SourceURL:    sourceURL,
+			TargetBranch: dest.Branch.Name,
+			TargetSHA:    dest.Commit.Hash,
+			Fork:         fork,
+		},
+	}
+}
+
+// firstLink returns the href of the first link with the given name, or of the first link if
+// name is empty.
+func firstLink(links []bitbucketLink, name string) string {
+	for _, link := range links {
+		if name == "" || link.Name == name {
+			return link.Href
+		}
+	}
+	return ""
+}
+
+func bitbucketServerProject(repo *bitbucketServerRepository) com.Project {
+	return com.Project{
+		Source:   "bitbucket-server",
+		SourceID: strconv.FormatInt(repo.ID, 10),
+		Name:     repo.Name,
+		Path:     repo.Project.Key + "/" + repo.Slug,
+		URL:      firstLink(repo.Links.Self, ""),
+		CloneURL: firstLink(repo.Links.Clone, "http"),
+	}
+}
+
+func bitbucketServerPushEvents(push *bitbucketServerPushEvent) (evs []*com.Event) {
+	if push.Repository == nil {
+		return nil
+	}
+	for _, change := range push.Changes {
+		if change.Type == "DELETE" || change.ToHash == "" || com.IsZeroSHA(change.ToHash) {
+			continue
+		}
+		ref, refType, ok := com.ParseRef(change.Ref.ID)
+		if !ok {
+			continue
+		}
+		evs = append(evs, &com.Event{
+			Kind:    com.EventPush,
+			Project: bitbucketServerProject(push.Repository),
+			Ref:     ref,
+			RefType: refType,
+			Before:  change.FromHash,
+			After:   change.ToHash,
+		})
+	}
+	return evs
+}
+
+func bitbucketServerPullRequestPipelineEvent(event *bitbucketServerPullRequestEvent) *com.Event {
+	pr := event.PullRequest
+	if pr == nil || pr.ToRef.Repository == nil || pr.FromRef.LatestCommit == "" {
+		return nil
+	}
+	from, to := &pr.FromRef, &pr.ToRef
+
+	var sourcePath, sourceURL string
+	fork := false
+	if repo := from.Repository; repo != nil {
+		sourcePath, sourceURL = repo.Project.Key+"/"+repo.Slug, firstLink(repo.Links.Self, "")
+		fork = repo.ID != to.Repository.ID
+	}
+	return &com.Event{
+		Kind:    com.EventPullRequest,
+		Project: bitbucketServerProject(to.Repository),
+		Ref:     from.DisplayID,
+		RefType: gciwire.RefTypeBranch,
+		Before:  com.ZeroSHA,
+		After:   from.LatestCommit,
+		PullRequest: &com.PullRequest{
+			Number:       pr.ID,
+			Title:        pr.Title,
+			URL:          firstLink(pr.Links.Self, ""),
+			HeadRef:      "refs/pull-requests/" + strconv.FormatInt(pr.ID, 10) + "/from",
+			SourceBranch: from.DisplayID,
+			SourcePath:   sourcePath,
+			SourceURL:    sourceURL,
+			TargetBranch: to.DisplayID,
+			TargetSHA:    to.LatestCommit,
+			Fork:         fork,
+		},
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	com "go.spiff.io/gribble/internal/common"
+)
+
+const (
+	testBitbucketServerSecret = "bitbucket-server-secret"
+	testBitbucketCloudSecret  = "bitbucket-cloud-secret"
+)
+
+func newBitbucketServer(t *testing.T) *testServer {
+	return newPipelineServer(t, &ServerConfig{
+		BitbucketServerSecret: testBitbucketServerSecret,
+		BitbucketCloudSecret:  testBitbucketCloudSecret,
+	})
+}
+
+func TestBitbucketCloudEvent(t *testing.T) {
+	s := newBitbucketServer(t)
+	defer s.Close()
+	runner := s.CreateRunner(t, "runner")
+
+	push := []byte(`{
+		"repository": {
+			"uuid": "{d5c2a0c1-0000-4000-8000-000000000001}",
+			"name": "repo",
+			"full_name": "team/repo",
+			"links": {"html": {"href": "https://bitbucket.org/team/repo"}}
+		},
+		"push": {"changes": [
+			{
+				"old": {"type": "branch", "name": "main", "target": {"hash": "1111111111111111111111111111111111111111"}},
+				"new": {"type": "branch", "name": "main", "target": {"hash": "2222222222222222222222222222222222222222"}}
+			},
+			{
+				"old": null,
+				"new": {"type": "tag", "name": "v2", "target": {"hash": "2222222222222222222222222222222222222222"}}
+			},
+			{
+				"old": {"type": "branch", "name": "gone", "target": {"hash": "1111111111111111111111111111111111111111"}},
+				"new": null
+			}
+		]}
+	}`)
+	header := http.Header{"Content-Type": {"application/json"}, "X-Event-Key": {"repo:push"}}
+	path := "/v1/events/bitbucket?secret=" + testBitbucketCloudSecret
+
+	rec := s.Do("POST", path, header, push)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST repo:push = %d; want %d", rec.Code, http.StatusCreated)
+	}
+	var rep pipelinesRep
+	if err := json.Unmarshal(rec.Body.Bytes(), &rep); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if len(rep.Pipelines) != 2 {
+		t.Fatalf("pipelines = %v; want 2 pipelines", rep.Pipelines)
+	}
+
+	job := s.RequestJob(t, runner)
+	if job.GitInfo.RepoURL != "https://bitbucket.org/team/repo.git" || job.GitInfo.Ref != "main" {
+		t.Errorf("GitInfo = %+v; want main of team/repo", job.GitInfo)
+	}
+	if job = s.RequestJob(t, runner); job.GitInfo.Ref != "v2" || job.GitInfo.RefType != "tag" {
+		t.Errorf("GitInfo = %+v; want tag v2", job.GitInfo)
+	}
+
+	if rec := s.Do("POST", "/v1/events/bitbucket?secret=wrong", header, push); rec.Code != http.StatusForbidden {
+		t.Errorf("POST with wrong secret = %d; want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestBitbucketCloudPullRequestUpdated(t *testing.T) {
+	s := newBitbucketServer(t)
+	defer s.Close()
+
+	pr := func(title, hash string) []byte {
+		return []byte(fmt.Sprintf(`{
+			"repository": {
+				"uuid": "{d5c2a0c1-0000-4000-8000-000000000001}",
+				"name": "repo",
+				"full_name": "team/repo",
+				"links": {"html": {"href": "https://bitbucket.org/team/repo"}}
+			},
+			"pullrequest": {
+				"id": 7,
+				"title": %q,
+				"links": {"html": {"href": "https://bitbucket.org/team/repo/pull-requests/7"}},
+				"source": {"branch": {"name": "feature"}, "commit": {"hash": %q}},
+				"destination": {"branch": {"name": "main"}, "commit": {"hash": "1111111111111111111111111111111111111111"}}
+			}
+		}`, title, hash))
+	}
+	post := func(typ string, body []byte) int {
+		header := http.Header{"Content-Type": {"application/json"}, "X-Event-Key": {typ}}
+		return s.Do("POST", "/v1/events/bitbucket?secret="+testBitbucketCloudSecret, header, body).Code
+	}
+
+	const first, second = "2222222222222222222222222222222222222222", "3333333333333333333333333333333333333333"
+	if code := post("pullrequest:created", pr("Add feature", first)); code != http.StatusCreated {
+		t.Fatalf("POST pullrequest:created = %d; want %d", code, http.StatusCreated)
+	}
+	// Editing the pull request's title doesn't change its commit, so there's nothing to run.
+	if code := post("pullrequest:updated", pr("Add a feature", first)); code != http.StatusAccepted {
+		t.Errorf("POST pullrequest:updated without new commits = %d; want %d", code, http.StatusAccepted)
+	}
+	if code := post("pullrequest:updated", pr("Add a feature", second)); code != http.StatusCreated {
+		t.Errorf("POST pullrequest:updated with new commit = %d; want %d", code, http.StatusCreated)
+	}
+	// Going back to an earlier commit is a change too.
+	if code := post("pullrequest:updated", pr("Add a feature", first)); code != http.StatusCreated {
+		t.Errorf("POST pullrequest:updated reverting commit = %d; want %d", code, http.StatusCreated)
+	}
+}
+
+// refErrorPlanner is a Planner that fails to plan pipelines for one ref.
+type refErrorPlanner struct {
+	Planner
+	ref string
+}
+
+func (p refErrorPlanner) Plan(ctx context.Context, project *com.Project, pipeline *com.Pipeline) ([]*com.Job, error) {
+	if pipeline.Event.Ref == p.ref {
+		return nil, errors.New("injected failure")
+	}
+	return p.Planner.Plan(ctx, project, pipeline)
+}
+
+func TestBitbucketPushEventError(t *testing.T) {
+	s := newBitbucketServer(t)
+	defer s.Close()
+	planner := s.Server.planner
+	s.Server.planner = refErrorPlanner{Planner: planner, ref: "v2"}
+
+	push := []byte(`{
+		"repository": {
+			"uuid": "{d5c2a0c1-0000-4000-8000-000000000001}",
+			"name": "repo",
+			"full_name": "team/repo",
+			"links": {"html": {"href": "https://bitbucket.org/team/repo"}}
+		},
+		"push": {"changes": [
+			{
+				"old": {"type": "branch", "name": "main", "target": {"hash": "1111111111111111111111111111111111111111"}},
+				"new": {"type": "branch", "name": "main", "target": {"hash": "2222222222222222222222222222222222222222"}}
+			},
+			{
+				"old": null,
+				"new": {"type": "tag", "name": "v2", "target": {"hash": "2222222222222222222222222222222222222222"}}
+			}
+		]}
+	}`)
+	header := http.Header{"Content-Type": {"application/json"}, "X-Event-Key": {"repo:push"}}
+	path := "/v1/events/bitbucket?secret=" + testBitbucketCloudSecret
+
+	// A failure on the second event doesn't leave the first event's pipeline behind.
+	if rec := s.Do("POST", path, header, push); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("POST repo:push = %d; want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if pipeline, err := s.DB.GetPipeline(s.Ctx, 1); err != com.ErrNotFound {
+		t.Fatalf("GetPipeline(1) = %+v, %v; want %v", pipeline, err, com.ErrNotFound)
+	}
+
+	// Retrying the delivery creates each pipeline once.
+	s.Server.planner = planner
+	rec := s.Do("POST", path, header, push)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST repo:push = %d; want %d", rec.Code, http.StatusCreated)
+	}
+	var rep pipelinesRep
+	if err := json.Unmarshal(rec.Body.Bytes(), &rep); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if len(rep.Pipelines) != 2 {
+		t.Fatalf("pipelines = %v; want 2 pipelines", rep.Pipelines)
+	}
+	for _, id := range rep.Pipelines {
+		if jobs, err := s.DB.GetPipelineJobs(s.Ctx, id); err != nil || len(jobs) != 1 {
+			t.Errorf("GetPipelineJobs(%d) = %d jobs, %v; want 1 job", id, len(jobs), err)
+		}
+	}
+}
+
+func TestBitbucketServerEvent(t *testing.T) {
+	s := newBitbucketServer(t)
+	defer s.Close()
+	runner := s.CreateRunner(t, "runner")
+
+	pr := []byte(`{
+		"eventKey": "pr:opened",
+		"pullRequest": {
+			"id": 12,
+			"title": "Feature",
+			"fromRef": {
+				"id": "refs/heads/feature",
+				"displayId": "feature",
+				"latestCommit": "3333333333333333333333333333333333333333",
+				"repository": {"id": 8, "slug": "repo", "project": {"key": "PRJ"}}
+			},
+			"toRef": {
+				"id": "refs/heads/main",
+				"displayId": "main",
+				"latestCommit": "2222222222222222222222222222222222222222",
+				"repository": {
+					"id": 8,
+					"slug": "repo",
+					"name": "repo",
+					"project": {"key": "PRJ"},
+					"links": {"clone": [
+						{"href": "ssh://git@bitbucket.example.com:7999/prj/repo.git", "name": "ssh"},
+						{"href": "https://bitbucket.example.com/scm/prj/repo.git", "name": "http"}
+					]}
+				}
+			}
+		}
+	}`)
+	mac := hmac.New(sha256.New, []byte(testBitbucketServerSecret))
+	mac.Write(pr)
+	header := http.Header{
+		"Content-Type":    {"application/json"},
+		"X-Event-Key":     {"pr:opened"},
+		"X-Hub-Signature": {"sha256=" + hex.EncodeToString(mac.Sum(nil))},
+	}
+
+	if rec := s.Do("POST", "/v1/events/bitbucket", header, pr); rec.Code != http.StatusCreated {
+		t.Fatalf("POST pr:opened = %d; want %d", rec.Code, http.StatusCreated)
+	}
+	job := s.RequestJob(t, runner)
+	if job.GitInfo.RepoURL != "https://bitbucket.example.com/scm/prj/repo.git" {
+		t.Errorf("RepoURL = %q; want HTTP clone URL", job.GitInfo.RepoURL)
+	}
+	if want := "+refs/pull-requests/12/from:refs/remotes/origin/pr/12"; len(job.GitInfo.Refspecs) != 1 || job.GitInfo.Refspecs[0] != want {
+		t.Errorf("Refspecs = %q; want [%q]", job.GitInfo.Refspecs, want)
+	}
+	if got := job.Variables.Get("CI_MERGE_REQUEST_PROJECT_PATH"); got != "PRJ/repo" {
+		t.Errorf("CI_MERGE_REQUEST_PROJECT_PATH = %q; want %q", got, "PRJ/repo")
+	}
+
+	// Signed requests aren't accepted with the Cloud secret alone.
+	header.Set("X-Hub-Signature", "sha256=00")
+	if rec := s.Do("POST", "/v1/events/bitbucket?secret="+testBitbucketCloudSecret, header, pr); rec.Code != http.StatusForbidden {
+		t.Errorf("POST with bad signature = %d; want %d", rec.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"go.spiff.io/gribble/internal/cache"
+	"go.spiff.io/gribble/internal/proc"
+	"go.uber.org/zap"
+)
+
+// The cache endpoints implement enough of the S3 API for the GitLab runner's S3 cache adapter to
+// use gribble as its cache server. Runners are configured with ServerAddress set to gribble's
+// address, BucketName set to the cache bucket, and the cache access and secret keys. Object names
+// are chosen by the runner and include the project ID and cache key.
+//
+// Only path-style requests signed with presigned URLs are accepted.
+
+const defaultCacheRegion = "us-east-1"
+
+var errCacheInternal = errors.New("internal error")
+
+var validBucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+type s3LocationConstraint struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+	Region  string   `xml:",chardata"`
+}
+
+func writeXML(w http.ResponseWriter, code int, v interface{}) {
+	p, err := xml.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(code)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(p)
+}
+
+func writeS3Error(w http.ResponseWriter, code int, s3code string, err error) {
+	writeXML(w, code, s3Error{Code: s3code, Message: err.Error()})
+}
+
+// cacheKey returns the cache object key for a request's object parameter.
+func cacheKey(params httprouter.Params) string {
+	return strings.TrimPrefix(params.ByName("object"), "/")
+}
+
+// authorizeCache verifies that a cache request is presigned with the server's cache credentials.
+// If it isn't, an error response is written and false is returned.
+func (s *Server) authorizeCache(w http.ResponseWriter, req *http.Request) bool {
+	ctx := req.Context()
+	switch err := cache.VerifyPresigned(req, s.cacheCreds, proc.Now(ctx)); err {
+	case nil:
+		return true
+	case cache.ErrUnsigned, cache.ErrExpired:
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", err)
+	case cache.ErrUnknownAccessKey:
+		writeS3Error(w, http.StatusForbidden, "InvalidAccessKeyId", err)
+	default:
+		proc.Warn(ctx, "Invalid cache request signature", zap.String("path", req.URL.Path))
+		writeS3Error(w, http.StatusForbidden, "SignatureDoesNotMatch", err)
+	}
+	return false
+}
+
+// GetCache writes a cache archive. It also answers bucket location requests, which S3 clients
+// make before presigning URLs if they aren't configured with a region.
+func (s *Server) GetCache(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	ctx := req.Context()
+	key := cacheKey(params)
+	if _, ok := req.URL.Query()["location"]; ok && key == "" {
+		writeXML(w, http.StatusOK, s3LocationConstraint{Region: s.cacheRegion})
+		return
+	}
+
+	if !s.authorizeCache(w, req) {
+		return
+	}
+
+	f, err := s.cache.Open(key)
+	if err == cache.ErrInvalidKey {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", err)
+		return
+	} else if os.IsNotExist(err) {
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey", os.ErrNotExist)
+		return
+	} else if err != nil {
+		proc.Error(ctx, "Error opening cache archive", zap.String("key", key), zap.Error(err))
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", errCacheInternal)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		proc.Error(ctx, "Error opening cache archive", zap.String("key", key), zap.Error(err))
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", errCacheInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, req, "", info.ModTime(), f)
+}
+
+// PutCache stores a cache archive, evicting least recently used archives if the cache is over
+// its quota.
+func (s *Server) PutCache(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	ctx := req.Context()
+	if !s.authorizeCache(w, req) {
+		return
+	}
+
+	key := cacheKey(params)
+	if max := s.cache.Quota(); max > 0 && req.ContentLength > max {
+		writeS3Error(w, http.StatusRequestEntityTooLarge, "EntityTooLarge", cache.ErrTooLarge)
+		return
+	}
+	size, err := s.cache.Put(key, req.Body)
+	if err == cache.ErrInvalidKey {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", err)
+		return
+	} else if err == cache.ErrTooLarge {
+		proc.Warn(ctx, "Cache archive exceeds quota", zap.String("key", key))
+		writeS3Error(w, http.StatusRequestEntityTooLarge, "EntityTooLarge", err)
+		return
+	} else if err != nil {
+		proc.Error(ctx, "Error storing cache archive", zap.String("key", key), zap.Error(err))
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", errCacheInternal)
+		return
+	}
+
+	proc.Info(ctx, "Cache archive stored", zap.String("key", key), zap.Int64("size", size))
+	w.WriteHeader(http.StatusOK)
+}
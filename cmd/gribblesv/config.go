@@ -14,6 +14,19 @@ const (
 	defaultListenAddr  = "127.0.0.1:4077"
 	defaultGracePeriod = time.Second * 30
 
+	defaultJobPollTimeout = time.Duration(0)
+
+	defaultArtifactDir     = "artifacts"
+	defaultArtifactMaxSize = 100 * megabyte
+	defaultArtifactExpiry  = 30 * 24 * time.Hour
+
+	defaultCacheDir    = "cache"
+	defaultCacheQuota  = 10 * 1024 * megabyte
+	defaultCacheBucket = "gribble-cache"
+
+	defaultRepoDir      = "repos"
+	defaultCIConfigPath = ".gitlab-ci.yml"
+
 	defaultBackendName BackendName = "sqlite"
 
 	defaultSQLiteFile     = "gribble.db"
@@ -27,6 +40,22 @@ func DefaultConfig() *Config {
 		Listen:      newSockAddr(defaultListenAddr),
 		GracePeriod: defaultGracePeriod,
 
+		JobPollTimeout: defaultJobPollTimeout,
+
+		ArtifactDir:     defaultArtifactDir,
+		ArtifactMaxSize: defaultArtifactMaxSize,
+		ArtifactExpiry:  defaultArtifactExpiry,
+
+		CacheDir:    defaultCacheDir,
+		CacheQuota:  defaultCacheQuota,
+		CacheBucket: defaultCacheBucket,
+		CacheRegion: defaultCacheRegion,
+
+		RepoDir:      defaultRepoDir,
+		CIConfigPath: defaultCIConfigPath,
+		PlanMaxJobs:  defaultPlanMaxJobs,
+		PlanMaxDepth: defaultPlanMaxDepth,
+
 		DB: defaultBackendName,
 		// SQLite defaults
 		SQLiteFile:     defaultSQLiteFile,
@@ -40,8 +69,67 @@ type Config struct {
 	// GracePeriod is how long the HTTP server will wait to finalize requests and shut down.
 	GracePeriod time.Duration `envi:"HTTP_GRACE_PERIOD"`
 
+	// JobPollTimeout is how long a runner's job request may be held open waiting for a job.
+	// If zero, job requests are not held open.
+	JobPollTimeout time.Duration `envi:"JOB_POLL_TIMEOUT"`
+
+	// ArtifactDir is the directory job artifacts are stored in.
+	ArtifactDir string `envi:"ARTIFACT_DIR"`
+	// ArtifactMaxSize is the largest artifact, in bytes, that a job may upload.
+	// If zero, artifact sizes are not limited.
+	ArtifactMaxSize int64 `envi:"ARTIFACT_MAX_SIZE"`
+	// ArtifactExpiry is how long artifacts are kept if their job doesn't set expire_in.
+	// If zero, artifacts are kept forever by default.
+	ArtifactExpiry time.Duration `envi:"ARTIFACT_EXPIRY"`
+	// ArtifactKeepLatest, if true, prevents the artifacts of the newest successful pipeline of
+	// each ref from expiring.
+	ArtifactKeepLatest bool `envi:"ARTIFACT_KEEP_LATEST"`
+
+	// CacheAccessKey and CacheSecretKey are the S3 credentials runners use to access the
+	// cache. If CacheAccessKey is empty, the cache server is disabled.
+	CacheAccessKey string `envi:"CACHE_ACCESS_KEY"`
+	CacheSecretKey string `envi:"CACHE_SECRET_KEY"`
+	// CacheDir is the directory runner cache archives are stored in.
+	CacheDir string `envi:"CACHE_DIR"`
+	// CacheQuota is the total size, in bytes, of cache archives to keep. When exceeded, the
+	// least recently used archives are evicted. If zero, the cache's size is not limited.
+	CacheQuota int64 `envi:"CACHE_QUOTA"`
+	// CacheBucket is the S3 bucket name runners use for the cache.
+	CacheBucket string `envi:"CACHE_BUCKET"`
+	// CacheRegion is the S3 region reported to runners.
+	CacheRegion string `envi:"CACHE_REGION"`
+
+	// PipelineJobs is a JSON file of job templates to run in every pipeline created by a
+	// webhook. If empty, jobs are read from the CI config file of each pipeline's commit.
+	PipelineJobs string `envi:"PIPELINE_JOBS"`
+	// RepoDir is the directory mirrors of project repositories are kept in.
+	RepoDir string `envi:"REPO_DIR"`
+	// CIConfigPath is the path of the CI config file in repositories.
+	CIConfigPath string `envi:"CI_CONFIG_PATH"`
+	// ForkSecrets, if true, passes variables that aren't public to jobs for pull requests from
+	// forks.
+	ForkSecrets bool `envi:"FORK_SECRETS"`
+	// PlanMaxJobs is the most jobs a pipeline may have after a plan job's plan is added to it.
+	PlanMaxJobs int `envi:"PLAN_MAX_JOBS"`
+	// PlanMaxDepth is how deeply plan jobs may be nested.
+	PlanMaxDepth int `envi:"PLAN_MAX_DEPTH"`
+
 	// GitHubToken is the webhook token used to validate incoming events.
 	GitHubToken string `envi:"GITHUB_TOKEN"`
+	// GiteaSecret is the secret used to validate incoming Gitea and Forgejo events.
+	GiteaSecret string `envi:"GITEA_SECRET"`
+	// GitLabToken is the secret token used to validate incoming GitLab events.
+	GitLabToken string `envi:"GITLAB_TOKEN"`
+	// BitbucketServerSecret is the secret used to validate incoming Bitbucket Server events.
+	BitbucketServerSecret string `envi:"BITBUCKET_SERVER_SECRET"`
+	// BitbucketCloudSecret is the secret query parameter of incoming Bitbucket Cloud events.
+	BitbucketCloudSecret string `envi:"BITBUCKET_CLOUD_SECRET"`
+	// GenericSecret is the secret that per-project generic webhook secrets are derived from.
+	GenericSecret string `envi:"GENERIC_SECRET"`
+
+	// AdminToken is the bearer token required by the admin API. If empty, the admin API is
+	// disabled.
+	AdminToken string `envi:"ADMIN_TOKEN"`
 
 	// DB is any valid database supported by gribble.
 	// These are declared under backend.go in the backends map.
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
 	"go.spiff.io/gribble/internal/sqlite"
 )
 
@@ -15,8 +16,45 @@ type DB interface {
 
 	CreateRunner(ctx context.Context, r *com.Runner) error
 	SetRunnerUpdatedTime(ctx context.Context, r *com.Runner, t time.Time) error
+	SetRunnerFeatures(ctx context.Context, r *com.Runner, features com.Feature) error
 	GetRunnerByToken(ctx context.Context, token string, getDeleted bool) (*com.Runner, error)
 	GetRunnerTags(ctx context.Context, r *com.Runner) error
+
+	UpsertProject(ctx context.Context, project *com.Project) error
+	GetProject(ctx context.Context, id int64) (*com.Project, error)
+
+	CreatePipeline(ctx context.Context, pipeline *com.Pipeline) error
+	CreatePipelines(ctx context.Context, pipelines []*com.Pipeline, newJobs func(i int, pipeline *com.Pipeline) []*com.Job) ([][]*com.Job, error)
+	GetPipeline(ctx context.Context, id int64) (*com.Pipeline, error)
+	GetPipelineJobs(ctx context.Context, pipeline int64) ([]*com.Job, error)
+	GetPullRequestSHA(ctx context.Context, project *com.Project, number int64) (string, error)
+
+	CreateWebhookDelivery(ctx context.Context, d *com.WebhookDelivery) error
+	SetWebhookDeliveryResult(ctx context.Context, d *com.WebhookDelivery, result com.WebhookResult, code int) error
+	TruncateWebhookDelivery(ctx context.Context, d *com.WebhookDelivery, size int) error
+	GetWebhookDelivery(ctx context.Context, id int64) (*com.WebhookDelivery, error)
+	GetWebhookDeliveries(ctx context.Context, source string, limit int) ([]*com.WebhookDelivery, error)
+
+	CreateJob(ctx context.Context, job *com.Job) error
+	GetJob(ctx context.Context, id int64) (*com.Job, error)
+	ClaimJob(ctx context.Context, r *com.Runner, tokenHash string) (*com.Job, error)
+	SetJobState(ctx context.Context, job *com.Job, state gciwire.JobState, reason gciwire.JobFailureReason) error
+	UpdateStuckJobs(ctx context.Context) (stuck []int64, err error)
+	AddJobDependency(ctx context.Context, dest, src int64, fetchArtifacts bool) error
+	PlayJob(ctx context.Context, job *com.Job, variables gciwire.JobVariables) error
+	ExpandPlan(ctx context.Context, job *com.Job, jobs []*com.Job) error
+
+	AppendTrace(ctx context.Context, job, offset int64, p []byte) (size int64, err error)
+	SetTrace(ctx context.Context, job int64, p []byte) error
+	GetTrace(ctx context.Context, job int64) ([]byte, error)
+
+	CreateArtifact(ctx context.Context, artifact *com.Artifact) error
+	GetJobArtifacts(ctx context.Context, job int64) ([]*com.Artifact, error)
+	GetArtifact(ctx context.Context, job int64, typ string) (*com.Artifact, error)
+	GetArtifactDependencies(ctx context.Context, job int64) ([]com.ArtifactDependency, error)
+	CanFetchArtifacts(ctx context.Context, src int64, tokenHash string) (bool, error)
+	GetExpiredArtifacts(ctx context.Context, now time.Time, keepLatest bool) ([]*com.Artifact, error)
+	DeleteArtifact(ctx context.Context, artifact *com.Artifact) error
 }
 
 type backendError struct {
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	com "go.spiff.io/gribble/internal/common"
+	"go.spiff.io/gribble/internal/proc"
+	"go.uber.org/zap"
+)
+
+// webhookSource is a source of webhooks, such as GitHub. Every delivery from a source is recorded
+// before it's handled so that it can be inspected and replayed later.
+type webhookSource struct {
+	Name string
+	// DeliveryHeaders and EventHeaders are the headers that hold the source's ID for a delivery
+	// and its event type. The first header that is set is used.
+	DeliveryHeaders []string
+	EventHeaders    []string
+	// Handle handles a delivery after it's recorded.
+	Handle JSONHandle
+}
+
+func firstHeader(h http.Header, names []string) string {
+	for _, name := range names {
+		if v := h.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// handleWebhook routes a source's webhooks to /v1/events/NAME.
+func (s *Server) handleWebhook(src *webhookSource) {
+	s.webhooks[src.Name] = src
+	s.mux.POST("/v1/events/"+src.Name, HandleJSON(func(w http.ResponseWriter, req *http.Request, params httprouter.Params) (int, interface{}) {
+		return s.receiveWebhook(w, req, params, src)
+	}))
+}
+
+// receiveWebhook records a webhook delivery and then handles it. Deliveries with the same
+// delivery ID as one already handled are acknowledged without handling them again, since sources
+// may redeliver webhooks that they didn't see a response to.
+func (s *Server) receiveWebhook(w http.ResponseWriter, req *http.Request, params httprouter.Params, src *webhookSource) (code int, msg interface{}) {
+	ctx := req.Context()
+	body, readErr := readWebhook(req)
+	d := &com.WebhookDelivery{
+		Source:     src.Name,
+		DeliveryID: firstHeader(req.Header, src.DeliveryHeaders),
+		Event:      firstHeader(req.Header, src.EventHeaders),
+		Query:      req.URL.RawQuery,
+		Header:     req.Header,
+		Body:       body,
+	}
+
+	err := s.db.CreateWebhookDelivery(ctx, d)
+	if err == com.ErrDuplicate {
+		proc.Info(ctx, "Ignoring duplicate webhook delivery",
+			zap.String("source", src.Name),
+			zap.String("delivery_id", d.DeliveryID),
+		)
+		return http.StatusOK, nil
+	} else if err != nil {
+		proc.Error(ctx, "Error recording webhook delivery", zap.String("source", src.Name), zap.Error(err))
+		return http.StatusInternalServerError, nil
+	}
+
+	var authenticated bool
+	if readErr == errWebhookTooLarge {
+		code = http.StatusRequestEntityTooLarge
+	} else if readErr != nil {
+		code, msg = http.StatusBadRequest, errBadRequest
+	} else {
+		code, msg, authenticated = s.handleDelivery(ctx, w, params, src, d)
+	}
+	s.setDeliveryResult(ctx, d, code, authenticated)
+	return code, msg
+}
+
+// handleDelivery rebuilds a request from a recorded delivery and passes it to its source's
+// handler. It returns the handler's response and whether the handler authenticated the delivery.
+func (s *Server) handleDelivery(ctx context.Context, w http.ResponseWriter, params httprouter.Params, src *webhookSource, d *com.WebhookDelivery) (code int, msg interface{}, authenticated bool) {
+	u := &url.URL{Path: "/v1/events/" + src.Name, RawQuery: d.Query}
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(d.Body))
+	if err != nil {
+		return http.StatusBadRequest, errBadRequest, false
+	}
+	req.Header = d.Header
+	state := &deliveryState{id: d.ID}
+	req = req.WithContext(context.WithValue(ctx, deliveryKey{}, state))
+	code, msg = src.Handle(w, req, params)
+	return code, msg, state.authenticated
+}
+
+// maxUnauthenticatedWebhookBody is the number of bytes of a delivery's body kept if it isn't
+// authenticated. Anyone who can reach the server can send these, so only enough of the body to
+// tell what was sent is kept.
+const maxUnauthenticatedWebhookBody = 4096
+
+// setDeliveryResult records the result of handling a delivery. If the delivery wasn't
+// authenticated, its body is truncated to maxUnauthenticatedWebhookBody bytes.
+func (s *Server) setDeliveryResult(ctx context.Context, d *com.WebhookDelivery, code int, authenticated bool) {
+	if err := s.db.SetWebhookDeliveryResult(ctx, d, webhookResult(code), code); err != nil {
+		proc.Error(ctx, "Error recording webhook delivery result",
+			zap.Int64("delivery", d.ID),
+			zap.Int("code", code),
+			zap.Error(err),
+		)
+	}
+	if authenticated {
+		return
+	}
+	if err := s.db.TruncateWebhookDelivery(ctx, d, maxUnauthenticatedWebhookBody); err != nil {
+		proc.Error(ctx, "Error truncating unauthenticated webhook delivery", zap.Int64("delivery", d.ID), zap.Error(err))
+	}
+}
+
+// deliveryKey is the context key of the *deliveryState of the webhook delivery being handled, if
+// any.
+type deliveryKey struct{}
+
+// deliveryState is the state of a webhook delivery while it's handled.
+type deliveryState struct {
+	id            int64
+	authenticated bool
+}
+
+// deliveryID returns the ID of the webhook delivery being handled by ctx, or 0 if there isn't
+// one.
+func deliveryID(ctx context.Context) int64 {
+	if state, _ := ctx.Value(deliveryKey{}).(*deliveryState); state != nil {
+		return state.id
+	}
+	return 0
+}
+
+// authenticated records that the webhook delivery being handled by ctx came from its source.
+// Handlers call it once they've checked the delivery's secret or signature, and before doing
+// anything else with it.
+func authenticated(ctx context.Context) {
+	if state, _ := ctx.Value(deliveryKey{}).(*deliveryState); state != nil {
+		state.authenticated = true
+	}
+}
+
+// webhookResult returns the result of a webhook delivery from its handler's response code.
+func webhookResult(code int) com.WebhookResult {
+	switch code {
+	case http.StatusCreated:
+		return com.WebhookCreated
+	case http.StatusOK, http.StatusAccepted:
+		return com.WebhookIgnored
+	case http.StatusBadRequest:
+		return com.WebhookMalformed
+	case http.StatusForbidden:
+		return com.WebhookInvalid
+	case http.StatusNotFound:
+		return com.WebhookUnsupported
+	case http.StatusRequestEntityTooLarge:
+		return com.WebhookTooLarge
+	default:
+		return com.WebhookError
+	}
+}
+
+const (
+	defaultDeliveriesLimit = 50
+	maxDeliveriesLimit     = 500
+)
+
+// redactedHeaders are webhook headers that hold secrets and are hidden by the admin API.
+var redactedHeaders = []string{"Authorization", "X-Gitlab-Token"}
+
+const redacted = "REDACTED"
+
+// deliveryRep is the admin API's representation of a webhook delivery.
+type deliveryRep struct {
+	ID           int64             `json:"id"`
+	Source       string            `json:"source"`
+	DeliveryID   string            `json:"delivery_id,omitempty"`
+	Event        string            `json:"event,omitempty"`
+	Result       com.WebhookResult `json:"result"`
+	ResponseCode int               `json:"response_code,omitempty"`
+	Pipelines    []int64           `json:"pipeline_ids"`
+	ReplayOf     int64             `json:"replay_of,omitempty"`
+	Created      time.Time         `json:"created_at"`
+	Updated      time.Time         `json:"updated_at"`
+
+	// Query, Header, and Body are only included for single deliveries.
+	Query  string      `json:"query,omitempty"`
+	Header http.Header `json:"headers,omitempty"`
+	Body   *string     `json:"body,omitempty"`
+}
+
+func newDeliveryRep(d *com.WebhookDelivery, full bool) *deliveryRep {
+	rep := &deliveryRep{
+		ID:           d.ID,
+		Source:       d.Source,
+		DeliveryID:   d.DeliveryID,
+		Event:        d.Event,
+		Result:       d.Result,
+		ResponseCode: d.ResponseCode,
+		Pipelines:    d.Pipelines,
+		ReplayOf:     d.ReplayOf,
+		Created:      d.Created,
+		Updated:      d.Updated,
+	}
+	if rep.Pipelines == nil {
+		rep.Pipelines = []int64{}
+	}
+	if !full {
+		return rep
+	}
+
+	rep.Header = d.Header.Clone()
+	for _, name := range redactedHeaders {
+		if rep.Header.Get(name) != "" {
+			rep.Header.Set(name, redacted)
+		}
+	}
+	if query, err := url.ParseQuery(d.Query); err == nil && query.Get("secret") != "" {
+		query.Set("secret", redacted)
+		rep.Query = query.Encode()
+	} else {
+		rep.Query = d.Query
+	}
+	body := string(d.Body)
+	rep.Body = &body
+	return rep
+}
+
+func (s *Server) GetDeliveries(w http.ResponseWriter, req *http.Request, params httprouter.Params) (code int, msg interface{}) {
+	ctx := req.Context()
+	query := req.URL.Query()
+	limit := defaultDeliveriesLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return http.StatusBadRequest, errBadRequest
+		}
+		limit = n
+	}
+	if limit > maxDeliveriesLimit {
+		limit = maxDeliveriesLimit
+	}
+
+	deliveries, err := s.db.GetWebhookDeliveries(ctx, query.Get("source"), limit)
+	if err != nil {
+		proc.Error(ctx, "Error getting webhook deliveries", zap.Error(err))
+		return http.StatusInternalServerError, nil
+	}
+	reps := make([]*deliveryRep, len(deliveries))
+	for i, d := range deliveries {
+		reps[i] = newDeliveryRep(d, false)
+	}
+	return http.StatusOK, reps
+}
+
+func (s *Server) getDelivery(ctx context.Context, params httprouter.Params) (*com.WebhookDelivery, int) {
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if err != nil || id <= 0 {
+		return nil, http.StatusNotFound
+	}
+	d, err := s.db.GetWebhookDelivery(ctx, id)
+	if err == com.ErrNotFound {
+		return nil, http.StatusNotFound
+	} else if err != nil {
+		proc.Error(ctx, "Error getting webhook delivery", zap.Int64("delivery", id), zap.Error(err))
+		return nil, http.StatusInternalServerError
+	}
+	return d, http.StatusOK
+}
+
+func (s *Server) GetDelivery(w http.ResponseWriter, req *http.Request, params httprouter.Params) (code int, msg interface{}) {
+	d, code := s.getDelivery(req.Context(), params)
+	if d == nil {
+		return code, nil
+	}
+	return http.StatusOK, newDeliveryRep(d, true)
+}
+
+// ReplayDelivery handles a recorded webhook delivery again, as though the source had sent it. The
+// replay is recorded as a new delivery and is never treated as a duplicate. Its result is
+// returned.
+func (s *Server) ReplayDelivery(w http.ResponseWriter, req *http.Request, params httprouter.Params) (code int, msg interface{}) {
+	ctx := req.Context()
+	orig, code := s.getDelivery(ctx, params)
+	if orig == nil {
+		return code, nil
+	}
+	src := s.webhooks[orig.Source]
+	if src == nil {
+		// The source's webhooks are no longer accepted.
+		return http.StatusConflict, ErrorRep{"webhook source is not enabled"}
+	} else if orig.Result == com.WebhookTooLarge {
+		return http.StatusConflict, ErrorRep{"webhook payload was not recorded"}
+	} else if orig.Result == com.WebhookInvalid {
+		return http.StatusConflict, ErrorRep{"webhook payload was truncated"}
+	}
+
+	d := &com.WebhookDelivery{
+		Source:     orig.Source,
+		DeliveryID: orig.DeliveryID,
+		Event:      orig.Event,
+		Query:      orig.Query,
+		Header:     orig.Header,
+		Body:       orig.Body,
+		ReplayOf:   orig.ID,
+	}
+	if err := s.db.CreateWebhookDelivery(ctx, d); err != nil {
+		proc.Error(ctx, "Error recording webhook delivery", zap.String("source", d.Source), zap.Error(err))
+		return http.StatusInternalServerError, nil
+	}
+	code, _, authenticated := s.handleDelivery(ctx, w, nil, src, d)
+	s.setDeliveryResult(ctx, d, code, authenticated)
+
+	proc.Info(ctx, "Replayed webhook delivery",
+		zap.Int64("delivery", d.ID),
+		zap.Int64("replay_of", orig.ID),
+		zap.String("result", string(d.Result)),
+	)
+
+	if replayed, err := s.db.GetWebhookDelivery(ctx, d.ID); err == nil {
+		d = replayed
+	} else {
+		proc.Warn(ctx, "Error getting replayed webhook delivery", zap.Int64("delivery", d.ID), zap.Error(err))
+	}
+	return http.StatusOK, newDeliveryRep(d, false)
+}
+
+// adminOnly wraps a handler to require the admin token as a bearer token.
+func (s *Server) adminOnly(fn JSONHandle) JSONHandle {
+	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params) (int, interface{}) {
+		const prefix = "Bearer "
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, prefix) ||
+			subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), s.adminToken) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gribble"`)
+			return http.StatusUnauthorized, nil
+		}
+		return fn(w, req, params)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	com "go.spiff.io/gribble/internal/common"
+)
+
+const testAdminToken = "admin-token"
+
+var adminHeader = http.Header{"Authorization": {"Bearer " + testAdminToken}}
+
+// githubDelivery returns the headers of a GitHub push webhook with a delivery ID.
+func githubDelivery(id string, body []byte) http.Header {
+	h := githubHeader("push", body)
+	h.Set("X-GitHub-Delivery", id)
+	return h
+}
+
+func getDeliveries(t *testing.T, s *testServer, path string) []*deliveryRep {
+	t.Helper()
+	rec := s.Do("GET", path, adminHeader, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d; want %d", path, rec.Code, http.StatusOK)
+	}
+	var reps []*deliveryRep
+	if err := json.Unmarshal(rec.Body.Bytes(), &reps); err != nil {
+		t.Fatalf("Error decoding deliveries: %v", err)
+	}
+	return reps
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	s := newPipelineServer(t, &ServerConfig{
+		GitHubToken: testGitHubSecret,
+		AdminToken:  testAdminToken,
+	})
+	defer s.Close()
+
+	body := []byte(githubPushBody)
+	if rec := s.Do("POST", "/v1/events/github", githubDelivery("d1", body), body); rec.Code != http.StatusCreated {
+		t.Fatalf("POST push = %d; want %d", rec.Code, http.StatusCreated)
+	}
+	// A redelivery of a handled delivery is acknowledged but not handled again.
+	if rec := s.Do("POST", "/v1/events/github", githubDelivery("d1", body), body); rec.Code != http.StatusOK {
+		t.Fatalf("POST duplicate push = %d; want %d", rec.Code, http.StatusOK)
+	}
+
+	// Deliveries that fail validation don't prevent a valid delivery with the same ID.
+	forged := githubDelivery("d2", body)
+	forged.Set("X-Hub-Signature", "sha1=0000000000000000000000000000000000000000")
+	if rec := s.Do("POST", "/v1/events/github", forged, body); rec.Code != http.StatusForbidden {
+		t.Fatalf("POST forged push = %d; want %d", rec.Code, http.StatusForbidden)
+	}
+	if rec := s.Do("POST", "/v1/events/github", githubDelivery("d2", body), body); rec.Code != http.StatusCreated {
+		t.Fatalf("POST redelivered push = %d; want %d", rec.Code, http.StatusCreated)
+	}
+
+	if rec := s.Do("GET", "/v1/admin/deliveries", nil, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET deliveries without token = %d; want %d", rec.Code, http.StatusUnauthorized)
+	}
+	wrong := http.Header{"Authorization": {"Bearer wrong"}}
+	if rec := s.Do("GET", "/v1/admin/deliveries", wrong, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET deliveries with wrong token = %d; want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	reps := getDeliveries(t, s, "/v1/admin/deliveries?source=github")
+	want := []struct {
+		id     string
+		result com.WebhookResult
+		code   int
+	}{
+		{"d2", com.WebhookCreated, http.StatusCreated},
+		{"d2", com.WebhookInvalid, http.StatusForbidden},
+		{"d1", com.WebhookCreated, http.StatusCreated},
+	}
+	if len(reps) != len(want) {
+		t.Fatalf("len(deliveries) = %d; want %d", len(reps), len(want))
+	}
+	for i, w := range want {
+		rep := reps[i]
+		if rep.DeliveryID != w.id || rep.Result != w.result || rep.ResponseCode != w.code || rep.Event != "push" {
+			t.Errorf("deliveries[%d] = %+v; want %s %s %d", i, rep, w.id, w.result, w.code)
+		}
+		if rep.Body != nil {
+			t.Errorf("deliveries[%d] has a body; want none when listing", i)
+		}
+	}
+	if len(reps[1].Pipelines) != 0 || len(reps[2].Pipelines) != 1 {
+		t.Fatalf("pipelines = %v, %v; want none and one", reps[1].Pipelines, reps[2].Pipelines)
+	}
+	if got := getDeliveries(t, s, "/v1/admin/deliveries?source=gitlab"); len(got) != 0 {
+		t.Errorf("len(gitlab deliveries) = %d; want 0", len(got))
+	}
+	if got := getDeliveries(t, s, "/v1/admin/deliveries?limit=1"); len(got) != 1 || got[0].ID != reps[0].ID {
+		t.Errorf("deliveries with limit=1 = %+v; want the newest delivery", got)
+	}
+
+	first := reps[2]
+	pipeline, err := s.DB.GetPipeline(s.Ctx, first.Pipelines[0])
+	if err != nil {
+		t.Fatalf("GetPipeline(%d) = %v; want nil", first.Pipelines[0], err)
+	} else if pipeline.Delivery != first.ID {
+		t.Errorf("pipeline.Delivery = %d; want %d", pipeline.Delivery, first.ID)
+	}
+
+	path := "/v1/admin/deliveries/" + strconv.FormatInt(first.ID, 10)
+	rec := s.Do("GET", path, adminHeader, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d; want %d", path, rec.Code, http.StatusOK)
+	}
+	var full deliveryRep
+	if err := json.Unmarshal(rec.Body.Bytes(), &full); err != nil {
+		t.Fatalf("Error decoding delivery: %v", err)
+	}
+	if full.Body == nil || *full.Body != githubPushBody {
+		t.Errorf("body = %v; want the push body", full.Body)
+	}
+	if got := full.Header.Get("X-Github-Event"); got != "push" {
+		t.Errorf("X-GitHub-Event = %q; want push", got)
+	}
+
+	if rec := s.Do("GET", "/v1/admin/deliveries/1000", adminHeader, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("GET missing delivery = %d; want %d", rec.Code, http.StatusNotFound)
+	}
+
+	// Replays are handled even though the delivery was already handled.
+	rec = s.Do("POST", path+"/replay", adminHeader, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST replay = %d; want %d", rec.Code, http.StatusOK)
+	}
+	var replay deliveryRep
+	if err := json.Unmarshal(rec.Body.Bytes(), &replay); err != nil {
+		t.Fatalf("Error decoding replay: %v", err)
+	}
+	if replay.ReplayOf != first.ID || replay.Result != com.WebhookCreated || len(replay.Pipelines) != 1 {
+		t.Fatalf("replay = %+v; want a created delivery replaying %d", replay, first.ID)
+	}
+	if replay.Pipelines[0] == first.Pipelines[0] {
+		t.Errorf("replay created pipeline %d; want a new pipeline", replay.Pipelines[0])
+	}
+}
+
+func TestInvalidWebhookDelivery(t *testing.T) {
+	s := newPipelineServer(t, &ServerConfig{
+		GitHubToken: testGitHubSecret,
+		AdminToken:  testAdminToken,
+	})
+	defer s.Close()
+
+	// Only the start of the body of a delivery that isn't authenticated is kept, whatever it was
+	// rejected for.
+	body := bytes.Repeat([]byte("x"), 2*maxUnauthenticatedWebhookBody)
+	forged := githubDelivery("d1", body)
+	forged.Set("X-Hub-Signature", "sha1=0000000000000000000000000000000000000000")
+	unsigned := githubDelivery("d2", body)
+	unsigned.Set("X-GitHub-Event", "issues")
+	unsigned.Del("X-Hub-Signature")
+	signed := githubHeader("issues", body)
+	signed.Set("X-GitHub-Delivery", "d3")
+
+	cases := []struct {
+		name   string
+		header http.Header
+		code   int
+		result com.WebhookResult
+		body   []byte
+	}{
+		{"forged push", forged, http.StatusForbidden, com.WebhookInvalid, body[:maxUnauthenticatedWebhookBody]},
+		{"unsigned unsupported event", unsigned, http.StatusForbidden, com.WebhookInvalid, body[:maxUnauthenticatedWebhookBody]},
+		{"signed unsupported event", signed, http.StatusNotFound, com.WebhookUnsupported, body},
+	}
+	for _, c := range cases {
+		if rec := s.Do("POST", "/v1/events/github", c.header, body); rec.Code != c.code {
+			t.Fatalf("POST %s = %d; want %d", c.name, rec.Code, c.code)
+		}
+	}
+
+	reps := getDeliveries(t, s, "/v1/admin/deliveries")
+	if len(reps) != len(cases) {
+		t.Fatalf("len(deliveries) = %d; want %d", len(reps), len(cases))
+	}
+	for i, c := range cases {
+		rep := reps[len(reps)-1-i]
+		if rep.Result != c.result {
+			t.Errorf("%s result = %s; want %s", c.name, rep.Result, c.result)
+		}
+		d, err := s.DB.GetWebhookDelivery(s.Ctx, rep.ID)
+		if err != nil {
+			t.Fatalf("GetWebhookDelivery() = %v; want nil", err)
+		}
+		if !bytes.Equal(d.Body, c.body) {
+			t.Errorf("%s body is %d bytes; want the first %d", c.name, len(d.Body), len(c.body))
+		}
+	}
+
+	// The truncated body can't be replayed.
+	path := "/v1/admin/deliveries/" + strconv.FormatInt(reps[len(reps)-1].ID, 10) + "/replay"
+	if rec := s.Do("POST", path, adminHeader, nil); rec.Code != http.StatusConflict {
+		t.Errorf("POST replay = %d; want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestWebhookDeliveryRedaction(t *testing.T) {
+	s := newPipelineServer(t, &ServerConfig{
+		GitLabToken: testGitLabToken,
+		AdminToken:  testAdminToken,
+	})
+	defer s.Close()
+
+	body := []byte(`{}`)
+	header := http.Header{
+		"X-Gitlab-Event": {"Push Hook"},
+		"X-Gitlab-Token": {testGitLabToken},
+	}
+	s.Do("POST", "/v1/events/gitlab", header, body)
+
+	reps := getDeliveries(t, s, "/v1/admin/deliveries")
+	if len(reps) != 1 {
+		t.Fatalf("len(deliveries) = %d; want 1", len(reps))
+	}
+	rec := s.Do("GET", "/v1/admin/deliveries/"+strconv.FormatInt(reps[0].ID, 10), adminHeader, nil)
+	var full deliveryRep
+	if err := json.Unmarshal(rec.Body.Bytes(), &full); err != nil {
+		t.Fatalf("Error decoding delivery: %v", err)
+	}
+	if got := full.Header.Get("X-Gitlab-Token"); got != redacted {
+		t.Errorf("X-Gitlab-Token = %q; want %q", got, redacted)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+	"go.spiff.io/gribble/internal/proc"
+	"go.uber.org/zap"
+)
+
+// The generic webhook lets any git server trigger pipelines, such as from a post-receive hook.
+// Requests are signed per project: a project's secret is the hex-encoded HMAC-SHA256 of its
+// repo_url using the server's generic secret, and the X-Gribble-Signature header of a request is
+// "sha256=" followed by the hex-encoded HMAC-SHA256 of the body using the project's secret.
+//
+// Both can be computed with openssl:
+//
+//	secret=$(printf %s "$repo_url" | openssl dgst -sha256 -hmac "$generic_secret" | sed 's/^.* //')
+//	sig=$(printf %s "$body" | openssl dgst -sha256 -hmac "$secret" | sed 's/^.* //')
+
+// genericEvent is the payload of a generic webhook.
+type genericEvent struct {
+	RepoURL string `json:"repo_url"`
+	// Ref is either a full ref, such as refs/heads/main, or a branch or tag name if RefType is
+	// set.
+	Ref     string                 `json:"ref"`
+	RefType gciwire.GitInfoRefType `json:"ref_type"`
+	Before  string                 `json:"before"`
+	After   string                 `json:"after"`
+}
+
+// genericProjectSecret returns the secret a project's generic webhooks are signed with.
+func genericProjectSecret(secret []byte, repoURL string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write([]byte(repoURL))
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
+
+func (s *Server) GenericEvent(w http.ResponseWriter, req *http.Request, params httprouter.Params) (code int, msg interface{}) {
+	ctx := req.Context()
+	body, err := readWebhook(req)
+	if err == errWebhookTooLarge {
+		return http.StatusRequestEntityTooLarge, nil
+	} else if err != nil {
+		return http.StatusBadRequest, errBadRequest
+	}
+
+	// The payload is parsed before it's authenticated, since its secret depends on its repository.
+	var payload genericEvent
+	if err := json.Unmarshal(body, &payload); err != nil || payload.RepoURL == "" {
+		return http.StatusBadRequest, errBadRequest
+	}
+
+	sig := req.Header.Get("X-Gribble-Signature")
+	secret := genericProjectSecret(s.genericSecret, payload.RepoURL)
+	if !strings.HasPrefix(sig, "sha256=") || !validHMACSHA256(secret, body, strings.TrimPrefix(sig, "sha256=")) {
+		return http.StatusForbidden, nil
+	}
+	authenticated(ctx)
+
+	ev, err := genericPipelineEvent(&payload)
+	if err != nil {
+		proc.Warn(ctx, "Invalid generic webhook payload", zap.String("repo_url", payload.RepoURL), zap.Error(err))
+		return http.StatusBadRequest, errBadRequest
+	}
+	return s.eventResponse(ctx, "generic", "push", ev)
+}
+
+// genericProject returns the project for a repository URL. Its path is the URL's path without a
+// .git suffix, such as owner/repo.
+func genericProject(repoURL string) com.Project {
+	repoPath := repoURL
+	if u, err := url.Parse(repoURL); err == nil && u.Path != "" {
+		repoPath = u.Path
+	} else if i := strings.LastIndexByte(repoURL, ':'); i != -1 {
+		// scp-like syntax, such as git@example.com:owner/repo.git
+		repoPath = repoURL[i+1:]
+	}
+	repoPath = strings.TrimSuffix(strings.Trim(repoPath, "/"), ".git")
+	return com.Project{
+		Source:   "generic",
+		SourceID: repoURL,
+		Name:     path.Base(repoPath),
+		Path:     repoPath,
+		CloneURL: repoURL,
+	}
+}
+
+// genericPipelineEvent returns the event for a generic webhook. Deleted refs return nil.
+func genericPipelineEvent(payload *genericEvent) (*com.Event, error) {
+	if payload.After == "" {
+		return nil, errors.New("after SHA is required")
+	}
+	if com.IsZeroSHA(payload.After) {
+		return nil, nil
+	}
+
+	ref, refType := payload.Ref, payload.RefType
+	switch refType {
+	case "":
+		var ok bool
+		if ref, refType, ok = com.ParseRef(payload.Ref); !ok {
+			return nil, errors.New("ref must be a branch or tag")
+		}
+	case gciwire.RefTypeBranch, gciwire.RefTypeTag:
+		if strings.HasPrefix(ref, "refs/") {
+			return nil, errors.New("ref must be a name when ref_type is set")
+		}
+	default:
+		return nil, errors.New("ref_type must be branch or tag")
+	}
+	if ref == "" {
+		return nil, errors.New("ref is required")
+	}
+
+	before := payload.Before
+	if before == "" {
+		before = com.ZeroSHA
+	}
+	return &com.Event{
+		Kind:    com.EventPush,
+		Project: genericProject(payload.RepoURL),
+		Ref:     ref,
+		RefType: refType,
+		Before:  before,
+		After:   payload.After,
+	}, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+const testGenericSecret = "generic-secret"
+
+func genericHeader(repoURL string, body []byte) http.Header {
+	mac := hmac.New(sha256.New, genericProjectSecret([]byte(testGenericSecret), repoURL))
+	mac.Write(body)
+	return http.Header{
+		"Content-Type":        {"application/json"},
+		"X-Gribble-Signature": {"sha256=" + hex.EncodeToString(mac.Sum(nil))},
+	}
+}
+
+func TestGenericEvent(t *testing.T) {
+	s := newPipelineServer(t, &ServerConfig{GenericSecret: testGenericSecret})
+	defer s.Close()
+	runner := s.CreateRunner(t, "runner")
+
+	const repoURL = "git@git.example.com:tools/repo.git"
+	body := []byte(`{
+		"repo_url": "` + repoURL + `",
+		"ref": "refs/heads/main",
+		"before": "1111111111111111111111111111111111111111",
+		"after": "2222222222222222222222222222222222222222"
+	}`)
+	if rec := s.Do("POST", "/v1/events/generic", genericHeader(repoURL, body), body); rec.Code != http.StatusCreated {
+		t.Fatalf("POST generic = %d; want %d", rec.Code, http.StatusCreated)
+	}
+	job := s.RequestJob(t, runner)
+	if job.GitInfo.RepoURL != repoURL || job.GitInfo.Ref != "main" || job.GitInfo.RefType != "branch" {
+		t.Errorf("GitInfo = %+v; want branch main of %s", job.GitInfo, repoURL)
+	}
+	if got := job.Variables.Get("CI_PROJECT_PATH"); got != "tools/repo" {
+		t.Errorf("CI_PROJECT_PATH = %q; want %q", got, "tools/repo")
+	}
+
+	tag := []byte(`{"repo_url": "` + repoURL + `", "ref": "v1", "ref_type": "tag", "after": "2222222222222222222222222222222222222222"}`)
+	if rec := s.Do("POST", "/v1/events/generic", genericHeader(repoURL, tag), tag); rec.Code != http.StatusCreated {
+		t.Fatalf("POST generic tag = %d; want %d", rec.Code, http.StatusCreated)
+	}
+
+	// Each project's secret is distinct, so a signature for one repository doesn't work for
+	// another.
+	other := []byte(`{"repo_url": "https://git.example.com/other.git", "ref": "refs/heads/main", "after": "2222222222222222222222222222222222222222"}`)
+	if rec := s.Do("POST", "/v1/events/generic", genericHeader(repoURL, other), other); rec.Code != http.StatusForbidden {
+		t.Errorf("POST with another project's signature = %d; want %d", rec.Code, http.StatusForbidden)
+	}
+
+	bad := []byte(`{"repo_url": "` + repoURL + `", "ref": "refs/notes/x", "after": "2222222222222222222222222222222222222222"}`)
+	if rec := s.Do("POST", "/v1/events/generic", genericHeader(repoURL, bad), bad); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST with non-branch ref = %d; want %d", rec.Code, http.StatusBadRequest)
+	}
+}
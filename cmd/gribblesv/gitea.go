@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+	"go.spiff.io/gribble/internal/proc"
+	"go.uber.org/zap"
+)
+
+// Gitea and Forgejo webhook payloads. Only the fields gribble uses are declared.
+
+type giteaRepository struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+	HTMLURL  string `json:"html_url"`
+	CloneURL string `json:"clone_url"`
+}
+
+type giteaPushEvent struct {
+	Ref        string           `json:"ref"`
+	Before     string           `json:"before"`
+	After      string           `json:"after"`
+	Repository *giteaRepository `json:"repository"`
+}
+
+type giteaBranch struct {
+	Ref    string           `json:"ref"`
+	SHA    string           `json:"sha"`
+	RepoID int64            `json:"repo_id"`
+	Repo   *giteaRepository `json:"repo"`
+}
+
+type giteaPullRequestEvent struct {
+	Action      string `json:"action"`
+	Number      int64  `json:"number"`
+	PullRequest *struct {
+		ID      int64        `json:"id"`
+		Number  int64        `json:"number"`
+		Title   string       `json:"title"`
+		HTMLURL string       `json:"html_url"`
+		Head    *giteaBranch `json:"head"`
+		Base    *giteaBranch `json:"base"`
+	} `json:"pull_request"`
+	Repository *giteaRepository `json:"repository"`
+}
+
+// giteaHeader returns the value of a Gitea webhook header. Forgejo sends its own headers as well
+// as Gitea's, so either is accepted.
+func giteaHeader(req *http.Request, name string) string {
+	if v := req.Header.Get("X-Gitea-" + name); v != "" {
+		return v
+	}
+	return req.Header.Get("X-Forgejo-" + name)
+}
+
+func (s *Server) GiteaEvent(w http.ResponseWriter, req *http.Request, params httprouter.Params) (code int, msg interface{}) {
+	ctx := req.Context()
+	body, err := readWebhook(req)
+	if err == errWebhookTooLarge {
+		return http.StatusRequestEntityTooLarge, nil
+	} else if err != nil {
+		return http.StatusBadRequest, errBadRequest
+	}
+
+	if !validHMACSHA256(s.giteaSecret, body, giteaHeader(req, "Signature")) {
+		return http.StatusForbidden, nil
+	}
+	authenticated(ctx)
+
+	typ := giteaHeader(req, "Event")
+	switch typ {
+	case "push", "pull_request":
+	default:
+		return http.StatusNotFound, nil
+	}
+
+	ev, err := giteaEvent(typ, body)
+	if err != nil {
+		proc.Warn(ctx, "Invalid Gitea webhook payload", zap.String("type", typ), zap.Error(err))
+		return http.StatusBadRequest, errBadRequest
+	}
+	return s.eventResponse(ctx, "gitea", typ, ev)
+}
+
+// giteaEvent parses a Gitea webhook payload of the given type and returns its event. If the
+// payload doesn't call for a pipeline, giteaEvent returns nil.
+func giteaEvent(typ string, body []byte) (*com.Event, error) {
+	switch typ {
+	case "push":
+		var push giteaPushEvent
+		if err := json.Unmarshal(body, &push); err != nil {
+			return nil, err
+		}
+		return giteaPushPipelineEvent(&push), nil
+	case "pull_request":
+		var pr giteaPullRequestEvent
+		if err := json.Unmarshal(body, &pr); err != nil {
+			return nil, err
+		}
+		return giteaPullRequestPipelineEvent(&pr), nil
+	}
+	return nil, nil
+}
+
+func giteaProject(repo *giteaRepository) com.Project {
+	return com.Project{
+		Source:   "gitea",
+		SourceID: strconv.FormatInt(repo.ID, 10),
+		Name:     repo.Name,
+		Path:     repo.FullName,
+		URL:      repo.HTMLURL,
+		CloneURL: repo.CloneURL,
+	}
+}
+
+func giteaPushPipelineEvent(push *giteaPushEvent) *com.Event {
+	if push.Repository == nil || push.After == "" || com.IsZeroSHA(push.After) {
+		return nil
+	}
+	ref, refType, ok := com.ParseRef(push.Ref)
+	if !ok {
+		return nil
+	}
+	return &com.Event{
+		Kind:    com.EventPush,
+		Project: giteaProject(push.Repository),
+		Ref:     ref,
+		RefType: refType,
+		Before:  push.Before,
+		After:   push.After,
+	}
+}
+
+func giteaPullRequestPipelineEvent(event *giteaPullRequestEvent) *com.Event {
+	switch event.Action {
+	case "opened", "reopened", "synchronized":
+	default:
+		return nil
+	}
+	pr := event.PullRequest
+	if pr == nil || pr.Head == nil || pr.Base == nil || event.Repository == nil {
+		return nil
+	}
+
+	head, base := pr.Head, pr.Base
+	var sourcePath, sourceURL string
+	if head.Repo != nil {
+		sourcePath, sourceURL = head.Repo.FullName, head.Repo.HTMLURL
+	}
+	return &com.Event{
+		Kind:    com.EventPullRequest,
+		Project: giteaProject(event.Repository),
+		Ref:     head.Ref,
+		RefType: gciwire.RefTypeBranch,
+		Before:  com.ZeroSHA,
+		After:   head.SHA,
+		PullRequest: &com.PullRequest{
+			ID:           pr.ID,
+			Number:       pr.Number,
+			Title:        pr.Title,
+			URL:          pr.HTMLURL,
+			HeadRef:      "refs/pull/" + strconv.FormatInt(pr.Number, 10) + "/head",
+			SourceBranch: head.Ref,
+			SourcePath:   sourcePath,
+			SourceURL:    sourceURL,
+			TargetBranch: base.Ref,
+			TargetSHA:    base.SHA,
+			Fork:         head.RepoID != base.RepoID,
+		},
+	}
+}
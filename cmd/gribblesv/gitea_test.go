@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+const testGiteaSecret = "gitea-secret"
+
+func giteaTestHeader(typ string, body []byte) http.Header {
+	mac := hmac.New(sha256.New, []byte(testGiteaSecret))
+	mac.Write(body)
+	return http.Header{
+		"Content-Type":      {"application/json"},
+		"X-Gitea-Event":     {typ},
+		"X-Gitea-Signature": {hex.EncodeToString(mac.Sum(nil))},
+	}
+}
+
+func TestGiteaEvent(t *testing.T) {
+	s := newPipelineServer(t, &ServerConfig{GiteaSecret: testGiteaSecret})
+	defer s.Close()
+	runner := s.CreateRunner(t, "runner")
+
+	push := []byte(`{
+		"ref": "refs/tags/v1.0.0",
+		"before": "0000000000000000000000000000000000000000",
+		"after": "4444444444444444444444444444444444444444",
+		"repository": {
+			"id": 5,
+			"name": "repo",
+			"full_name": "team/repo",
+			"html_url": "https://git.example.com/team/repo",
+			"clone_url": "https://git.example.com/team/repo.git"
+		}
+	}`)
+	if rec := s.Do("POST", "/v1/events/gitea", giteaTestHeader("push", push), push); rec.Code != http.StatusCreated {
+		t.Fatalf("POST push = %d; want %d", rec.Code, http.StatusCreated)
+	}
+	job := s.RequestJob(t, runner)
+	if job.GitInfo.Ref != "v1.0.0" || job.GitInfo.RefType != "tag" {
+		t.Errorf("ref = %q %q; want tag v1.0.0", job.GitInfo.RefType, job.GitInfo.Ref)
+	}
+	if got := job.Variables.Get("CI_COMMIT_TAG"); got != "v1.0.0" {
+		t.Errorf("CI_COMMIT_TAG = %q; want %q", got, "v1.0.0")
+	}
+	if job.GitInfo.RepoURL != "https://git.example.com/team/repo.git" {
+		t.Errorf("RepoURL = %q; want clone URL", job.GitInfo.RepoURL)
+	}
+
+	pr := []byte(`{
+		"action": "synchronized",
+		"number": 3,
+		"pull_request": {
+			"id": 99,
+			"number": 3,
+			"title": "Change",
+			"head": {"ref": "feature", "sha": "5555555555555555555555555555555555555555", "repo_id": 5},
+			"base": {"ref": "main", "sha": "4444444444444444444444444444444444444444", "repo_id": 5}
+		},
+		"repository": {"id": 5, "name": "repo", "full_name": "team/repo"}
+	}`)
+	if rec := s.Do("POST", "/v1/events/gitea", giteaTestHeader("pull_request", pr), pr); rec.Code != http.StatusCreated {
+		t.Fatalf("POST pull_request = %d; want %d", rec.Code, http.StatusCreated)
+	}
+	job = s.RequestJob(t, runner)
+	if got := job.Variables.Get("CI_MERGE_REQUEST_IID"); got != "3" {
+		t.Errorf("CI_MERGE_REQUEST_IID = %q; want %q", got, "3")
+	}
+
+	header := giteaTestHeader("push", push)
+	header.Set("X-Gitea-Signature", "00")
+	if rec := s.Do("POST", "/v1/events/gitea", header, push); rec.Code != http.StatusForbidden {
+		t.Errorf("POST with bad signature = %d; want %d", rec.Code, http.StatusForbidden)
+	}
+}
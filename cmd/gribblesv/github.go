@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/google/go-github/v24/github"
+	"github.com/julienschmidt/httprouter"
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+)
+
+func (s *Server) GitHubEvent(w http.ResponseWriter, req *http.Request, params httprouter.Params) (code int, msg interface{}) {
+	ctx := req.Context()
+	body, err := github.ValidatePayload(req, s.githubToken)
+	if err != nil {
+		return http.StatusForbidden, nil
+	}
+	authenticated(ctx)
+
+	typ := github.WebHookType(req)
+	switch typ {
+	case "push", "pull_request", "pull_request_review_comment":
+	default:
+		return http.StatusNotFound, nil
+	}
+
+	payload, err := github.ParseWebHook(typ, body)
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	var ev *com.Event
+	switch payload := payload.(type) {
+	case *github.PushEvent:
+		ev = githubPushEvent(payload)
+	case *github.PullRequestEvent:
+		ev = githubPullRequestEvent(payload)
+	}
+	return s.eventResponse(ctx, "github", typ, ev)
+}
+
+// githubProject returns the project of a GitHub push event's repository.
+func githubProject(repo *github.PushEventRepository) com.Project {
+	return com.Project{
+		Source:   "github",
+		SourceID: strconv.FormatInt(repo.GetID(), 10),
+		Name:     repo.GetName(),
+		Path:     repo.GetFullName(),
+		URL:      repo.GetHTMLURL(),
+		CloneURL: repo.GetCloneURL(),
+	}
+}
+
+// githubRepoProject returns the project of a GitHub repository.
+func githubRepoProject(repo *github.Repository) com.Project {
+	return com.Project{
+		Source:   "github",
+		SourceID: strconv.FormatInt(repo.GetID(), 10),
+		Name:     repo.GetName(),
+		Path:     repo.GetFullName(),
+		URL:      repo.GetHTMLURL(),
+		CloneURL: repo.GetCloneURL(),
+	}
+}
+
+// githubPushEvent returns the event for a push to a branch or tag. Pushes that delete a ref, or
+// push to refs other than branches and tags, return nil.
+func githubPushEvent(push *github.PushEvent) *com.Event {
+	if push.GetDeleted() || com.IsZeroSHA(push.GetAfter()) || push.Repo == nil {
+		return nil
+	}
+	ref, refType, ok := com.ParseRef(push.GetRef())
+	if !ok {
+		return nil
+	}
+	return &com.Event{
+		Kind:    com.EventPush,
+		Project: githubProject(push.Repo),
+		Ref:     ref,
+		RefType: refType,
+		Before:  push.GetBefore(),
+		After:   push.GetAfter(),
+	}
+}
+
+// githubPullRequestEvent returns the event for a pull request that was opened, reopened, or
+// pushed to. Other pull request actions return nil.
+func githubPullRequestEvent(event *github.PullRequestEvent) *com.Event {
+	switch event.GetAction() {
+	case "opened", "reopened", "synchronize":
+	default:
+		return nil
+	}
+	pr := event.PullRequest
+	if pr == nil || pr.Head == nil || pr.Base == nil || pr.Base.Repo == nil {
+		return nil
+	}
+
+	head, base := pr.Head, pr.Base
+	// If the head repository was deleted, it can only have been a fork.
+	fork := head.Repo == nil || head.Repo.GetID() != base.Repo.GetID()
+	return &com.Event{
+		Kind:    com.EventPullRequest,
+		Project: githubRepoProject(base.Repo),
+		Ref:     head.GetRef(),
+		RefType: gciwire.RefTypeBranch,
+		Before:  com.ZeroSHA,
+		After:   head.GetSHA(),
+		PullRequest: &com.PullRequest{
+			ID:           pr.GetID(),
+			Number:       int64(pr.GetNumber()),
+			Title:        pr.GetTitle(),
+			URL:          pr.GetHTMLURL(),
+			HeadRef:      "refs/pull/" + strconv.Itoa(pr.GetNumber()) + "/head",
+			SourceBranch: head.GetRef(),
+			SourcePath:   head.GetRepo().GetFullName(),
+			SourceURL:    head.GetRepo().GetHTMLURL(),
+			TargetBranch: base.GetRef(),
+			TargetSHA:    base.GetSHA(),
+			Fork:         fork,
+		},
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+)
+
+const testGitHubSecret = "github-secret"
+
+// githubHeader returns the headers GitHub sends with a webhook of the given type and body.
+func githubHeader(typ string, body []byte) http.Header {
+	mac := hmac.New(sha1.New, []byte(testGitHubSecret))
+	mac.Write(body)
+	return http.Header{
+		"Content-Type":    {"application/json"},
+		"X-Github-Event":  {typ},
+		"X-Hub-Signature": {"sha1=" + hex.EncodeToString(mac.Sum(nil))},
+	}
+}
+
+func newPipelineServer(t *testing.T, conf *ServerConfig) *testServer {
+	if conf == nil {
+		conf = &ServerConfig{}
+	}
+	spec := &com.JobSpec{}
+	spec.GitLab.JobInfo.Name = "test"
+	spec.GitLab.JobInfo.Stage = "test"
+	conf.Planner = StaticPlanner{{Spec: spec}}
+	return newTestServer(t, conf)
+}
+
+const githubPushBody = `{
+	"ref": "refs/heads/main",
+	"before": "1111111111111111111111111111111111111111",
+	"after": "2222222222222222222222222222222222222222",
+	"repository": {
+		"id": 42,
+		"name": "repo",
+		"full_name": "owner/repo",
+		"html_url": "https://github.com/owner/repo",
+		"clone_url": "https://github.com/owner/repo.git"
+	}
+}`
+
+func TestGitHubPushEvent(t *testing.T) {
+	s := newPipelineServer(t, &ServerConfig{GitHubToken: testGitHubSecret})
+	defer s.Close()
+
+	body := []byte(githubPushBody)
+	rec := s.Do("POST", "/v1/events/github", githubHeader("push", body), body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST push = %d; want %d", rec.Code, http.StatusCreated)
+	}
+	var rep pipelineRep
+	if err := json.Unmarshal(rec.Body.Bytes(), &rep); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+
+	pipeline, err := s.DB.GetPipeline(s.Ctx, rep.Pipeline)
+	if err != nil {
+		t.Fatalf("GetPipeline(%d) = %v; want nil", rep.Pipeline, err)
+	}
+	project, err := s.DB.GetProject(s.Ctx, pipeline.Project)
+	if err != nil {
+		t.Fatalf("GetProject(%d) = %v; want nil", pipeline.Project, err)
+	}
+	if project.Source != "github" || project.SourceID != "42" || project.Path != "owner/repo" {
+		t.Errorf("project = %+v; want github project 42 owner/repo", project)
+	}
+
+	runner := s.CreateRunner(t, "runner")
+	job := s.RequestJob(t, runner)
+	want := gciwire.GitInfo{
+		RepoURL:   "https://github.com/owner/repo.git",
+		Ref:       "main",
+		Sha:       "2222222222222222222222222222222222222222",
+		BeforeSha: "1111111111111111111111111111111111111111",
+		RefType:   gciwire.RefTypeBranch,
+		Refspecs:  []string{"+refs/heads/main:refs/remotes/origin/main"},
+	}
+	if !reflect.DeepEqual(job.GitInfo, want) {
+		t.Errorf("GitInfo = %+v; want %+v", job.GitInfo, want)
+	}
+	if got := job.Variables.Get("CI_COMMIT_BRANCH"); got != "main" {
+		t.Errorf("CI_COMMIT_BRANCH = %q; want %q", got, "main")
+	}
+	if got, want := job.Variables.Get("CI_PIPELINE_ID"), strconv.FormatInt(rep.Pipeline, 10); got != want {
+		t.Errorf("CI_PIPELINE_ID = %q; want %q", got, want)
+	}
+
+	// Pushing the same repository again reuses its project.
+	rec = s.Do("POST", "/v1/events/github", githubHeader("push", body), body)
+	if err := json.Unmarshal(rec.Body.Bytes(), &rep); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if second, err := s.DB.GetPipeline(s.Ctx, rep.Pipeline); err != nil {
+		t.Fatalf("GetPipeline(%d) = %v; want nil", rep.Pipeline, err)
+	} else if second.Project != project.ID {
+		t.Errorf("second pipeline project = %d; want %d", second.Project, project.ID)
+	}
+}
+
+func TestGitHubPushEventDeleted(t *testing.T) {
+	s := newPipelineServer(t, &ServerConfig{GitHubToken: testGitHubSecret})
+	defer s.Close()
+
+	body := []byte(`{
+		"ref": "refs/heads/gone",
+		"before": "1111111111111111111111111111111111111111",
+		"after": "0000000000000000000000000000000000000000",
+		"deleted": true,
+		"repository": {"id": 42, "full_name": "owner/repo"}
+	}`)
+	if rec := s.Do("POST", "/v1/events/github", githubHeader("push", body), body); rec.Code != http.StatusAccepted {
+		t.Fatalf("POST deleting push = %d; want %d", rec.Code, http.StatusAccepted)
+	}
+	if _, err := s.DB.GetPipeline(s.Ctx, 1); err != com.ErrNotFound {
+		t.Errorf("GetPipeline(1) = %v; want %v", err, com.ErrNotFound)
+	}
+
+	if rec := s.Do("POST", "/v1/events/github", githubHeader("push", []byte("{}")), body); rec.Code != http.StatusForbidden {
+		t.Errorf("POST with bad signature = %d; want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+// githubPullRequestBody returns a pull_request webhook body for PR #7 with the given action. If
+// fork is true, the PR's head is in another repository.
+func githubPullRequestBody(action string, fork bool) []byte {
+	headRepo := `{"id": 42, "full_name": "owner/repo"}`
+	if fork {
+		headRepo = `{"id": 43, "full_name": "forker/repo"}`
+	}
+	return []byte(`{
+		"action": "` + action + `",
+		"number": 7,
+		"pull_request": {
+			"id": 1007,
+			"number": 7,
+			"title": "Fix things",
+			"head": {"ref": "fix", "sha": "3333333333333333333333333333333333333333", "repo": ` + headRepo + `},
+			"base": {
+				"ref": "main",
+				"sha": "2222222222222222222222222222222222222222",
+				"repo": {"id": 42, "name": "repo", "full_name": "owner/repo", "clone_url": "https://github.com/owner/repo.git"}
+			}
+		},
+		"repository": {"id": 42, "full_name": "owner/repo"}
+	}`)
+}
+
+func TestGitHubPullRequestEvent(t *testing.T) {
+	spec := &com.JobSpec{}
+	spec.GitLab.Variables = gciwire.JobVariables{
+		{Key: "PUBLIC", Value: "public", Public: true},
+		{Key: "SECRET", Value: "secret"},
+	}
+	s := newTestServer(t, &ServerConfig{
+		GitHubToken: testGitHubSecret,
+		Planner:     StaticPlanner{{Spec: spec}},
+	})
+	defer s.Close()
+	runner := s.CreateRunner(t, "runner")
+
+	body := githubPullRequestBody("closed", false)
+	if rec := s.Do("POST", "/v1/events/github", githubHeader("pull_request", body), body); rec.Code != http.StatusAccepted {
+		t.Fatalf("POST closed pull_request = %d; want %d", rec.Code, http.StatusAccepted)
+	}
+
+	for _, fork := range []bool{false, true} {
+		body := githubPullRequestBody("opened", fork)
+		if rec := s.Do("POST", "/v1/events/github", githubHeader("pull_request", body), body); rec.Code != http.StatusCreated {
+			t.Fatalf("POST pull_request (fork=%t) = %d; want %d", fork, rec.Code, http.StatusCreated)
+		}
+
+		job := s.RequestJob(t, runner)
+		if want := []string{"+refs/pull/7/head:refs/remotes/origin/pr/7"}; !reflect.DeepEqual(job.GitInfo.Refspecs, want) {
+			t.Errorf("Refspecs = %q; want %q", job.GitInfo.Refspecs, want)
+		}
+		if job.GitInfo.Sha != "3333333333333333333333333333333333333333" {
+			t.Errorf("Sha = %q; want PR head", job.GitInfo.Sha)
+		}
+		for key, want := range map[string]string{
+			"CI_PIPELINE_SOURCE":                  "merge_request_event",
+			"CI_MERGE_REQUEST_IID":                "7",
+			"CI_MERGE_REQUEST_SOURCE_BRANCH_NAME": "fix",
+			"CI_MERGE_REQUEST_TARGET_BRANCH_NAME": "main",
+			"PUBLIC":                              "public",
+		} {
+			if got := job.Variables.Get(key); got != want {
+				t.Errorf("%s (fork=%t) = %q; want %q", key, fork, got, want)
+			}
+		}
+
+		want := "secret"
+		if fork {
+			want = ""
+		}
+		if got := job.Variables.Get("SECRET"); got != want {
+			t.Errorf("SECRET (fork=%t) = %q; want %q", fork, got, want)
+		}
+	}
+}
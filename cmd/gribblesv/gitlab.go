@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+	"go.spiff.io/gribble/internal/proc"
+	"go.uber.org/zap"
+)
+
+// GitLab webhook payloads. Only the fields gribble uses are declared.
+
+type gitlabProject struct {
+	ID                int64  `json:"id"`
+	Name              string `json:"name"`
+	PathWithNamespace string `json:"path_with_namespace"`
+	WebURL            string `json:"web_url"`
+	GitHTTPURL        string `json:"git_http_url"`
+}
+
+type gitlabPushEvent struct {
+	Ref     string         `json:"ref"`
+	Before  string         `json:"before"`
+	After   string         `json:"after"`
+	Project *gitlabProject `json:"project"`
+}
+
+type gitlabMergeRequestEvent struct {
+	Project          *gitlabProject `json:"project"`
+	ObjectAttributes *struct {
+		ID              int64          `json:"id"`
+		IID             int64          `json:"iid"`
+		Title           string         `json:"title"`
+		URL             string         `json:"url"`
+		Action          string         `json:"action"`
+		OldRev          string         `json:"oldrev"`
+		SourceBranch    string         `json:"source_branch"`
+		TargetBranch    string         `json:"target_branch"`
+		SourceProjectID int64          `json:"source_project_id"`
+		TargetProjectID int64          `json:"target_project_id"`
+		Source          *gitlabProject `json:"source"`
+		LastCommit      struct {
+			ID string `json:"id"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+func (s *Server) GitLabEvent(w http.ResponseWriter, req *http.Request, params httprouter.Params) (code int, msg interface{}) {
+	ctx := req.Context()
+	token := []byte(req.Header.Get("X-Gitlab-Token"))
+	if subtle.ConstantTimeCompare(token, s.gitlabToken) != 1 {
+		return http.StatusForbidden, nil
+	}
+	authenticated(ctx)
+
+	typ := req.Header.Get("X-Gitlab-Event")
+	switch typ {
+	case "Push Hook", "Tag Push Hook", "Merge Request Hook":
+	default:
+		return http.StatusNotFound, nil
+	}
+
+	body, err := readWebhook(req)
+	if err == errWebhookTooLarge {
+		return http.StatusRequestEntityTooLarge, nil
+	} else if err != nil {
+		return http.StatusBadRequest, errBadRequest
+	}
+
+	ev, err := gitlabEvent(typ, body)
+	if err != nil {
+		proc.Warn(ctx, "Invalid GitLab webhook payload", zap.String("type", typ), zap.Error(err))
+		return http.StatusBadRequest, errBadRequest
+	}
+	return s.eventResponse(ctx, "gitlab", typ, ev)
+}
+
+// gitlabEvent parses a GitLab webhook payload of the given type and returns its event. If the
+// payload doesn't call for a pipeline, gitlabEvent returns nil.
+func gitlabEvent(typ string, body []byte) (*com.Event, error) {
+	switch typ {
+	case "Push Hook", "Tag Push Hook":
+		var push gitlabPushEvent
+		if err := json.Unmarshal(body, &push); err != nil {
+			return nil, err
+		}
+		return gitlabPushPipelineEvent(&push), nil
+	case "Merge Request Hook":
+		var mr gitlabMergeRequestEvent
+		if err := json.Unmarshal(body, &mr); err != nil {
+			return nil, err
+		}
+		return gitlabMergeRequestPipelineEvent(&mr), nil
+	}
+	return nil, nil
+}
+
+func gitlabProjectOf(project *gitlabProject) com.Project {
+	return com.Project{
+		Source:   "gitlab",
+		SourceID: strconv.FormatInt(project.ID, 10),
+		Name:     project.Name,
+		Path:     project.PathWithNamespace,
+		URL:      project.WebURL,
+		CloneURL: project.GitHTTPURL,
+	}
+}
+
+func gitlabPushPipelineEvent(push *gitlabPushEvent) *com.Event {
+	if push.Project == nil || push.After == "" || com.IsZeroSHA(push.After) {
+		return nil
+	}
+	ref, refType, ok := com.ParseRef(push.Ref)
+	if !ok {
+		return nil
+	}
+	return &com.Event{
+		Kind:    com.EventPush,
+		Project: gitlabProjectOf(push.Project),
+		Ref:     ref,
+		RefType: refType,
+		Before:  push.Before,
+		After:   push.After,
+	}
+}
+
+// gitlabMergeRequestPipelineEvent returns the event for a merge request that was opened,
+// reopened, or given new commits. Other merge request actions return nil.
+func gitlabMergeRequestPipelineEvent(event *gitlabMergeRequestEvent) *com.Event {
+	mr := event.ObjectAttributes
+	if mr == nil || event.Project == nil || mr.LastCommit.ID == "" {
+		return nil
+	}
+	switch mr.Action {
+	case "open", "reopen":
+	case "update":
+		// Updates without an oldrev only changed the merge request's description, labels,
+		// and so on.
+		if mr.OldRev == "" {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	var sourcePath, sourceURL string
+	if mr.Source != nil {
+		sourcePath, sourceURL = mr.Source.PathWithNamespace, mr.Source.WebURL
+	}
+	return &com.Event{
+		Kind:    com.EventPullRequest,
+		Project: gitlabProjectOf(event.Project),
+		Ref:     mr.SourceBranch,
+		RefType: gciwire.RefTypeBranch,
+		Before:  com.ZeroSHA,
+		After:   mr.LastCommit.ID,
+		PullRequest: &com.PullRequest{
+			ID:           mr.ID,
+			Number:       mr.IID,
+			Title:        mr.Title,
+			URL:          mr.URL,
+			HeadRef:      "refs/merge-requests/" + strconv.FormatInt(mr.IID, 10) + "/head",
+			SourceBranch: mr.SourceBranch,
+			SourcePath:   sourcePath,
+			SourceURL:    sourceURL,
+			TargetBranch: mr.TargetBranch,
+			Fork:         mr.SourceProjectID != mr.TargetProjectID,
+		},
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+const testGitLabToken = "gitlab-token"
+
+func gitlabHeader(typ string) http.Header {
+	return http.Header{
+		"Content-Type":   {"application/json"},
+		"X-Gitlab-Event": {typ},
+		"X-Gitlab-Token": {testGitLabToken},
+	}
+}
+
+func TestGitLabEvent(t *testing.T) {
+	s := newPipelineServer(t, &ServerConfig{GitLabToken: testGitLabToken})
+	defer s.Close()
+	runner := s.CreateRunner(t, "runner")
+
+	push := []byte(`{
+		"object_kind": "push",
+		"ref": "refs/heads/main",
+		"before": "1111111111111111111111111111111111111111",
+		"after": "2222222222222222222222222222222222222222",
+		"project": {
+			"id": 15,
+			"name": "repo",
+			"path_with_namespace": "group/repo",
+			"web_url": "https://gitlab.example.com/group/repo",
+			"git_http_url": "https://gitlab.example.com/group/repo.git"
+		}
+	}`)
+	if rec := s.Do("POST", "/v1/events/gitlab", gitlabHeader("Push Hook"), push); rec.Code != http.StatusCreated {
+		t.Fatalf("POST Push Hook = %d; want %d", rec.Code, http.StatusCreated)
+	}
+	job := s.RequestJob(t, runner)
+	if job.GitInfo.RepoURL != "https://gitlab.example.com/group/repo.git" || job.GitInfo.Ref != "main" {
+		t.Errorf("GitInfo = %+v; want main of group/repo", job.GitInfo)
+	}
+
+	mr := func(action, oldrev string) []byte {
+		return []byte(`{
+			"object_kind": "merge_request",
+			"project": {"id": 15, "name": "repo", "path_with_namespace": "group/repo"},
+			"object_attributes": {
+				"id": 301,
+				"iid": 4,
+				"action": "` + action + `",
+				"oldrev": "` + oldrev + `",
+				"source_branch": "feature",
+				"target_branch": "main",
+				"source_project_id": 15,
+				"target_project_id": 15,
+				"last_commit": {"id": "3333333333333333333333333333333333333333"}
+			}
+		}`)
+	}
+	if rec := s.Do("POST", "/v1/events/gitlab", gitlabHeader("Merge Request Hook"), mr("update", "")); rec.Code != http.StatusAccepted {
+		t.Errorf("POST update without commits = %d; want %d", rec.Code, http.StatusAccepted)
+	}
+	if rec := s.Do("POST", "/v1/events/gitlab", gitlabHeader("Merge Request Hook"), mr("open", "")); rec.Code != http.StatusCreated {
+		t.Fatalf("POST Merge Request Hook = %d; want %d", rec.Code, http.StatusCreated)
+	}
+	job = s.RequestJob(t, runner)
+	if want := "+refs/merge-requests/4/head:refs/remotes/origin/pr/4"; len(job.GitInfo.Refspecs) != 1 || job.GitInfo.Refspecs[0] != want {
+		t.Errorf("Refspecs = %q; want [%q]", job.GitInfo.Refspecs, want)
+	}
+	if got := job.Variables.Get("CI_MERGE_REQUEST_ID"); got != "301" {
+		t.Errorf("CI_MERGE_REQUEST_ID = %q; want %q", got, "301")
+	}
+
+	header := gitlabHeader("Push Hook")
+	header.Set("X-Gitlab-Token", "wrong")
+	if rec := s.Do("POST", "/v1/events/gitlab", header, push); rec.Code != http.StatusForbidden {
+		t.Errorf("POST with wrong token = %d; want %d", rec.Code, http.StatusForbidden)
+	}
+}
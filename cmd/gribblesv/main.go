@@ -13,6 +13,9 @@ import (
 	"strings"
 
 	"github.com/Kochava/envi"
+	"go.spiff.io/gribble/internal/artifact"
+	"go.spiff.io/gribble/internal/cache"
+	"go.spiff.io/gribble/internal/gitfetch"
 	"go.spiff.io/gribble/internal/proc"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -39,6 +42,10 @@ type Prog struct {
 	flags  *flag.FlagSet
 	db     DB
 
+	artifacts artifact.Store
+	cache     *cache.Store
+	planner   Planner
+
 	setDefaultLogger bool
 	logLevel         zap.AtomicLevel
 	logger           *zap.Logger
@@ -121,6 +128,18 @@ func (p Prog) Run(ctx context.Context, flags *flag.FlagSet, argv ...string) (cod
 	defer listener.Close() // will double-close on successful runs
 	proc.Info(ctx, "Listening", zap.Stringer("addr", listener.Addr()))
 
+	if p.conf.PipelineJobs != "" {
+		if p.planner, err = LoadStaticPlanner(p.conf.PipelineJobs); err != nil {
+			proc.DPanic(ctx, "Unable to load pipeline jobs", zap.String("file", p.conf.PipelineJobs), zap.Error(err))
+			return 1
+		}
+	} else {
+		p.planner = &RepoPlanner{
+			Fetcher:    gitfetch.New(p.conf.RepoDir),
+			ConfigFile: p.conf.CIConfigPath,
+		}
+	}
+
 	wg, ctx := errgroup.WithContext(ctx)
 	defer func() {
 		if err := wg.Wait(); err != nil && err != context.Canceled {
@@ -129,7 +148,22 @@ func (p Prog) Run(ctx context.Context, flags *flag.FlagSet, argv ...string) (cod
 		}
 	}()
 
+	p.artifacts = artifact.NewFileStore(p.conf.ArtifactDir)
+	if p.conf.CacheAccessKey != "" {
+		if p.cache, err = cache.Open(p.conf.CacheDir, p.conf.CacheQuota); err != nil {
+			proc.DPanic(ctx, "Unable to open cache directory", zap.String("dir", p.conf.CacheDir), zap.Error(err))
+			return 1
+		}
+	}
+	reaper := &artifactReaper{
+		db:         p.db,
+		store:      p.artifacts,
+		interval:   artifactReapInterval,
+		keepLatest: p.conf.ArtifactKeepLatest,
+	}
+
 	wg.Go(func() error { return p.serve(ctx, listener) })
+	wg.Go(func() error { return reaper.Run(ctx) })
 
 	<-ctx.Done()
 	cancel()
@@ -147,7 +181,33 @@ func (p *Prog) listen() (net.Listener, error) {
 
 func (p *Prog) serve(ctx context.Context, listener net.Listener) (err error) {
 	conf := &ServerConfig{
-		GitHubToken: p.conf.GitHubToken,
+		GitHubToken:           p.conf.GitHubToken,
+		GiteaSecret:           p.conf.GiteaSecret,
+		GitLabToken:           p.conf.GitLabToken,
+		BitbucketServerSecret: p.conf.BitbucketServerSecret,
+		BitbucketCloudSecret:  p.conf.BitbucketCloudSecret,
+		GenericSecret:         p.conf.GenericSecret,
+
+		AdminToken: p.conf.AdminToken,
+
+		JobPollTimeout:  p.conf.JobPollTimeout,
+		Artifacts:       p.artifacts,
+		ArtifactMaxSize: p.conf.ArtifactMaxSize,
+		ArtifactExpiry:  p.conf.ArtifactExpiry,
+
+		Cache:       p.cache,
+		CacheBucket: p.conf.CacheBucket,
+		CacheCredentials: cache.Credentials{
+			AccessKey: p.conf.CacheAccessKey,
+			SecretKey: p.conf.CacheSecretKey,
+		},
+		CacheRegion: p.conf.CacheRegion,
+
+		Planner:     p.planner,
+		ForkSecrets: p.conf.ForkSecrets,
+
+		PlanMaxJobs:  p.conf.PlanMaxJobs,
+		PlanMaxDepth: p.conf.PlanMaxDepth,
 	}
 	p.server, err = NewServer(conf, p.db) // TODO: Configure server
 	if err != nil {
@@ -163,6 +223,7 @@ func (p *Prog) serve(ctx context.Context, listener net.Listener) (err error) {
 
 	go func() {
 		<-ctx.Done()
+		p.server.Shutdown()
 		timeout, cancel := context.WithTimeout(context.Background(), p.conf.GracePeriod)
 		defer cancel()
 		if err := sv.Shutdown(timeout); err == context.DeadlineExceeded {
@@ -196,11 +257,85 @@ Options:
     (1.2.3.4:80) or a path to a Unix domain socket.
   -http-grace-period DUR (default `, defaultGracePeriod, `)
     HTTP server shutdown grace period.
+  -job-poll-timeout DUR (default `, defaultJobPollTimeout, `)
+    How long to hold a runner's job request open waiting for a new
+    job. If 0, job requests return immediately when no job is
+    available.
+  -artifact-dir DIR (default: `, defaultArtifactDir, `)
+    Directory to store job artifacts in.
+  -artifact-max-size BYTES (default: `, defaultArtifactMaxSize, `)
+    The largest artifact, in bytes, that a job may upload. If 0,
+    artifact sizes are not limited.
+  -artifact-expiry DUR (default: `, defaultArtifactExpiry, `)
+    How long to keep artifacts from jobs that don't set expire_in.
+    If 0, these artifacts are kept forever.
+  -artifact-keep-latest
+    Never expire the artifacts of the newest successful pipeline of
+    each ref.
+  -cache-access-key KEY
+  -cache-secret-key KEY
+    The S3 access key and secret key runners use to access the
+    cache. If no access key is given, the cache server is disabled.
+    To use it, set a runner's [runners.cache] Type to "s3" and its
+    ServerAddress, BucketName, AccessKey, and SecretKey to match
+    gribble's.
+  -cache-dir DIR (default: `, defaultCacheDir, `)
+    Directory to store runner cache archives in.
+  -cache-quota BYTES (default: `, defaultCacheQuota, `)
+    Total size, in bytes, of cache archives to keep. Least recently
+    used archives are evicted when it is exceeded. If 0, the cache's
+    size is not limited.
+  -cache-bucket NAME (default: `, defaultCacheBucket, `)
+    The S3 bucket name runners use for the cache.
+  -cache-region REGION (default: `, defaultCacheRegion, `)
+    The S3 region reported to runners.
+  -pipeline-jobs FILE
+    A JSON file of job templates to run in every pipeline created
+    by a webhook. Each template is a job spec with optional tags.
+    If not given, jobs are read from the CI config file of each
+    pipeline's commit.
+  -repo-dir DIR (default: `, defaultRepoDir, `)
+    The directory to keep mirrors of project repositories in.
+  -ci-config-path PATH (default: `, defaultCIConfigPath, `)
+    The path of the CI config file in repositories.
+  -fork-secrets
+    Pass variables that aren't public to jobs in pipelines for pull
+    requests from forks. By default, these are withheld.
+  -plan-max-jobs N (default: `, defaultPlanMaxJobs, `)
+    The most jobs a pipeline may have once a plan job's plan is
+    added to it. Plan jobs whose plans exceed this fail.
+  -plan-max-depth N (default: `, defaultPlanMaxDepth, `)
+    How deeply plan jobs may be nested, counting a pipeline's first
+    plan job as 1.
   -github-token
     The GitHub token to validate GitHub events with.
     If not given, GitHub events are not accepted.
     Can be set to DEV (uppercase) to allow all events without
     validation.
+  -gitea-secret
+    The secret to validate Gitea and Forgejo events with.
+    If not given, Gitea events are not accepted.
+  -gitlab-token
+    The secret token to validate GitLab events with.
+    If not given, GitLab events are not accepted.
+  -bitbucket-server-secret
+    The secret to validate Bitbucket Server events with.
+  -bitbucket-cloud-secret
+    The secret Bitbucket Cloud webhook URLs must pass in their
+    secret query parameter, as in /v1/events/bitbucket?secret=...
+    If neither Bitbucket secret is given, Bitbucket events are not
+    accepted.
+  -generic-secret
+    The secret that each project's generic webhook secret is derived
+    from. A project's secret is the hex-encoded HMAC-SHA256 of its
+    repository URL using this secret, and generic webhooks are signed
+    with an X-Gribble-Signature header of sha256=HMAC-SHA256(body)
+    using the project's secret. If not given, generic events are not
+    accepted.
+  -admin-token
+    The bearer token required by the admin API, which lists and
+    replays webhook deliveries and plays manual jobs. If not given,
+    the admin API is not served.
   -backend BACKEND (default: `, defaultBackendName, `)
     Database driver backend.
     May be one of the following:
@@ -226,7 +361,30 @@ Logging:
 func bindConfigFlags(f *flag.FlagSet, conf *Config) {
 	f.Var(NewTextFlag(conf.Listen), "http-listen-addr", "Listen `address`")
 	f.DurationVar(&conf.GracePeriod, "http-grace-period", conf.GracePeriod, "Shutdown grace period")
+	f.DurationVar(&conf.JobPollTimeout, "job-poll-timeout", conf.JobPollTimeout, "Job request long-polling timeout")
+	f.StringVar(&conf.ArtifactDir, "artifact-dir", conf.ArtifactDir, "Artifact directory")
+	f.Int64Var(&conf.ArtifactMaxSize, "artifact-max-size", conf.ArtifactMaxSize, "Maximum artifact size")
+	f.DurationVar(&conf.ArtifactExpiry, "artifact-expiry", conf.ArtifactExpiry, "Default artifact expiry")
+	f.BoolVar(&conf.ArtifactKeepLatest, "artifact-keep-latest", conf.ArtifactKeepLatest, "Keep latest artifacts per ref")
+	f.StringVar(&conf.CacheAccessKey, "cache-access-key", conf.CacheAccessKey, "Cache access key")
+	f.StringVar(&conf.CacheSecretKey, "cache-secret-key", conf.CacheSecretKey, "Cache secret key")
+	f.StringVar(&conf.CacheDir, "cache-dir", conf.CacheDir, "Cache directory")
+	f.Int64Var(&conf.CacheQuota, "cache-quota", conf.CacheQuota, "Cache size quota")
+	f.StringVar(&conf.CacheBucket, "cache-bucket", conf.CacheBucket, "Cache bucket name")
+	f.StringVar(&conf.CacheRegion, "cache-region", conf.CacheRegion, "Cache region")
+	f.StringVar(&conf.PipelineJobs, "pipeline-jobs", conf.PipelineJobs, "Pipeline job templates file")
+	f.StringVar(&conf.RepoDir, "repo-dir", conf.RepoDir, "Repository mirror directory")
+	f.StringVar(&conf.CIConfigPath, "ci-config-path", conf.CIConfigPath, "CI config file path")
+	f.BoolVar(&conf.ForkSecrets, "fork-secrets", conf.ForkSecrets, "Pass secret variables to fork PRs")
+	f.IntVar(&conf.PlanMaxJobs, "plan-max-jobs", conf.PlanMaxJobs, "Maximum jobs per planned pipeline")
+	f.IntVar(&conf.PlanMaxDepth, "plan-max-depth", conf.PlanMaxDepth, "Maximum plan job nesting")
 	f.StringVar(&conf.GitHubToken, "github-token", conf.GitHubToken, "GitHub token")
+	f.StringVar(&conf.GiteaSecret, "gitea-secret", conf.GiteaSecret, "Gitea secret")
+	f.StringVar(&conf.GitLabToken, "gitlab-token", conf.GitLabToken, "GitLab token")
+	f.StringVar(&conf.BitbucketServerSecret, "bitbucket-server-secret", conf.BitbucketServerSecret, "Bitbucket Server secret")
+	f.StringVar(&conf.BitbucketCloudSecret, "bitbucket-cloud-secret", conf.BitbucketCloudSecret, "Bitbucket Cloud secret")
+	f.StringVar(&conf.GenericSecret, "generic-secret", conf.GenericSecret, "Generic webhook secret")
+	f.StringVar(&conf.AdminToken, "admin-token", conf.AdminToken, "Admin API token")
 
 	f.Var(NewTextFlag(&conf.DB), "backend", "Database `backend`")
 	f.StringVar(&conf.SQLiteFile, "sqlite-file", conf.SQLiteFile, "SQLite database file")
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Notifier broadcasts updates to the job queue to requests waiting on it.
+//
+// Each update is identified by a last-update string, sent to runners in the X-GitLab-Last-Update
+// header. Runners send this value back in JobRequest.LastUpdate, allowing the server to tell
+// whether the job queue has changed since the runner's last request.
+type Notifier struct {
+	prefix string
+
+	m      sync.Mutex
+	update uint64
+	wake   chan struct{}
+}
+
+func NewNotifier() *Notifier {
+	return &Notifier{
+		// The prefix ensures last-update values aren't reused across restarts.
+		prefix: strconv.FormatInt(time.Now().UnixNano(), 36) + "-",
+		wake:   make(chan struct{}),
+	}
+}
+
+// Notify wakes all requests currently waiting on the notifier.
+func (n *Notifier) Notify() {
+	n.m.Lock()
+	defer n.m.Unlock()
+	n.update++
+	close(n.wake)
+	n.wake = make(chan struct{})
+}
+
+// Wait returns the current last-update value and a channel that is closed on the next call to
+// Notify.
+func (n *Notifier) Wait() (lastUpdate string, wake <-chan struct{}) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	return n.prefix + strconv.FormatUint(n.update, 36), n.wake
+}
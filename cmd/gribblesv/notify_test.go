@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestNotifier(t *testing.T) {
+	n := NewNotifier()
+	first, wake := n.Wait()
+	if again, _ := n.Wait(); again != first {
+		t.Fatalf("Wait() = %q; want %q", again, first)
+	}
+
+	select {
+	case <-wake:
+		t.Fatal("wake closed before Notify")
+	default:
+	}
+
+	n.Notify()
+
+	select {
+	case <-wake:
+	default:
+		t.Fatal("wake not closed after Notify")
+	}
+
+	if next, _ := n.Wait(); next == first {
+		t.Fatalf("Wait() = %q after Notify; want new last-update", next)
+	}
+}
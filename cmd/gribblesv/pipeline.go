@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+	"go.spiff.io/gribble/internal/proc"
+	"go.uber.org/zap"
+)
+
+// pipelineRep is the response to a webhook that created a pipeline.
+type pipelineRep struct {
+	Pipeline int64 `json:"pipeline_id"`
+}
+
+// eventResponse creates a pipeline for a webhook's event and returns the webhook's response. If
+// ev is nil, the webhook is acknowledged without creating a pipeline.
+func (s *Server) eventResponse(ctx context.Context, source, typ string, ev *com.Event) (code int, msg interface{}) {
+	if ev == nil {
+		proc.Debug(ctx, "Ignoring webhook event", zap.String("source", source), zap.String("type", typ))
+		return http.StatusAccepted, nil
+	}
+
+	pipelines, err := s.createPipelines(ctx, []*com.Event{ev})
+	if err != nil {
+		proc.Error(ctx, "Error creating pipeline",
+			zap.String("source", source),
+			zap.String("project", ev.Project.Path),
+			zap.Error(err),
+		)
+		return http.StatusInternalServerError, nil
+	}
+	return http.StatusCreated, &pipelineRep{Pipeline: pipelines[0].ID}
+}
+
+// pipelinesRep is the response to a webhook that may create several pipelines.
+type pipelinesRep struct {
+	Pipelines []int64 `json:"pipeline_ids"`
+}
+
+// eventsResponse creates a pipeline for each of a webhook's events and returns the webhook's
+// response. If there are no events, the webhook is acknowledged without creating a pipeline.
+func (s *Server) eventsResponse(ctx context.Context, source, typ string, evs []*com.Event) (code int, msg interface{}) {
+	if len(evs) == 0 {
+		proc.Debug(ctx, "Ignoring webhook event", zap.String("source", source), zap.String("type", typ))
+		return http.StatusAccepted, nil
+	}
+
+	pipelines, err := s.createPipelines(ctx, evs)
+	if err != nil {
+		proc.Error(ctx, "Error creating pipelines",
+			zap.String("source", source),
+			zap.String("project", evs[0].Project.Path),
+			zap.Int("events", len(evs)),
+			zap.Error(err),
+		)
+		return http.StatusInternalServerError, nil
+	}
+	rep := &pipelinesRep{Pipelines: make([]int64, len(pipelines))}
+	for i, pipeline := range pipelines {
+		rep.Pipelines[i] = pipeline.ID
+	}
+	return http.StatusCreated, rep
+}
+
+// eventPlan is the project and job templates planned for an event's pipeline.
+type eventPlan struct {
+	project   com.Project
+	templates []*com.Job
+	order     []int
+	deps      [][]templateDep
+}
+
+// createPipelines records the events' projects, creates a pipeline for each event, and enqueues
+// the jobs planned for them. Webhooks from every source go through createPipelines once their
+// payloads are normalized into events.
+//
+// Jobs are created after the jobs they depend on. Each job waits on either the jobs it needs or,
+// if it has no needs, every job in earlier stages.
+func (s *Server) createPipelines(ctx context.Context, evs []*com.Event) ([]*com.Pipeline, error) {
+	pipelines := make([]*com.Pipeline, len(evs))
+	plans := make([]eventPlan, len(evs))
+	for i, ev := range evs {
+		plan := &plans[i]
+		plan.project = ev.Project
+		if err := s.db.UpsertProject(ctx, &plan.project); err != nil {
+			return nil, err
+		}
+		ev.Project.ID = plan.project.ID
+
+		pipelines[i] = &com.Pipeline{Project: plan.project.ID, Event: ev, Delivery: deliveryID(ctx)}
+		templates, err := s.planner.Plan(ctx, &plan.project, pipelines[i])
+		if err != nil {
+			return nil, err
+		}
+		if plan.order, plan.deps, err = templateDepends(templates); err != nil {
+			return nil, err
+		}
+		plan.templates = templates
+	}
+
+	// The pipelines and their jobs are created together so that none of their jobs can run until
+	// all of them exist, and so that a failure doesn't leave part of a delivery's pipelines behind
+	// to be created again when the delivery is retried. The jobs are built once their pipeline has
+	// an ID, since their specs include it.
+	jobs, err := s.db.CreatePipelines(ctx, pipelines, func(i int, pipeline *com.Pipeline) []*com.Job {
+		plan := &plans[i]
+		return s.templateJobs(&plan.project, pipeline, plan.templates, plan.order, plan.deps, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, pipeline := range pipelines {
+		s.jobsCreated(ctx, jobs[i])
+		proc.Info(ctx, "Pipeline created",
+			zap.Int64("pipeline_id", pipeline.ID),
+			zap.String("project", plans[i].project.Path),
+			zap.String("ref", pipeline.Event.Ref),
+			zap.String("sha", pipeline.Event.After),
+			zap.Int("jobs", len(plans[i].templates)),
+		)
+	}
+	return pipelines, nil
+}
+
+// templateJobs returns the jobs of a pipeline for job templates, in the order and with the
+// dependencies returned by templateDepends. The jobs are given the plan depth depth and refer to
+// the jobs they depend on through their dependencies' Src, since none of them have been created.
+func (s *Server) templateJobs(project *com.Project, pipeline *com.Pipeline, templates []*com.Job, order []int, deps [][]templateDep, depth int) []*com.Job {
+	// Fork PRs run code from outside of the project, so they don't get its secrets unless
+	// configured to.
+	ev := pipeline.Event
+	withholdSecrets := ev.PullRequest != nil && ev.PullRequest.Fork && !s.forkSecrets
+
+	jobs := make([]*com.Job, 0, len(order))
+	byTemplate := make([]*com.Job, len(templates))
+	for _, i := range order {
+		tmpl := templates[i]
+		job := &com.Job{
+			Project:      project.ID,
+			Pipeline:     pipeline.ID,
+			Tags:         tmpl.Tags,
+			Spec:         pipelineJobSpec(project, pipeline, tmpl.Spec, withholdSecrets),
+			When:         tmpl.When,
+			AllowFailure: tmpl.AllowFailure,
+			DAG:          tmpl.Needs != nil,
+			Plan:         tmpl.Plan,
+			PlanDepth:    depth,
+		}
+		if job.Plan {
+			planJobSpec(job.Spec)
+		}
+		for _, dep := range deps[i] {
+			job.Depends = append(job.Depends, com.JobDependency{
+				Src:            byTemplate[dep.src],
+				FetchArtifacts: dep.fetchArtifacts,
+			})
+		}
+		jobs = append(jobs, job)
+		byTemplate[i] = job
+	}
+	return jobs
+}
+
+// jobsCreated logs stuck jobs among newly created jobs and wakes any job requests waiting on a
+// new job.
+func (s *Server) jobsCreated(ctx context.Context, jobs []*com.Job) {
+	for _, job := range jobs {
+		if job.Stuck {
+			proc.Warn(ctx, "Job is stuck: no runner has the features it requires", zap.Int64("job_id", job.ID))
+		}
+	}
+	s.jobs.Notify()
+}
+
+// logPipelineFinished logs the status of a pipeline if all of its jobs have finished.
+func (s *Server) logPipelineFinished(ctx context.Context, id int64) {
+	pipeline, err := s.db.GetPipeline(ctx, id)
+	if err != nil {
+		proc.Error(ctx, "Error fetching pipeline", zap.Int64("pipeline_id", id), zap.Error(err))
+		return
+	}
+	if com.IsFinished(pipeline.Status) {
+		proc.Info(ctx, "Pipeline finished", zap.Int64("pipeline_id", id), zap.Any("status", pipeline.Status))
+	}
+}
+
+// templateDep is a job template's dependency on another template of the same pipeline.
+type templateDep struct {
+	src            int // The index of the template depended on
+	fetchArtifacts bool
+}
+
+// templateDepends returns the dependencies of each job template and an order to create the
+// templates in, such that each template comes after the templates it depends on.
+//
+// Templates with needs depend on the templates they name. Templates without needs depend on every
+// template in an earlier stage, with stages ordered by where they first appear in templates.
+func templateDepends(templates []*com.Job) (order []int, deps [][]templateDep, err error) {
+	names := make(map[string]int, len(templates))
+	stages := map[string]int{}
+	stageOf := make([]int, len(templates))
+	for i, tmpl := range templates {
+		info := templateInfo(tmpl)
+		if _, ok := names[info.Name]; ok {
+			names[info.Name] = -1 // Ambiguous
+		} else {
+			names[info.Name] = i
+		}
+		stage, ok := stages[info.Stage]
+		if !ok {
+			stage = len(stages)
+			stages[info.Stage] = stage
+		}
+		stageOf[i] = stage
+	}
+
+	deps = make([][]templateDep, len(templates))
+	for i, tmpl := range templates {
+		name := templateInfo(tmpl).Name
+		if tmpl.Needs == nil {
+			for j, src := range templates {
+				if stageOf[j] < stageOf[i] {
+					deps[i] = append(deps[i], templateDep{j, fetchesArtifacts(tmpl, templateInfo(src).Name)})
+				}
+			}
+			continue
+		}
+		for _, need := range tmpl.Needs {
+			j, ok := names[need.Job]
+			switch {
+			case !ok:
+				return nil, nil, fmt.Errorf("job %q needs %q, which is not in the pipeline", name, need.Job)
+			case j < 0:
+				return nil, nil, fmt.Errorf("job %q needs %q, which names more than one job", name, need.Job)
+			case j == i:
+				return nil, nil, fmt.Errorf("job %q needs itself", name)
+			}
+			deps[i] = append(deps[i], templateDep{j, need.Artifacts && fetchesArtifacts(tmpl, need.Job)})
+		}
+	}
+
+	// Repeatedly take every template whose dependencies have all been taken. If none can be
+	// taken, the remaining templates' needs form a cycle.
+	taken := make([]bool, len(templates))
+	order = make([]int, 0, len(templates))
+	for len(order) < len(templates) {
+		n := len(order)
+		for i := range templates {
+			if !taken[i] && allTaken(deps[i], taken) {
+				order = append(order, i)
+			}
+		}
+		if len(order) == n {
+			return nil, nil, errors.New("job needs form a cycle")
+		}
+		for _, i := range order[n:] {
+			taken[i] = true
+		}
+	}
+	return order, deps, nil
+}
+
+func allTaken(deps []templateDep, taken []bool) bool {
+	for _, dep := range deps {
+		if !taken[dep.src] {
+			return false
+		}
+	}
+	return true
+}
+
+// templateInfo returns the job info of a job template's spec.
+func templateInfo(tmpl *com.Job) *gciwire.JobInfo {
+	if tmpl.Spec == nil {
+		return &gciwire.JobInfo{}
+	}
+	return &tmpl.Spec.GitLab.JobInfo
+}
+
+// fetchesArtifacts returns true if a job template fetches the artifacts of the job named src.
+func fetchesArtifacts(tmpl *com.Job, src string) bool {
+	if tmpl.Dependencies == nil {
+		return true
+	}
+	for _, dep := range tmpl.Dependencies {
+		if dep == src {
+			return true
+		}
+	}
+	return false
+}
+
+// pipelineJobSpec returns a copy of a job template with the git and CI information of the
+// pipeline's event filled in. If withholdSecrets is true, the template's variables that aren't
+// public are removed.
+func pipelineJobSpec(project *com.Project, pipeline *com.Pipeline, tmpl *com.JobSpec, withholdSecrets bool) *com.JobSpec {
+	spec := new(com.JobSpec)
+	if tmpl != nil {
+		*spec = *tmpl
+	}
+	job := &spec.GitLab
+	ev := pipeline.Event
+
+	job.JobInfo.ProjectID = int(project.ID)
+	job.JobInfo.ProjectName = project.Name
+	job.GitInfo = gciwire.GitInfo{
+		RepoURL:   project.CloneURL,
+		Ref:       ev.Ref,
+		Sha:       ev.After,
+		BeforeSha: ev.Before,
+		RefType:   ev.RefType,
+		Refspecs:  eventRefspecs(ev),
+		Depth:     job.GitInfo.Depth,
+	}
+
+	// Template variables come last so that they take precedence.
+	vars := pipelineVariables(project, pipeline, &job.JobInfo)
+	for _, v := range job.Variables {
+		if withholdSecrets && !v.Public {
+			continue
+		}
+		vars = append(vars, v)
+	}
+	job.Variables = vars
+	return spec
+}
+
+// eventRefspecs returns the refspecs a runner needs to fetch the event's ref.
+func eventRefspecs(ev *com.Event) []string {
+	ref := ev.FullRef()
+	if pr := ev.PullRequest; pr != nil {
+		return []string{"+" + ref + ":refs/remotes/origin/pr/" + strconv.FormatInt(pr.Number, 10)}
+	}
+	if ev.RefType == gciwire.RefTypeTag {
+		return []string{"+" + ref + ":" + ref}
+	}
+	return []string{"+" + ref + ":refs/remotes/origin/" + ev.Ref}
+}
+
+// pipelineVariables returns the predefined CI variables of a job in the pipeline.
+func pipelineVariables(project *com.Project, pipeline *com.Pipeline, info *gciwire.JobInfo) gciwire.JobVariables {
+	ev := pipeline.Event
+	shortSHA := ev.After
+	if len(shortSHA) > 8 {
+		shortSHA = shortSHA[:8]
+	}
+	source := "push"
+	if ev.Kind == com.EventPullRequest {
+		source = "merge_request_event"
+	}
+
+	vars := gciwire.JobVariables{
+		{Key: "CI", Value: "true"},
+		{Key: "GRIBBLE_CI", Value: "true"},
+		{Key: "CI_PIPELINE_ID", Value: strconv.FormatInt(pipeline.ID, 10)},
+		{Key: "CI_PIPELINE_SOURCE", Value: source},
+		{Key: "CI_PROJECT_ID", Value: strconv.FormatInt(project.ID, 10)},
+		{Key: "CI_PROJECT_NAME", Value: project.Name},
+		{Key: "CI_PROJECT_PATH", Value: project.Path},
+		{Key: "CI_PROJECT_URL", Value: project.URL},
+		{Key: "CI_REPOSITORY_URL", Value: project.CloneURL},
+		{Key: "CI_COMMIT_SHA", Value: ev.After},
+		{Key: "CI_COMMIT_SHORT_SHA", Value: shortSHA},
+		{Key: "CI_COMMIT_BEFORE_SHA", Value: ev.Before},
+		{Key: "CI_COMMIT_REF_NAME", Value: ev.Ref},
+		{Key: "CI_JOB_NAME", Value: info.Name},
+		{Key: "CI_JOB_STAGE", Value: info.Stage},
+	}
+	if ev.RefType == gciwire.RefTypeTag {
+		vars = append(vars, gciwire.JobVariable{Key: "CI_COMMIT_TAG", Value: ev.Ref})
+	} else if ev.Kind == com.EventPush {
+		vars = append(vars, gciwire.JobVariable{Key: "CI_COMMIT_BRANCH", Value: ev.Ref})
+	}
+	if ev.PullRequest != nil {
+		vars = append(vars, mergeRequestVariables(project, ev)...)
+	}
+	if pipeline.Changes != nil {
+		// GitLab has no equivalent; the paths are listed one per line.
+		vars = append(vars, gciwire.JobVariable{Key: "GRIBBLE_CHANGED_FILES", Value: strings.Join(pipeline.Changes, "\n")})
+	}
+	for i := range vars {
+		vars[i].Public = true
+	}
+	return vars
+}
+
+// mergeRequestVariables returns the CI_MERGE_REQUEST_ variables of a job in a pull request's
+// pipeline.
+func mergeRequestVariables(project *com.Project, ev *com.Event) gciwire.JobVariables {
+	pr := ev.PullRequest
+	id := pr.ID
+	if id == 0 {
+		id = pr.Number
+	}
+	return gciwire.JobVariables{
+		{Key: "CI_MERGE_REQUEST_ID", Value: strconv.FormatInt(id, 10)},
+		{Key: "CI_MERGE_REQUEST_IID", Value: strconv.FormatInt(pr.Number, 10)},
+		{Key: "CI_MERGE_REQUEST_TITLE", Value: pr.Title},
+		{Key: "CI_MERGE_REQUEST_REF_PATH", Value: pr.HeadRef},
+		{Key: "CI_MERGE_REQUEST_PROJECT_ID", Value: strconv.FormatInt(project.ID, 10)},
+		{Key: "CI_MERGE_REQUEST_PROJECT_PATH", Value: project.Path},
+		{Key: "CI_MERGE_REQUEST_PROJECT_URL", Value: project.URL},
+		{Key: "CI_MERGE_REQUEST_SOURCE_BRANCH_NAME", Value: pr.SourceBranch},
+		{Key: "CI_MERGE_REQUEST_SOURCE_BRANCH_SHA", Value: ev.After},
+		{Key: "CI_MERGE_REQUEST_SOURCE_PROJECT_PATH", Value: pr.SourcePath},
+		{Key: "CI_MERGE_REQUEST_SOURCE_PROJECT_URL", Value: pr.SourceURL},
+		{Key: "CI_MERGE_REQUEST_TARGET_BRANCH_NAME", Value: pr.TargetBranch},
+		{Key: "CI_MERGE_REQUEST_TARGET_BRANCH_SHA", Value: pr.TargetSHA},
+		{Key: "CI_MERGE_REQUEST_EVENT_TYPE", Value: "detached"},
+	}
+}
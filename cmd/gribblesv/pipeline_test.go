@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+)
+
+// jobTemplate returns a job template with the given name and stage.
+func jobTemplate(name, stage string) *com.Job {
+	spec := &com.JobSpec{}
+	spec.GitLab.JobInfo.Name = name
+	spec.GitLab.JobInfo.Stage = stage
+	return &com.Job{Spec: spec}
+}
+
+func withNeeds(tmpl *com.Job, needs ...com.JobNeed) *com.Job {
+	tmpl.Needs = append([]com.JobNeed{}, needs...)
+	return tmpl
+}
+
+func TestTemplateDepends(t *testing.T) {
+	withDeps := func(tmpl *com.Job, deps ...string) *com.Job {
+		tmpl.Dependencies = append([]string{}, deps...)
+		return tmpl
+	}
+
+	templates := []*com.Job{
+		jobTemplate("build", "build"),
+		jobTemplate("vet", "build"),
+		withDeps(jobTemplate("test", "test"), "build"),
+		withNeeds(jobTemplate("lint", "test")),
+		withNeeds(jobTemplate("deploy", "deploy"), com.JobNeed{Job: "publish"}),
+		withNeeds(jobTemplate("publish", "deploy"), com.JobNeed{Job: "build", Artifacts: true}, com.JobNeed{Job: "lint"}),
+	}
+	order, deps, err := templateDepends(templates)
+	if err != nil {
+		t.Fatalf("templateDepends() = %v; want nil", err)
+	}
+	if want := []int{0, 1, 3, 2, 5, 4}; !reflect.DeepEqual(order, want) {
+		t.Errorf("order = %v; want %v", order, want)
+	}
+	wantDeps := [][]templateDep{
+		nil,
+		nil,
+		{{0, true}, {1, false}},
+		nil,
+		{{5, false}},
+		{{0, true}, {3, false}},
+	}
+	if !reflect.DeepEqual(deps, wantDeps) {
+		t.Errorf("deps = %v; want %v", deps, wantDeps)
+	}
+
+	invalid := map[string][]*com.Job{
+		"missing":   {withNeeds(jobTemplate("test", ""), com.JobNeed{Job: "build"})},
+		"self":      {withNeeds(jobTemplate("test", ""), com.JobNeed{Job: "test"})},
+		"ambiguous": {jobTemplate("a", ""), jobTemplate("a", ""), withNeeds(jobTemplate("b", ""), com.JobNeed{Job: "a"})},
+		"cycle": {
+			withNeeds(jobTemplate("a", ""), com.JobNeed{Job: "b"}),
+			withNeeds(jobTemplate("b", ""), com.JobNeed{Job: "a"}),
+		},
+	}
+	for name, templates := range invalid {
+		if _, _, err := templateDepends(templates); err == nil {
+			t.Errorf("%s: templateDepends() = nil; want error", name)
+		}
+	}
+}
+
+func TestPipelineStages(t *testing.T) {
+	s := newTestServer(t, &ServerConfig{
+		GitHubToken: testGitHubSecret,
+		Planner: StaticPlanner{
+			jobTemplate("build", "build"),
+			jobTemplate("test", "test"),
+			withNeeds(jobTemplate("lint", "test")),
+		},
+	})
+	defer s.Close()
+
+	body := []byte(githubPushBody)
+	if rec := s.Do("POST", "/v1/events/github", githubHeader("push", body), body); rec.Code != http.StatusCreated {
+		t.Fatalf("POST push = %d; want %d", rec.Code, http.StatusCreated)
+	}
+
+	runner := s.CreateRunner(t, "runner")
+
+	// lint needs nothing, so it runs alongside build.
+	build := s.RequestJob(t, runner)
+	lint := s.RequestJob(t, runner)
+	if build.JobInfo.Name != "build" || lint.JobInfo.Name != "lint" {
+		t.Fatalf("claimed %q, %q; want build, lint", build.JobInfo.Name, lint.JobInfo.Name)
+	}
+	req := gciwire.JobRequest{Token: runner.Token}
+	req.Info.Features = allFeatures
+	if rec := s.Do("POST", "/_gitlab/api/v4/jobs/request", nil, req); rec.Code != http.StatusNoContent {
+		t.Fatalf("POST /jobs/request before build finished = %d; want %d", rec.Code, http.StatusNoContent)
+	}
+
+	update := gciwire.UpdateJobRequest{Token: build.Token, State: gciwire.Success}
+	if rec := s.Do("PUT", "/_gitlab/api/v4/jobs/"+strconv.Itoa(build.ID), nil, update); rec.Code != http.StatusOK {
+		t.Fatalf("PUT build success = %d; want %d", rec.Code, http.StatusOK)
+	}
+	if test := s.RequestJob(t, runner); test.JobInfo.Name != "test" {
+		t.Errorf("claimed %q; want test", test.JobInfo.Name)
+	}
+
+	pipeline, err := s.DB.GetPipeline(s.Ctx, 1)
+	if err != nil {
+		t.Fatalf("GetPipeline() = %v; want nil", err)
+	}
+	if pipeline.Status != gciwire.Running {
+		t.Errorf("pipeline status = %q; want %q", pipeline.Status, gciwire.Running)
+	}
+}
+
+func TestLoadStaticPlanner(t *testing.T) {
+	f, err := ioutil.TempFile("", "gribble-jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	cases := map[string]string{
+		`[{"when": "always", "gitlab": {"job_info": {"name": "test"}}}]`: "",
+		`[{"gitlab": {}}, {"when": "delayed", "gitlab": {}}]`:            `job template 1: unsupported when "delayed"`,
+	}
+	for src, want := range cases {
+		if err := ioutil.WriteFile(f.Name(), []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+		planner, err := LoadStaticPlanner(f.Name())
+		if want == "" && (err != nil || len(planner) != 1 || planner[0].When != com.WhenAlways) {
+			t.Errorf("LoadStaticPlanner(%s) = %v, %v; want one always job", src, planner, err)
+		} else if want != "" && (err == nil || err.Error() != want) {
+			t.Errorf("LoadStaticPlanner(%s) = %v; want %q", src, err, want)
+		}
+	}
+}
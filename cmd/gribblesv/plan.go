@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"go.spiff.io/gribble/internal/ciconfig"
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+	"go.spiff.io/gribble/internal/proc"
+	"go.uber.org/zap"
+)
+
+const (
+	// planArtifactType is the artifact type that plan jobs upload their plans as.
+	planArtifactType = "plan"
+	// planFile is the file, relative to the project directory, that plan jobs write their plans
+	// to. Plan jobs are given its path in the GRIBBLE_PLAN_FILE variable.
+	planFile = "gribble-plan.yml"
+	// maxPlanSize is the largest plan, in bytes, that will be read.
+	maxPlanSize = megabyte
+
+	defaultPlanMaxJobs  = 200
+	defaultPlanMaxDepth = 2
+)
+
+// planJobSpec adds the upload of a plan job's plan to its spec.
+func planJobSpec(spec *com.JobSpec) {
+	job := &spec.GitLab
+	job.Artifacts = append(append(gciwire.Artifacts(nil), job.Artifacts...), gciwire.Artifact{
+		Name:   planArtifactType,
+		Paths:  gciwire.ArtifactPaths{planFile},
+		When:   gciwire.ArtifactWhenOnSuccess,
+		Type:   planArtifactType,
+		Format: gciwire.ArtifactFormatRaw,
+	})
+	job.Variables = append(job.Variables, gciwire.JobVariable{
+		Key:    "GRIBBLE_PLAN_FILE",
+		Value:  planFile,
+		Public: true,
+	})
+}
+
+// planError is a problem with the plan uploaded by a plan job, as opposed to an error reading it.
+type planError struct {
+	err error
+}
+
+func (e *planError) Error() string {
+	return "invalid plan: " + e.err.Error()
+}
+
+// plan is the validated plan of a plan job.
+type plan struct {
+	project   *com.Project
+	pipeline  *com.Pipeline
+	templates []*com.Job
+	order     []int
+	deps      [][]templateDep
+}
+
+// readPlan reads and validates the plan uploaded by a plan job. A plan is a .gitlab-ci.yml
+// configuration, in YAML or JSON, whose jobs are added to the plan job's pipeline. Its rules are
+// evaluated against the pipeline, and it may not include other files.
+//
+// If the plan is invalid, readPlan returns a *planError.
+func (s *Server) readPlan(ctx context.Context, job *com.Job) (*plan, error) {
+	if job.PlanDepth >= s.planMaxDepth {
+		return nil, &planError{fmt.Errorf("plan jobs may only be nested %d deep", s.planMaxDepth)}
+	}
+	if s.artifacts == nil {
+		return nil, errors.New("artifacts are disabled")
+	}
+
+	meta, err := s.db.GetArtifact(ctx, job.ID, planArtifactType)
+	if err == com.ErrNotFound {
+		return nil, &planError{errors.New("no plan was uploaded")}
+	} else if err != nil {
+		return nil, err
+	}
+	r, err := s.artifacts.Open(ctx, meta.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	src, err := ioutil.ReadAll(io.LimitReader(r, maxPlanSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(src) > maxPlanSize {
+		return nil, &planError{fmt.Errorf("plan is larger than %d bytes", maxPlanSize)}
+	}
+	conf, err := ciconfig.Parse(src)
+	if err != nil {
+		return nil, &planError{err}
+	}
+
+	p := &plan{}
+	if p.pipeline, err = s.db.GetPipeline(ctx, job.Pipeline); err != nil {
+		return nil, err
+	}
+	if p.project, err = s.db.GetProject(ctx, job.Project); err != nil {
+		return nil, err
+	}
+	jobs, err := conf.Evaluate(pipelineContext(p.project, p.pipeline))
+	if err != nil {
+		return nil, &planError{err}
+	}
+	p.templates = configTemplates(jobs)
+
+	existing, err := s.db.GetPipelineJobs(ctx, job.Pipeline)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(existing) + len(p.templates); n > s.planMaxJobs {
+		return nil, &planError{fmt.Errorf("plan would give the pipeline %d jobs, more than the limit of %d", n, s.planMaxJobs)}
+	}
+	if p.order, p.deps, err = templateDepends(p.templates); err != nil {
+		return nil, &planError{err}
+	}
+	return p, nil
+}
+
+// expandPlan adds the jobs of a plan job's plan to its pipeline and moves the plan job to success.
+// If the jobs can't be added, the plan job fails instead.
+func (s *Server) expandPlan(ctx context.Context, job *com.Job, p *plan) error {
+	jobs := s.templateJobs(p.project, p.pipeline, p.templates, p.order, p.deps, job.PlanDepth+1)
+	if err := s.db.ExpandPlan(ctx, job, jobs); err == com.ErrConflict {
+		return err
+	} else if err != nil {
+		proc.Error(ctx, "Error creating planned jobs",
+			zap.Int64("job_id", job.ID),
+			zap.Int64("pipeline_id", job.Pipeline),
+			zap.Error(err),
+		)
+		s.appendTraceLine(ctx, job.ID, "ERROR: unable to add the plan's jobs to the pipeline")
+		return s.db.SetJobState(ctx, job, gciwire.Failed, gciwire.ScriptFailure)
+	}
+	s.jobsCreated(ctx, jobs)
+
+	proc.Info(ctx, "Plan expanded",
+		zap.Int64("job_id", job.ID),
+		zap.Int64("pipeline_id", job.Pipeline),
+		zap.Int("jobs", len(jobs)),
+	)
+	return nil
+}
+
+// appendTraceLine adds a line to the end of a job's trace so that it's shown to the job's users.
+func (s *Server) appendTraceLine(ctx context.Context, job int64, line string) {
+	trace, err := s.db.GetTrace(ctx, job)
+	if err == nil {
+		if len(trace) > 0 && trace[len(trace)-1] != '\n' {
+			trace = append(trace, '\n')
+		}
+		err = s.db.SetTrace(ctx, job, append(trace, line+"\n"...))
+	}
+	if err != nil {
+		proc.Error(ctx, "Error appending to trace", zap.Int64("job_id", job), zap.Error(err))
+	}
+}
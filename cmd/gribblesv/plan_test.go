@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.spiff.io/gribble/internal/artifact"
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+)
+
+// newPlanServer returns a test server whose pipelines start with a plan job, followed by the
+// given job templates.
+func newPlanServer(t *testing.T, conf *ServerConfig, templates ...*com.Job) *testServer {
+	dir, err := ioutil.TempDir("", "gribble-artifacts")
+	if err != nil {
+		t.Fatalf("Error creating artifact directory: %v", err)
+	}
+	tmpl := jobTemplate("plan", "plan")
+	tmpl.Plan = true
+	conf.GitHubToken = testGitHubSecret
+	conf.Artifacts = artifact.NewFileStore(dir)
+	conf.Planner = append(StaticPlanner{tmpl}, templates...)
+	s := newTestServer(t, conf)
+	s.cleanup = append(s.cleanup, func() { os.RemoveAll(dir) })
+
+	body := []byte(githubPushBody)
+	if rec := s.Do("POST", "/v1/events/github", githubHeader("push", body), body); rec.Code != http.StatusCreated {
+		s.Close()
+		t.Fatalf("POST push = %d; want %d", rec.Code, http.StatusCreated)
+	}
+	return s
+}
+
+// finishPlan uploads a plan for a claimed plan job and reports the job as successful.
+func (s *testServer) finishPlan(t *testing.T, rep *gciwire.JobResponse, plan string) *httptest.ResponseRecorder {
+	body, ctype := multipartFile(planFile, []byte(plan))
+	header := http.Header{"Job-Token": {rep.Token}, "Content-Type": {ctype}}
+	path := "/_gitlab/api/v4/jobs/" + strconv.Itoa(rep.ID)
+	if rec := s.Do("POST", path+"/artifacts?artifact_type=plan&artifact_format=raw", header, body); rec.Code != http.StatusCreated {
+		t.Fatalf("POST plan = %d; want %d", rec.Code, http.StatusCreated)
+	}
+	return s.Do("PUT", path, nil, gciwire.UpdateJobRequest{Token: rep.Token, State: gciwire.Success})
+}
+
+func TestPlanJob(t *testing.T) {
+	s := newPlanServer(t, &ServerConfig{}, jobTemplate("deploy", "deploy"))
+	defer s.Close()
+	runner := s.CreateRunner(t, "runner")
+
+	rep := s.RequestJob(t, runner)
+	if len(rep.Artifacts) != 1 || rep.Artifacts[0].Type != planArtifactType || rep.Artifacts[0].Format != gciwire.ArtifactFormatRaw {
+		t.Errorf("plan job artifacts = %+v; want a raw plan artifact", rep.Artifacts)
+	}
+	if v := rep.Variables.Get("GRIBBLE_PLAN_FILE"); v != planFile {
+		t.Errorf("GRIBBLE_PLAN_FILE = %q; want %q", v, planFile)
+	}
+
+	// Plans may be JSON as well as YAML.
+	plan := `{
+		"stages": ["build", "test"],
+		"build": {"stage": "build", "script": "make"},
+		"test": {"stage": "test", "script": "make test"},
+		"lint": {"stage": "test", "script": "make lint", "needs": []},
+		"skipped": {"script": "false", "only": ["tags"]}
+	}`
+	rec := s.finishPlan(t, rep, plan)
+	if rec.Code != http.StatusOK || rec.Header().Get("Job-Status") != string(gciwire.Success) {
+		t.Fatalf("PUT plan success = %d, %q; want %d, success", rec.Code, rec.Header().Get("Job-Status"), http.StatusOK)
+	}
+
+	jobs, err := s.DB.GetPipelineJobs(s.Ctx, 1)
+	if err != nil {
+		t.Fatalf("GetPipelineJobs() = %v; want nil", err)
+	}
+	var names []string
+	for _, job := range jobs {
+		name := job.Spec.GitLab.JobInfo.Name
+		names = append(names, name+":"+string(job.State))
+		if name != "plan" && name != "deploy" && job.PlanDepth != 1 {
+			t.Errorf("%s plan depth = %d; want 1", name, job.PlanDepth)
+		}
+	}
+	if got, want := strings.Join(names, " "), "plan:success deploy:created build:pending lint:pending test:created"; got != want {
+		t.Errorf("pipeline jobs = %s; want %s", got, want)
+	}
+
+	// Jobs after the plan job wait for the planned jobs to finish.
+	for i := 0; i < 3; i++ {
+		rep := s.RequestJob(t, runner)
+		if name := rep.JobInfo.Name; name == "deploy" {
+			t.Fatalf("deploy claimed before planned jobs finished")
+		}
+		path := "/_gitlab/api/v4/jobs/" + strconv.Itoa(rep.ID)
+		if rec := s.Do("PUT", path, nil, gciwire.UpdateJobRequest{Token: rep.Token, State: gciwire.Success}); rec.Code != http.StatusOK {
+			t.Fatalf("PUT %s success = %d; want %d", rep.JobInfo.Name, rec.Code, http.StatusOK)
+		}
+	}
+	if rep := s.RequestJob(t, runner); rep.JobInfo.Name != "deploy" {
+		t.Errorf("claimed %q; want deploy", rep.JobInfo.Name)
+	}
+}
+
+// expandPlanErrorDB is a DB that fails to add planned jobs to pipelines.
+type expandPlanErrorDB struct {
+	DB
+}
+
+func (expandPlanErrorDB) ExpandPlan(context.Context, *com.Job, []*com.Job) error {
+	return errors.New("injected failure")
+}
+
+func TestPlanJobExpandError(t *testing.T) {
+	s := newPlanServer(t, &ServerConfig{}, jobTemplate("deploy", "deploy"))
+	defer s.Close()
+	runner := s.CreateRunner(t, "runner")
+	s.Server.db = expandPlanErrorDB{s.Server.db}
+
+	rep := s.RequestJob(t, runner)
+	rec := s.finishPlan(t, rep, "build:\n  script: make\n")
+	if rec.Code != http.StatusOK || rec.Header().Get("Job-Status") != string(gciwire.Failed) {
+		t.Fatalf("PUT plan success = %d, %q; want %d, failed", rec.Code, rec.Header().Get("Job-Status"), http.StatusOK)
+	}
+	trace, err := s.DB.GetTrace(s.Ctx, int64(rep.ID))
+	if want := "unable to add the plan's jobs"; err != nil || !strings.Contains(string(trace), want) {
+		t.Errorf("trace = %q, %v; want it to contain %q", trace, err, want)
+	}
+
+	jobs, err := s.DB.GetPipelineJobs(s.Ctx, 1)
+	if err != nil {
+		t.Fatalf("GetPipelineJobs() = %v; want nil", err)
+	}
+	var names []string
+	for _, job := range jobs {
+		names = append(names, job.Spec.GitLab.JobInfo.Name+":"+string(job.State))
+	}
+	if got, want := strings.Join(names, " "), "plan:failed deploy:skipped"; got != want {
+		t.Errorf("pipeline jobs = %s; want %s", got, want)
+	}
+}
+
+func TestPlanJobInvalid(t *testing.T) {
+	cases := []struct {
+		name string
+		conf ServerConfig
+		plan string
+		want string
+	}{
+		{
+			name: "syntax",
+			plan: "build: [",
+			want: "invalid plan: ",
+		},
+		{
+			name: "needs",
+			plan: "test:\n  script: test\n  needs: [build]\n",
+			want: `job "build" is not defined`,
+		},
+		{
+			name: "jobs",
+			conf: ServerConfig{PlanMaxJobs: 2},
+			plan: "a:\n  script: a\nb:\n  script: b\n",
+			want: "plan would give the pipeline 3 jobs, more than the limit of 2",
+		},
+		{
+			name: "depth",
+			conf: ServerConfig{PlanMaxDepth: 1},
+			plan: "plan:\n  script: plan\n  plan: true\n",
+			want: "plan jobs may only be nested 1 deep",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newPlanServer(t, &c.conf)
+			defer s.Close()
+			runner := s.CreateRunner(t, "runner")
+
+			rep := s.RequestJob(t, runner)
+			if c.name == "depth" {
+				// The first plan is valid, but its plan job can't plan more jobs.
+				if rec := s.finishPlan(t, rep, c.plan); rec.Header().Get("Job-Status") != string(gciwire.Success) {
+					t.Fatalf("first plan job status = %q; want success", rec.Header().Get("Job-Status"))
+				}
+				rep = s.RequestJob(t, runner)
+			}
+
+			rec := s.finishPlan(t, rep, c.plan)
+			if rec.Code != http.StatusOK || rec.Header().Get("Job-Status") != string(gciwire.Failed) {
+				t.Fatalf("PUT plan success = %d, %q; want %d, failed", rec.Code, rec.Header().Get("Job-Status"), http.StatusOK)
+			}
+			trace, err := s.DB.GetTrace(s.Ctx, int64(rep.ID))
+			if err != nil || !strings.Contains(string(trace), c.want) {
+				t.Errorf("trace = %q, %v; want it to contain %q", trace, err, c.want)
+			}
+			pipeline, err := s.DB.GetPipeline(s.Ctx, 1)
+			if err != nil || pipeline.Status != gciwire.Failed {
+				t.Errorf("GetPipeline() = %+v, %v; want failed pipeline", pipeline, err)
+			}
+		})
+	}
+}
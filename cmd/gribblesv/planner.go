@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"go.spiff.io/gribble/internal/ciconfig"
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+	"go.spiff.io/gribble/internal/gitfetch"
+	"go.spiff.io/gribble/internal/proc"
+	"go.uber.org/zap"
+)
+
+// Planner decides which jobs to run for a new pipeline. The jobs it returns are templates: only
+// their tags, specs, and scheduling fields are used, and the server fills in each job's git and
+// CI information. Templates should be in stage order. A planner may also set the pipeline's
+// Changes, which are kept with the pipeline.
+type Planner interface {
+	Plan(ctx context.Context, project *com.Project, pipeline *com.Pipeline) ([]*com.Job, error)
+}
+
+// StaticPlanner is a Planner that runs the same jobs for every pipeline.
+type StaticPlanner []*com.Job
+
+func (p StaticPlanner) Plan(ctx context.Context, project *com.Project, pipeline *com.Pipeline) ([]*com.Job, error) {
+	return p, nil
+}
+
+// staticJob is a job template in a static planner's jobs file.
+type staticJob struct {
+	Tags         []string      `json:"tags"`
+	When         com.JobWhen   `json:"when"`
+	AllowFailure bool          `json:"allow_failure"`
+	Plan         bool          `json:"plan"`
+	Needs        []com.JobNeed `json:"needs"`
+	Dependencies []string      `json:"dependencies"`
+	com.JobSpec
+}
+
+// LoadStaticPlanner reads a JSON array of job templates from a file and returns a StaticPlanner
+// for them. Each template is a job spec with an optional list of tags, such as:
+//
+//	[{"tags": ["docker"], "gitlab": {"job_info": {"name": "test"}, "steps": [...]}}]
+//
+// Templates may also set when, allow_failure, needs, and dependencies as in .gitlab-ci.yml, and
+// plan to make the job a plan job. A template's stage is taken from its job info.
+func LoadStaticPlanner(path string) (StaticPlanner, error) {
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var templates []staticJob
+	if err := json.Unmarshal(p, &templates); err != nil {
+		return nil, err
+	}
+	planner := make(StaticPlanner, len(templates))
+	for i := range templates {
+		tmpl := &templates[i]
+		switch tmpl.When {
+		case "", com.WhenOnSuccess, com.WhenOnFailure, com.WhenAlways, com.WhenManual:
+		default:
+			return nil, fmt.Errorf("job template %d: unsupported when %q", i, tmpl.When)
+		}
+		planner[i] = &com.Job{
+			Tags:         tmpl.Tags,
+			Spec:         &tmpl.JobSpec,
+			When:         tmpl.When,
+			AllowFailure: tmpl.AllowFailure,
+			Plan:         tmpl.Plan,
+			Needs:        tmpl.Needs,
+			Dependencies: tmpl.Dependencies,
+		}
+	}
+	return planner, nil
+}
+
+// RepoPlanner is a Planner that reads the jobs of each pipeline from the configuration file in
+// the pipeline's commit, fetched into a local mirror of its project's repository.
+type RepoPlanner struct {
+	Fetcher *gitfetch.Fetcher
+	// ConfigFile is the path of the configuration file in repositories, such as .gitlab-ci.yml.
+	ConfigFile string
+}
+
+// Plan returns templates for the jobs of the pipeline's configuration file. If the commit has no
+// configuration file, or its workflow rules exclude the pipeline, the pipeline has no jobs.
+func (p *RepoPlanner) Plan(ctx context.Context, project *com.Project, pipeline *com.Pipeline) ([]*com.Job, error) {
+	ev := pipeline.Event
+	tree, err := p.Fetcher.Fetch(ctx, project.CloneURL, ev.FullRef(), ev.After)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := ciconfig.Load(tree, p.ConfigFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	changes, err := p.changes(ctx, project, ev)
+	if err != nil {
+		// Without the changes, changes rules match every pipeline.
+		proc.Warn(ctx, "Unable to find changed files",
+			zap.String("project", project.Path),
+			zap.String("ref", ev.Ref),
+			zap.String("sha", ev.After),
+			zap.Error(err),
+		)
+	}
+	pipeline.Changes = changes
+
+	evalCtx := pipelineContext(project, pipeline)
+	evalCtx.Repo = tree
+	jobs, err := conf.Evaluate(evalCtx)
+	if err != nil {
+		return nil, err
+	}
+	return configTemplates(jobs), nil
+}
+
+// changes returns the paths of the files changed by a pipeline's event. Pushes to existing
+// branches are compared with the commit before the push, and pull requests and new branches with
+// their merge base with the target or default branch. The changes of tags, and of new default
+// branches, aren't known and are nil.
+func (p *RepoPlanner) changes(ctx context.Context, project *com.Project, ev *com.Event) ([]string, error) {
+	url := project.CloneURL
+	var base string
+	var err error
+	switch {
+	case ev.RefType == gciwire.RefTypeTag:
+		return nil, nil
+	case ev.PullRequest != nil:
+		base, err = p.Fetcher.MergeBase(ctx, url, "refs/heads/"+ev.PullRequest.TargetBranch, ev.After)
+	case ev.Before != "" && !com.IsZeroSHA(ev.Before):
+		base = ev.Before
+	default:
+		var branch string
+		if branch, err = p.Fetcher.DefaultBranch(ctx, url); err != nil || branch == ev.Ref {
+			return nil, err
+		}
+		base, err = p.Fetcher.MergeBase(ctx, url, "refs/heads/"+branch, ev.After)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p.Fetcher.Diff(ctx, url, base, ev.After)
+}
+
+// pipelineContext returns the context that .gitlab-ci.yml rules are evaluated in for a pipeline.
+func pipelineContext(project *com.Project, pipeline *com.Pipeline) *ciconfig.Context {
+	ev := pipeline.Event
+	ctx := &ciconfig.Context{
+		Ref:       ev.Ref,
+		Tag:       ev.RefType == gciwire.RefTypeTag,
+		Source:    ciconfig.SourcePush,
+		Variables: pipelineVariables(project, pipeline, &gciwire.JobInfo{}),
+		Changes:   pipeline.Changes,
+	}
+	if ev.Kind == com.EventPullRequest {
+		ctx.Source = ciconfig.SourceMergeRequest
+	}
+	return ctx
+}
+
+// configTemplates returns job templates for jobs from a .gitlab-ci.yml configuration.
+func configTemplates(jobs []*ciconfig.Job) []*com.Job {
+	templates := make([]*com.Job, len(jobs))
+	for i, job := range jobs {
+		tmpl := &com.Job{
+			Tags:         job.Tags,
+			Spec:         job.Spec,
+			When:         com.JobWhen(job.When),
+			AllowFailure: job.AllowFailure,
+			Plan:         job.Plan,
+			Dependencies: job.Dependencies,
+		}
+		if job.Needs != nil {
+			tmpl.Needs = make([]com.JobNeed, len(job.Needs))
+			for i, need := range job.Needs {
+				tmpl.Needs[i] = com.JobNeed{Job: need.Job, Artifacts: need.Artifacts}
+			}
+		}
+		templates[i] = tmpl
+	}
+	return templates
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+	"go.spiff.io/gribble/internal/gitfetch"
+)
+
+// gitRun runs git in dir and returns its output.
+func gitRun(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// gitCommit writes files to the git repository in dir, creating the repository with a main
+// branch if needed, and commits them. It returns the commit's SHA.
+func gitCommit(t *testing.T, dir string, files map[string]string) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		gitRun(t, dir, "init", "--quiet")
+		gitRun(t, dir, "symbolic-ref", "HEAD", "refs/heads/main")
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gitRun(t, dir, "add", "-A")
+	gitRun(t, dir, "commit", "--quiet", "--allow-empty", "-m", "commit")
+	return gitRun(t, dir, "rev-parse", "HEAD")
+}
+
+// newRepoPlanner returns a RepoPlanner, an empty repository directory for it to fetch from, and
+// the repository's project.
+func newRepoPlanner(t *testing.T) (planner *RepoPlanner, repo string, project *com.Project, done func()) {
+	dir, err := ioutil.TempDir("", "gribble-planner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo = filepath.Join(dir, "repo")
+	if err := os.Mkdir(repo, 0700); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	planner = &RepoPlanner{
+		Fetcher:    gitfetch.New(filepath.Join(dir, "mirrors")),
+		ConfigFile: ".gitlab-ci.yml",
+	}
+	project = &com.Project{ID: 1, Path: "owner/repo", CloneURL: "file://" + filepath.ToSlash(repo)}
+	return planner, repo, project, func() { os.RemoveAll(dir) }
+}
+
+// templateNames returns the names of job templates.
+func templateNames(templates []*com.Job) string {
+	names := make([]string, len(templates))
+	for i, tmpl := range templates {
+		names[i] = tmpl.Spec.GitLab.JobInfo.Name
+	}
+	return strings.Join(names, " ")
+}
+
+func TestRepoPlanner(t *testing.T) {
+	planner, repo, project, done := newRepoPlanner(t)
+	defer done()
+
+	plan := func(sha string) ([]*com.Job, error) {
+		pipeline := &com.Pipeline{ID: 1, Project: 1, Event: &com.Event{
+			Kind:    com.EventPush,
+			Project: *project,
+			Ref:     "main",
+			RefType: gciwire.RefTypeBranch,
+			After:   sha,
+		}}
+		return planner.Plan(context.Background(), project, pipeline)
+	}
+
+	// Commits without a config file have no jobs.
+	if templates, err := plan(gitCommit(t, repo, nil)); err != nil || len(templates) != 0 {
+		t.Errorf("Plan() without config = %d templates, %v; want none", len(templates), err)
+	}
+
+	sha := gitCommit(t, repo, map[string]string{
+		".gitlab-ci.yml": "include: test.yml\nbuild:\n  script: make\n  tags: [docker]\n",
+		"test.yml": "test:\n  stage: test\n  script: make test\n  needs: [build]\ntags:\n  script: make\n  only: [tags]\n" +
+			"lint:\n  script: make lint\n  rules:\n    - exists: [test.yml]\n",
+	})
+	templates, err := plan(sha)
+	if err != nil {
+		t.Fatalf("Plan() = %v; want nil", err)
+	}
+	byName := map[string]*com.Job{}
+	for _, tmpl := range templates {
+		byName[tmpl.Spec.GitLab.JobInfo.Name] = tmpl
+	}
+	build, test := byName["build"], byName["test"]
+	if len(templates) != 3 || build == nil || test == nil || byName["lint"] == nil {
+		t.Fatalf("Plan() = %d templates; want build, test, and lint", len(templates))
+	}
+	if len(build.Tags) != 1 || build.Tags[0] != "docker" {
+		t.Errorf("build tags = %q; want [docker]", build.Tags)
+	}
+	if len(test.Needs) != 1 || test.Needs[0].Job != "build" {
+		t.Errorf("test needs = %+v; want build", test.Needs)
+	}
+
+	if _, err := plan(strings.Repeat("1", 40)); err == nil {
+		t.Error("Plan() for missing commit = nil; want error")
+	}
+}
+
+func TestRepoPlannerChanges(t *testing.T) {
+	planner, repo, project, done := newRepoPlanner(t)
+	defer done()
+
+	first := gitCommit(t, repo, map[string]string{
+		".gitlab-ci.yml": "build:\n  script: make\n  rules:\n    - changes: [src/*]\n" +
+			"docs:\n  script: make docs\n  rules:\n    - changes: [docs/*]\n",
+		"src/main.go":   "package main",
+		"docs/index.md": "docs",
+	})
+	docs := gitCommit(t, repo, map[string]string{"docs/index.md": "more docs"})
+	gitRun(t, repo, "checkout", "--quiet", "-b", "feature")
+	gitCommit(t, repo, map[string]string{"src/main.go": "package main // changed"})
+	feature := gitCommit(t, repo, map[string]string{"src/util.go": "package main"})
+	gitRun(t, repo, "checkout", "--quiet", "main")
+
+	cases := []struct {
+		name    string
+		ev      com.Event
+		changes []string
+		jobs    string
+	}{
+		{
+			name:    "push",
+			ev:      com.Event{Kind: com.EventPush, Ref: "main", Before: first, After: docs},
+			changes: []string{"docs/index.md"},
+			jobs:    "docs",
+		},
+		{
+			name:    "new branch",
+			ev:      com.Event{Kind: com.EventPush, Ref: "feature", Before: com.ZeroSHA, After: feature},
+			changes: []string{"src/main.go", "src/util.go"},
+			jobs:    "build",
+		},
+		{
+			name: "pull request",
+			ev: com.Event{Kind: com.EventPullRequest, Ref: "feature", After: feature,
+				PullRequest: &com.PullRequest{Number: 1, SourceBranch: "feature", TargetBranch: "main"}},
+			changes: []string{"src/main.go", "src/util.go"},
+			jobs:    "build",
+		},
+		{
+			name: "new default branch",
+			ev:   com.Event{Kind: com.EventPush, Ref: "main", Before: com.ZeroSHA, After: docs},
+			jobs: "build docs",
+		},
+		{
+			name: "tag",
+			ev:   com.Event{Kind: com.EventPush, Ref: "v1", RefType: gciwire.RefTypeTag, After: docs},
+			jobs: "build docs",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ev := c.ev
+			ev.Project = *project
+			if ev.RefType == "" {
+				ev.RefType = gciwire.RefTypeBranch
+			}
+			pipeline := &com.Pipeline{ID: 1, Project: project.ID, Event: &ev}
+			templates, err := planner.Plan(context.Background(), project, pipeline)
+			if err != nil {
+				t.Fatalf("Plan() = %v; want nil", err)
+			}
+			if !reflect.DeepEqual(pipeline.Changes, c.changes) {
+				t.Errorf("pipeline changes = %q; want %q", pipeline.Changes, c.changes)
+			}
+			if got := templateNames(templates); got != c.jobs {
+				t.Errorf("Plan() jobs = %s; want %s", got, c.jobs)
+			}
+
+			vars := pipelineVariables(project, pipeline, &gciwire.JobInfo{})
+			if got, want := vars.Get("GRIBBLE_CHANGED_FILES"), strings.Join(c.changes, "\n"); got != want {
+				t.Errorf("GRIBBLE_CHANGED_FILES = %q; want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+	"go.spiff.io/gribble/internal/proc"
+	"go.uber.org/zap"
+)
+
+var errNotManual = ErrorRep{"job is not a manual job waiting to be played"}
+
+// playJobRequest is the optional body of a request to play a manual job.
+type playJobRequest struct {
+	// Variables are added to the job's variables, taking precedence over them.
+	Variables []struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	} `json:"variables"`
+}
+
+// jobRep is the admin API's representation of a job.
+type jobRep struct {
+	ID       int64            `json:"id"`
+	Pipeline int64            `json:"pipeline_id,omitempty"`
+	Name     string           `json:"name"`
+	Stage    string           `json:"stage"`
+	State    gciwire.JobState `json:"state"`
+}
+
+func newJobRep(job *com.Job) *jobRep {
+	return &jobRep{
+		ID:       job.ID,
+		Pipeline: job.Pipeline,
+		Name:     job.Spec.GitLab.JobInfo.Name,
+		Stage:    job.Spec.GitLab.JobInfo.Stage,
+		State:    job.State,
+	}
+}
+
+// PlayJob starts a manual job by moving it to pending, where it can be claimed by a runner. Any
+// variables in the request are added to the job. The job must be waiting in the manual state.
+func (s *Server) PlayJob(w http.ResponseWriter, req *http.Request, params httprouter.Params) (code int, msg interface{}) {
+	ctx := req.Context()
+	id, ok := jobID(params)
+	if !ok {
+		return http.StatusNotFound, nil
+	}
+
+	var body playJobRequest
+	p, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return http.StatusBadRequest, errBadRequest
+	} else if len(bytes.TrimSpace(p)) > 0 {
+		if err := json.Unmarshal(p, &body); err != nil {
+			return http.StatusBadRequest, errBadRequest
+		}
+	}
+	// CI_JOB_MANUAL is set for manual jobs that were played, as in GitLab.
+	vars := gciwire.JobVariables{{Key: "CI_JOB_MANUAL", Value: "true", Public: true}}
+	for _, v := range body.Variables {
+		if v.Key == "" {
+			return http.StatusBadRequest, ErrorRep{"variables must have a key"}
+		}
+		vars = append(vars, gciwire.JobVariable{Key: v.Key, Value: v.Value})
+	}
+
+	job, err := s.db.GetJob(ctx, id)
+	if err == com.ErrNotFound {
+		return http.StatusNotFound, nil
+	} else if err != nil {
+		proc.Error(ctx, "Error fetching job", zap.Int64("job_id", id), zap.Error(err))
+		return http.StatusInternalServerError, nil
+	}
+	if job.State != com.JobManual {
+		return http.StatusConflict, errNotManual
+	}
+
+	if err := s.db.PlayJob(ctx, job, vars); err == com.ErrConflict {
+		return http.StatusConflict, errNotManual
+	} else if err != nil {
+		proc.Error(ctx, "Error playing manual job", zap.Int64("job_id", id), zap.Error(err))
+		return http.StatusInternalServerError, nil
+	}
+	s.jobs.Notify()
+
+	proc.Info(ctx, "Manual job played",
+		zap.Int64("job_id", job.ID),
+		zap.Int64("pipeline_id", job.Pipeline),
+		zap.Int("variables", len(body.Variables)),
+	)
+	return http.StatusOK, newJobRep(job)
+}
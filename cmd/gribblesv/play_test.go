@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+)
+
+func TestPlayJob(t *testing.T) {
+	deploy := jobTemplate("deploy", "deploy")
+	deploy.When = com.WhenManual
+	s := newTestServer(t, &ServerConfig{
+		GitHubToken: testGitHubSecret,
+		AdminToken:  testAdminToken,
+		Planner:     StaticPlanner{deploy},
+	})
+	defer s.Close()
+
+	body := []byte(githubPushBody)
+	if rec := s.Do("POST", "/v1/events/github", githubHeader("push", body), body); rec.Code != http.StatusCreated {
+		t.Fatalf("POST push = %d; want %d", rec.Code, http.StatusCreated)
+	}
+	jobs, err := s.DB.GetPipelineJobs(s.Ctx, 1)
+	if err != nil || len(jobs) != 1 || jobs[0].State != com.JobManual {
+		t.Fatalf("GetPipelineJobs() = %v; want one manual job", err)
+	}
+	path := "/v1/admin/jobs/" + strconv.FormatInt(jobs[0].ID, 10) + "/play"
+
+	// Runners never receive manual jobs.
+	runner := s.CreateRunner(t, "runner")
+	req := gciwire.JobRequest{Token: runner.Token}
+	req.Info.Features = allFeatures
+	if rec := s.Do("POST", "/_gitlab/api/v4/jobs/request", nil, req); rec.Code != http.StatusNoContent {
+		t.Fatalf("POST /jobs/request for manual job = %d; want %d", rec.Code, http.StatusNoContent)
+	}
+
+	if rec := s.Do("POST", path, nil, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("POST play without token = %d; want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := s.Do("POST", "/v1/admin/jobs/100/play", adminHeader, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("POST play for missing job = %d; want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := s.Do("POST", path, adminHeader, []byte(`{"variables": [{"value": "x"}]}`)); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST play without variable key = %d; want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	play := map[string]interface{}{
+		"variables": []map[string]string{{"key": "TARGET", "value": "production"}},
+	}
+	rec := s.Do("POST", path, adminHeader, play)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST play = %d; want %d", rec.Code, http.StatusOK)
+	}
+	var rep jobRep
+	if err := json.Unmarshal(rec.Body.Bytes(), &rep); err != nil || rep.Name != "deploy" || rep.State != gciwire.Pending {
+		t.Errorf("POST play = %s, %v; want pending deploy job", rec.Body, err)
+	}
+	if rec := s.Do("POST", path, adminHeader, nil); rec.Code != http.StatusConflict {
+		t.Errorf("POST play again = %d; want %d", rec.Code, http.StatusConflict)
+	}
+
+	job := s.RequestJob(t, runner)
+	if job.JobInfo.Name != "deploy" {
+		t.Fatalf("claimed %q; want deploy", job.JobInfo.Name)
+	}
+	for key, want := range map[string]string{"TARGET": "production", "CI_JOB_MANUAL": "true"} {
+		if got := job.Variables.Get(key); got != want {
+			t.Errorf("%s = %q; want %q", key, got, want)
+		}
+	}
+}
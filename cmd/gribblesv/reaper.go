@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.spiff.io/gribble/internal/artifact"
+	"go.spiff.io/gribble/internal/proc"
+	"go.uber.org/zap"
+)
+
+const artifactReapInterval = time.Hour
+
+// artifactReaper periodically deletes expired artifacts.
+type artifactReaper struct {
+	db         DB
+	store      artifact.Store
+	interval   time.Duration
+	keepLatest bool
+}
+
+// Run reaps expired artifacts every interval until the context is canceled. Errors reaping
+// artifacts are logged and do not stop the reaper.
+func (r *artifactReaper) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.Reap(ctx); err != nil && ctx.Err() == nil {
+			proc.Error(ctx, "Error reaping expired artifacts", zap.Error(err))
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Reap deletes the blobs and records of artifacts that have expired and returns the number of
+// artifacts deleted.
+func (r *artifactReaper) Reap(ctx context.Context) (n int, err error) {
+	expired, err := r.db.GetExpiredArtifacts(ctx, proc.Now(ctx), r.keepLatest)
+	if err != nil {
+		return 0, err
+	}
+	for _, a := range expired {
+		if err := r.store.Delete(ctx, a.Key); err != nil {
+			return n, err
+		}
+		if err := r.db.DeleteArtifact(ctx, a); err != nil {
+			return n, err
+		}
+		n++
+		proc.Debug(ctx, "Deleted expired artifact",
+			zap.Int64("job_id", a.Job),
+			zap.String("artifact_type", a.Type),
+			zap.Time("expired", a.Expires),
+		)
+	}
+	if n > 0 {
+		proc.Info(ctx, "Deleted expired artifacts", zap.Int("count", n))
+	}
+	return n, nil
+}
@@ -3,14 +3,19 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/go-github/v24/github"
 	"github.com/julienschmidt/httprouter"
+	"go.spiff.io/gribble/internal/artifact"
+	"go.spiff.io/gribble/internal/cache"
 	com "go.spiff.io/gribble/internal/common"
 	gciwire "go.spiff.io/gribble/internal/gci-wire"
 	"go.spiff.io/gribble/internal/proc"
@@ -19,11 +24,14 @@ import (
 
 var (
 	errBadRequest = ErrorRep{"bad request"}
+
+	errInvalidJobToken = errors.New("invalid job token")
 )
 
 const (
 	defaultTokenLength = 20
 	runnerTokenLen     = 48
+	jobTokenLen        = 32
 )
 
 type Server struct {
@@ -33,13 +41,98 @@ type Server struct {
 	toker *randomToken
 	rng   io.Reader
 
+	artifacts       artifact.Store
+	artifactMaxSize int64
+	artifactExpiry  time.Duration
+
+	cache       *cache.Store
+	cacheCreds  cache.Credentials
+	cacheRegion string
+
+	planner     Planner
+	forkSecrets bool
+
+	planMaxJobs  int
+	planMaxDepth int
+
+	jobs        *Notifier
+	pollTimeout time.Duration
+	stop        chan struct{}
+	stopOnce    sync.Once
+
 	githubToken []byte
+	giteaSecret []byte
+	gitlabToken []byte
+
+	bitbucketServerSecret []byte
+	bitbucketCloudSecret  []byte
+
+	genericSecret []byte
+
+	webhooks   map[string]*webhookSource
+	adminToken []byte
 }
 
 type ServerConfig struct {
 	TokenLength int
 	RandSource  io.Reader
 	GitHubToken string
+	// GiteaSecret is the secret Gitea webhooks are signed with. If empty, Gitea webhooks are
+	// not accepted.
+	GiteaSecret string
+	// GitLabToken is the secret token GitLab webhooks send. If empty, GitLab webhooks are not
+	// accepted.
+	GitLabToken string
+	// BitbucketServerSecret is the secret Bitbucket Server webhooks are signed with, and
+	// BitbucketCloudSecret is the secret query parameter of Bitbucket Cloud webhooks. If both
+	// are empty, Bitbucket webhooks are not accepted.
+	BitbucketServerSecret string
+	BitbucketCloudSecret  string
+	// GenericSecret is the secret that each project's generic webhook secret is derived from.
+	// If empty, generic webhooks are not accepted.
+	GenericSecret string
+
+	// AdminToken is the bearer token required by the admin API. If empty, the admin API is not
+	// served.
+	AdminToken string
+
+	// JobPollTimeout is the longest time a job request is held open waiting for a job.
+	// If zero, job requests return immediately.
+	JobPollTimeout time.Duration
+
+	// Artifacts is the store job artifacts are kept in. If nil, artifact uploads are not
+	// accepted.
+	Artifacts artifact.Store
+	// ArtifactMaxSize is the largest artifact, in bytes, that may be uploaded. If zero or less,
+	// artifact sizes are not limited.
+	ArtifactMaxSize int64
+	// ArtifactExpiry is how long artifacts without an expire_in are kept. If zero or less, they
+	// are kept forever.
+	ArtifactExpiry time.Duration
+
+	// Cache is the store runner cache archives are kept in. If nil, the cache endpoints are
+	// not served.
+	Cache *cache.Store
+	// CacheBucket is the bucket name runners are configured to use for the cache.
+	CacheBucket string
+	// CacheCredentials are the access and secret keys cache requests must be signed with.
+	CacheCredentials cache.Credentials
+	// CacheRegion is the region reported to S3 clients. If empty, it is us-east-1.
+	CacheRegion string
+
+	// Planner decides which jobs are run for pipelines created by webhooks. If nil, pipelines
+	// have no jobs.
+	Planner Planner
+	// ForkSecrets, if true, gives jobs in pipelines for pull requests from forks variables that
+	// aren't public. By default, these are withheld.
+	ForkSecrets bool
+
+	// PlanMaxJobs is the most jobs a pipeline may have after a plan job's plan is added to it.
+	// If zero or less, it is 200.
+	PlanMaxJobs int
+	// PlanMaxDepth is how deeply plan jobs may be nested, counting the first plan job of a
+	// pipeline as one. If zero or less, it is 2.
+	PlanMaxDepth int
 }
 
 func (s *ServerConfig) tokenLength() int {
@@ -70,13 +163,67 @@ func NewServer(conf *ServerConfig, db DB) (*Server, error) {
 
 		toker: toker,
 		rng:   rng,
+
+		artifacts:       conf.Artifacts,
+		artifactMaxSize: conf.ArtifactMaxSize,
+		artifactExpiry:  conf.ArtifactExpiry,
+
+		cache:       conf.Cache,
+		cacheCreds:  conf.CacheCredentials,
+		cacheRegion: conf.CacheRegion,
+
+		planner:     conf.Planner,
+		forkSecrets: conf.ForkSecrets,
+
+		planMaxJobs:  conf.PlanMaxJobs,
+		planMaxDepth: conf.PlanMaxDepth,
+
+		jobs:        NewNotifier(),
+		pollTimeout: conf.JobPollTimeout,
+		stop:        make(chan struct{}),
+
+		webhooks: map[string]*webhookSource{},
+	}
+
+	if s.planner == nil {
+		s.planner = StaticPlanner(nil)
+	}
+	if s.planMaxJobs <= 0 {
+		s.planMaxJobs = defaultPlanMaxJobs
+	}
+	if s.planMaxDepth <= 0 {
+		s.planMaxDepth = defaultPlanMaxDepth
 	}
 
 	s.mux.POST("/_gitlab/api/v4/runners", HandleJSON(s.RegisterRunner))
-	s.mux.POST("/_gitlab/api/v4/jobs/request", HandleJSON(s.RequestJob))
 	s.mux.PATCH("/_gitlab/api/v4/jobs/:id/trace", HandleJSON(s.PatchTrace))
 	s.mux.PUT("/_gitlab/api/v4/jobs/:id", HandleJSON(s.UpdateJob))
 
+	jobRoutes := jobPOSTRoutes{
+		Request: HandleJSON(s.RequestJob),
+	}
+	if s.artifacts != nil {
+		jobRoutes.Artifacts = HandleJSON(s.UploadArtifacts)
+		s.mux.GET("/_gitlab/api/v4/jobs/:id/artifacts", s.DownloadArtifacts)
+	}
+	s.mux.POST("/_gitlab/api/v4/jobs/*path", jobRoutes.Handle)
+
+	if s.cache != nil {
+		if !validBucketName.MatchString(conf.CacheBucket) {
+			return nil, fmt.Errorf("invalid cache bucket name: %q", conf.CacheBucket)
+		}
+		if s.cacheCreds.AccessKey == "" || s.cacheCreds.SecretKey == "" {
+			return nil, errors.New("cache access key and secret key are required")
+		}
+		if s.cacheRegion == "" {
+			s.cacheRegion = defaultCacheRegion
+		}
+		route := "/" + conf.CacheBucket + "/*object"
+		s.mux.GET(route, s.GetCache)
+		s.mux.HEAD(route, s.GetCache)
+		s.mux.PUT(route, s.PutCache)
+	}
+
 	if token := []byte(conf.GitHubToken); len(token) > 0 {
 		if conf.GitHubToken == "DEV" {
 			// If token is DEV (uppercase), don't validate payloads by using an empty
@@ -85,16 +232,107 @@ func NewServer(conf *ServerConfig, db DB) (*Server, error) {
 			token = nil
 		}
 		s.githubToken = token
-		s.mux.POST("/v1/events/github", HandleJSON(s.GitHubEvent))
+		s.handleWebhook(&webhookSource{
+			Name:            "github",
+			DeliveryHeaders: []string{"X-GitHub-Delivery"},
+			EventHeaders:    []string{"X-GitHub-Event"},
+			Handle:          s.GitHubEvent,
+		})
+	}
+
+	if conf.GiteaSecret != "" {
+		s.giteaSecret = []byte(conf.GiteaSecret)
+		s.handleWebhook(&webhookSource{
+			Name:            "gitea",
+			DeliveryHeaders: []string{"X-Gitea-Delivery", "X-Forgejo-Delivery"},
+			EventHeaders:    []string{"X-Gitea-Event", "X-Forgejo-Event"},
+			Handle:          s.GiteaEvent,
+		})
+	}
+
+	if conf.GitLabToken != "" {
+		s.gitlabToken = []byte(conf.GitLabToken)
+		s.handleWebhook(&webhookSource{
+			Name:            "gitlab",
+			DeliveryHeaders: []string{"X-Gitlab-Event-UUID"},
+			EventHeaders:    []string{"X-Gitlab-Event"},
+			Handle:          s.GitLabEvent,
+		})
+	}
+
+	if conf.BitbucketServerSecret != "" || conf.BitbucketCloudSecret != "" {
+		s.bitbucketServerSecret = []byte(conf.BitbucketServerSecret)
+		s.bitbucketCloudSecret = []byte(conf.BitbucketCloudSecret)
+		s.handleWebhook(&webhookSource{
+			Name: "bitbucket",
+			// Bitbucket Cloud and Bitbucket Server, respectively.
+			DeliveryHeaders: []string{"X-Request-UUID", "X-Request-Id"},
+			EventHeaders:    []string{"X-Event-Key"},
+			Handle:          s.BitbucketEvent,
+		})
+	}
+
+	if conf.GenericSecret != "" {
+		s.genericSecret = []byte(conf.GenericSecret)
+		s.handleWebhook(&webhookSource{
+			Name:            "generic",
+			DeliveryHeaders: []string{"X-Gribble-Delivery"},
+			Handle:          s.GenericEvent,
+		})
+	}
+
+	if conf.AdminToken != "" {
+		s.adminToken = []byte(conf.AdminToken)
+		s.mux.GET("/v1/admin/deliveries", HandleJSON(s.adminOnly(s.GetDeliveries)))
+		s.mux.GET("/v1/admin/deliveries/:id", HandleJSON(s.adminOnly(s.GetDelivery)))
+		s.mux.POST("/v1/admin/deliveries/:id/replay", HandleJSON(s.adminOnly(s.ReplayDelivery)))
+		s.mux.POST("/v1/admin/jobs/:id/play", HandleJSON(s.adminOnly(s.PlayJob)))
 	}
 
 	return s, nil
 }
 
+// jobPOSTRoutes dispatches POST requests under /_gitlab/api/v4/jobs/. This is necessary because
+// httprouter does not allow a static path segment (request) and a parameter (:id) in the same
+// position for the same method.
+type jobPOSTRoutes struct {
+	Request   httprouter.Handle // jobs/request
+	Artifacts httprouter.Handle // jobs/:id/artifacts
+}
+
+func (j *jobPOSTRoutes) Handle(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	path := strings.Split(strings.TrimPrefix(params.ByName("path"), "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "request" && j.Request != nil:
+		j.Request(w, req, nil)
+	case len(path) == 2 && path[1] == "artifacts" && j.Artifacts != nil:
+		j.Artifacts(w, req, httprouter.Params{{Key: "id", Value: path[0]}})
+	default:
+		http.NotFound(w, req)
+	}
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	s.mux.ServeHTTP(w, req)
 }
 
+// Shutdown releases any job requests waiting on new jobs. It does not stop the server from
+// handling requests.
+func (s *Server) Shutdown() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+func jobFetchErrorCode(err error) int {
+	switch err {
+	case com.ErrNotFound:
+		return http.StatusNotFound
+	case errInvalidJobToken:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func runnerFetchErrorCode(err error) int {
 	switch err {
 	case com.ErrNotFound:
@@ -125,6 +363,19 @@ func (s *Server) getRunnerByToken(ctx context.Context, token string, tags bool)
 	return runner, err
 }
 
+// getJobByToken returns the job with the given ID if token is the job's current token. Jobs that
+// have finished no longer have a valid token.
+func (s *Server) getJobByToken(ctx context.Context, id int64, token string) (*com.Job, error) {
+	job, err := s.db.GetJob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !compareTokenHash(job.TokenHash, token) {
+		return job, errInvalidJobToken
+	}
+	return job, nil
+}
+
 func (s *Server) RegisterRunner(w http.ResponseWriter, req *http.Request, params httprouter.Params) (int, interface{}) {
 	ctx := req.Context()
 	var body gciwire.RegisterRunnerRequest
@@ -161,40 +412,179 @@ func (s *Server) RegisterRunner(w http.ResponseWriter, req *http.Request, params
 	return http.StatusCreated, &rep
 }
 
+// jobID returns the job ID in the request's path parameters.
+func jobID(params httprouter.Params) (int64, bool) {
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	return id, err == nil && id > 0
+}
+
+// parseContentRange parses a trace patch's Content-Range header, of the form "start-end", and
+// returns the start offset of the patch. The end offset is inclusive. If the header is empty,
+// parseContentRange returns -1.
+func parseContentRange(header string, length int) (start int64, err error) {
+	if header == "" {
+		return -1, nil
+	}
+	sep := strings.IndexByte(header, '-')
+	if sep == -1 {
+		return 0, fmt.Errorf("malformed content range: %q", header)
+	}
+	start, err = strconv.ParseInt(header[:sep], 10, 64)
+	if err != nil || start < 0 {
+		return 0, fmt.Errorf("malformed content range start: %q", header)
+	}
+	end, err := strconv.ParseInt(header[sep+1:], 10, 64)
+	if err != nil || end-start+1 != int64(length) {
+		return 0, fmt.Errorf("content range does not match content length: %q", header)
+	}
+	return start, nil
+}
+
 func (s *Server) PatchTrace(w http.ResponseWriter, req *http.Request, params httprouter.Params) (code int, msg interface{}) {
 	ctx := req.Context()
+	id, ok := jobID(params)
+	if !ok {
+		return http.StatusNotFound, nil
+	}
+
 	trace, err := ioutil.ReadAll(req.Body)
-	job := params[0].Value
 	if err != nil {
 		proc.Warn(ctx, "Unable to consume trace",
-			zap.String("job_id", job),
+			zap.Int64("job_id", id),
 			zap.Error(err),
 		)
 		return http.StatusBadRequest, errBadRequest
 	}
 
-	proc.Debug(ctx, "Trace patch received", zap.ByteString("trace", trace))
+	start, err := parseContentRange(req.Header.Get("Content-Range"), len(trace))
+	if err != nil {
+		proc.Warn(ctx, "Invalid trace patch", zap.Int64("job_id", id), zap.Error(err))
+		return http.StatusBadRequest, errBadRequest
+	}
+
+	job, err := s.getJobByToken(ctx, id, req.Header.Get("JOB-TOKEN"))
+	if job != nil {
+		w.Header().Set("Job-Status", string(job.State))
+	}
+	if code := jobFetchErrorCode(err); err != nil {
+		if code == http.StatusInternalServerError {
+			proc.Error(ctx, "Error fetching job", zap.Int64("job_id", id), zap.Error(err))
+		}
+		return code, nil
+	}
+
+	if job.State != gciwire.Running {
+		return http.StatusForbidden, nil
+	}
+
+	size, err := s.db.AppendTrace(ctx, id, start, trace)
+	if err == nil || err == com.ErrRangeMismatch {
+		w.Header().Set("Range", "0-"+strconv.FormatInt(size, 10))
+	}
+	if err == com.ErrRangeMismatch {
+		proc.Debug(ctx, "Trace patch out of range",
+			zap.Int64("job_id", id),
+			zap.Int64("start", start),
+			zap.Int64("length", size),
+		)
+		return http.StatusRequestedRangeNotSatisfiable, nil
+	} else if err != nil {
+		proc.Error(ctx, "Error appending trace", zap.Int64("job_id", id), zap.Error(err))
+		return http.StatusInternalServerError, nil
+	}
 
 	return http.StatusAccepted, nil
 }
 
 func (s *Server) UpdateJob(w http.ResponseWriter, req *http.Request, params httprouter.Params) (code int, msg interface{}) {
 	ctx := req.Context()
+	id, ok := jobID(params)
+	if !ok {
+		return http.StatusNotFound, nil
+	}
+
 	var body gciwire.UpdateJobRequest
 	if err := ReadJSON(req.Body, &body); err != nil {
 		return http.StatusBadRequest, errBadRequest
 	}
 
-	if trace := body.Trace; trace != nil {
-		proc.Debug(ctx, "Trace received", zap.String("trace", *trace))
+	job, err := s.getJobByToken(ctx, id, body.Token)
+	if code := jobFetchErrorCode(err); err != nil {
+		if code == http.StatusInternalServerError {
+			proc.Error(ctx, "Error fetching job", zap.Int64("job_id", id), zap.Error(err))
+		}
+		return code, nil
 	}
 
 	proc.Debug(ctx, "Update job",
+		zap.Int64("job_id", id),
 		zap.Any("info", body.Info),
 		zap.Any("state", body.State),
 		zap.Any("reason", body.FailureReason),
 	)
-	w.Header().Set("Job-Status", string(body.State))
+
+	if body.State == job.State && body.FailureReason == job.FailureReason && body.Trace == nil {
+		w.Header().Set("Job-Status", string(job.State))
+		return http.StatusOK, nil
+	}
+
+	if !com.CanTransition(job.State, body.State) {
+		proc.Warn(ctx, "Illegal job state transition",
+			zap.Int64("job_id", id),
+			zap.Any("from", job.State),
+			zap.Any("to", body.State),
+		)
+		w.Header().Set("Job-Status", string(job.State))
+		return http.StatusConflict, nil
+	}
+
+	if trace := body.Trace; trace != nil {
+		if err := s.db.SetTrace(ctx, id, []byte(*trace)); err != nil {
+			proc.Error(ctx, "Error storing trace", zap.Int64("job_id", id), zap.Error(err))
+			return http.StatusInternalServerError, nil
+		}
+	}
+
+	// A plan job only succeeds if its plan is valid and its jobs can be added to the pipeline.
+	var planned *plan
+	if job.Plan && body.State == gciwire.Success {
+		planned, err = s.readPlan(ctx, job)
+		if perr, ok := err.(*planError); ok {
+			proc.Warn(ctx, "Plan job uploaded an invalid plan", zap.Int64("job_id", id), zap.Error(perr))
+			s.appendTraceLine(ctx, id, "ERROR: "+perr.Error())
+			body.State, body.FailureReason = gciwire.Failed, gciwire.ScriptFailure
+		} else if err != nil {
+			proc.Error(ctx, "Error reading plan", zap.Int64("job_id", id), zap.Error(err))
+			return http.StatusInternalServerError, nil
+		}
+	}
+
+	if planned != nil {
+		err = s.expandPlan(ctx, job, planned)
+	} else {
+		err = s.db.SetJobState(ctx, job, body.State, body.FailureReason)
+	}
+	if err == com.ErrConflict {
+		return http.StatusConflict, nil
+	} else if err != nil {
+		proc.Error(ctx, "Error updating job state", zap.Int64("job_id", id), zap.Error(err))
+		return http.StatusInternalServerError, nil
+	}
+
+	if com.IsFinished(job.State) {
+		proc.Info(ctx, "Job finished",
+			zap.Int64("job_id", id),
+			zap.Any("state", job.State),
+			zap.Any("reason", job.FailureReason),
+		)
+		// Jobs waiting on this one may have been released.
+		s.jobs.Notify()
+		if job.Pipeline != 0 {
+			s.logPipelineFinished(ctx, job.Pipeline)
+		}
+	}
+
+	w.Header().Set("Job-Status", string(job.State))
 	return http.StatusOK, nil
 }
 
@@ -214,29 +604,117 @@ func (s *Server) RequestJob(w http.ResponseWriter, req *http.Request, params htt
 		return http.StatusNoContent, nil
 	}
 
-	return http.StatusNoContent, nil
-}
+	// If the runner's last update is current, there's nothing new in the queue for it to claim
+	// and the request can go straight to waiting on the next update.
+	lastUpdate, wake := s.jobs.Wait()
+	unchanged := s.pollTimeout > 0 && body.LastUpdate == lastUpdate
 
-func (s *Server) GitHubEvent(w http.ResponseWriter, req *http.Request, params httprouter.Params) (code int, msg interface{}) {
-	typ := github.WebHookType(req)
-	switch typ {
-	case "push", "pull_request", "pull_request_review_comment":
-	default:
-		return http.StatusNotFound, nil
+	if features := com.ToFeatureFlags(body.Info.Features); features != runner.Features {
+		if err := s.db.SetRunnerFeatures(ctx, runner, features); err != nil {
+			proc.Error(ctx, "Error updating runner features", zap.Int64("runner_id", runner.ID), zap.Error(err))
+			return http.StatusInternalServerError, nil
+		}
+		s.updateStuckJobs(ctx)
+		unchanged = false
+	}
+
+	var timeout <-chan time.Time
+	if s.pollTimeout > 0 {
+		timer := time.NewTimer(s.pollTimeout)
+		defer timer.Stop()
+		timeout = timer.C
 	}
 
-	body, err := github.ValidatePayload(req, s.githubToken)
+	token, err := genToken(jobTokenLen, s.rng)
 	if err != nil {
-		return http.StatusForbidden, nil
+		proc.Error(ctx, "Error generating job token", zap.Error(err))
+		return http.StatusInternalServerError, nil
+	}
+	tokenHash := hashToken(token)
+
+	var job *com.Job
+	for {
+		if !unchanged {
+			job, err = s.db.ClaimJob(ctx, runner, tokenHash)
+			if err == nil {
+				break
+			} else if err != com.ErrNotFound {
+				proc.Error(ctx, "Error claiming job", zap.Int64("runner_id", runner.ID), zap.Error(err))
+				return http.StatusInternalServerError, nil
+			}
+		}
+		unchanged = false
+
+		w.Header().Set("X-GitLab-Last-Update", lastUpdate)
+		if timeout == nil {
+			return http.StatusNoContent, nil
+		}
+
+		select {
+		case <-wake:
+			lastUpdate, wake = s.jobs.Wait()
+		case <-timeout:
+			return http.StatusNoContent, nil
+		case <-s.stop:
+			return http.StatusNoContent, nil
+		case <-ctx.Done():
+			return http.StatusNoContent, nil
+		}
 	}
+	w.Header().Del("X-GitLab-Last-Update")
 
-	payload, err := github.ParseWebHook(typ, body)
+	proc.Info(ctx, "Job claimed", zap.Int64("job_id", job.ID), zap.Int64("runner_id", runner.ID))
+
+	deps, err := s.db.GetArtifactDependencies(ctx, job.ID)
 	if err != nil {
-		return http.StatusBadRequest, nil
+		// The job has already been claimed, so continue without artifacts rather than fail.
+		proc.Error(ctx, "Error fetching job dependencies", zap.Int64("job_id", job.ID), zap.Error(err))
 	}
 
-	log.Printf("-- WEBHOOK --\n%s\n-- END WEBHOOK --", body)
-	log.Print(payload)
+	rep := job.Spec.GitLab
+	rep.ID = int(job.ID)
+	rep.Token = token
+	rep.Dependencies = make(gciwire.Dependencies, len(deps))
+	for i, dep := range deps {
+		rep.Dependencies[i] = gciwire.Dependency{
+			ID:    int(dep.Job),
+			Token: token,
+			Name:  dep.JobName,
+			ArtifactsFile: gciwire.DependencyArtifactsFile{
+				Filename: dep.Filename,
+				Size:     dep.Size,
+			},
+		}
+	}
+	if max := int(runner.MaxTimeout / time.Second); max <= 0 {
+		// nop
+	} else if rep.RunnerInfo.Timeout <= 0 || rep.RunnerInfo.Timeout > max {
+		rep.RunnerInfo.Timeout = max
+	}
+	return http.StatusCreated, &rep
+}
 
-	return http.StatusAccepted, nil
+// enqueueJob creates a pending job and wakes any job requests waiting on a new job.
+func (s *Server) enqueueJob(ctx context.Context, job *com.Job) error {
+	if err := s.db.CreateJob(ctx, job); err != nil {
+		return err
+	}
+	if job.Stuck {
+		proc.Warn(ctx, "Job is stuck: no runner has the features it requires", zap.Int64("job_id", job.ID))
+	}
+	s.jobs.Notify()
+	return nil
+}
+
+// updateStuckJobs re-evaluates whether pending jobs can be run by any registered runner and logs
+// jobs that cannot.
+func (s *Server) updateStuckJobs(ctx context.Context) {
+	stuck, err := s.db.UpdateStuckJobs(ctx)
+	if err != nil {
+		proc.Error(ctx, "Error updating stuck jobs", zap.Error(err))
+		return
+	}
+	for _, id := range stuck {
+		proc.Warn(ctx, "Job is stuck: no runner has the features it requires", zap.Int64("job_id", id))
+	}
 }
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.spiff.io/gribble/internal/artifact"
+	"go.spiff.io/gribble/internal/cache"
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+	"go.spiff.io/gribble/internal/sqlite"
+)
+
+type testServer struct {
+	*Server
+	DB  *sqlite.DB
+	Ctx context.Context
+
+	cleanup []func()
+}
+
+func newTestServer(t *testing.T, conf *ServerConfig) *testServer {
+	ctx := context.Background()
+	db, err := sqlite.NewMemoryDB(ctx, 1)
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	if err := db.Migrate(ctx); err != nil {
+		db.Close()
+		t.Fatalf("Error migrating database: %v", err)
+	}
+	if conf == nil {
+		conf = &ServerConfig{}
+	}
+	s, err := NewServer(conf, db)
+	if err != nil {
+		db.Close()
+		t.Fatalf("Error creating server: %v", err)
+	}
+	return &testServer{Server: s, DB: db, Ctx: ctx}
+}
+
+func (s *testServer) Close() {
+	s.DB.Close()
+	for _, fn := range s.cleanup {
+		fn()
+	}
+}
+
+// Do sends a request to the server and returns the recorded response. If body is not a []byte,
+// it is encoded as JSON.
+func (s *testServer) Do(method, path string, header http.Header, body interface{}) *httptest.ResponseRecorder {
+	p, ok := body.([]byte)
+	if !ok && body != nil {
+		var err error
+		if p, err = json.Marshal(body); err != nil {
+			panic(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(p))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+// CreateRunner creates an active runner that runs untagged jobs.
+func (s *testServer) CreateRunner(t *testing.T, token string) *com.Runner {
+	runner := &com.Runner{Token: token, RunUntagged: true, Active: true}
+	if err := s.DB.CreateRunner(s.Ctx, runner); err != nil {
+		t.Fatalf("CreateRunner(%q) = %v; want nil", token, err)
+	}
+	return runner
+}
+
+// allFeatures is the feature set advertised by RequestJob.
+var allFeatures = com.FromFeatureFlags(^com.Feature(0))
+
+// RequestJob requests a job for the runner, advertising every runner feature, and returns the
+// response.
+func (s *testServer) RequestJob(t *testing.T, runner *com.Runner) *gciwire.JobResponse {
+	body := gciwire.JobRequest{Token: runner.Token}
+	body.Info.Features = allFeatures
+	rec := s.Do("POST", "/_gitlab/api/v4/jobs/request", nil, body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /jobs/request = %d; want %d", rec.Code, http.StatusCreated)
+	}
+	var rep gciwire.JobResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &rep); err != nil {
+		t.Fatalf("Error decoding job response: %v", err)
+	}
+	return &rep
+}
+
+func TestRequestJob(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+
+	runner := s.CreateRunner(t, "runner")
+	rec := s.Do("POST", "/_gitlab/api/v4/jobs/request", nil, gciwire.JobRequest{Token: runner.Token})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("POST /jobs/request = %d; want %d", rec.Code, http.StatusNoContent)
+	}
+	if rec.Header().Get("X-GitLab-Last-Update") == "" {
+		t.Error("X-GitLab-Last-Update not set")
+	}
+
+	job := &com.Job{Spec: &com.JobSpec{}}
+	job.Spec.GitLab.JobInfo.Name = "build"
+	if err := s.enqueueJob(s.Ctx, job); err != nil {
+		t.Fatalf("enqueueJob() = %v; want nil", err)
+	}
+
+	rep := s.RequestJob(t, runner)
+	if rep.ID != int(job.ID) || rep.JobInfo.Name != "build" {
+		t.Errorf("job = %d %q; want %d %q", rep.ID, rep.JobInfo.Name, job.ID, "build")
+	}
+}
+
+func TestRequestJobPoll(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	s := newTestServer(t, &ServerConfig{JobPollTimeout: timeout})
+	defer s.Close()
+	runner := s.CreateRunner(t, "runner")
+
+	// poll requests a job with the given last update, returning the response and how long it
+	// took. The request is cancelled when ctx is.
+	poll := func(ctx context.Context, lastUpdate string) (*httptest.ResponseRecorder, time.Duration) {
+		body := gciwire.JobRequest{Token: runner.Token, LastUpdate: lastUpdate}
+		body.Info.Features = allFeatures
+		p, err := json.Marshal(body)
+		if err != nil {
+			panic(err)
+		}
+		req := httptest.NewRequest("POST", "/_gitlab/api/v4/jobs/request", bytes.NewReader(p)).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		s.ServeHTTP(rec, req)
+		return rec, time.Since(start)
+	}
+
+	// With nothing to claim, the request is held open until the timeout.
+	rec, elapsed := poll(s.Ctx, "")
+	if rec.Code != http.StatusNoContent || elapsed < timeout {
+		t.Fatalf("POST /jobs/request = %d after %v; want %d after %v", rec.Code, elapsed, http.StatusNoContent, timeout)
+	}
+	lastUpdate := rec.Header().Get("X-GitLab-Last-Update")
+	if lastUpdate == "" {
+		t.Fatal("X-GitLab-Last-Update not set")
+	}
+
+	// A runner whose last update is current doesn't look at the queue until it changes, so a job
+	// created without a notification isn't claimed.
+	if err := s.DB.CreateJob(s.Ctx, &com.Job{Spec: &com.JobSpec{}}); err != nil {
+		t.Fatalf("CreateJob() = %v; want nil", err)
+	}
+	rec, elapsed = poll(s.Ctx, lastUpdate)
+	if rec.Code != http.StatusNoContent || elapsed < timeout {
+		t.Fatalf("POST /jobs/request unchanged = %d after %v; want %d after %v", rec.Code, elapsed, http.StatusNoContent, timeout)
+	}
+	if got := rec.Header().Get("X-GitLab-Last-Update"); got != lastUpdate {
+		t.Errorf("X-GitLab-Last-Update = %q; want %q", got, lastUpdate)
+	}
+	if rec, _ = poll(s.Ctx, ""); rec.Code != http.StatusCreated {
+		t.Fatalf("POST /jobs/request = %d; want %d", rec.Code, http.StatusCreated)
+	}
+
+	// A job enqueued while a request is waiting is claimed without waiting for the timeout.
+	s.pollTimeout = time.Minute
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rec, _ := poll(s.Ctx, "")
+		done <- rec
+	}()
+	time.Sleep(timeout)
+	if err := s.enqueueJob(s.Ctx, &com.Job{Spec: &com.JobSpec{}}); err != nil {
+		t.Fatalf("enqueueJob() = %v; want nil", err)
+	}
+	select {
+	case rec := <-done:
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("POST /jobs/request = %d; want %d", rec.Code, http.StatusCreated)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("job request not woken by new job")
+	}
+
+	// A request whose client goes away returns early.
+	ctx, cancel := context.WithTimeout(s.Ctx, timeout)
+	defer cancel()
+	rec, elapsed = poll(ctx, "")
+	if rec.Code != http.StatusNoContent || elapsed >= s.pollTimeout {
+		t.Fatalf("POST /jobs/request disconnected = %d after %v; want %d", rec.Code, elapsed, http.StatusNoContent)
+	}
+}
+
+func TestPatchTrace(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+
+	runner := s.CreateRunner(t, "runner")
+	if err := s.enqueueJob(s.Ctx, &com.Job{Spec: &com.JobSpec{}}); err != nil {
+		t.Fatalf("enqueueJob() = %v; want nil", err)
+	}
+	rep := s.RequestJob(t, runner)
+	path := "/_gitlab/api/v4/jobs/" + strconv.Itoa(rep.ID) + "/trace"
+
+	patches := []struct {
+		rng   string
+		body  string
+		code  int
+		after string
+	}{
+		{"0-5", "hello\n", http.StatusAccepted, "0-6"},
+		{"0-5", "hello\n", http.StatusRequestedRangeNotSatisfiable, "0-6"},
+		{"6-11", "world\n", http.StatusAccepted, "0-12"},
+		{"20-21", "!\n", http.StatusRequestedRangeNotSatisfiable, "0-12"},
+	}
+	for i, p := range patches {
+		header := http.Header{"Content-Range": {p.rng}, "Job-Token": {rep.Token}}
+		rec := s.Do("PATCH", path, header, []byte(p.body))
+		if rec.Code != p.code {
+			t.Errorf("%d: PATCH %s = %d; want %d", i, p.rng, rec.Code, p.code)
+		}
+		if got := rec.Header().Get("Range"); got != p.after {
+			t.Errorf("%d: Range = %q; want %q", i, got, p.after)
+		}
+		if got := rec.Header().Get("Job-Status"); got != string(gciwire.Running) {
+			t.Errorf("%d: Job-Status = %q; want %q", i, got, gciwire.Running)
+		}
+	}
+
+	trace, err := s.DB.GetTrace(s.Ctx, int64(rep.ID))
+	if want := "hello\nworld\n"; err != nil || string(trace) != want {
+		t.Errorf("GetTrace() = %q, %v; want %q, nil", trace, err, want)
+	}
+}
+
+func TestJobTokens(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+
+	runner := s.CreateRunner(t, "runner")
+	if err := s.enqueueJob(s.Ctx, &com.Job{Spec: &com.JobSpec{}}); err != nil {
+		t.Fatalf("enqueueJob() = %v; want nil", err)
+	}
+	rep := s.RequestJob(t, runner)
+	if rep.Token == "" {
+		t.Fatal("job token is empty")
+	}
+	jobPath := "/_gitlab/api/v4/jobs/" + strconv.Itoa(rep.ID)
+	tracePath := jobPath + "/trace"
+
+	bad := http.Header{"Job-Token": {"invalid"}}
+	if rec := s.Do("PATCH", tracePath, bad, []byte("trace")); rec.Code != http.StatusForbidden {
+		t.Errorf("PATCH trace with invalid token = %d; want %d", rec.Code, http.StatusForbidden)
+	}
+	update := gciwire.UpdateJobRequest{Token: "invalid", State: gciwire.Running}
+	if rec := s.Do("PUT", jobPath, nil, update); rec.Code != http.StatusForbidden {
+		t.Errorf("PUT job with invalid token = %d; want %d", rec.Code, http.StatusForbidden)
+	}
+	if rec := s.Do("PUT", "/_gitlab/api/v4/jobs/1000", nil, update); rec.Code != http.StatusNotFound {
+		t.Errorf("PUT missing job = %d; want %d", rec.Code, http.StatusNotFound)
+	}
+
+	update = gciwire.UpdateJobRequest{Token: rep.Token, State: gciwire.Success}
+	if rec := s.Do("PUT", jobPath, nil, update); rec.Code != http.StatusOK {
+		t.Errorf("PUT job = %d; want %d", rec.Code, http.StatusOK)
+	}
+
+	// Token is no longer valid once the job has finished
+	if rec := s.Do("PUT", jobPath, nil, update); rec.Code != http.StatusForbidden {
+		t.Errorf("PUT finished job = %d; want %d", rec.Code, http.StatusForbidden)
+	}
+	good := http.Header{"Job-Token": {rep.Token}}
+	if rec := s.Do("PATCH", tracePath, good, []byte("trace")); rec.Code != http.StatusForbidden {
+		t.Errorf("PATCH finished job trace = %d; want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestUpdateJob(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+
+	runner := s.CreateRunner(t, "runner")
+	if err := s.enqueueJob(s.Ctx, &com.Job{Spec: &com.JobSpec{}}); err != nil {
+		t.Fatalf("enqueueJob() = %v; want nil", err)
+	}
+	rep := s.RequestJob(t, runner)
+	path := "/_gitlab/api/v4/jobs/" + strconv.Itoa(rep.ID)
+
+	update := gciwire.UpdateJobRequest{Token: rep.Token, State: gciwire.Pending}
+	if rec := s.Do("PUT", path, nil, update); rec.Code != http.StatusConflict {
+		t.Errorf("PUT running -> pending = %d; want %d", rec.Code, http.StatusConflict)
+	}
+
+	trace := "failed\n"
+	update = gciwire.UpdateJobRequest{
+		Token:         rep.Token,
+		State:         gciwire.Failed,
+		FailureReason: gciwire.ScriptFailure,
+		Trace:         &trace,
+	}
+	rec := s.Do("PUT", path, nil, update)
+	if rec.Code != http.StatusOK {
+		t.Errorf("PUT running -> failed = %d; want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Header().Get("Job-Status"); got != string(gciwire.Failed) {
+		t.Errorf("Job-Status = %q; want %q", got, gciwire.Failed)
+	}
+
+	job, err := s.DB.GetJob(s.Ctx, int64(rep.ID))
+	if err != nil {
+		t.Fatalf("GetJob() = %v; want nil", err)
+	}
+	if job.State != gciwire.Failed || job.FailureReason != gciwire.ScriptFailure || job.Finished.IsZero() {
+		t.Errorf("job = %#v; want failed with %q", job, gciwire.ScriptFailure)
+	}
+	if job.TokenHash != "" {
+		t.Errorf("job.TokenHash = %q; want empty", job.TokenHash)
+	}
+	if got, err := s.DB.GetTrace(s.Ctx, job.ID); err != nil || string(got) != trace {
+		t.Errorf("GetTrace() = %q, %v; want %q, nil", got, err, trace)
+	}
+}
+
+// multipartFile returns a multipart body containing a single file field and its content type.
+func multipartFile(filename string, content []byte) ([]byte, string) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("file", filename)
+	if err == nil {
+		_, err = fw.Write(content)
+	}
+	if err == nil {
+		err = mw.Close()
+	}
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes(), mw.FormDataContentType()
+}
+
+// newArtifactServer returns a test server storing artifacts in a temporary directory. The
+// directory is removed when the server is closed.
+func newArtifactServer(t *testing.T, maxSize int64) (s *testServer, dir string) {
+	dir, err := ioutil.TempDir("", "gribble-artifacts")
+	if err != nil {
+		t.Fatalf("Error creating artifact directory: %v", err)
+	}
+	s = newTestServer(t, &ServerConfig{
+		Artifacts:       artifact.NewFileStore(dir),
+		ArtifactMaxSize: maxSize,
+	})
+	s.cleanup = append(s.cleanup, func() { os.RemoveAll(dir) })
+	return s, dir
+}
+
+func TestUploadArtifacts(t *testing.T) {
+	s, dir := newArtifactServer(t, 16)
+	defer s.Close()
+
+	runner := s.CreateRunner(t, "runner")
+	if err := s.enqueueJob(s.Ctx, &com.Job{Spec: &com.JobSpec{}}); err != nil {
+		t.Fatalf("enqueueJob() = %v; want nil", err)
+	}
+	rep := s.RequestJob(t, runner)
+	path := "/_gitlab/api/v4/jobs/" + strconv.Itoa(rep.ID) + "/artifacts?artifact_format=zip&expire_in=1+week"
+
+	content := []byte("not really a zip")
+	body, ctype := multipartFile("artifacts.zip", content)
+	header := http.Header{"Job-Token": {rep.Token}, "Content-Type": {ctype}}
+	if rec := s.Do("POST", path, header, body); rec.Code != http.StatusCreated {
+		t.Fatalf("POST artifacts = %d; want %d", rec.Code, http.StatusCreated)
+	}
+
+	tooLarge, ctype := multipartFile("artifacts.zip", append(content, '!'))
+	header.Set("Content-Type", ctype)
+	if rec := s.Do("POST", path, header, tooLarge); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST large artifacts = %d; want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	artifacts, err := s.DB.GetJobArtifacts(s.Ctx, int64(rep.ID))
+	if err != nil || len(artifacts) != 1 {
+		t.Fatalf("GetJobArtifacts() = %v, %v; want 1 artifact", artifacts, err)
+	}
+	sum := sha256.Sum256(content)
+	a := artifacts[0]
+	if a.Type != "archive" || a.Format != gciwire.ArtifactFormatZip || a.Filename != "artifacts.zip" ||
+		a.Size != int64(len(content)) || a.SHA256 != hex.EncodeToString(sum[:]) || a.ExpireIn != "1 week" {
+		t.Errorf("artifact = %#v", a)
+	}
+
+	stored, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(a.Key)))
+	if err != nil || !bytes.Equal(stored, content) {
+		t.Errorf("stored artifact = %q, %v; want %q", stored, err, content)
+	}
+}
+
+func TestDownloadArtifacts(t *testing.T) {
+	s, _ := newArtifactServer(t, 0)
+	defer s.Close()
+
+	runner := s.CreateRunner(t, "runner")
+	build := &com.Job{Spec: &com.JobSpec{}}
+	build.Spec.GitLab.JobInfo.Name = "build"
+	test := &com.Job{Spec: &com.JobSpec{}}
+	for _, job := range []*com.Job{build, test} {
+		if err := s.enqueueJob(s.Ctx, job); err != nil {
+			t.Fatalf("enqueueJob() = %v; want nil", err)
+		}
+	}
+	if err := s.DB.AddJobDependency(s.Ctx, test.ID, build.ID, true); err != nil {
+		t.Fatalf("AddJobDependency() = %v; want nil", err)
+	}
+
+	buildRep := s.RequestJob(t, runner)
+	content := []byte("artifact archive")
+	body, ctype := multipartFile("artifacts.zip", content)
+	header := http.Header{"Job-Token": {buildRep.Token}, "Content-Type": {ctype}}
+	path := "/_gitlab/api/v4/jobs/" + strconv.Itoa(buildRep.ID) + "/artifacts"
+	if rec := s.Do("POST", path, header, body); rec.Code != http.StatusCreated {
+		t.Fatalf("POST artifacts = %d; want %d", rec.Code, http.StatusCreated)
+	}
+
+	testRep := s.RequestJob(t, runner)
+	want := gciwire.Dependencies{{
+		ID:    buildRep.ID,
+		Token: testRep.Token,
+		Name:  "build",
+		ArtifactsFile: gciwire.DependencyArtifactsFile{
+			Filename: "artifacts.zip",
+			Size:     int64(len(content)),
+		},
+	}}
+	if !reflect.DeepEqual(testRep.Dependencies, want) {
+		t.Errorf("Dependencies = %#v; want %#v", testRep.Dependencies, want)
+	}
+
+	if rec := s.Do("GET", path, http.Header{"Job-Token": {buildRep.Token}}, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("GET artifacts with upstream token = %d; want %d", rec.Code, http.StatusForbidden)
+	}
+	rec := s.Do("GET", path, http.Header{"Job-Token": {testRep.Token}}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET artifacts = %d; want %d", rec.Code, http.StatusOK)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), content) {
+		t.Errorf("GET artifacts = %q; want %q", rec.Body.Bytes(), content)
+	}
+}
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gribble-cache")
+	if err != nil {
+		t.Fatalf("Error creating cache directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := cache.Open(dir, 16)
+	if err != nil {
+		t.Fatalf("cache.Open() = %v; want nil", err)
+	}
+
+	creds := cache.Credentials{AccessKey: "access", SecretKey: "secret"}
+	s := newTestServer(t, &ServerConfig{
+		Cache:            store,
+		CacheBucket:      "gribble-cache",
+		CacheCredentials: creds,
+	})
+	defer s.Close()
+
+	object, _ := url.Parse("http://gribble.test/gribble-cache/runner/abc/project/1/default")
+	presign := func(method string, creds cache.Credentials) string {
+		return cache.Presign(method, object, creds, defaultCacheRegion, time.Now(), time.Hour).String()
+	}
+
+	if rec := s.Do("GET", presign("GET", creds), nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("GET missing archive = %d; want %d", rec.Code, http.StatusNotFound)
+	}
+
+	content := []byte("cache archive")
+	if rec := s.Do("PUT", presign("PUT", creds), nil, content); rec.Code != http.StatusOK {
+		t.Fatalf("PUT archive = %d; want %d", rec.Code, http.StatusOK)
+	}
+
+	rec := s.Do("GET", presign("GET", creds), nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET archive = %d; want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Body.Bytes(); !bytes.Equal(got, content) {
+		t.Errorf("GET archive = %q; want %q", got, content)
+	}
+
+	// Requests must be signed with the cache's credentials and for their own method.
+	bad := cache.Credentials{AccessKey: "access", SecretKey: "wrong"}
+	if rec := s.Do("GET", presign("GET", bad), nil, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("GET with wrong secret = %d; want %d", rec.Code, http.StatusForbidden)
+	}
+	if rec := s.Do("PUT", presign("GET", creds), nil, content); rec.Code != http.StatusForbidden {
+		t.Errorf("PUT with GET signature = %d; want %d", rec.Code, http.StatusForbidden)
+	}
+	if rec := s.Do("GET", object.String(), nil, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("unsigned GET = %d; want %d", rec.Code, http.StatusForbidden)
+	}
+
+	big := []byte(strings.Repeat("x", 17))
+	if rec := s.Do("PUT", presign("PUT", creds), nil, big); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PUT over quota = %d; want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	rec = s.Do("GET", "http://gribble.test/gribble-cache/?location=", nil, nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), ">"+defaultCacheRegion+"<") {
+		t.Errorf("GET location = %d %q; want %d with region", rec.Code, rec.Body.String(), http.StatusOK)
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"io"
 	"sync"
 
@@ -17,6 +20,21 @@ func genToken(length int, rand io.Reader) (string, error) {
 	return token, nil
 }
 
+// hashToken returns the hex-encoded SHA-256 hash of a token. This is used instead of bcrypt for
+// job tokens since they're randomly generated and checked on every trace and job update.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// compareTokenHash returns true if hash is non-empty and is the hash of token.
+func compareTokenHash(hash, token string) bool {
+	if hash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(hashToken(token))) == 1
+}
+
 type randomToken struct {
 	length int
 	rand   io.Reader
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// maxWebhookSize is the largest webhook payload accepted. This is the same as GitHub's limit.
+const maxWebhookSize = 25 * megabyte
+
+var errWebhookTooLarge = errors.New("webhook payload is too large")
+
+// readWebhook reads a webhook's body, up to maxWebhookSize bytes.
+func readWebhook(req *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxWebhookSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxWebhookSize {
+		return nil, errWebhookTooLarge
+	}
+	return body, nil
+}
+
+// validHMACSHA256 returns true if sig is the hex-encoded HMAC-SHA256 of body using secret.
+func validHMACSHA256(secret, body []byte, sig string) bool {
+	want, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), want)
+}
@@ -19,4 +19,5 @@ require (
 	golang.org/x/crypto v0.0.0-20190404164418-38d8ce5564a5
 	golang.org/x/sync v0.0.0-20190227155943-e225da77a7e6
 	golang.org/x/sys v0.0.0-20190403152447-81d4e9dc473e
+	gopkg.in/yaml.v3 v3.0.1
 )
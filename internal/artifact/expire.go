@@ -0,0 +1,113 @@
+package artifact
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	day   = 24 * time.Hour
+	week  = 7 * day
+	month = 30 * day
+	year  = 365 * day
+)
+
+var expireUnits = map[string]time.Duration{
+	"s": time.Second, "sec": time.Second, "secs": time.Second, "second": time.Second, "seconds": time.Second,
+	"m": time.Minute, "min": time.Minute, "mins": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"h": time.Hour, "hr": time.Hour, "hrs": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"d": day, "day": day, "days": day,
+	"w": week, "wk": week, "wks": week, "week": week, "weeks": week,
+	"mo": month, "mos": month, "month": month, "months": month,
+	"y": year, "yr": year, "yrs": year, "year": year, "years": year,
+}
+
+// ParseExpireIn parses an artifact's expire_in value, such as "1 week" or "3 days 4 hrs", and
+// returns the duration it describes. If the value is "never", ParseExpireIn returns never=true.
+//
+// Values are a sequence of numbers followed by units. A number without a unit is a number of
+// seconds. The word "and" and commas between terms are ignored. Months are 30 days and years are
+// 365 days. Values longer than a time.Duration can hold, about 292 years, are an error.
+func ParseExpireIn(s string) (d time.Duration, never bool, err error) {
+	in := strings.ToLower(strings.TrimSpace(s))
+	switch in {
+	case "":
+		return 0, false, fmt.Errorf("empty expire_in")
+	case "never":
+		return 0, true, nil
+	}
+
+	tokens, err := expireTokens(in)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid expire_in %q: %v", s, err)
+	}
+
+	var terms int
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok == "and" {
+			continue
+		}
+
+		n, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid expire_in %q: expected number, got %q", s, tok)
+		}
+
+		scale := time.Second
+		if i+1 < len(tokens) && !isNumber(tokens[i+1]) && tokens[i+1] != "and" {
+			i++
+			var ok bool
+			if scale, ok = expireUnits[tokens[i]]; !ok {
+				return 0, false, fmt.Errorf("invalid expire_in %q: unknown unit %q", s, tokens[i])
+			}
+		}
+		term := n * float64(scale)
+		if term >= math.MaxInt64 || d > math.MaxInt64-time.Duration(term) {
+			return 0, false, fmt.Errorf("invalid expire_in %q: duration is too long", s)
+		}
+		d += time.Duration(term)
+		terms++
+	}
+
+	if terms == 0 {
+		return 0, false, fmt.Errorf("invalid expire_in %q", s)
+	}
+	return d, false, nil
+}
+
+func isNumber(tok string) bool {
+	return tok != "" && (unicode.IsDigit(rune(tok[0])) || tok[0] == '.')
+}
+
+// expireTokens splits an expire_in value into numbers and words. Whitespace and commas separate
+// tokens, but are not required between a number and a word.
+func expireTokens(s string) (tokens []string, err error) {
+	start := -1
+	var number bool
+	for i, r := range s {
+		isNum := unicode.IsDigit(r) || r == '.'
+		isWord := unicode.IsLetter(r)
+		if start != -1 && (!(isNum || isWord) || isNum != number) {
+			tokens = append(tokens, s[start:i])
+			start = -1
+		}
+		switch {
+		case isNum || isWord:
+			if start == -1 {
+				start, number = i, isNum
+			}
+		case unicode.IsSpace(r) || r == ',':
+		default:
+			return nil, fmt.Errorf("unexpected character %q", r)
+		}
+	}
+	if start != -1 {
+		tokens = append(tokens, s[start:])
+	}
+	return tokens, nil
+}
@@ -0,0 +1,46 @@
+package artifact
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseExpireIn(t *testing.T) {
+	cases := []struct {
+		in    string
+		want  time.Duration
+		never bool
+		err   bool
+	}{
+		{in: "never", never: true},
+		{in: "Never", never: true},
+		{in: "42", want: 42 * time.Second},
+		{in: "1 week", want: week},
+		{in: "3 days 4 hrs", want: 3*day + 4*time.Hour},
+		{in: "3 mins 4 sec", want: 3*time.Minute + 4*time.Second},
+		{in: "2 hrs 20 min", want: 2*time.Hour + 20*time.Minute},
+		{in: "2h20min", want: 2*time.Hour + 20*time.Minute},
+		{in: "6 mos 1 day", want: 6*month + day},
+		{in: "47 yrs 6 mos and 4d", want: 47*year + 6*month + 4*day},
+		{in: "1.5 hours", want: 90 * time.Minute},
+		{in: "1 day, 2 hours", want: day + 2*time.Hour},
+		{in: "", err: true},
+		{in: "soon", err: true},
+		{in: "3 fortnights", err: true},
+		{in: "and", err: true},
+		{in: "999999999 years", err: true},
+		{in: "290 years 290 years", err: true},
+	}
+	for _, c := range cases {
+		d, never, err := ParseExpireIn(c.in)
+		if c.err {
+			if err == nil {
+				t.Errorf("ParseExpireIn(%q) = %v, %t, nil; want error", c.in, d, never)
+			}
+			continue
+		}
+		if err != nil || d != c.want || never != c.never {
+			t.Errorf("ParseExpireIn(%q) = %v, %t, %v; want %v, %t, nil", c.in, d, never, err, c.want, c.never)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package artifact
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FileStore is a Store that keeps artifacts in a local directory.
+type FileStore struct {
+	dir string
+}
+
+var _ Store = (*FileStore)(nil)
+
+// NewFileStore returns a FileStore rooted at dir. The directory is created on first write if it
+// does not exist.
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+func (f *FileStore) path(key string) (string, error) {
+	if key == "" || path.IsAbs(key) || path.Clean(key) != key || strings.HasPrefix(key, "../") || key == ".." {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(f.dir, filepath.FromSlash(key)), nil
+}
+
+func (f *FileStore) Put(ctx context.Context, key string, r io.Reader) (size int64, err error) {
+	dest, err := f.path(key)
+	if err != nil {
+		return 0, err
+	}
+
+	dir := filepath.Dir(dest)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+
+	// Write to a temporary file first so that partial uploads never replace a blob.
+	tmp, err := ioutil.TempFile(dir, ".upload-")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if size, err = io.Copy(tmp, r); err != nil {
+		return 0, err
+	}
+	if err = tmp.Sync(); err != nil {
+		return 0, err
+	}
+	if err = tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err = os.Rename(tmp.Name(), dest); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (f *FileStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	src, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(src)
+}
+
+func (f *FileStore) Delete(ctx context.Context, key string) error {
+	dest, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(dest); os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,23 @@
+// Package artifact defines storage for job artifacts.
+package artifact
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrInvalidKey is returned by stores for keys that cannot be stored.
+var ErrInvalidKey = errors.New("invalid artifact key")
+
+// Store is a storage backend for artifact blobs. Keys are slash-separated paths.
+type Store interface {
+	// Put writes the contents of r to the given key, replacing any existing blob. If reading
+	// from r fails, no blob is stored and the error is returned.
+	Put(ctx context.Context, key string, r io.Reader) (size int64, err error)
+	// Open returns a reader for the blob at key. If there is no blob at key, Open returns an
+	// error satisfying os.IsNotExist.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the blob at key. Deleting a key that doesn't exist is not an error.
+	Delete(ctx context.Context, key string) error
+}
@@ -0,0 +1,192 @@
+package cache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Presigned URLs are verified using AWS Signature Version 4 query parameters, the same as S3.
+// This allows the GitLab runner's S3 cache adapter to use gribble as a cache server.
+
+const (
+	sigAlgorithm  = "AWS4-HMAC-SHA256"
+	sigService    = "s3"
+	sigTerminator = "aws4_request"
+	sigTimeFormat = "20060102T150405Z"
+	sigDateFormat = "20060102"
+
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// maxExpires is the longest a presigned URL may be valid for (7 days).
+	maxExpires = 7 * 24 * time.Hour
+)
+
+var (
+	ErrUnsigned         = errors.New("request is not presigned")
+	ErrInvalidSig       = errors.New("request signature is invalid")
+	ErrExpired          = errors.New("presigned request has expired")
+	ErrUnknownAccessKey = errors.New("unknown access key")
+)
+
+// Credentials are the access key and secret key used to sign requests.
+type Credentials struct {
+	AccessKey string
+	SecretKey string
+}
+
+// VerifyPresigned checks that req carries a valid, unexpired presigned URL signature made with
+// the given credentials.
+func VerifyPresigned(req *http.Request, creds Credentials, now time.Time) error {
+	query := req.URL.Query()
+	if query.Get("X-Amz-Algorithm") != sigAlgorithm {
+		return ErrUnsigned
+	}
+
+	signature := query.Get("X-Amz-Signature")
+	credential := strings.Split(query.Get("X-Amz-Credential"), "/")
+	if signature == "" || len(credential) != 5 || credential[3] != sigService || credential[4] != sigTerminator {
+		return ErrInvalidSig
+	}
+	if !hmac.Equal([]byte(credential[0]), []byte(creds.AccessKey)) {
+		return ErrUnknownAccessKey
+	}
+	date, region := credential[1], credential[2]
+
+	signedAt, err := time.Parse(sigTimeFormat, query.Get("X-Amz-Date"))
+	if err != nil || signedAt.Format(sigDateFormat) != date {
+		return ErrInvalidSig
+	}
+	expiresSecs, err := strconv.ParseInt(query.Get("X-Amz-Expires"), 10, 64)
+	expires := time.Duration(expiresSecs) * time.Second
+	if err != nil || expires <= 0 || expires > maxExpires {
+		return ErrInvalidSig
+	}
+	if now.After(signedAt.Add(expires)) {
+		return ErrExpired
+	}
+
+	signedHeaders := query.Get("X-Amz-SignedHeaders")
+	canonical := canonicalRequest(req, query, signedHeaders)
+	want := signature4(creds.SecretKey, signedAt, region, canonical)
+	if !hmac.Equal([]byte(want), []byte(signature)) {
+		return ErrInvalidSig
+	}
+	return nil
+}
+
+// Presign returns a presigned URL for the method and URL, valid for the given duration from t.
+func Presign(method string, u *url.URL, creds Credentials, region string, t time.Time, expires time.Duration) *url.URL {
+	t = t.UTC()
+	scope := strings.Join([]string{t.Format(sigDateFormat), region, sigService, sigTerminator}, "/")
+
+	signed := *u
+	query := signed.Query()
+	query.Set("X-Amz-Algorithm", sigAlgorithm)
+	query.Set("X-Amz-Credential", creds.AccessKey+"/"+scope)
+	query.Set("X-Amz-Date", t.Format(sigTimeFormat))
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(expires/time.Second), 10))
+	query.Set("X-Amz-SignedHeaders", "host")
+	signed.RawQuery = query.Encode()
+
+	req := &http.Request{Method: method, URL: &signed, Host: signed.Host}
+	canonical := canonicalRequest(req, query, "host")
+	query.Set("X-Amz-Signature", signature4(creds.SecretKey, t, region, canonical))
+	signed.RawQuery = query.Encode()
+	return &signed
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func signature4(secret string, t time.Time, region, canonical string) string {
+	t = t.UTC()
+	date := t.Format(sigDateFormat)
+	scope := strings.Join([]string{date, region, sigService, sigTerminator}, "/")
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{sigAlgorithm, t.Format(sigTimeFormat), scope, hex.EncodeToString(sum[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, sigService)
+	key = hmacSHA256(key, sigTerminator)
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func canonicalRequest(req *http.Request, query url.Values, signedHeaders string) string {
+	var buf strings.Builder
+	buf.WriteString(req.Method)
+	buf.WriteByte('\n')
+	buf.WriteString(uriEncode(req.URL.Path, false))
+	buf.WriteByte('\n')
+
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		if k != "X-Amz-Signature" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	first := true
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			if !first {
+				buf.WriteByte('&')
+			}
+			first = false
+			buf.WriteString(uriEncode(k, true))
+			buf.WriteByte('=')
+			buf.WriteString(uriEncode(v, true))
+		}
+	}
+	buf.WriteByte('\n')
+
+	headers := strings.Split(signedHeaders, ";")
+	for _, h := range headers {
+		buf.WriteString(h)
+		buf.WriteByte(':')
+		if h == "host" {
+			buf.WriteString(req.Host)
+		} else {
+			buf.WriteString(strings.Join(strings.Fields(req.Header.Get(h)), " "))
+		}
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	buf.WriteString(signedHeaders)
+	buf.WriteByte('\n')
+	buf.WriteString(unsignedPayload)
+	return buf.String()
+}
+
+// uriEncode encodes s as described by the SigV4 specification: all bytes other than unreserved
+// characters are percent-encoded. If encodeSlash is false, slashes are not encoded.
+func uriEncode(s string, encodeSlash bool) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,261 @@
+// Package cache implements a local store for runner cache archives and verification of the S3
+// presigned URLs runners use to access it.
+package cache
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidKey is returned for keys that cannot be stored.
+	ErrInvalidKey = errors.New("invalid cache key")
+	// ErrTooLarge is returned when an archive is larger than the store's quota.
+	ErrTooLarge = errors.New("cache archive exceeds quota")
+)
+
+const tempPrefix = ".upload-"
+
+// Store keeps cache archives in a local directory. If the total size of its archives would
+// exceed its quota, the least recently used archives are evicted to make room.
+//
+// Archive use is recorded by updating the file's modification time, so that the order of
+// eviction is kept across restarts.
+type Store struct {
+	dir   string
+	quota int64
+
+	m       sync.Mutex
+	size    int64
+	lru     *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+type entry struct {
+	key  string
+	size int64
+}
+
+// Open returns a Store rooted at dir, creating the directory if it does not exist. Existing
+// archives in dir are added to the store. If quota is zero or less, the store's size is not
+// limited.
+func Open(dir string, quota int64) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	type found struct {
+		entry
+		mtime time.Time
+	}
+	var files []found
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), tempPrefix) {
+			// Left over from an interrupted upload.
+			return os.Remove(p)
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, found{entry{filepath.ToSlash(rel), info.Size()}, info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		dir:     dir,
+		quota:   quota,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element, len(files)),
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.After(files[j].mtime) })
+	for _, f := range files {
+		e := f.entry
+		s.entries[e.key] = s.lru.PushBack(&e)
+		s.size += e.size
+	}
+
+	// Apply the quota in case it was lowered since the store was last used.
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := s.evict(0); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) path(key string) (string, error) {
+	if key == "" || path.IsAbs(key) || path.Clean(key) != key {
+		return "", ErrInvalidKey
+	}
+	for _, elem := range strings.Split(key, "/") {
+		// Rejects "..", as well as names that could be mistaken for temporary files.
+		if strings.HasPrefix(elem, ".") {
+			return "", ErrInvalidKey
+		}
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// Quota returns the store's size quota. If zero or less, the store's size is not limited.
+func (s *Store) Quota() int64 {
+	return s.quota
+}
+
+// Size returns the total size of the archives in the store.
+func (s *Store) Size() int64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.size
+}
+
+// Open returns the archive stored at key and marks it as recently used. If there is no archive
+// at key, Open returns an error satisfying os.IsNotExist.
+func (s *Store) Open(key string) (*os.File, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		// Removed from outside of the store.
+		s.remove(elem)
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	s.lru.MoveToFront(elem)
+	now := time.Now()
+	_ = os.Chtimes(p, now, now)
+	return f, nil
+}
+
+// Put writes the contents of r to the given key, replacing any existing archive, and evicts the
+// least recently used archives if necessary to stay under the quota. If r holds more than the
+// quota, Put returns ErrTooLarge and nothing is stored.
+func (s *Store) Put(key string, r io.Reader) (size int64, err error) {
+	dest, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+
+	dir := filepath.Dir(dest)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	tmp, err := ioutil.TempFile(dir, tempPrefix)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if s.quota > 0 {
+		r = io.LimitReader(r, s.quota+1)
+	}
+	if size, err = io.Copy(tmp, r); err != nil {
+		return 0, err
+	}
+	if s.quota > 0 && size > s.quota {
+		return 0, ErrTooLarge
+	}
+	if err = tmp.Close(); err != nil {
+		return 0, err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	// The old archive at key stays in the index until the new one replaces it, so that it's still
+	// tracked if eviction or the rename fails. Its space counts toward the new archive's, and it's
+	// moved to the front so that it isn't evicted to make room for its replacement.
+	elem, replace := s.entries[key]
+	need := size
+	if replace {
+		s.lru.MoveToFront(elem)
+		need -= elem.Value.(*entry).size
+	}
+	if err = s.evict(need); err != nil {
+		return 0, err
+	}
+	if err = os.Rename(tmp.Name(), dest); err != nil {
+		return 0, err
+	}
+	if replace {
+		e := elem.Value.(*entry)
+		s.size += size - e.size
+		e.size = size
+		return size, nil
+	}
+	s.entries[key] = s.lru.PushFront(&entry{key: key, size: size})
+	s.size += size
+	return size, nil
+}
+
+// Delete removes the archive at key. Deleting a key that doesn't exist is not an error.
+func (s *Store) Delete(key string) error {
+	if _, err := s.path(key); err != nil {
+		return err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if elem, ok := s.entries[key]; ok {
+		return s.remove(elem)
+	}
+	return nil
+}
+
+// evict removes least recently used archives until n more bytes fit under the quota.
+// The caller must hold s.m.
+func (s *Store) evict(n int64) error {
+	if s.quota <= 0 {
+		return nil
+	}
+	for s.size+n > s.quota && s.lru.Len() > 0 {
+		if err := s.remove(s.lru.Back()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove deletes an archive and drops it from the index. The caller must hold s.m.
+func (s *Store) remove(elem *list.Element) error {
+	e := elem.Value.(*entry)
+	s.lru.Remove(elem)
+	delete(s.entries, e.key)
+	s.size -= e.size
+	err := os.Remove(filepath.Join(s.dir, filepath.FromSlash(e.key)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
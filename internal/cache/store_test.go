@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tempStore(t *testing.T, quota int64) (s *Store, dir string) {
+	dir, err := ioutil.TempDir("", "gribble-cache")
+	if err != nil {
+		t.Fatalf("Error creating cache directory: %v", err)
+	}
+	s, err = Open(dir, quota)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Open(%q, %d) = %v; want nil", dir, quota, err)
+	}
+	return s, dir
+}
+
+func put(t *testing.T, s *Store, key, content string) {
+	t.Helper()
+	if _, err := s.Put(key, strings.NewReader(content)); err != nil {
+		t.Fatalf("Put(%q) = %v; want nil", key, err)
+	}
+}
+
+func has(s *Store, key string) bool {
+	f, err := s.Open(key)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+func TestStoreEviction(t *testing.T) {
+	s, dir := tempStore(t, 10)
+	defer os.RemoveAll(dir)
+
+	put(t, s, "project/1/a", "aaaa")
+	put(t, s, "project/1/b", "bbbb")
+	if !has(s, "project/1/a") { // a is now more recently used than b
+		t.Fatal("Open(a) failed; want archive")
+	}
+	put(t, s, "project/2/c", "cccc")
+
+	if has(s, "project/1/b") {
+		t.Error("b was not evicted")
+	}
+	if !has(s, "project/1/a") || !has(s, "project/2/c") {
+		t.Error("a or c was evicted; want b evicted")
+	}
+	if size := s.Size(); size != 8 {
+		t.Errorf("Size() = %d; want 8", size)
+	}
+
+	// Replacing an archive doesn't count its old size against the quota.
+	put(t, s, "project/2/c", "cccccc")
+	if !has(s, "project/1/a") {
+		t.Error("a was evicted when replacing c")
+	}
+
+	if _, err := s.Put("project/1/big", strings.NewReader("01234567890")); err != ErrTooLarge {
+		t.Errorf("Put(big) = %v; want %v", err, ErrTooLarge)
+	}
+	if size := s.Size(); size != 10 {
+		t.Errorf("Size() = %d; want 10", size)
+	}
+
+	// Reopening the store keeps the archives and their order of use.
+	s, err := Open(dir, 10)
+	if err != nil {
+		t.Fatalf("Open() = %v; want nil", err)
+	}
+	if size := s.Size(); size != 10 {
+		t.Errorf("Size() after reopen = %d; want 10", size)
+	}
+	f, err := s.Open("project/2/c")
+	if err != nil {
+		t.Fatalf("Open(c) = %v; want nil", err)
+	}
+	defer f.Close()
+	if p, _ := ioutil.ReadAll(f); string(p) != "cccccc" {
+		t.Errorf("c = %q; want %q", p, "cccccc")
+	}
+}
+
+func TestStorePutEvictError(t *testing.T) {
+	s, dir := tempStore(t, 10)
+	defer os.RemoveAll(dir)
+
+	put(t, s, "project/1/b", "bbbb")
+	put(t, s, "project/1/a", "aaaa")
+
+	// b can't be removed to make room for a's replacement, so a's old archive is kept.
+	b := filepath.Join(dir, "project", "1", "b")
+	if err := os.Remove(b); err != nil {
+		t.Fatalf("Error removing b: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(b, "x"), 0700); err != nil {
+		t.Fatalf("Error replacing b with a directory: %v", err)
+	}
+	if _, err := s.Put("project/1/a", strings.NewReader("aaaaaaa")); err == nil {
+		t.Fatal("Put(a) = nil; want error")
+	}
+	f, err := s.Open("project/1/a")
+	if err != nil {
+		t.Fatalf("Open(a) = %v; want nil", err)
+	}
+	defer f.Close()
+	if p, _ := ioutil.ReadAll(f); string(p) != "aaaa" {
+		t.Errorf("a = %q; want %q", p, "aaaa")
+	}
+	if size := s.Size(); size != 4 {
+		t.Errorf("Size() = %d; want 4", size)
+	}
+
+	put(t, s, "project/1/a", "aaaaaaa")
+	if size := s.Size(); size != 7 {
+		t.Errorf("Size() = %d; want 7", size)
+	}
+}
+
+func TestStoreInvalidKeys(t *testing.T) {
+	s, dir := tempStore(t, 0)
+	defer os.RemoveAll(dir)
+
+	for _, key := range []string{"", "/abs", "../up", "a/../b", "a/.upload-x", "a//b"} {
+		if _, err := s.Put(key, strings.NewReader("x")); err != ErrInvalidKey {
+			t.Errorf("Put(%q) = %v; want %v", key, err, ErrInvalidKey)
+		}
+	}
+	if _, err := s.Open("missing"); !os.IsNotExist(err) {
+		t.Errorf("Open(missing) = %v; want not-exist error", err)
+	}
+}
@@ -0,0 +1,364 @@
+// Package ciconfig parses GitLab CI pipeline configuration, such as a .gitlab-ci.yml file, into
+// job specs that can be enqueued for runners.
+//
+// Only a subset of GitLab's keywords is supported. Keywords that aren't supported are reported as
+// errors instead of being ignored, since a job that silently drops part of its configuration may
+// pass when it shouldn't.
+package ciconfig
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// StagePre and StagePost are the stages that always run first and last.
+	StagePre  = ".pre"
+	StagePost = ".post"
+
+	// DefaultStage is the stage of jobs that don't set one.
+	DefaultStage = "test"
+	// DefaultTimeout is the timeout of jobs that don't set one.
+	DefaultTimeout = time.Hour
+)
+
+// DefaultStages are the stages of a configuration that doesn't set any, not including StagePre
+// and StagePost.
+var DefaultStages = []string{"build", "test", "deploy"}
+
+// When is when a job runs, relative to the jobs in earlier stages.
+type When string
+
+const (
+	WhenOnSuccess When = "on_success" // When all jobs in earlier stages succeed
+	WhenOnFailure When = "on_failure" // When any job in an earlier stage fails
+	WhenAlways    When = "always"     // Regardless of earlier stages
+	WhenManual    When = "manual"     // When started by a user
+)
+
+// Config is a parsed pipeline configuration.
+type Config struct {
+	// Stages are the configuration's stages in the order they run, including StagePre and
+	// StagePost.
+	Stages []string
+	// Variables are the configuration's global variables.
+	Variables gciwire.JobVariables
+	// Workflow are the rules that decide whether a pipeline runs. If nil, pipelines always
+	// run.
+	Workflow []*Rule
+	// Jobs are the configuration's jobs, ordered by stage and then by where they're defined.
+	// Hidden jobs, whose names start with ".", are not included.
+	Jobs []*Job
+}
+
+// Job returns the job with the given name, or nil if there is no such job.
+func (c *Config) Job(name string) *Job {
+	for _, job := range c.Jobs {
+		if job.Name == name {
+			return job
+		}
+	}
+	return nil
+}
+
+// Job is a job in a pipeline configuration.
+type Job struct {
+	Name         string
+	Stage        string
+	Tags         []string
+	When         When
+	AllowFailure bool
+	// Plan is true if the job is a gribble plan job, whose plan artifact describes more jobs to
+	// add to its pipeline. This is not a GitLab keyword.
+	Plan bool
+	// Dependencies are the names of the jobs whose artifacts are passed to the job. If nil,
+	// the artifacts of every job the job depends on are passed.
+	Dependencies []string
+	// Needs are the jobs the job depends on. If nil, the job depends on every job in earlier
+	// stages. If empty, the job doesn't depend on any jobs.
+	Needs []Need
+	// Rules decide whether the job runs in a pipeline. If nil, Only and Except are used
+	// instead. If those are also nil, the job runs for branches and tags, or in every
+	// pipeline if the configuration has workflow rules.
+	Rules  []*Rule
+	Only   *Filter
+	Except *Filter
+	// Spec is the job's spec. Its git info and predefined variables are not set, since those
+	// depend on the pipeline the job is run in.
+	Spec *com.JobSpec
+}
+
+// Need is a job that another job needs.
+type Need struct {
+	Job string
+	// Artifacts is true if the needed job's artifacts are passed to the job. It defaults to
+	// true.
+	Artifacts bool
+	// Optional is true if the job may run without the needed job, such as when the needed
+	// job's rules exclude it from a pipeline.
+	Optional bool
+}
+
+// globalKeywords are the top-level keys of a configuration that aren't jobs.
+var globalKeywords = map[string]bool{
+	"after_script":  true,
+	"before_script": true,
+	"cache":         true,
+	"default":       true,
+	"image":         true,
+	"include":       true,
+	"services":      true,
+	"stages":        true,
+	"types":         true,
+	"variables":     true,
+	"workflow":      true,
+}
+
+// Parse parses a pipeline configuration. If the configuration has errors, they're returned as
+// Errors. Configurations parsed by Parse may not include other files.
+func Parse(p []byte) (*Config, error) {
+	return parse(nil, "", p)
+}
+
+// Load reads and parses the pipeline configuration file name from src, including any local files
+// it includes. If the configuration has errors, they're returned as Errors.
+func Load(src Source, name string) (*Config, error) {
+	p, err := src.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return parse(src, name, p)
+}
+
+func parse(src Source, name string, p []byte) (*Config, error) {
+	ps := &parser{src: src, files: map[*yaml.Node]string{}}
+	root, err := ps.load(name, p, nil)
+	if err != nil {
+		return nil, err
+	}
+	conf := ps.parse(ps.extends(root))
+	if len(ps.errs) > 0 {
+		return nil, ps.errs
+	}
+	return conf, nil
+}
+
+// parser collects errors while parsing a configuration.
+type parser struct {
+	src      Source
+	files    map[*yaml.Node]string // The files that nodes from included files came from
+	included int                   // The number of files included so far
+	errs     Errors
+}
+
+// loc is the location of a value in a configuration.
+type loc struct {
+	job string
+	key string
+}
+
+// at returns the location of a key under l.
+func (l loc) at(key string) loc {
+	if l.key != "" {
+		key = l.key + ":" + key
+	}
+	return loc{job: l.job, key: key}
+}
+
+func (p *parser) errorf(l loc, n *yaml.Node, format string, args ...interface{}) {
+	line := 0
+	if n != nil {
+		line = n.Line
+	}
+	p.errs = append(p.errs, &Error{
+		File: p.files[n],
+		Line: line,
+		Job:  l.job,
+		Key:  l.key,
+		Msg:  fmt.Sprintf(format, args...),
+	})
+}
+
+// parse builds a configuration from its normalized root mapping.
+func (p *parser) parse(root *yaml.Node) *Config {
+	if root.Kind != yaml.MappingNode {
+		p.errorf(loc{}, root, "configuration must be a mapping")
+		return nil
+	}
+
+	var (
+		stages    = DefaultStages
+		variables gciwire.JobVariables
+		workflow  []*Rule
+		defaults  = newJobKeys()
+		jobNodes  [][2]*yaml.Node
+	)
+	eachPair(root, func(k, v *yaml.Node) {
+		l := loc{key: k.Value}
+		switch k.Value {
+		case "stages":
+			if list, ok := p.strs(l, v); ok {
+				stages = list
+			}
+		case "variables":
+			variables = p.variables(l, v)
+		case "default":
+			p.keys(loc{job: "default"}, v, defaults, defaultKeywords)
+		case "image", "services", "before_script", "after_script", "cache":
+			// Deprecated globals that are equivalent to setting them under default.
+			p.keyword(l, k.Value, v, defaults)
+			defaults.set[k.Value] = true
+		case "workflow":
+			p.fields(l, v, map[string]func(loc, *yaml.Node){
+				"rules": func(l loc, v *yaml.Node) { workflow = p.rules(l, v, true) },
+			}, "name", "auto_cancel")
+		case "types":
+			p.errorf(l, k, "%s is not supported", k.Value)
+		default:
+			if strings.HasPrefix(k.Value, ".") {
+				// Hidden jobs are only used as templates.
+				return
+			}
+			jobNodes = append(jobNodes, [2]*yaml.Node{k, v})
+		}
+	})
+
+	conf := &Config{
+		Stages:    withPrePost(stages),
+		Variables: variables,
+		Workflow:  workflow,
+	}
+	stageIndex := make(map[string]int, len(conf.Stages))
+	for i, stage := range conf.Stages {
+		stageIndex[stage] = i
+	}
+
+	for _, kv := range jobNodes {
+		k, v := kv[0], kv[1]
+		name := k.Value
+		keys := newJobKeys()
+		if !p.keys(loc{job: name}, v, keys, nil) {
+			continue
+		}
+		job := p.job(name, k, keys, defaults, variables)
+		if job == nil {
+			continue
+		}
+		if _, ok := stageIndex[job.Stage]; !ok {
+			p.errorf(loc{job: name, key: "stage"}, keys.nodes["stage"], "stage %q is not defined", job.Stage)
+			continue
+		}
+		conf.Jobs = append(conf.Jobs, job)
+	}
+
+	sort.SliceStable(conf.Jobs, func(i, j int) bool {
+		return stageIndex[conf.Jobs[i].Stage] < stageIndex[conf.Jobs[j].Stage]
+	})
+	p.checkDependencies(conf, stageIndex)
+	p.checkNeeds(conf, stageIndex)
+
+	if len(conf.Jobs) == 0 && len(p.errs) == 0 {
+		p.errorf(loc{}, root, "configuration has no jobs")
+	}
+	return conf
+}
+
+// withPrePost returns stages with StagePre and StagePost added if they're missing.
+func withPrePost(stages []string) []string {
+	all := make([]string, 0, len(stages)+2)
+	if len(stages) == 0 || stages[0] != StagePre {
+		all = append(all, StagePre)
+	}
+	all = append(all, stages...)
+	if len(stages) == 0 || stages[len(stages)-1] != StagePost {
+		all = append(all, StagePost)
+	}
+	return all
+}
+
+// checkDependencies checks that each job's dependencies are jobs in earlier stages.
+func (p *parser) checkDependencies(conf *Config, stageIndex map[string]int) {
+	for _, job := range conf.Jobs {
+		for _, dep := range job.Dependencies {
+			src := conf.Job(dep)
+			if src == nil {
+				p.errorf(loc{job: job.Name, key: "dependencies"}, nil, "job %q is not defined", dep)
+			} else if stageIndex[src.Stage] >= stageIndex[job.Stage] {
+				p.errorf(loc{job: job.Name, key: "dependencies"}, nil, "job %q is not in an earlier stage", dep)
+			}
+		}
+	}
+}
+
+// checkNeeds checks that each job's needs are jobs in the same or earlier stages, and that needs
+// don't form a cycle.
+func (p *parser) checkNeeds(conf *Config, stageIndex map[string]int) {
+	valid := true
+	for _, job := range conf.Jobs {
+		for _, need := range job.Needs {
+			src := conf.Job(need.Job)
+			switch {
+			case src == nil:
+				p.errorf(loc{job: job.Name, key: "needs"}, nil, "job %q is not defined", need.Job)
+			case src == job:
+				p.errorf(loc{job: job.Name, key: "needs"}, nil, "job can't need itself")
+			case stageIndex[src.Stage] > stageIndex[job.Stage]:
+				p.errorf(loc{job: job.Name, key: "needs"}, nil, "job %q is in a later stage", need.Job)
+			default:
+				continue
+			}
+			valid = false
+		}
+	}
+	if !valid {
+		return
+	}
+
+	// Needs can only form a cycle between jobs of the same stage, but it's simpler to search
+	// every job's needs.
+	done := map[string]bool{}
+	var visit func(job *Job, stack []string) bool
+	visit = func(job *Job, stack []string) bool {
+		if done[job.Name] {
+			return true
+		}
+		stack = append(stack, job.Name)
+		for _, need := range job.Needs {
+			if stringsContain(stack, need.Job) {
+				p.errorf(loc{job: job.Name, key: "needs"}, nil, "circular needs: %s -> %s", strings.Join(stack, " -> "), need.Job)
+				return false
+			}
+			if !visit(conf.Job(need.Job), stack) {
+				return false
+			}
+		}
+		done[job.Name] = true
+		return true
+	}
+	for _, job := range conf.Jobs {
+		if !visit(job, nil) {
+			return
+		}
+	}
+}
+
+// deref returns the node an alias refers to, or n if it isn't an alias.
+func deref(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	return n
+}
+
+// eachPair calls fn with each key and value of a mapping node.
+func eachPair(n *yaml.Node, fn func(k, v *yaml.Node)) {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		fn(n.Content[i], deref(n.Content[i+1]))
+	}
+}
@@ -0,0 +1,583 @@
+package ciconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+)
+
+func mustParse(t *testing.T, src string) *Config {
+	t.Helper()
+	conf, err := Parse([]byte(src))
+	if err != nil {
+		t.Fatalf("Parse() = %v; want nil", err)
+	}
+	return conf
+}
+
+func TestParse(t *testing.T) {
+	conf := mustParse(t, `
+stages: [build, test]
+
+variables:
+  GLOBAL: global
+  SHADOWED: global
+
+default:
+  image: golang:1.13
+  before_script:
+    - go version
+  tags: [docker]
+
+.template:
+  script: echo hidden
+
+test:
+  script:
+    - go test ./...
+    - [go vet ./..., echo done]
+  after_script: echo cleanup
+  variables:
+    SHADOWED: job
+    DESCRIBED:
+      value: described
+      description: A variable with a description.
+  services:
+    - postgres:11
+    - name: redis:5
+      alias: cache
+  dependencies: [build]
+  allow_failure: true
+  timeout: 1h 30m
+
+build:
+  stage: build
+  image:
+    name: golang:1.12
+    entrypoint: [""]
+  tags: [linux, amd64]
+  script: go build ./...
+  artifacts:
+    name: binaries
+    paths: [bin/]
+    expire_in: 1 week
+    when: always
+  cache:
+    key: $CI_COMMIT_REF_SLUG
+    paths: [.cache/]
+    policy: pull
+  when: on_failure
+`)
+
+	if want := []string{StagePre, "build", "test", StagePost}; !reflect.DeepEqual(conf.Stages, want) {
+		t.Errorf("Stages = %q; want %q", conf.Stages, want)
+	}
+	if len(conf.Jobs) != 2 || conf.Jobs[0].Name != "build" || conf.Jobs[1].Name != "test" {
+		t.Fatalf("Jobs = %+v; want build and test, in stage order", conf.Jobs)
+	}
+
+	build := conf.Job("build")
+	if build.When != WhenOnFailure || build.Dependencies != nil {
+		t.Errorf("build = %+v; want an on_failure job with no dependencies set", build)
+	}
+	if want := []string{"linux", "amd64"}; !reflect.DeepEqual(build.Tags, want) {
+		t.Errorf("build.Tags = %q; want %q", build.Tags, want)
+	}
+	spec := &build.Spec.GitLab
+	if want := (gciwire.Image{Name: "golang:1.12", Entrypoint: []string{""}}); !reflect.DeepEqual(spec.Image, want) {
+		t.Errorf("build image = %+v; want %+v", spec.Image, want)
+	}
+	wantArtifacts := gciwire.Artifacts{{
+		Name:     "binaries",
+		Paths:    gciwire.ArtifactPaths{"bin/"},
+		When:     gciwire.ArtifactWhenAlways,
+		Type:     "archive",
+		Format:   gciwire.ArtifactFormatZip,
+		ExpireIn: "1 week",
+	}}
+	if !reflect.DeepEqual(spec.Artifacts, wantArtifacts) {
+		t.Errorf("build artifacts = %+v; want %+v", spec.Artifacts, wantArtifacts)
+	}
+	wantCache := gciwire.Caches{{Key: "$CI_COMMIT_REF_SLUG", Paths: gciwire.ArtifactPaths{".cache/"}, Policy: gciwire.CachePolicyPull}}
+	if !reflect.DeepEqual(spec.Cache, wantCache) {
+		t.Errorf("build cache = %+v; want %+v", spec.Cache, wantCache)
+	}
+	if spec.JobInfo.Name != "build" || spec.JobInfo.Stage != "build" || spec.RunnerInfo.Timeout != 3600 {
+		t.Errorf("build job info = %+v, %+v; want build/build with the default timeout", spec.JobInfo, spec.RunnerInfo)
+	}
+
+	test := conf.Job("test")
+	if test.Stage != DefaultStage || !test.AllowFailure || !reflect.DeepEqual(test.Dependencies, []string{"build"}) {
+		t.Errorf("test = %+v; want an allowed failure in the test stage depending on build", test)
+	}
+	if want := []string{"docker"}; !reflect.DeepEqual(test.Tags, want) {
+		t.Errorf("test.Tags = %q; want default tags %q", test.Tags, want)
+	}
+	spec = &test.Spec.GitLab
+	if spec.Image.Name != "golang:1.13" {
+		t.Errorf("test image = %q; want the default image", spec.Image.Name)
+	}
+	wantSteps := gciwire.Steps{
+		{
+			Name:    gciwire.StepNameScript,
+			Script:  gciwire.StepScript{"go version", "go test ./...", "go vet ./...", "echo done"},
+			Timeout: 5400,
+			When:    gciwire.StepWhenOnSuccess,
+		},
+		{
+			Name:    gciwire.StepNameAfterScript,
+			Script:  gciwire.StepScript{"echo cleanup"},
+			Timeout: 5400,
+			When:    gciwire.StepWhenAlways,
+		},
+	}
+	if !reflect.DeepEqual(spec.Steps, wantSteps) {
+		t.Errorf("test steps = %+v; want %+v", spec.Steps, wantSteps)
+	}
+	wantServices := gciwire.Services{{Name: "postgres:11"}, {Name: "redis:5", Alias: "cache"}}
+	if !reflect.DeepEqual(spec.Services, wantServices) {
+		t.Errorf("test services = %+v; want %+v", spec.Services, wantServices)
+	}
+	for key, want := range map[string]string{"GLOBAL": "global", "SHADOWED": "job", "DESCRIBED": "described"} {
+		if got := spec.Variables.Get(key); got != want {
+			t.Errorf("test variable %s = %q; want %q", key, got, want)
+		}
+	}
+	for _, v := range spec.Variables {
+		if !v.Public {
+			t.Errorf("variable %s is not public", v.Key)
+		}
+	}
+}
+
+func TestParseGlobals(t *testing.T) {
+	// Deprecated global keywords are equivalent to setting them under default.
+	conf := mustParse(t, `
+image: alpine
+before_script: [setup]
+cache:
+  - paths: [a]
+  - key: other
+    paths: [b]
+job:
+  script: run
+`)
+	spec := &conf.Job("job").Spec.GitLab
+	if spec.Image.Name != "alpine" || len(spec.Cache) != 2 || spec.Cache[0].Key != "default" {
+		t.Errorf("spec = %+v; want image and caches from globals", spec)
+	}
+	if want := (gciwire.StepScript{"setup", "run"}); !reflect.DeepEqual(spec.Steps[0].Script, want) {
+		t.Errorf("script = %q; want %q", spec.Steps[0].Script, want)
+	}
+	if want := append([]string{StagePre}, append(DefaultStages, StagePost)...); !reflect.DeepEqual(conf.Stages, want) {
+		t.Errorf("Stages = %q; want %q", conf.Stages, want)
+	}
+}
+
+func TestParseNeeds(t *testing.T) {
+	conf := mustParse(t, `
+stages: [build, test]
+build:
+  stage: build
+  script: make
+lint:
+  stage: test
+  script: lint
+  needs: []
+test:
+  stage: test
+  script: test
+  needs:
+    - build
+    - job: lint
+      artifacts: false
+      optional: true
+deploy:
+  stage: test
+  script: deploy
+`)
+	cases := map[string][]Need{
+		"build":  nil,
+		"lint":   {},
+		"test":   {{Job: "build", Artifacts: true}, {Job: "lint", Optional: true}},
+		"deploy": nil,
+	}
+	for name, want := range cases {
+		if got := conf.Job(name).Needs; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s needs = %#v; want %#v", name, got, want)
+		}
+	}
+}
+
+func TestParseManual(t *testing.T) {
+	conf := mustParse(t, `
+review:
+  script: review
+  when: manual
+deploy:
+  script: deploy
+  when: manual
+  allow_failure: false
+lint:
+  script: lint
+  allow_failure: true
+test:
+  script: test
+`)
+	// Manual jobs are allowed to fail unless they say otherwise.
+	cases := map[string]bool{"review": true, "deploy": false, "lint": true, "test": false}
+	for name, want := range cases {
+		if got := conf.Job(name).AllowFailure; got != want {
+			t.Errorf("%s allow_failure = %t; want %t", name, got, want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		src  string
+		want []string // Substrings of each error, in order
+	}{
+		{
+			name: "unsupported",
+			src:  "job:\n  script: run\n  retry: 2\n",
+			want: []string{"line 3: job: retry: keyword is not supported"},
+		},
+		{
+			name: "unknown",
+			src:  "job:\n  script: run\n  scirpt: run\n",
+			want: []string{"line 3: job: scirpt: unknown keyword"},
+		},
+		{
+			name: "nested",
+			src:  "job:\n  script: run\n  artifacts:\n    paths: [a]\n    reports: {junit: a.xml}\n    when: sometimes\n",
+			want: []string{
+				"job: artifacts:reports: keyword is not supported",
+				"line 6: job: artifacts:when: must be one of",
+			},
+		},
+		{
+			name: "stage",
+			src:  "stages: [build]\njob:\n  stage: test\n  script: run\n",
+			want: []string{`job: stage: stage "test" is not defined`},
+		},
+		{
+			name: "script",
+			src:  "job:\n  image: alpine\n",
+			want: []string{"job: script is required"},
+		},
+		{
+			name: "dependencies",
+			src:  "a:\n  script: run\nb:\n  script: run\n  dependencies: [a, c]\n",
+			want: []string{
+				`b: dependencies: job "a" is not in an earlier stage`,
+				`b: dependencies: job "c" is not defined`,
+			},
+		},
+		{
+			name: "needs",
+			src:  "stages: [build, test]\na:\n  stage: build\n  script: run\n  needs: [b, a, c, {job: b, pipeline: other}]\nb:\n  stage: test\n  script: run\n",
+			want: []string{
+				"a: needs:pipeline: keyword is not supported",
+				`a: needs: job "b" is in a later stage`,
+				"a: needs: job can't need itself",
+				`a: needs: job "c" is not defined`,
+				`a: needs: job "b" is in a later stage`,
+			},
+		},
+		{
+			name: "needs cycle",
+			src:  "a:\n  script: run\n  needs: [b]\nb:\n  script: run\n  needs: [c]\nc:\n  script: run\n  needs: [a]\n",
+			want: []string{"c: needs: circular needs: a -> b -> c -> a"},
+		},
+		{
+			name: "default",
+			src:  "default:\n  script: run\njob:\n  script: run\n",
+			want: []string{"default: script: keyword is not allowed here"},
+		},
+		{
+			name: "values",
+			src:  "job:\n  script: {a: b}\n  when: delayed\n  timeout: soon\n  allow_failure: maybe\n  variables:\n    BAD-NAME: x\n",
+			want: []string{
+				"job: script: must be a string or a list of strings",
+				"job: when: delayed jobs are not supported",
+				`job: timeout: invalid duration "soon"`,
+				"job: allow_failure: must be true or false",
+				"job: variables:BAD-NAME: invalid variable name",
+			},
+		},
+		{
+			name: "include",
+			src:  "include: ci/build.yml\njob:\n  script: run\n",
+			want: []string{"include: includes require a repository"},
+		},
+		{
+			name: "empty",
+			src:  ".hidden:\n  script: run\n",
+			want: []string{"configuration has no jobs"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := Parse([]byte(c.src))
+			errs, ok := err.(Errors)
+			if !ok {
+				t.Fatalf("Parse() = %v; want Errors", err)
+			}
+			if len(errs) != len(c.want) {
+				t.Fatalf("Parse() = %d errors:\n%v\nwant %d", len(errs), errs, len(c.want))
+			}
+			for i, want := range c.want {
+				if got := errs[i].Error(); !strings.Contains(got, want) {
+					t.Errorf("errs[%d] = %q; want it to contain %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseExtends(t *testing.T) {
+	conf := mustParse(t, `
+.base:
+  image: alpine
+  variables:
+    A: base
+    B: base
+  tags: [base]
+
+.go:
+  extends: .base
+  image: golang
+  variables:
+    B: go
+  script: go test ./...
+
+.lint:
+  variables:
+    C: lint
+  tags: [lint]
+
+job:
+  extends: [.go, .lint]
+  variables:
+    D: job
+`)
+	spec := &conf.Job("job").Spec.GitLab
+	if spec.Image.Name != "golang" {
+		t.Errorf("image = %q; want golang", spec.Image.Name)
+	}
+	if got := conf.Job("job").Tags; !reflect.DeepEqual(got, []string{"lint"}) {
+		t.Errorf("tags = %q; want the last parent's tags, since lists aren't merged", got)
+	}
+	for key, want := range map[string]string{"A": "base", "B": "go", "C": "lint", "D": "job"} {
+		if got := spec.Variables.Get(key); got != want {
+			t.Errorf("variable %s = %q; want %q", key, got, want)
+		}
+	}
+	if want := (gciwire.StepScript{"go test ./..."}); !reflect.DeepEqual(spec.Steps[0].Script, want) {
+		t.Errorf("script = %q; want %q", spec.Steps[0].Script, want)
+	}
+}
+
+func TestParseExtendsErrors(t *testing.T) {
+	_, err := Parse([]byte(`
+.a:
+  extends: .b
+.b:
+  extends: .a
+job:
+  extends: [.a, .missing]
+  script: run
+`))
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("Parse() = %v; want Errors", err)
+	}
+	var cycle, missing bool
+	for _, err := range errs {
+		cycle = cycle || strings.Contains(err.Msg, "circular extends: .a -> .b -> .a")
+		missing = missing || strings.Contains(err.Msg, `job ".missing" is not defined`)
+	}
+	if !cycle || !missing {
+		t.Errorf("Parse() = %v; want cycle and missing parent errors", errs)
+	}
+}
+
+func TestParseAnchors(t *testing.T) {
+	conf := mustParse(t, `
+.defaults: &defaults
+  image: alpine
+  script: &script
+    - make
+  tags: [a]
+
+.more: &more
+  tags: [b]
+  allow_failure: true
+
+job:
+  <<: [*defaults, *more]
+  tags: [c]
+  after_script: *script
+`)
+	job := conf.Job("job")
+	spec := &job.Spec.GitLab
+	if spec.Image.Name != "alpine" || !job.AllowFailure {
+		t.Errorf("job = %+v; want keys merged from both anchors", job)
+	}
+	if !reflect.DeepEqual(job.Tags, []string{"c"}) {
+		t.Errorf("tags = %q; want explicit tags to take precedence", job.Tags)
+	}
+	if len(spec.Steps) != 2 || !reflect.DeepEqual(spec.Steps[1].Script, gciwire.StepScript{"make"}) {
+		t.Errorf("steps = %+v; want an aliased after_script", spec.Steps)
+	}
+}
+
+func writeFiles(t *testing.T, files map[string]string) DirSource {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "ciconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return DirSource(dir)
+}
+
+func TestLoadIncludes(t *testing.T) {
+	src := writeFiles(t, map[string]string{
+		".gitlab-ci.yml": `
+include:
+  - local: /ci/base.yml
+  - local: ci/jobs/*.yml
+build:
+  variables:
+    MODE: main
+`,
+		"ci/base.yml": `
+stages: [build, test]
+.go:
+  image: golang
+`,
+		"ci/jobs/build.yml": `
+build:
+  extends: .go
+  stage: build
+  script: go build
+  variables:
+    MODE: include
+    OTHER: include
+`,
+		"ci/jobs/test.yml": `
+include: ci/shared.yml
+test:
+  extends: .go
+  script: go test
+`,
+		"ci/shared.yml": `
+variables:
+  SHARED: "yes"
+`,
+	})
+	defer os.RemoveAll(string(src))
+
+	conf, err := Load(src, ".gitlab-ci.yml")
+	if err != nil {
+		t.Fatalf("Load() = %v; want nil", err)
+	}
+	if len(conf.Jobs) != 2 || conf.Jobs[0].Name != "build" || conf.Jobs[1].Name != "test" {
+		t.Fatalf("Jobs = %+v; want build and test", conf.Jobs)
+	}
+	build := &conf.Job("build").Spec.GitLab
+	if build.Image.Name != "golang" || build.Variables.Get("MODE") != "main" || build.Variables.Get("OTHER") != "include" {
+		t.Errorf("build = %+v; want included job merged with the main file", build)
+	}
+	if got := build.Variables.Get("SHARED"); got != "yes" {
+		t.Errorf("SHARED = %q; want variable from nested include", got)
+	}
+}
+
+func TestLoadIncludeErrors(t *testing.T) {
+	src := writeFiles(t, map[string]string{
+		".gitlab-ci.yml": `
+include:
+  - ci/a.yml
+  - ci/missing.yml
+  - local: ci/none/*.yml
+  - https://example.com/ci.yml
+job:
+  script: run
+`,
+		"ci/a.yml": "include: ci/b.yml\n",
+		"ci/b.yml": "include: ci/a.yml\njob:\n  script: run\n  when: later\n",
+	})
+	defer os.RemoveAll(string(src))
+
+	_, err := Load(src, ".gitlab-ci.yml")
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("Load() = %v; want Errors", err)
+	}
+	want := []string{
+		"ci/b.yml:1: include: ci/a.yml includes itself",
+		"ci/missing.yml does not exist",
+		"no files match ci/none/*.yml",
+		"remote includes are not supported",
+		"ci/b.yml:4: job: when: must be one of",
+	}
+	for _, want := range want {
+		found := false
+		for _, err := range errs {
+			found = found || strings.Contains(err.Error(), want)
+		}
+		if !found {
+			t.Errorf("Load() = %v; want an error containing %q", errs, want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"ci/*.yml", "ci/a.yml", true},
+		{"ci/*.yml", "ci/sub/a.yml", false},
+		{"ci/**.yml", "ci/sub/a.yml", true},
+		{"ci/**/*.yml", "ci/a.yml", true},
+		{"ci/**/*.yml", "ci/x/y/a.yml", true},
+		{"**/*.md", "README.md", true},
+		{"docs/*", "docs/.hidden", true},
+		{"*.{go,mod}", "go.mod", true},
+		{"*.{go,mod}", "go.sum", false},
+		{"file?.txt", "file1.txt", true},
+		{"file?.txt", "file/.txt", false},
+		{"[a-c].txt", "b.txt", true},
+		{"[!a-c].txt", "b.txt", false},
+		{"a+b.txt", "a+b.txt", true},
+		{"a+b.txt", "aab.txt", false},
+	}
+	for _, c := range cases {
+		got, err := Match(c.pattern, c.name)
+		if err != nil || got != c.want {
+			t.Errorf("Match(%q, %q) = %t, %v; want %t", c.pattern, c.name, got, err, c.want)
+		}
+	}
+	if _, err := Match("{a,b", "a"); err == nil {
+		t.Errorf("Match with unterminated brace = nil; want error")
+	}
+}
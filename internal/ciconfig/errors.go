@@ -0,0 +1,50 @@
+package ciconfig
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Error is an error in a pipeline configuration, such as an invalid value or an unsupported
+// keyword.
+type Error struct {
+	File string // The file the error occurred in, if it isn't the main configuration file
+	Line int    // The line the error occurred on, if known
+	Job  string // The job the error occurred in, if any
+	Key  string // The key the error occurred at, such as "artifacts:when"
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	switch {
+	case e.File != "" && e.Line > 0:
+		fmt.Fprintf(&b, "%s:%d: ", e.File, e.Line)
+	case e.File != "":
+		fmt.Fprintf(&b, "%s: ", e.File)
+	case e.Line > 0:
+		fmt.Fprintf(&b, "line %d: ", e.Line)
+	}
+	if e.Job != "" {
+		b.WriteString(e.Job)
+		b.WriteString(": ")
+	}
+	if e.Key != "" {
+		b.WriteString(e.Key)
+		b.WriteString(": ")
+	}
+	b.WriteString(e.Msg)
+	return b.String()
+}
+
+// Errors is the list of errors found in a pipeline configuration. Parsing continues after most
+// errors so that every problem with a configuration can be reported at once.
+type Errors []*Error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
@@ -0,0 +1,72 @@
+package ciconfig
+
+import (
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxExtendsDepth is how many levels of extends a job may use. This is the same as GitLab's
+// limit.
+const maxExtendsDepth = 11
+
+// extends returns a copy of the configuration root with each job's extends resolved. A job is
+// deep merged over its parents in the order they're listed, so later parents take precedence over
+// earlier ones and the job takes precedence over all of them.
+func (p *parser) extends(root *yaml.Node) *yaml.Node {
+	jobs := map[string]*yaml.Node{}
+	eachPair(root, func(k, v *yaml.Node) {
+		if !globalKeywords[k.Value] && v.Kind == yaml.MappingNode {
+			jobs[k.Value] = v
+		}
+	})
+
+	resolved := map[string]*yaml.Node{}
+	var resolve func(name string, stack []string) *yaml.Node
+	resolve = func(name string, stack []string) *yaml.Node {
+		if job, ok := resolved[name]; ok {
+			return job
+		}
+		job := jobs[name]
+		ext := lookup(job, "extends")
+		if ext == nil {
+			resolved[name] = job
+			return job
+		}
+
+		l := loc{job: name, key: "extends"}
+		own := p.without(job, "extends")
+		stack = append(stack, name)
+		if len(stack) > maxExtendsDepth {
+			p.errorf(l, ext, "extends is nested too deeply (more than %d levels)", maxExtendsDepth)
+			return own
+		}
+
+		parents, _ := p.strs(l, ext)
+		var merged *yaml.Node
+		for _, parent := range parents {
+			if stringsContain(stack, parent) {
+				p.errorf(l, ext, "circular extends: %s -> %s", strings.Join(stack, " -> "), parent)
+				continue
+			}
+			if jobs[parent] == nil {
+				p.errorf(l, ext, "job %q is not defined", parent)
+				continue
+			}
+			merged = p.merge(merged, resolve(parent, stack))
+		}
+		job = p.merge(merged, own)
+		resolved[name] = job
+		return job
+	}
+
+	out := *root
+	out.Content = make([]*yaml.Node, 0, len(root.Content))
+	eachPair(root, func(k, v *yaml.Node) {
+		if jobs[k.Value] != nil {
+			v = resolve(k.Value, nil)
+		}
+		out.Content = append(out.Content, k, v)
+	})
+	return p.node(p.files[root], &out)
+}
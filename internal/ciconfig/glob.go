@@ -0,0 +1,95 @@
+package ciconfig
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Match reports whether a slash-separated path matches a glob pattern. Patterns are matched the
+// same way GitLab matches include and changes patterns:
+//
+//   - matches any sequence of characters other than /
+//     **     matches any sequence of characters, including /; **/ also matches no directories
+//     ?      matches any single character other than /
+//     [abc]  matches any character in the class; [!abc] matches any character not in it
+//     {a,b}  matches either alternative
+//
+// Leading dots aren't special, so * matches dotfiles.
+func Match(pattern, name string) (bool, error) {
+	re, err := globRegexp(pattern)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(name), nil
+}
+
+// isGlob returns true if pattern contains any glob metacharacters.
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[{")
+}
+
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	braces := 0
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == -1 {
+				return nil, fmt.Errorf("invalid pattern %q: unterminated [", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			i += end + 1
+			b.WriteString("[")
+			if strings.HasPrefix(class, "!") {
+				b.WriteString("^")
+				class = class[1:]
+			}
+			b.WriteString(strings.Replace(class, `\`, `\\`, -1))
+			b.WriteString("]")
+		case '{':
+			braces++
+			b.WriteString("(?:")
+		case '}':
+			if braces == 0 {
+				b.WriteString(`\}`)
+				continue
+			}
+			braces--
+			b.WriteString(")")
+		case ',':
+			if braces > 0 {
+				b.WriteString("|")
+			} else {
+				b.WriteString(",")
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if braces > 0 {
+		return nil, fmt.Errorf("invalid pattern %q: unterminated {", pattern)
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	return re, nil
+}
@@ -0,0 +1,200 @@
+package ciconfig
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxIncludes is the most files a configuration may include, including nested includes. This is
+// the same as GitLab's default limit.
+const maxIncludes = 150
+
+// Source reads files from the repository a configuration belongs to. Paths are slash-separated
+// and relative to the root of the repository.
+type Source interface {
+	// ReadFile returns the contents of a file. If the file doesn't exist, it returns an error
+	// for which os.IsNotExist returns true.
+	ReadFile(name string) ([]byte, error)
+	// Files returns the paths of every file in the repository.
+	Files() ([]string, error)
+}
+
+// DirSource is a Source that reads files from a directory, such as a repository checkout.
+type DirSource string
+
+func (d DirSource) path(name string) string {
+	return filepath.Join(string(d), filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (d DirSource) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(d.path(name))
+}
+
+// Files returns the paths of every regular file under the directory, other than those in .git.
+func (d DirSource) Files() ([]string, error) {
+	var files []string
+	root := string(d)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+var errNoSource = errors.New("includes require a repository")
+
+// load parses a configuration file and merges the files it includes into it. Included files are
+// merged in order, and the including file takes precedence over all of them. stack is the list of
+// files including this one, which is used to detect cycles; it's empty for the main file.
+func (p *parser) load(file string, src []byte, stack []string) (*yaml.Node, error) {
+	// Errors in the main file only report their lines.
+	errFile := file
+	if len(stack) == 0 {
+		errFile = ""
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(src, &doc); err != nil {
+		if errFile != "" {
+			return nil, fmt.Errorf("%s: %v", errFile, err)
+		}
+		return nil, err
+	}
+
+	root := p.normalize(errFile, &doc)
+	include := lookup(root, "include")
+	if include == nil {
+		return root, nil
+	}
+	root = p.without(root, "include")
+
+	var merged *yaml.Node
+	for _, name := range p.includes(loc{key: "include"}, include) {
+		if p.included++; p.included > maxIncludes {
+			p.errorf(loc{key: "include"}, include, "too many included files (more than %d)", maxIncludes)
+			break
+		}
+		if name == file || stringsContain(stack, name) {
+			p.errorf(loc{key: "include"}, include, "%s includes itself", name)
+			continue
+		}
+		data, err := p.src.ReadFile(name)
+		if os.IsNotExist(err) {
+			p.errorf(loc{key: "include"}, include, "%s does not exist", name)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		inc, err := p.load(name, data, append(stack, file))
+		if err != nil {
+			return nil, err
+		}
+		merged = p.merge(merged, inc)
+	}
+	return p.merge(merged, root), nil
+}
+
+// includes returns the paths of the files included by an include keyword, expanding any
+// wildcards.
+func (p *parser) includes(l loc, n *yaml.Node) []string {
+	if p.src == nil {
+		p.errorf(l, n, "%v", errNoSource)
+		return nil
+	}
+
+	var entries []*yaml.Node
+	if n.Kind == yaml.SequenceNode {
+		entries = n.Content
+	} else {
+		entries = []*yaml.Node{n}
+	}
+
+	var names []string
+	for _, entry := range entries {
+		var local string
+		switch {
+		case entry.Kind == yaml.ScalarNode:
+			if strings.Contains(entry.Value, "://") {
+				p.errorf(l, entry, "remote includes are not supported")
+				continue
+			}
+			local = entry.Value
+		case entry.Kind == yaml.MappingNode:
+			p.fields(l, entry, map[string]func(loc, *yaml.Node){
+				"local": func(l loc, v *yaml.Node) { local, _ = p.str(l, v) },
+			}, "remote", "project", "file", "ref", "template", "component", "rules", "inputs")
+		default:
+			p.errorf(l, entry, "must be a path or a mapping")
+		}
+		if local == "" {
+			continue
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+local), "/")
+		if !isGlob(name) {
+			names = append(names, name)
+			continue
+		}
+		matches, err := p.glob(name)
+		if err != nil {
+			p.errorf(l, entry, "%v", err)
+		} else if len(matches) == 0 {
+			p.errorf(l, entry, "no files match %s", local)
+		}
+		names = append(names, matches...)
+	}
+	return names
+}
+
+// glob returns the files in the source that match pattern.
+func (p *parser) glob(pattern string) ([]string, error) {
+	re, err := globRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+	files, err := p.src.Files()
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, file := range files {
+		if re.MatchString(file) {
+			matches = append(matches, file)
+		}
+	}
+	return matches, nil
+}
+
+func stringsContain(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
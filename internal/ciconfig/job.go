@@ -0,0 +1,251 @@
+package ciconfig
+
+import (
+	"time"
+
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultKeywords are the job keywords that may be set under default.
+var defaultKeywords = map[string]bool{
+	"after_script":  true,
+	"artifacts":     true,
+	"before_script": true,
+	"cache":         true,
+	"image":         true,
+	"services":      true,
+	"tags":          true,
+	"timeout":       true,
+}
+
+// unsupportedKeywords are GitLab job keywords that gribble doesn't support yet.
+var unsupportedKeywords = map[string]bool{
+	"coverage":       true,
+	"environment":    true,
+	"hooks":          true,
+	"id_tokens":      true,
+	"identity":       true,
+	"inherit":        true,
+	"interruptible":  true,
+	"parallel":       true,
+	"release":        true,
+	"resource_group": true,
+	"retry":          true,
+	"secrets":        true,
+	"start_in":       true,
+	"trigger":        true,
+}
+
+// jobKeys are the keywords set on a job or under default.
+type jobKeys struct {
+	set   map[string]bool       // The keywords that were set
+	nodes map[string]*yaml.Node // The values of the keywords that were set
+
+	stage        string
+	script       []string
+	beforeScript []string
+	afterScript  []string
+	image        gciwire.Image
+	services     gciwire.Services
+	variables    gciwire.JobVariables
+	tags         []string
+	artifacts    gciwire.Artifacts
+	cache        gciwire.Caches
+	dependencies []string
+	needs        []Need
+	rules        []*Rule
+	only         *Filter
+	except       *Filter
+	allowFailure bool
+	plan         bool
+	when         When
+	timeout      time.Duration
+}
+
+func newJobKeys() *jobKeys {
+	return &jobKeys{set: map[string]bool{}, nodes: map[string]*yaml.Node{}}
+}
+
+// keys reads the keywords of a job from n into k. If allowed is not nil, only the keywords in it
+// may be set. It returns false if n is not a mapping.
+func (p *parser) keys(l loc, n *yaml.Node, k *jobKeys, allowed map[string]bool) bool {
+	n = deref(n)
+	if n.Kind != yaml.MappingNode {
+		p.errorf(l, n, "must be a mapping")
+		return false
+	}
+	eachPair(n, func(key, v *yaml.Node) {
+		kl := l.at(key.Value)
+		switch {
+		case unsupportedKeywords[key.Value]:
+			p.errorf(kl, key, "keyword is not supported")
+		case allowed != nil && !allowed[key.Value]:
+			p.errorf(kl, key, "keyword is not allowed here")
+		case !p.keyword(kl, key.Value, v, k):
+			p.errorf(kl, key, "unknown keyword")
+		default:
+			k.set[key.Value] = true
+			k.nodes[key.Value] = v
+		}
+	})
+	return true
+}
+
+// keyword reads the value of a single job keyword into k. It returns false if the keyword is not
+// a job keyword.
+func (p *parser) keyword(l loc, key string, n *yaml.Node, k *jobKeys) bool {
+	switch key {
+	case "stage":
+		k.stage, _ = p.str(l, n)
+	case "script":
+		k.script = p.script(l, n)
+	case "before_script":
+		k.beforeScript = p.script(l, n)
+	case "after_script":
+		k.afterScript = p.script(l, n)
+	case "image":
+		k.image = p.image(l, n)
+	case "services":
+		k.services = p.services(l, n)
+	case "variables":
+		k.variables = p.variables(l, n)
+	case "tags":
+		k.tags, _ = p.strs(l, n)
+	case "artifacts":
+		k.artifacts = p.artifacts(l, n)
+	case "cache":
+		k.cache = p.caches(l, n)
+	case "dependencies":
+		k.dependencies, _ = p.strs(l, n)
+		if k.dependencies == nil {
+			// An empty list passes no artifacts, unlike leaving dependencies unset.
+			k.dependencies = []string{}
+		}
+	case "needs":
+		k.needs = p.needs(l, n)
+	case "rules":
+		k.rules = p.rules(l, n, false)
+	case "only":
+		k.only = p.filter(l, n)
+	case "except":
+		k.except = p.filter(l, n)
+	case "allow_failure":
+		k.allowFailure, _ = p.bool(l, n)
+	case "plan":
+		k.plan, _ = p.bool(l, n)
+	case "when":
+		k.when = p.when(l, n)
+	case "timeout":
+		k.timeout = p.timeout(l, n)
+	default:
+		return false
+	}
+	return true
+}
+
+// inherit copies keywords from defaults that k doesn't set.
+func (k *jobKeys) inherit(defaults *jobKeys) {
+	for key := range defaults.set {
+		if k.set[key] {
+			continue
+		}
+		switch key {
+		case "after_script":
+			k.afterScript = defaults.afterScript
+		case "artifacts":
+			k.artifacts = defaults.artifacts
+		case "before_script":
+			k.beforeScript = defaults.beforeScript
+		case "cache":
+			k.cache = defaults.cache
+		case "image":
+			k.image = defaults.image
+		case "services":
+			k.services = defaults.services
+		case "tags":
+			k.tags = defaults.tags
+		case "timeout":
+			k.timeout = defaults.timeout
+		}
+	}
+}
+
+// job builds a job from its keywords, using defaults for keywords it doesn't set.
+func (p *parser) job(name string, node *yaml.Node, k, defaults *jobKeys, variables gciwire.JobVariables) *Job {
+	k.inherit(defaults)
+
+	if !k.set["script"] {
+		p.errorf(loc{job: name}, node, "script is required")
+		return nil
+	}
+	if k.set["rules"] && (k.set["only"] || k.set["except"]) {
+		p.errorf(loc{job: name, key: "rules"}, k.nodes["rules"], "rules can't be used with only or except")
+		return nil
+	}
+
+	job := &Job{
+		Name:         name,
+		Stage:        k.stage,
+		Tags:         k.tags,
+		When:         k.when,
+		AllowFailure: k.allowFailure,
+		Plan:         k.plan,
+		Dependencies: k.dependencies,
+		Needs:        k.needs,
+		Rules:        k.rules,
+		Only:         k.only,
+		Except:       k.except,
+		Spec:         &com.JobSpec{},
+	}
+	if job.Stage == "" {
+		job.Stage = DefaultStage
+	}
+	if job.When == "" {
+		job.When = WhenOnSuccess
+	}
+	if job.When == WhenManual && !k.set["allow_failure"] {
+		// As in GitLab, manual jobs don't block later stages unless they set allow_failure.
+		job.AllowFailure = true
+	}
+	timeout := k.timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	secs := int(timeout / time.Second)
+
+	spec := &job.Spec.GitLab
+	spec.JobInfo.Name = name
+	spec.JobInfo.Stage = job.Stage
+	spec.RunnerInfo.Timeout = secs
+	spec.Image = k.image
+	spec.Services = k.services
+	spec.Artifacts = k.artifacts
+	spec.Cache = k.cache
+
+	// Job variables come after global variables so that they take precedence.
+	for _, vars := range []gciwire.JobVariables{variables, k.variables} {
+		spec.Variables = append(spec.Variables, vars...)
+	}
+
+	// before_script runs in the same shell as script, so they're one step.
+	script := make(gciwire.StepScript, 0, len(k.beforeScript)+len(k.script))
+	script = append(script, k.beforeScript...)
+	script = append(script, k.script...)
+	spec.Steps = gciwire.Steps{{
+		Name:    gciwire.StepNameScript,
+		Script:  script,
+		Timeout: secs,
+		When:    gciwire.StepWhenOnSuccess,
+	}}
+	if len(k.afterScript) > 0 {
+		spec.Steps = append(spec.Steps, gciwire.Step{
+			Name:    gciwire.StepNameAfterScript,
+			Script:  k.afterScript,
+			Timeout: secs,
+			When:    gciwire.StepWhenAlways,
+		})
+	}
+	return job
+}
@@ -0,0 +1,461 @@
+package ciconfig
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.spiff.io/gribble/internal/ciexpr"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+	"gopkg.in/yaml.v3"
+)
+
+// WhenNever excludes a job or pipeline. It may only be used in rules.
+const WhenNever When = "never"
+
+// Pipeline sources, as in CI_PIPELINE_SOURCE, that affect how rules are evaluated.
+const (
+	SourcePush         = "push"
+	SourceMergeRequest = "merge_request_event"
+)
+
+// refSources maps the keywords of only:refs and except:refs to the pipeline sources they match.
+var refSources = map[string]string{
+	"api":                    "api",
+	"chat":                   "chat",
+	"external":               "external",
+	"external_pull_requests": "external_pull_request_event",
+	"merge_requests":         SourceMergeRequest,
+	"pipelines":              "pipeline",
+	"pushes":                 SourcePush,
+	"schedules":              "schedule",
+	"triggers":               "trigger",
+	"web":                    "web",
+}
+
+// defaultOnly is the only of jobs that set neither rules nor only, unless the configuration has
+// workflow rules.
+var defaultOnly = &Filter{Refs: []string{"branches", "tags"}}
+
+// Rule is a rule in a job's rules or in workflow:rules. A rule matches if all of its conditions
+// are true.
+type Rule struct {
+	If      *ciexpr.Expr // If set, the rule matches if the expression is true
+	Changes []string     // If set, the rule matches if a changed file matches any of the patterns
+	Exists  []string     // If set, the rule matches if a file matches any of the patterns
+
+	// When replaces the job's when if the rule matches. If it's WhenNever, the job is excluded.
+	// If empty, the job's when is used.
+	When When
+	// AllowFailure, if not nil, replaces the job's allow_failure if the rule matches.
+	AllowFailure *bool
+	// Variables are added to the job's variables if the rule matches.
+	Variables gciwire.JobVariables
+}
+
+// Filter is a job's only or except. A filter matches if, for each kind of condition it sets, any
+// condition of that kind is true.
+type Filter struct {
+	// Refs are ref names, regular expressions such as /^release-/, or keywords such as branches,
+	// tags, and merge_requests.
+	Refs      []string
+	Variables []*ciexpr.Expr
+	Changes   []string
+}
+
+// Context is the pipeline that rules are evaluated for.
+type Context struct {
+	// Ref is the name of the branch or tag the pipeline runs for.
+	Ref string
+	// Tag is true if Ref is a tag.
+	Tag bool
+	// Source is the pipeline's source, as in CI_PIPELINE_SOURCE.
+	Source string
+	// Variables are the pipeline's predefined variables.
+	Variables gciwire.JobVariables
+	// Changes are the paths of the files changed in the pipeline. If nil, the changes aren't
+	// known, such as for new branches and tags, and changes conditions are always true.
+	Changes []string
+	// Repo is the repository at the pipeline's commit. If nil, exists conditions are false.
+	Repo Source
+
+	files []string // Repo's files, once read
+}
+
+// Evaluate returns the jobs that run in a pipeline. Jobs are copied and have the when,
+// allow_failure, and variables set by their matching rules, if any. If workflow:rules exclude the
+// pipeline, no jobs are returned.
+func (c *Config) Evaluate(ctx *Context) ([]*Job, error) {
+	var workflowVars gciwire.JobVariables
+	if c.Workflow != nil {
+		vars := append(append(gciwire.JobVariables(nil), ctx.Variables...), c.Variables...)
+		rule, err := firstRule(c.Workflow, ctx, vars)
+		if err != nil || rule == nil || rule.When == WhenNever {
+			return nil, err
+		}
+		workflowVars = rule.Variables
+	}
+
+	var jobs []*Job
+	included := map[string]bool{}
+	for _, job := range c.Jobs {
+		// Workflow variables take precedence over global variables, but not job variables.
+		spec := *job.Spec
+		global := len(c.Variables)
+		spec.GitLab.Variables = make(gciwire.JobVariables, 0, len(job.Spec.GitLab.Variables)+len(workflowVars))
+		spec.GitLab.Variables = append(spec.GitLab.Variables, job.Spec.GitLab.Variables[:global]...)
+		spec.GitLab.Variables = append(spec.GitLab.Variables, workflowVars...)
+		spec.GitLab.Variables = append(spec.GitLab.Variables, job.Spec.GitLab.Variables[global:]...)
+
+		out := *job
+		out.Spec = &spec
+		ok, err := out.evaluate(ctx, c.Workflow != nil)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			jobs = append(jobs, &out)
+			included[job.Name] = true
+		}
+	}
+
+	// Drop dependencies and optional needs on jobs that aren't in the pipeline.
+	for _, job := range jobs {
+		if job.Needs != nil {
+			needs := make([]Need, 0, len(job.Needs))
+			for _, need := range job.Needs {
+				if included[need.Job] {
+					needs = append(needs, need)
+				} else if !need.Optional {
+					return nil, &Error{Job: job.Name, Key: "needs", Msg: fmt.Sprintf("job %q is not in the pipeline", need.Job)}
+				}
+			}
+			job.Needs = needs
+		}
+		if job.Dependencies == nil {
+			continue
+		}
+		deps := make([]string, 0, len(job.Dependencies))
+		for _, dep := range job.Dependencies {
+			if included[dep] {
+				deps = append(deps, dep)
+			}
+		}
+		job.Dependencies = deps
+	}
+	return jobs, nil
+}
+
+// evaluate returns whether a job runs in a pipeline, updating it with its matching rule. As in
+// GitLab, jobs without rules or only run in every pipeline if the configuration has workflow
+// rules, and only for branches and tags otherwise.
+func (j *Job) evaluate(ctx *Context, workflow bool) (bool, error) {
+	vars := append(append(gciwire.JobVariables(nil), ctx.Variables...), j.Spec.GitLab.Variables...)
+	if j.Rules == nil {
+		only := j.Only
+		if only == nil && !workflow {
+			only = defaultOnly
+		}
+		if only != nil {
+			if ok, err := only.match(ctx, vars); err != nil || !ok {
+				return false, err
+			}
+		}
+		if j.Except != nil {
+			if ok, err := j.Except.match(ctx, vars); err != nil || ok {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	rule, err := firstRule(j.Rules, ctx, vars)
+	if err != nil || rule == nil || rule.When == WhenNever {
+		return false, err
+	}
+	if rule.When != "" {
+		j.When = rule.When
+	}
+	if rule.AllowFailure != nil {
+		j.AllowFailure = *rule.AllowFailure
+	}
+	if len(rule.Variables) > 0 {
+		j.Spec.GitLab.Variables = append(j.Spec.GitLab.Variables, rule.Variables...)
+	}
+	return true, nil
+}
+
+// firstRule returns the first rule that matches, or nil if none do.
+func firstRule(rules []*Rule, ctx *Context, vars gciwire.JobVariables) (*Rule, error) {
+	for _, rule := range rules {
+		ok, err := rule.match(ctx, vars)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			return rule, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *Rule) match(ctx *Context, vars gciwire.JobVariables) (bool, error) {
+	if r.If != nil && !r.If.Eval(varLookup(vars)) {
+		return false, nil
+	}
+	if r.Changes != nil && !ctx.changed(r.Changes) {
+		return false, nil
+	}
+	if r.Exists != nil {
+		return ctx.exists(r.Exists)
+	}
+	return true, nil
+}
+
+func (f *Filter) match(ctx *Context, vars gciwire.JobVariables) (bool, error) {
+	if f.Refs != nil && !anyRef(f.Refs, ctx) {
+		return false, nil
+	}
+	if f.Variables != nil {
+		ok := false
+		for _, e := range f.Variables {
+			if ok = e.Eval(varLookup(vars)); ok {
+				break
+			}
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	if f.Changes != nil && !ctx.changed(f.Changes) {
+		return false, nil
+	}
+	return true, nil
+}
+
+func anyRef(refs []string, ctx *Context) bool {
+	for _, ref := range refs {
+		switch ref {
+		case "branches":
+			if !ctx.Tag && ctx.Source != SourceMergeRequest {
+				return true
+			}
+			continue
+		case "tags":
+			if ctx.Tag {
+				return true
+			}
+			continue
+		}
+		if source, ok := refSources[ref]; ok {
+			if ctx.Source == source {
+				return true
+			}
+			continue
+		}
+		if re, ok, _ := refRegexp(ref); ok {
+			if re.MatchString(ctx.Ref) {
+				return true
+			}
+		} else if ref == ctx.Ref {
+			return true
+		}
+	}
+	return false
+}
+
+// refRegexp returns the regular expression in a ref pattern, such as /^release-/i. It returns
+// false if the pattern isn't a regular expression.
+func refRegexp(ref string) (*regexp.Regexp, bool, error) {
+	end := strings.LastIndexByte(ref, '/')
+	if len(ref) < 2 || ref[0] != '/' || end < 1 {
+		return nil, false, nil
+	}
+	pattern, flags := ref[1:end], ref[end+1:]
+	switch flags {
+	case "":
+	case "i":
+		pattern = "(?i)" + pattern
+	default:
+		return nil, true, fmt.Errorf("unknown flags %q", flags)
+	}
+	re, err := regexp.Compile(pattern)
+	return re, true, err
+}
+
+// changed returns true if any changed file matches any of the patterns.
+func (ctx *Context) changed(patterns []string) bool {
+	if ctx.Changes == nil {
+		return true
+	}
+	return anyMatch(patterns, ctx.Changes)
+}
+
+// exists returns true if any file in the repository matches any of the patterns.
+func (ctx *Context) exists(patterns []string) (bool, error) {
+	if ctx.Repo == nil {
+		return false, nil
+	}
+	if ctx.files == nil {
+		files, err := ctx.Repo.Files()
+		if err != nil {
+			return false, err
+		}
+		ctx.files = files
+	}
+	return anyMatch(patterns, ctx.files), nil
+}
+
+func anyMatch(patterns, files []string) bool {
+	for _, pattern := range patterns {
+		re, err := globRegexp(pattern)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if re.MatchString(file) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// varLookup returns a Lookup for vars. Later variables take precedence over earlier ones.
+func varLookup(vars gciwire.JobVariables) ciexpr.Lookup {
+	return func(name string) (string, bool) {
+		for i := len(vars) - 1; i >= 0; i-- {
+			if vars[i].Key == name {
+				return vars[i].Value, true
+			}
+		}
+		return "", false
+	}
+}
+
+// rules reads a list of rules. If workflow is true, the rules are workflow:rules, which may only
+// set when to always or never.
+func (p *parser) rules(l loc, n *yaml.Node, workflow bool) []*Rule {
+	if n.Kind != yaml.SequenceNode {
+		p.errorf(l, n, "must be a list of rules")
+		return nil
+	}
+	rules := make([]*Rule, 0, len(n.Content))
+	for _, item := range n.Content {
+		rule := &Rule{}
+		fields := map[string]func(loc, *yaml.Node){
+			"if": func(l loc, v *yaml.Node) {
+				s, _ := p.str(l, v)
+				e, err := ciexpr.Parse(s)
+				if err != nil {
+					p.errorf(l, v, "%v", err)
+					return
+				}
+				rule.If = e
+			},
+			"changes": func(l loc, v *yaml.Node) {
+				if v.Kind == yaml.MappingNode {
+					p.fields(l, v, map[string]func(loc, *yaml.Node){
+						"paths": func(l loc, v *yaml.Node) { rule.Changes = p.patterns(l, v) },
+					}, "compare_to")
+					return
+				}
+				rule.Changes = p.patterns(l, v)
+			},
+			"exists": func(l loc, v *yaml.Node) {
+				if v.Kind == yaml.MappingNode {
+					p.fields(l, v, map[string]func(loc, *yaml.Node){
+						"paths": func(l loc, v *yaml.Node) { rule.Exists = p.patterns(l, v) },
+					}, "project", "ref")
+					return
+				}
+				rule.Exists = p.patterns(l, v)
+			},
+			"when":      func(l loc, v *yaml.Node) { rule.When = p.ruleWhen(l, v, workflow) },
+			"variables": func(l loc, v *yaml.Node) { rule.Variables = p.variables(l, v) },
+		}
+		unsupported := []string{"start_in", "needs", "interruptible"}
+		if !workflow {
+			fields["allow_failure"] = func(l loc, v *yaml.Node) {
+				if b, ok := p.bool(l, v); ok {
+					rule.AllowFailure = &b
+				}
+			}
+		} else {
+			unsupported = append(unsupported, "auto_cancel")
+		}
+		if p.fields(l, deref(item), fields, unsupported...) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func (p *parser) ruleWhen(l loc, n *yaml.Node, workflow bool) When {
+	s, ok := p.str(l, n)
+	switch {
+	case !ok:
+		return ""
+	case When(s) == WhenNever:
+		return WhenNever
+	case workflow && When(s) == WhenAlways:
+		return WhenAlways
+	case workflow:
+		p.errorf(l, n, "must be always or never")
+		return ""
+	}
+	return p.when(l, n)
+}
+
+// patterns reads a list of glob patterns.
+func (p *parser) patterns(l loc, n *yaml.Node) []string {
+	patterns, _ := p.strs(l, n)
+	for _, pattern := range patterns {
+		if _, err := globRegexp(pattern); err != nil {
+			p.errorf(l, n, "%v", err)
+		}
+	}
+	if patterns == nil {
+		patterns = []string{}
+	}
+	return patterns
+}
+
+// filter reads a job's only or except, which is either a list of refs or a mapping.
+func (p *parser) filter(l loc, n *yaml.Node) *Filter {
+	f := &Filter{}
+	if n.Kind != yaml.MappingNode {
+		f.Refs = p.refs(l, n)
+		return f
+	}
+	p.fields(l, n, map[string]func(loc, *yaml.Node){
+		"refs": func(l loc, v *yaml.Node) { f.Refs = p.refs(l, v) },
+		"variables": func(l loc, v *yaml.Node) {
+			exprs, _ := p.strs(l, v)
+			f.Variables = []*ciexpr.Expr{}
+			for _, s := range exprs {
+				e, err := ciexpr.Parse(s)
+				if err != nil {
+					p.errorf(l, v, "%v", err)
+					continue
+				}
+				f.Variables = append(f.Variables, e)
+			}
+		},
+		"changes": func(l loc, v *yaml.Node) { f.Changes = p.patterns(l, v) },
+	}, "kubernetes")
+	return f
+}
+
+func (p *parser) refs(l loc, n *yaml.Node) []string {
+	refs, _ := p.strs(l, n)
+	for _, ref := range refs {
+		if _, _, err := refRegexp(ref); err != nil {
+			p.errorf(l, n, "invalid ref pattern %q: %v", ref, err)
+		} else if strings.Contains(ref, "@") {
+			p.errorf(l, n, "refs with project paths are not supported")
+		}
+	}
+	if refs == nil {
+		refs = []string{}
+	}
+	return refs
+}
@@ -0,0 +1,357 @@
+package ciconfig
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+)
+
+// jobNames returns the names of jobs.
+func jobNames(jobs []*Job) []string {
+	names := make([]string, len(jobs))
+	for i, job := range jobs {
+		names[i] = job.Name
+	}
+	return names
+}
+
+func evaluate(t *testing.T, conf *Config, ctx *Context) []*Job {
+	t.Helper()
+	jobs, err := conf.Evaluate(ctx)
+	if err != nil {
+		t.Fatalf("Evaluate() = %v; want nil", err)
+	}
+	return jobs
+}
+
+func TestEvaluateRules(t *testing.T) {
+	src := writeFiles(t, map[string]string{
+		"go.mod":         "module example.com/m\n",
+		"docs/README.md": "docs\n",
+	})
+	defer os.RemoveAll(string(src))
+
+	conf := mustParse(t, `
+variables:
+  DEPLOY_BRANCH: main
+
+build:
+  script: make
+  rules:
+    - exists: [go.mod]
+
+docs:
+  script: make docs
+  rules:
+    - changes: ["docs/**/*"]
+
+deploy:
+  stage: deploy
+  script: make deploy
+  rules:
+    - if: $CI_PIPELINE_SOURCE == "merge_request_event"
+      when: never
+    - if: $CI_COMMIT_BRANCH == $DEPLOY_BRANCH
+      when: manual
+      allow_failure: false
+      variables:
+        TARGET: production
+    - if: $CI_COMMIT_TAG =~ /^v\d+/
+      variables:
+        TARGET: release
+
+review:
+  script: make review
+  rules:
+    - if: $CI_MERGE_REQUEST_IID
+      allow_failure: true
+`)
+
+	branch := func(name string, changes []string) *Context {
+		return &Context{
+			Ref:    name,
+			Source: SourcePush,
+			Variables: gciwire.JobVariables{
+				{Key: "CI_PIPELINE_SOURCE", Value: SourcePush},
+				{Key: "CI_COMMIT_BRANCH", Value: name},
+			},
+			Changes: changes,
+			Repo:    src,
+		}
+	}
+
+	jobs := evaluate(t, conf, branch("main", []string{"main.go"}))
+	if want := []string{"build", "deploy"}; !reflect.DeepEqual(jobNames(jobs), want) {
+		t.Fatalf("jobs on main = %q; want %q", jobNames(jobs), want)
+	}
+	deploy := jobs[1]
+	if deploy.When != WhenManual || deploy.AllowFailure {
+		t.Errorf("deploy = %+v; want a manual job that can't fail", deploy)
+	}
+	if got := deploy.Spec.GitLab.Variables.Get("TARGET"); got != "production" {
+		t.Errorf("TARGET = %q; want production", got)
+	}
+	if got := conf.Job("deploy").Spec.GitLab.Variables.Get("TARGET"); got != "" {
+		t.Errorf("Evaluate modified the configuration's job, TARGET = %q", got)
+	}
+
+	// Unknown changes always match.
+	jobs = evaluate(t, conf, branch("feature", nil))
+	if want := []string{"build", "docs"}; !reflect.DeepEqual(jobNames(jobs), want) {
+		t.Errorf("jobs on new branch = %q; want %q", jobNames(jobs), want)
+	}
+	jobs = evaluate(t, conf, branch("feature", []string{"docs/api/index.md"}))
+	if want := []string{"build", "docs"}; !reflect.DeepEqual(jobNames(jobs), want) {
+		t.Errorf("jobs changing docs = %q; want %q", jobNames(jobs), want)
+	}
+
+	tag := &Context{
+		Ref:       "v1.0.0",
+		Tag:       true,
+		Source:    SourcePush,
+		Variables: gciwire.JobVariables{{Key: "CI_COMMIT_TAG", Value: "v1.0.0"}},
+		Changes:   []string{},
+	}
+	jobs = evaluate(t, conf, tag)
+	if want := []string{"deploy"}; !reflect.DeepEqual(jobNames(jobs), want) {
+		t.Fatalf("jobs on tag = %q; want %q (exists is false without a repository)", jobNames(jobs), want)
+	}
+	if jobs[0].When != WhenOnSuccess || jobs[0].Spec.GitLab.Variables.Get("TARGET") != "release" {
+		t.Errorf("deploy on tag = %+v; want an on_success release", jobs[0])
+	}
+
+	mr := &Context{
+		Ref:    "feature",
+		Source: SourceMergeRequest,
+		Variables: gciwire.JobVariables{
+			{Key: "CI_PIPELINE_SOURCE", Value: SourceMergeRequest},
+			{Key: "CI_MERGE_REQUEST_IID", Value: "7"},
+			{Key: "CI_COMMIT_BRANCH", Value: "main"},
+		},
+		Changes: []string{"main.go"},
+	}
+	jobs = evaluate(t, conf, mr)
+	if want := []string{"review"}; !reflect.DeepEqual(jobNames(jobs), want) {
+		t.Fatalf("jobs on merge request = %q; want %q", jobNames(jobs), want)
+	}
+	if !jobs[0].AllowFailure {
+		t.Errorf("review.AllowFailure = false; want true")
+	}
+}
+
+func TestEvaluateOnlyExcept(t *testing.T) {
+	conf := mustParse(t, `
+.job:
+  script: run
+
+all:
+  extends: .job
+release:
+  extends: .job
+  only: [/^release-.*$/, tags]
+not-main:
+  extends: .job
+  except: [main]
+mr:
+  extends: .job
+  only: [merge_requests]
+scheduled-vars:
+  extends: .job
+  only:
+    refs: [branches]
+    variables: [$NIGHTLY == "1", $FORCE]
+changed:
+  extends: .job
+  only:
+    changes: ["*.go"]
+  except:
+    variables: [$SKIP]
+`)
+
+	cases := []struct {
+		name string
+		ctx  *Context
+		want []string
+	}{
+		{
+			name: "main",
+			ctx:  &Context{Ref: "main", Source: SourcePush, Changes: []string{"README.md"}},
+			want: []string{"all"},
+		},
+		{
+			name: "release branch",
+			ctx:  &Context{Ref: "release-1.0", Source: SourcePush, Changes: []string{"a.go"}},
+			want: []string{"all", "release", "not-main", "changed"},
+		},
+		{
+			name: "tag",
+			ctx:  &Context{Ref: "v1", Tag: true, Source: SourcePush},
+			want: []string{"all", "release", "not-main", "changed"},
+		},
+		{
+			name: "merge request",
+			ctx:  &Context{Ref: "feature", Source: SourceMergeRequest},
+			// changed doesn't set refs, so it isn't limited to branches and tags.
+			want: []string{"mr", "changed"},
+		},
+		{
+			name: "variables",
+			ctx: &Context{
+				Ref:       "main",
+				Source:    SourcePush,
+				Variables: gciwire.JobVariables{{Key: "NIGHTLY", Value: "1"}, {Key: "SKIP", Value: "yes"}},
+			},
+			want: []string{"all", "scheduled-vars"},
+		},
+	}
+	for _, c := range cases {
+		jobs := evaluate(t, conf, c.ctx)
+		if got := jobNames(jobs); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: jobs = %q; want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestEvaluateWorkflow(t *testing.T) {
+	conf := mustParse(t, `
+variables:
+  MODE: global
+workflow:
+  rules:
+    - if: $CI_COMMIT_MESSAGE =~ /\[skip ci\]/
+      when: never
+    - if: $CI_PIPELINE_SOURCE == "merge_request_event"
+      variables:
+        MODE: workflow
+    - if: $CI_COMMIT_BRANCH
+job:
+  script: run
+override:
+  script: run
+  variables:
+    MODE: job
+  rules:
+    - when: on_success
+`)
+
+	ctx := &Context{Variables: gciwire.JobVariables{
+		{Key: "CI_PIPELINE_SOURCE", Value: SourceMergeRequest},
+		{Key: "CI_COMMIT_MESSAGE", Value: "Fix things"},
+	}}
+	jobs := evaluate(t, conf, ctx)
+	if len(jobs) != 2 {
+		t.Fatalf("jobs = %q; want job and override", jobNames(jobs))
+	}
+	if got := jobs[0].Spec.GitLab.Variables.Get("MODE"); got != "workflow" {
+		t.Errorf("job MODE = %q; want workflow variables to override global variables", got)
+	}
+	if got := jobs[1].Spec.GitLab.Variables.Get("MODE"); got != "job" {
+		t.Errorf("override MODE = %q; want job variables to override workflow variables", got)
+	}
+
+	ctx.Variables[1].Value = "Fix things [skip ci]"
+	if jobs := evaluate(t, conf, ctx); len(jobs) != 0 {
+		t.Errorf("jobs with [skip ci] = %q; want none", jobNames(jobs))
+	}
+	if jobs := evaluate(t, conf, &Context{Variables: gciwire.JobVariables{{Key: "CI_COMMIT_TAG", Value: "v1"}}}); len(jobs) != 0 {
+		t.Errorf("jobs without a matching workflow rule = %q; want none", jobNames(jobs))
+	}
+}
+
+func TestEvaluateDependencies(t *testing.T) {
+	conf := mustParse(t, `
+stages: [build, test]
+build:
+  stage: build
+  script: make
+  rules:
+    - if: $BUILD
+lint:
+  stage: build
+  script: lint
+test:
+  script: test
+  dependencies: [build, lint]
+`)
+	jobs := evaluate(t, conf, &Context{Ref: "main", Source: SourcePush})
+	test := jobs[len(jobs)-1]
+	if want := []string{"lint"}; test.Name != "test" || !reflect.DeepEqual(test.Dependencies, want) {
+		t.Errorf("test dependencies = %q; want %q", test.Dependencies, want)
+	}
+}
+
+func TestEvaluateNeeds(t *testing.T) {
+	conf := mustParse(t, `
+build:
+  stage: build
+  script: make
+  rules:
+    - if: $BUILD
+lint:
+  script: lint
+  needs:
+    - job: build
+      optional: true
+test:
+  script: test
+  needs: [build]
+`)
+	_, err := conf.Evaluate(&Context{Ref: "main", Source: SourcePush})
+	if want := `test: needs: job "build" is not in the pipeline`; err == nil || err.Error() != want {
+		t.Errorf("Evaluate() = %v; want %q", err, want)
+	}
+
+	conf.Jobs = conf.Jobs[:2]
+	jobs := evaluate(t, conf, &Context{Ref: "main", Source: SourcePush})
+	if len(jobs) != 1 || jobs[0].Name != "lint" || jobs[0].Needs == nil || len(jobs[0].Needs) != 0 {
+		t.Errorf("Evaluate() = %+v; want lint without needs", jobs)
+	}
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	_, err := Parse([]byte(`
+a:
+  script: run
+  rules:
+    - if: $A ==
+    - when: sometimes
+    - changes:
+        compare_to: main
+b:
+  script: run
+  rules: [{when: always}]
+  only: [main]
+c:
+  script: run
+  only:
+    refs: [/(/]
+    kubernetes: active
+workflow:
+  rules:
+    - when: manual
+`))
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("Parse() = %v; want Errors", err)
+	}
+	want := []string{
+		"workflow:rules:when: must be always or never",
+		"a: rules:if: invalid expression",
+		"a: rules:when: must be one of",
+		"a: rules:changes:compare_to: keyword is not supported",
+		"b: rules: rules can't be used with only or except",
+		"c: only:refs: invalid ref pattern",
+		"c: only:kubernetes: keyword is not supported",
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Parse() = %d errors:\n%v\nwant %d", len(errs), errs, len(want))
+	}
+	for i, want := range want {
+		if got := errs[i].Error(); !strings.Contains(got, want) {
+			t.Errorf("errs[%d] = %q; want it to contain %q", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package ciconfig
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"go.spiff.io/gribble/internal/artifact"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+	"gopkg.in/yaml.v3"
+)
+
+// maxScriptDepth is how deeply lists in scripts may be nested. Nested lists are flattened, which
+// allows scripts to include lists from anchors.
+const maxScriptDepth = 10
+
+var validVariableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func isNull(n *yaml.Node) bool {
+	return n.Kind == yaml.ScalarNode && n.Tag == "!!null"
+}
+
+func (p *parser) str(l loc, n *yaml.Node) (string, bool) {
+	if n.Kind != yaml.ScalarNode || isNull(n) {
+		p.errorf(l, n, "must be a string")
+		return "", false
+	}
+	return n.Value, true
+}
+
+// strs reads a string or a list of strings.
+func (p *parser) strs(l loc, n *yaml.Node) ([]string, bool) {
+	if n.Kind == yaml.ScalarNode && !isNull(n) {
+		return []string{n.Value}, true
+	}
+	if n.Kind != yaml.SequenceNode {
+		p.errorf(l, n, "must be a string or a list of strings")
+		return nil, false
+	}
+	list := make([]string, 0, len(n.Content))
+	for _, item := range n.Content {
+		item = deref(item)
+		if item.Kind != yaml.ScalarNode || isNull(item) {
+			p.errorf(l, item, "must be a string or a list of strings")
+			return nil, false
+		}
+		list = append(list, item.Value)
+	}
+	return list, true
+}
+
+// script reads a script, which is a string or a list of strings and nested lists of strings.
+func (p *parser) script(l loc, n *yaml.Node) []string {
+	var lines []string
+	var flatten func(n *yaml.Node, depth int) bool
+	flatten = func(n *yaml.Node, depth int) bool {
+		n = deref(n)
+		switch {
+		case n.Kind == yaml.ScalarNode && !isNull(n):
+			lines = append(lines, n.Value)
+		case n.Kind == yaml.SequenceNode && depth < maxScriptDepth:
+			for _, item := range n.Content {
+				if !flatten(item, depth+1) {
+					return false
+				}
+			}
+		default:
+			p.errorf(l, n, "must be a string or a list of strings")
+			return false
+		}
+		return true
+	}
+	if !flatten(n, 0) {
+		return nil
+	}
+	return lines
+}
+
+func (p *parser) bool(l loc, n *yaml.Node) (bool, bool) {
+	var b bool
+	if n.Kind != yaml.ScalarNode || n.Tag != "!!bool" || n.Decode(&b) != nil {
+		p.errorf(l, n, "must be true or false")
+		return false, false
+	}
+	return b, true
+}
+
+// fields reads the keys of a mapping, calling the function in fields for each key. Keys that
+// aren't in fields are reported as unknown, unless they're in unsupported.
+func (p *parser) fields(l loc, n *yaml.Node, fields map[string]func(loc, *yaml.Node), unsupported ...string) bool {
+	if n.Kind != yaml.MappingNode {
+		p.errorf(l, n, "must be a mapping")
+		return false
+	}
+	eachPair(n, func(k, v *yaml.Node) {
+		kl := l.at(k.Value)
+		if fn := fields[k.Value]; fn != nil {
+			fn(kl, v)
+			return
+		}
+		for _, key := range unsupported {
+			if key == k.Value {
+				p.errorf(kl, k, "keyword is not supported")
+				return
+			}
+		}
+		p.errorf(kl, k, "unknown keyword")
+	})
+	return true
+}
+
+func (p *parser) image(l loc, n *yaml.Node) gciwire.Image {
+	return p.container(l, n, false)
+}
+
+func (p *parser) services(l loc, n *yaml.Node) gciwire.Services {
+	if n.Kind != yaml.SequenceNode {
+		p.errorf(l, n, "must be a list of services")
+		return nil
+	}
+	services := make(gciwire.Services, 0, len(n.Content))
+	for _, item := range n.Content {
+		services = append(services, p.container(l, deref(item), true))
+	}
+	return services
+}
+
+// container reads an image or a service, either of which may be a name or a mapping.
+func (p *parser) container(l loc, n *yaml.Node, service bool) (image gciwire.Image) {
+	if n.Kind == yaml.ScalarNode {
+		image.Name, _ = p.str(l, n)
+		return image
+	}
+
+	fields := map[string]func(loc, *yaml.Node){
+		"name":       func(l loc, v *yaml.Node) { image.Name, _ = p.str(l, v) },
+		"entrypoint": func(l loc, v *yaml.Node) { image.Entrypoint, _ = p.strs(l, v) },
+	}
+	unsupported := []string{"docker", "pull_policy"}
+	if service {
+		fields["alias"] = func(l loc, v *yaml.Node) { image.Alias, _ = p.str(l, v) }
+		fields["command"] = func(l loc, v *yaml.Node) { image.Command, _ = p.strs(l, v) }
+		unsupported = append(unsupported, "variables")
+	}
+	if p.fields(l, n, fields, unsupported...) && image.Name == "" {
+		p.errorf(l, n, "name is required")
+	}
+	return image
+}
+
+func (p *parser) variables(l loc, n *yaml.Node) gciwire.JobVariables {
+	if n.Kind != yaml.MappingNode {
+		p.errorf(l, n, "must be a mapping")
+		return nil
+	}
+	vars := make(gciwire.JobVariables, 0, len(n.Content)/2)
+	eachPair(n, func(k, v *yaml.Node) {
+		kl := l.at(k.Value)
+		if !validVariableName.MatchString(k.Value) {
+			p.errorf(kl, k, "invalid variable name")
+			return
+		}
+		// Variables in the configuration are visible to anyone who can read the repository.
+		variable := gciwire.JobVariable{Key: k.Value, Public: true}
+		switch {
+		case isNull(v):
+		case v.Kind == yaml.ScalarNode:
+			variable.Value = v.Value
+		case v.Kind == yaml.MappingNode:
+			p.fields(kl, v, map[string]func(loc, *yaml.Node){
+				"value":       func(l loc, v *yaml.Node) { variable.Value, _ = p.str(l, v) },
+				"description": func(loc, *yaml.Node) {},
+			}, "expand", "options")
+		default:
+			p.errorf(kl, v, "must be a string or a mapping")
+			return
+		}
+		vars = append(vars, variable)
+	})
+	return vars
+}
+
+func (p *parser) artifacts(l loc, n *yaml.Node) gciwire.Artifacts {
+	a := gciwire.Artifact{
+		Type:   "archive",
+		Format: gciwire.ArtifactFormatZip,
+		When:   gciwire.ArtifactWhenOnSuccess,
+	}
+	ok := p.fields(l, n, map[string]func(loc, *yaml.Node){
+		"name":      func(l loc, v *yaml.Node) { a.Name, _ = p.str(l, v) },
+		"paths":     func(l loc, v *yaml.Node) { a.Paths, _ = p.strs(l, v) },
+		"untracked": func(l loc, v *yaml.Node) { a.Untracked, _ = p.bool(l, v) },
+		"when": func(l loc, v *yaml.Node) {
+			s, _ := p.str(l, v)
+			switch when := gciwire.ArtifactWhen(s); when {
+			case gciwire.ArtifactWhenOnSuccess, gciwire.ArtifactWhenOnFailure, gciwire.ArtifactWhenAlways:
+				a.When = when
+			default:
+				p.errorf(l, v, "must be one of on_success, on_failure, or always")
+			}
+		},
+		"expire_in": func(l loc, v *yaml.Node) {
+			s, _ := p.str(l, v)
+			if _, _, err := artifact.ParseExpireIn(s); err != nil {
+				p.errorf(l, v, "%v", err)
+				return
+			}
+			a.ExpireIn = s
+		},
+	}, "exclude", "expose_as", "public", "access", "reports")
+	if !ok || (len(a.Paths) == 0 && !a.Untracked) {
+		return nil
+	}
+	return gciwire.Artifacts{a}
+}
+
+// caches reads a cache or a list of caches.
+func (p *parser) caches(l loc, n *yaml.Node) gciwire.Caches {
+	if n.Kind != yaml.SequenceNode {
+		if c, ok := p.cache(l, n); ok {
+			return gciwire.Caches{c}
+		}
+		return nil
+	}
+	caches := make(gciwire.Caches, 0, len(n.Content))
+	for _, item := range n.Content {
+		if c, ok := p.cache(l, deref(item)); ok {
+			caches = append(caches, c)
+		}
+	}
+	return caches
+}
+
+func (p *parser) cache(l loc, n *yaml.Node) (gciwire.Cache, bool) {
+	c := gciwire.Cache{Key: "default", Policy: gciwire.CachePolicyPullPush}
+	ok := p.fields(l, n, map[string]func(loc, *yaml.Node){
+		"key": func(l loc, v *yaml.Node) {
+			if v.Kind == yaml.MappingNode {
+				p.errorf(l, v, "keys computed from files are not supported")
+				return
+			}
+			c.Key, _ = p.str(l, v)
+		},
+		"paths":     func(l loc, v *yaml.Node) { c.Paths, _ = p.strs(l, v) },
+		"untracked": func(l loc, v *yaml.Node) { c.Untracked, _ = p.bool(l, v) },
+		"policy": func(l loc, v *yaml.Node) {
+			s, _ := p.str(l, v)
+			switch policy := gciwire.CachePolicy(s); policy {
+			case gciwire.CachePolicyPullPush, gciwire.CachePolicyPull, gciwire.CachePolicyPush:
+				c.Policy = policy
+			default:
+				p.errorf(l, v, "must be one of pull-push, pull, or push")
+			}
+		},
+	}, "when", "fallback_keys", "unprotect")
+	return c, ok
+}
+
+// needs reads a job's needs, each of which is either a job name or a mapping.
+func (p *parser) needs(l loc, n *yaml.Node) []Need {
+	if n.Kind != yaml.SequenceNode {
+		p.errorf(l, n, "must be a list of jobs")
+		return nil
+	}
+	needs := make([]Need, 0, len(n.Content))
+	for _, item := range n.Content {
+		item = deref(item)
+		need := Need{Artifacts: true}
+		if item.Kind != yaml.MappingNode {
+			if need.Job, _ = p.str(l, item); need.Job != "" {
+				needs = append(needs, need)
+			}
+			continue
+		}
+		p.fields(l, item, map[string]func(loc, *yaml.Node){
+			"job":       func(l loc, v *yaml.Node) { need.Job, _ = p.str(l, v) },
+			"artifacts": func(l loc, v *yaml.Node) { need.Artifacts, _ = p.bool(l, v) },
+			"optional":  func(l loc, v *yaml.Node) { need.Optional, _ = p.bool(l, v) },
+		}, "pipeline", "project", "ref", "parallel")
+		if need.Job == "" {
+			p.errorf(l, item, "job is required")
+			continue
+		}
+		needs = append(needs, need)
+	}
+	return needs
+}
+
+func (p *parser) when(l loc, n *yaml.Node) When {
+	s, ok := p.str(l, n)
+	if !ok {
+		return ""
+	}
+	switch when := When(s); when {
+	case WhenOnSuccess, WhenOnFailure, WhenAlways, WhenManual:
+		return when
+	case "delayed":
+		p.errorf(l, n, "delayed jobs are not supported")
+	default:
+		p.errorf(l, n, "must be one of on_success, on_failure, always, or manual")
+	}
+	return ""
+}
+
+func (p *parser) timeout(l loc, n *yaml.Node) time.Duration {
+	s, ok := p.str(l, n)
+	if !ok {
+		return 0
+	}
+	d, never, err := artifact.ParseExpireIn(s)
+	if err != nil || never || d < time.Second {
+		p.errorf(l, n, "invalid duration %q", strings.TrimSpace(s))
+		return 0
+	}
+	return d
+}
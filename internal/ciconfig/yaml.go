@@ -0,0 +1,164 @@
+package ciconfig
+
+import (
+	"gopkg.in/yaml.v3"
+)
+
+// maxAliasDepth limits how deeply aliases may refer to other aliases, which prevents
+// exponential expansion of documents that alias the same anchor repeatedly.
+const maxAliasDepth = 64
+
+// normalize returns a copy of n with aliases replaced by the nodes they refer to and merge keys
+// (<<) merged into their mappings, so that the rest of the parser only sees plain mappings,
+// sequences, and scalars. The copy's nodes are recorded as coming from file.
+func (p *parser) normalize(file string, n *yaml.Node) *yaml.Node {
+	return p.normalizeDepth(file, n, 0)
+}
+
+func (p *parser) normalizeDepth(file string, n *yaml.Node, depth int) *yaml.Node {
+	if n.Kind == yaml.DocumentNode {
+		if len(n.Content) == 0 {
+			return p.node(file, &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: n.Line})
+		}
+		return p.normalizeDepth(file, n.Content[0], depth)
+	}
+	if n.Kind == yaml.AliasNode {
+		if depth >= maxAliasDepth {
+			p.errorf(loc{}, n, "aliases are nested too deeply")
+			return p.node(file, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Line: n.Line})
+		}
+		return p.normalizeDepth(file, n.Alias, depth+1)
+	}
+
+	out := *n
+	out.Anchor = ""
+	out.Content = nil
+	switch n.Kind {
+	case yaml.SequenceNode:
+		if n.Tag == "!reference" {
+			p.errorf(loc{}, n, "!reference tags are not supported")
+		}
+		out.Content = make([]*yaml.Node, len(n.Content))
+		for i, item := range n.Content {
+			out.Content[i] = p.normalizeDepth(file, item, depth)
+		}
+	case yaml.MappingNode:
+		out.Content = p.mergeKeys(file, n, depth)
+	}
+	return p.node(file, &out)
+}
+
+// mergeKeys returns the normalized keys and values of a mapping with any merge keys expanded.
+// Keys set explicitly take precedence over merged keys, and earlier merged mappings take
+// precedence over later ones.
+func (p *parser) mergeKeys(file string, n *yaml.Node, depth int) []*yaml.Node {
+	explicit := map[string]bool{}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if !isMergeKey(n.Content[i]) {
+			explicit[n.Content[i].Value] = true
+		}
+	}
+
+	seen := map[string]bool{}
+	content := make([]*yaml.Node, 0, len(n.Content))
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		if !isMergeKey(k) {
+			seen[k.Value] = true
+			content = append(content, p.normalizeDepth(file, k, depth), p.normalizeDepth(file, v, depth))
+			continue
+		}
+
+		sources := []*yaml.Node{v}
+		if deref(v).Kind == yaml.SequenceNode {
+			sources = deref(v).Content
+		}
+		for _, src := range sources {
+			src = p.normalizeDepth(file, src, depth)
+			if src.Kind != yaml.MappingNode {
+				p.errorf(loc{}, src, "merge keys must refer to mappings")
+				continue
+			}
+			for j := 0; j+1 < len(src.Content); j += 2 {
+				key := src.Content[j].Value
+				if explicit[key] || seen[key] {
+					continue
+				}
+				seen[key] = true
+				content = append(content, src.Content[j], src.Content[j+1])
+			}
+		}
+	}
+	return content
+}
+
+func isMergeKey(k *yaml.Node) bool {
+	return k.Kind == yaml.ScalarNode && k.Value == "<<" && (k.Tag == "!!merge" || k.Tag == "")
+}
+
+// node records the file a normalized node came from and returns it.
+func (p *parser) node(file string, n *yaml.Node) *yaml.Node {
+	if file != "" {
+		p.files[n] = file
+	}
+	return n
+}
+
+// merge deep merges over into base the same way GitLab merges extends and includes: mappings are
+// merged key by key, and any other value in over replaces the value in base. Neither node is
+// modified. If base is nil, over is returned.
+func (p *parser) merge(base, over *yaml.Node) *yaml.Node {
+	if base == nil {
+		return over
+	}
+	if base.Kind != yaml.MappingNode || over.Kind != yaml.MappingNode {
+		return over
+	}
+
+	out := *over
+	out.Content = make([]*yaml.Node, 0, len(base.Content)+len(over.Content))
+	overValues := map[string]*yaml.Node{}
+	for i := 0; i+1 < len(over.Content); i += 2 {
+		overValues[over.Content[i].Value] = over.Content[i+1]
+	}
+	for i := 0; i+1 < len(base.Content); i += 2 {
+		k, v := base.Content[i], base.Content[i+1]
+		if ov, ok := overValues[k.Value]; ok {
+			v = p.merge(v, ov)
+			delete(overValues, k.Value)
+		}
+		out.Content = append(out.Content, k, v)
+	}
+	for i := 0; i+1 < len(over.Content); i += 2 {
+		k := over.Content[i]
+		if _, ok := overValues[k.Value]; ok {
+			out.Content = append(out.Content, k, over.Content[i+1])
+		}
+	}
+	return p.node(p.files[over], &out)
+}
+
+// without returns a copy of the mapping n without key.
+func (p *parser) without(n *yaml.Node, key string) *yaml.Node {
+	out := *n
+	out.Content = make([]*yaml.Node, 0, len(n.Content))
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value != key {
+			out.Content = append(out.Content, n.Content[i], n.Content[i+1])
+		}
+	}
+	return p.node(p.files[n], &out)
+}
+
+// lookup returns the value of key in the mapping n, or nil if it isn't set.
+func lookup(n *yaml.Node, key string) *yaml.Node {
+	if n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
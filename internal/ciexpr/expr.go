@@ -0,0 +1,306 @@
+// Package ciexpr implements the expression language of GitLab CI's rules:if and only:variables.
+//
+// An expression compares variables, strings, regular expressions, and null:
+//
+//	$CI_COMMIT_BRANCH == "main" && $CI_PIPELINE_SOURCE != "schedule"
+//	$CI_COMMIT_TAG =~ /^v\d+(\.\d+)*$/ || ($DEPLOY && $ENV != null)
+//
+// A variable on its own is true if it's set and not empty. Variables that aren't set are null,
+// which only equals null. Regular expressions are RE2 and accept the flags i, m, and s. The right
+// side of =~ and !~ may also be a variable holding a regular expression, such as "/^v1/i".
+// && binds more tightly than ||, and both short-circuit.
+package ciexpr
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Lookup returns the value of a variable and whether it is set.
+type Lookup func(name string) (value string, ok bool)
+
+// SyntaxError is an error parsing an expression.
+type SyntaxError struct {
+	Expr string
+	Pos  int // The byte offset of the error in Expr
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("invalid expression %q: at offset %d: %s", e.Expr, e.Pos, e.Msg)
+}
+
+func syntaxErrorf(expr string, pos int, format string, args ...interface{}) error {
+	return &SyntaxError{Expr: expr, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Expr is a parsed expression.
+type Expr struct {
+	src  string
+	root node
+}
+
+// Parse parses an expression.
+func Parse(s string) (*Expr, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{src: s, tokens: tokens}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, syntaxErrorf(s, tok.pos, "unexpected %v", tok.kind)
+	}
+	return &Expr{src: s, root: root}, nil
+}
+
+// Eval parses and evaluates an expression.
+func Eval(s string, vars Lookup) (bool, error) {
+	e, err := Parse(s)
+	if err != nil {
+		return false, err
+	}
+	return e.Eval(vars), nil
+}
+
+// String returns the expression's source.
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Eval evaluates the expression. If vars is nil, every variable is null.
+func (e *Expr) Eval(vars Lookup) bool {
+	if vars == nil {
+		vars = func(string) (string, bool) { return "", false }
+	}
+	return e.root.eval(vars)
+}
+
+// value is the value of an operand.
+type value struct {
+	null bool
+	str  string
+	re   *regexp.Regexp // Set for regular expression literals
+}
+
+func (v value) truthy() bool {
+	return !v.null && (v.re != nil || v.str != "")
+}
+
+func (v value) equal(o value) bool {
+	if v.null || o.null {
+		return v.null == o.null
+	}
+	return v.str == o.str
+}
+
+// regexp returns the regular expression v holds, either as a literal or as a string in the form
+// /pattern/flags. It returns nil if v isn't a valid regular expression.
+func (v value) regexp() *regexp.Regexp {
+	if v.re != nil || v.null {
+		return v.re
+	}
+	s := v.str
+	end := strings.LastIndexByte(s, '/')
+	if len(s) < 2 || s[0] != '/' || end < 1 {
+		return nil
+	}
+	re, err := compileRegexp(s[1:end], s[end+1:])
+	if err != nil {
+		return nil
+	}
+	return re
+}
+
+func compileRegexp(pattern, flags string) (*regexp.Regexp, error) {
+	for _, f := range flags {
+		if !strings.ContainsRune("ims", f) {
+			return nil, fmt.Errorf("unknown flag %q", f)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+type node interface {
+	eval(vars Lookup) bool
+}
+
+type operand interface {
+	value(vars Lookup) value
+}
+
+type varOperand string
+
+func (o varOperand) value(vars Lookup) value {
+	s, ok := vars(string(o))
+	return value{null: !ok, str: s}
+}
+
+type stringOperand string
+
+func (o stringOperand) value(Lookup) value {
+	return value{str: string(o)}
+}
+
+type nullOperand struct{}
+
+func (nullOperand) value(Lookup) value {
+	return value{null: true}
+}
+
+type regexpOperand struct {
+	re *regexp.Regexp
+}
+
+func (o regexpOperand) value(Lookup) value {
+	return value{str: o.re.String(), re: o.re}
+}
+
+// truthyNode is an operand used as a condition.
+type truthyNode struct {
+	operand operand
+}
+
+func (n *truthyNode) eval(vars Lookup) bool {
+	return n.operand.value(vars).truthy()
+}
+
+type compareNode struct {
+	op          tokenKind
+	left, right operand
+}
+
+func (n *compareNode) eval(vars Lookup) bool {
+	left, right := n.left.value(vars), n.right.value(vars)
+	switch n.op {
+	case tokEq:
+		return left.equal(right)
+	case tokNe:
+		return !left.equal(right)
+	}
+
+	// =~ and !~ never match null or an invalid regular expression.
+	matched := false
+	if re := right.regexp(); re != nil && !left.null {
+		matched = re.MatchString(left.str)
+	}
+	if n.op == tokNotMatch {
+		return !matched
+	}
+	return matched
+}
+
+type binaryNode struct {
+	op          tokenKind
+	left, right node
+}
+
+func (n *binaryNode) eval(vars Lookup) bool {
+	if n.op == tokAnd {
+		return n.left.eval(vars) && n.right.eval(vars)
+	}
+	return n.left.eval(vars) || n.right.eval(vars)
+}
+
+// parser is a recursive descent parser of the grammar:
+//
+//	or      = and { "||" and }
+//	and     = term { "&&" term }
+//	term    = "(" or ")" | operand [ ( "==" | "!=" | "=~" | "!~" ) operand ]
+//	operand = variable | string | regexp | "null"
+type parser struct {
+	src    string
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	for err == nil && p.peek().kind == tokOr {
+		p.next()
+		var right node
+		if right, err = p.and(); err == nil {
+			left = &binaryNode{op: tokOr, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.term()
+	for err == nil && p.peek().kind == tokAnd {
+		p.next()
+		var right node
+		if right, err = p.term(); err == nil {
+			left = &binaryNode{op: tokAnd, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) term() (node, error) {
+	if p.peek().kind == tokLParen {
+		p.next()
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.next(); tok.kind != tokRParen {
+			return nil, syntaxErrorf(p.src, tok.pos, "expected ), got %v", tok.kind)
+		}
+		return n, nil
+	}
+
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.peek().kind; op {
+	case tokEq, tokNe, tokMatch, tokNotMatch:
+		p.next()
+		right, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return &compareNode{op: op, left: left, right: right}, nil
+	}
+	return &truthyNode{operand: left}, nil
+}
+
+func (p *parser) operand() (operand, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokVar:
+		return varOperand(tok.text), nil
+	case tokString:
+		return stringOperand(tok.text), nil
+	case tokNull:
+		return nullOperand{}, nil
+	case tokRegexp:
+		re, err := compileRegexp(tok.text, tok.flags)
+		if err != nil {
+			return nil, syntaxErrorf(p.src, tok.pos, "invalid regular expression: %v", err)
+		}
+		return regexpOperand{re: re}, nil
+	}
+	return nil, syntaxErrorf(p.src, tok.pos, "expected a variable, string, regular expression, or null, got %v", tok.kind)
+}
@@ -0,0 +1,158 @@
+package ciexpr
+
+import (
+	"testing"
+)
+
+func testVars(vars map[string]string) Lookup {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func TestEval(t *testing.T) {
+	vars := testVars(map[string]string{
+		"BRANCH":  "main",
+		"TAG":     "v1.2.3",
+		"EMPTY":   "",
+		"SOURCE":  "push",
+		"PATTERN": "/^MAIN$/i",
+		"PLAIN":   "main",
+		"QUOTE":   `say "hi"`,
+	})
+
+	cases := []struct {
+		expr string
+		want bool
+	}{
+		// Variables alone are true if set and not empty.
+		{`$BRANCH`, true},
+		{`${BRANCH}`, true},
+		{`$EMPTY`, false},
+		{`$UNSET`, false},
+		{`"literal"`, true},
+		{`""`, false},
+		{`null`, false},
+		{`/re/`, true},
+
+		// Equality.
+		{`$BRANCH == "main"`, true},
+		{`$BRANCH == 'main'`, true},
+		{`"main" == $BRANCH`, true},
+		{`$BRANCH == "master"`, false},
+		{`$BRANCH != "master"`, true},
+		{`$BRANCH == $PLAIN`, true},
+		{`$BRANCH != $PLAIN`, false},
+		{`$QUOTE == "say \"hi\""`, true},
+		{`$QUOTE == 'say "hi"'`, true},
+
+		// null only equals null, so unset and empty variables differ.
+		{`$UNSET == null`, true},
+		{`$UNSET != null`, false},
+		{`$EMPTY == null`, false},
+		{`$EMPTY == ""`, true},
+		{`$UNSET == ""`, false},
+		{`$UNSET == $ALSO_UNSET`, true},
+		{`null == null`, true},
+		{`$BRANCH != null`, true},
+
+		// Regular expressions.
+		{`$TAG =~ /^v\d+\.\d+\.\d+$/`, true},
+		{`$TAG =~ /^v2/`, false},
+		{`$TAG !~ /^v2/`, true},
+		{`$TAG !~ /^v1/`, false},
+		{`$BRANCH =~ /MAIN/`, false},
+		{`$BRANCH =~ /MAIN/i`, true},
+		{`$BRANCH =~ /ma/`, true},
+		{`"a/b" =~ /a\/b/`, true},
+		{`$UNSET =~ /.*/`, false},
+		{`$UNSET !~ /.*/`, true},
+
+		// Regular expressions held in variables or strings.
+		{`$BRANCH =~ $PATTERN`, true},
+		{`$BRANCH =~ "/^ma/"`, true},
+		{`$BRANCH =~ $PLAIN`, false},
+		{`$BRANCH =~ $UNSET`, false},
+		{`$BRANCH =~ "/[/"`, false},
+
+		// Logical operators and precedence.
+		{`$BRANCH == "main" && $SOURCE == "push"`, true},
+		{`$BRANCH == "main" && $SOURCE == "schedule"`, false},
+		{`$BRANCH == "dev" || $SOURCE == "push"`, true},
+		{`$BRANCH == "dev" || $SOURCE == "schedule"`, false},
+		{`$UNSET || $BRANCH && $EMPTY`, false},
+		{`$BRANCH || $UNSET && $EMPTY`, true},
+		{`($BRANCH || $UNSET) && $EMPTY`, false},
+		{`$EMPTY && $UNSET || $TAG`, true},
+		{`(($BRANCH == "main"))`, true},
+		{`($BRANCH == "dev" || $TAG =~ /^v1/) && ($SOURCE == "push")`, true},
+		{"$BRANCH == \"main\"\n&& $SOURCE == \"push\"", true},
+	}
+	for _, c := range cases {
+		got, err := Eval(c.expr, vars)
+		if err != nil {
+			t.Errorf("Eval(%q) = %v; want %t", c.expr, err, c.want)
+		} else if got != c.want {
+			t.Errorf("Eval(%q) = %t; want %t", c.expr, got, c.want)
+		}
+	}
+}
+
+func TestEvalNilLookup(t *testing.T) {
+	e, err := Parse(`$A == null && $B != "x"`)
+	if err != nil {
+		t.Fatalf("Parse() = %v; want nil", err)
+	}
+	if !e.Eval(nil) {
+		t.Errorf("Eval(nil) = false; want true")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		expr string
+		pos  int
+	}{
+		{``, 0},
+		{`$`, 0},
+		{`$1A`, 0},
+		{`${A`, 0},
+		{`"unterminated`, 0},
+		{`/unterminated`, 0},
+		{`$A ==`, 5},
+		{`$A == == "a"`, 6},
+		{`$A = "a"`, 3},
+		{`$A & $B`, 3},
+		{`($A`, 3},
+		{`$A)`, 2},
+		{`$A "b"`, 3},
+		{`$A =~ /(/`, 6},
+		{`$A =~ /a/x`, 6},
+		{`&& $A`, 0},
+		{`nullify`, 0},
+		{`($A == "a") == "b"`, 12},
+	}
+	for _, c := range cases {
+		_, err := Parse(c.expr)
+		serr, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("Parse(%q) = %v; want *SyntaxError", c.expr, err)
+			continue
+		}
+		if serr.Pos != c.pos {
+			t.Errorf("Parse(%q) error at %d (%v); want %d", c.expr, serr.Pos, serr, c.pos)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	const src = `$A == "b" || $C`
+	e, err := Parse(src)
+	if err != nil {
+		t.Fatalf("Parse() = %v; want nil", err)
+	}
+	if e.String() != src {
+		t.Errorf("String() = %q; want %q", e.String(), src)
+	}
+}
@@ -0,0 +1,193 @@
+package ciexpr
+
+import (
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokVar
+	tokString
+	tokRegexp
+	tokNull
+	tokEq
+	tokNe
+	tokMatch
+	tokNotMatch
+	tokAnd
+	tokOr
+	tokLParen
+	tokRParen
+)
+
+var tokenNames = [...]string{
+	tokEOF:      "end of expression",
+	tokVar:      "variable",
+	tokString:   "string",
+	tokRegexp:   "regular expression",
+	tokNull:     "null",
+	tokEq:       "==",
+	tokNe:       "!=",
+	tokMatch:    "=~",
+	tokNotMatch: "!~",
+	tokAnd:      "&&",
+	tokOr:       "||",
+	tokLParen:   "(",
+	tokRParen:   ")",
+}
+
+func (k tokenKind) String() string {
+	return tokenNames[k]
+}
+
+type token struct {
+	kind tokenKind
+	pos  int
+	// text is the variable name, the unquoted string, or the regular expression's pattern.
+	text string
+	// flags are a regular expression's flags.
+	flags string
+}
+
+// operators are the two-character operators.
+var operators = map[string]tokenKind{
+	"==": tokEq,
+	"!=": tokNe,
+	"=~": tokMatch,
+	"!~": tokNotMatch,
+	"&&": tokAnd,
+	"||": tokOr,
+}
+
+// lex splits an expression into tokens. The last token is always tokEOF.
+func lex(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; ; {
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+		if i == len(s) {
+			return append(tokens, token{kind: tokEOF, pos: i}), nil
+		}
+
+		start := i
+		switch c := s[i]; {
+		case c == '(':
+			tokens = append(tokens, token{kind: tokLParen, pos: start})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokRParen, pos: start})
+			i++
+		case c == '$':
+			name, n, err := lexVar(s, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokVar, pos: start, text: name})
+			i += n
+		case c == '"' || c == '\'':
+			str, n, err := lexString(s, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokString, pos: start, text: str})
+			i += n
+		case c == '/':
+			pattern, flags, n, err := lexRegexp(s, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokRegexp, pos: start, text: pattern, flags: flags})
+			i += n
+		case strings.HasPrefix(s[i:], "null") && (i+4 == len(s) || !isNameChar(s[i+4])):
+			tokens = append(tokens, token{kind: tokNull, pos: start})
+			i += 4
+		default:
+			if i+2 <= len(s) {
+				if kind, ok := operators[s[i:i+2]]; ok {
+					tokens = append(tokens, token{kind: kind, pos: start})
+					i += 2
+					continue
+				}
+			}
+			return nil, syntaxErrorf(s, i, "unexpected character %q", c)
+		}
+	}
+}
+
+// lexVar lexes a variable, either $NAME or ${NAME}, starting at s[i]. It returns the name and
+// the length of the variable.
+func lexVar(s string, i int) (name string, n int, err error) {
+	j := i + 1
+	braced := j < len(s) && s[j] == '{'
+	if braced {
+		j++
+	}
+	start := j
+	for j < len(s) && isNameChar(s[j]) {
+		j++
+	}
+	name = s[start:j]
+	if name == "" || isDigit(name[0]) {
+		return "", 0, syntaxErrorf(s, i, "invalid variable name")
+	}
+	if braced {
+		if j == len(s) || s[j] != '}' {
+			return "", 0, syntaxErrorf(s, i, "unterminated variable")
+		}
+		j++
+	}
+	return name, j - i, nil
+}
+
+// lexString lexes a single- or double-quoted string starting at s[i]. A backslash escapes the
+// quote character or another backslash; any other backslash is kept as is.
+func lexString(s string, i int) (str string, n int, err error) {
+	quote := s[i]
+	var b strings.Builder
+	for j := i + 1; j < len(s); j++ {
+		switch c := s[j]; {
+		case c == quote:
+			return b.String(), j + 1 - i, nil
+		case c == '\\' && j+1 < len(s) && (s[j+1] == quote || s[j+1] == '\\'):
+			j++
+			b.WriteByte(s[j])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, syntaxErrorf(s, i, "unterminated string")
+}
+
+// lexRegexp lexes a regular expression literal, /pattern/flags, starting at s[i]. A backslash
+// followed by a slash doesn't end the pattern.
+func lexRegexp(s string, i int) (pattern, flags string, n int, err error) {
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '/':
+			pattern = s[i+1 : j]
+			k := j + 1
+			for k < len(s) && isNameChar(s[k]) {
+				k++
+			}
+			return pattern, s[j+1 : k], k - i, nil
+		}
+	}
+	return "", "", 0, syntaxErrorf(s, i, "unterminated regular expression")
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || isDigit(c) || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
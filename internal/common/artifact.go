@@ -0,0 +1,48 @@
+package com
+
+import (
+	"time"
+
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+)
+
+// ArtifactArchive is the artifact type of a job's artifact archive, which is passed on to jobs
+// that depend on it.
+const ArtifactArchive = "archive"
+
+// Artifact describes an artifact uploaded by a job. The artifact's contents are kept in an
+// artifact store under Key.
+type Artifact struct {
+	ID       int64
+	Job      int64
+	Type     string // Such as "archive" or "junit"
+	Format   gciwire.ArtifactFormat
+	Filename string
+	Size     int64
+	SHA256   string // Hex-encoded
+	Key      string
+	ExpireIn string
+	Expires  time.Time // Zero if the artifact never expires.
+	Created  time.Time
+}
+
+func (a *Artifact) CanCreate() error {
+	if a == nil {
+		return ErrNil
+	}
+	if a.ID != 0 {
+		return ErrHasID
+	}
+	if a.Job <= 0 {
+		return ErrNoID
+	}
+	return nil
+}
+
+// ArtifactDependency is an artifact archive uploaded by a job that another job depends on.
+type ArtifactDependency struct {
+	Job      int64 // The job that uploaded the artifact.
+	JobName  string
+	Filename string
+	Size     int64
+}
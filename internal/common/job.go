@@ -0,0 +1,164 @@
+package com
+
+import (
+	"encoding/json"
+
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+)
+
+// Job states set by the server. Runners are never given jobs in these states.
+const (
+	// JobCreated is the state of a job waiting on the jobs it depends on to finish.
+	JobCreated gciwire.JobState = "created"
+	// JobSkipped is the state of a job that didn't run because of the results of the jobs it
+	// depends on.
+	JobSkipped gciwire.JobState = "skipped"
+	// JobManual is the state of a manual job that is waiting to be played.
+	JobManual gciwire.JobState = "manual"
+)
+
+// jobTransitions maps job states to the states a job may move to from them.
+var jobTransitions = map[gciwire.JobState][]gciwire.JobState{
+	JobCreated:      {gciwire.Pending, JobSkipped, JobManual},
+	JobManual:       {gciwire.Pending},
+	gciwire.Pending: {gciwire.Running},
+	gciwire.Running: {gciwire.Running, gciwire.Success, gciwire.Failed},
+}
+
+// CanTransition returns true if a job may move from one state to another.
+func CanTransition(from, to gciwire.JobState) bool {
+	for _, state := range jobTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFinished returns true if state is a terminal job state.
+func IsFinished(state gciwire.JobState) bool {
+	switch state {
+	case gciwire.Success, gciwire.Failed, JobSkipped:
+		return true
+	}
+	return false
+}
+
+// JobWhen is the result of the jobs a job depends on that the job runs after.
+type JobWhen string
+
+const (
+	// WhenOnSuccess jobs run if the jobs they depend on succeeded. This is the default.
+	WhenOnSuccess JobWhen = "on_success"
+	// WhenOnFailure jobs run only if a job they depend on failed.
+	WhenOnFailure JobWhen = "on_failure"
+	// WhenAlways jobs run once the jobs they depend on finish, regardless of their results.
+	WhenAlways JobWhen = "always"
+	// WhenManual jobs are released like on_success jobs, but wait in the manual state until
+	// they're played.
+	WhenManual JobWhen = "manual"
+)
+
+// Runs returns true if a job should run once the jobs it depends on have finished with the given
+// result, as returned by Result. As in GitLab, jobs ordered by stage also run after skipped jobs,
+// but DAG jobs, whose dependencies come from needs, are skipped along with the jobs they need.
+func (w JobWhen) Runs(result gciwire.JobState, dag bool) bool {
+	switch w {
+	case WhenAlways:
+		return true
+	case WhenOnFailure:
+		return result == gciwire.Failed
+	}
+	return result == gciwire.Success || result == JobSkipped && !dag
+}
+
+// Optional returns true if the job is a manual job that doesn't block the jobs in later stages
+// of its pipeline. As in GitLab, these are manual jobs that are allowed to fail.
+func (j *Job) Optional() bool {
+	return j.State == JobManual && j.AllowFailure
+}
+
+// Result returns the combined result of finished jobs. It is failed if any job failed without
+// being allowed to, skipped if every job was skipped or is an optional manual job, and success
+// otherwise.
+func Result(jobs []*Job) gciwire.JobState {
+	skipped := len(jobs) > 0
+	for _, job := range jobs {
+		if job.State == gciwire.Failed && !job.AllowFailure {
+			return gciwire.Failed
+		} else if job.State != JobSkipped && !job.Optional() {
+			skipped = false
+		}
+	}
+	if skipped {
+		return JobSkipped
+	}
+	return gciwire.Success
+}
+
+// PipelineStatus returns the status of a pipeline derived from its jobs. Once all of its jobs
+// have finished, other than optional manual jobs, it is the jobs' Result. Until then, the
+// pipeline is manual if it's waiting on manual jobs to be played, created if all of its jobs are
+// waiting on others, pending if none have been claimed by a runner, and running otherwise.
+func PipelineStatus(jobs []*Job) gciwire.JobState {
+	var created, pending, running, manual, blocking, finished int
+	for _, job := range jobs {
+		switch job.State {
+		case JobCreated:
+			created++
+		case gciwire.Pending:
+			pending++
+		case gciwire.Running:
+			running++
+		case JobManual:
+			manual++
+			if !job.Optional() {
+				blocking++
+			}
+		default:
+			finished++
+		}
+	}
+	switch {
+	case created+pending+running+blocking == 0:
+		return Result(jobs)
+	case pending+running == 0 && manual > 0:
+		return JobManual
+	case running+finished > 0:
+		return gciwire.Running
+	case pending > 0:
+		return gciwire.Pending
+	}
+	return JobCreated
+}
+
+// JobNeed is a job of the same pipeline that a job template needs, by name.
+type JobNeed struct {
+	Job       string `json:"job"`
+	Artifacts bool   `json:"artifacts"` // If true, the needed job's artifacts are fetched
+}
+
+// UnmarshalJSON reads a need from either a job name or an object. As in GitLab, the needed job's
+// artifacts are fetched unless artifacts is false.
+func (n *JobNeed) UnmarshalJSON(p []byte) error {
+	var name string
+	if err := json.Unmarshal(p, &name); err == nil {
+		*n = JobNeed{Job: name, Artifacts: true}
+		return nil
+	}
+	type need JobNeed
+	v := need{Artifacts: true}
+	if err := json.Unmarshal(p, &v); err != nil {
+		return err
+	}
+	*n = JobNeed(v)
+	return nil
+}
+
+// JobDependency is a job that another job depends on. When jobs are created together, Src may
+// refer to a job created before the dependent one in place of its ID.
+type JobDependency struct {
+	Job            int64
+	Src            *Job
+	FetchArtifacts bool
+}
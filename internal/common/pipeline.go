@@ -0,0 +1,131 @@
+package com
+
+import (
+	"strings"
+	"time"
+
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+)
+
+// Project is a repository that pipelines are run for.
+type Project struct {
+	ID       int64
+	Source   string // Such as "github"
+	SourceID string // The project's ID in its source, if it has one.
+	Name     string
+	Path     string // Such as "owner/repo"
+	URL      string // The project's web page
+	CloneURL string
+}
+
+func (p *Project) CanCreate() error {
+	if p == nil {
+		return ErrNil
+	}
+	if p.ID != 0 {
+		return ErrHasID
+	}
+	return nil
+}
+
+// EventKind is the kind of repository event that triggered a pipeline.
+type EventKind string
+
+const (
+	EventPush        EventKind = "push"
+	EventPullRequest EventKind = "pull_request"
+)
+
+// Event is a change to a project's repository that pipelines are created for. Webhook payloads
+// from each source are normalized into an Event.
+type Event struct {
+	Kind    EventKind              `json:"kind"`
+	Project Project                `json:"project"`
+	Ref     string                 `json:"ref"` // A branch or tag name, not a full ref
+	RefType gciwire.GitInfoRefType `json:"ref_type"`
+	Before  string                 `json:"before"`
+	After   string                 `json:"after"`
+
+	// PullRequest is set for pull request events. The event's Ref is the PR's source branch
+	// and After is the PR's head SHA.
+	PullRequest *PullRequest `json:"pull_request,omitempty"`
+}
+
+// PullRequest describes the pull request of a pull request event.
+type PullRequest struct {
+	ID     int64  `json:"id"` // The PR's ID in its source, if different from its number
+	Number int64  `json:"number"`
+	Title  string `json:"title"`
+	URL    string `json:"url"`
+	// HeadRef is a ref in the target repository pointing to the PR's head, such as
+	// refs/pull/1/head.
+	HeadRef string `json:"head_ref"`
+
+	SourceBranch string `json:"source_branch"`
+	SourcePath   string `json:"source_path"` // The source repository's path
+	SourceURL    string `json:"source_url"`  // The source repository's web page
+	TargetBranch string `json:"target_branch"`
+	TargetSHA    string `json:"target_sha"`
+	// Fork is true if the PR's source repository is not its target repository.
+	Fork bool `json:"fork"`
+}
+
+// FullRef returns the event's ref with its refs/heads/ or refs/tags/ prefix. For pull requests,
+// FullRef returns the PR's head ref.
+func (e *Event) FullRef() string {
+	if e.PullRequest != nil {
+		return e.PullRequest.HeadRef
+	}
+	if e.RefType == gciwire.RefTypeTag {
+		return "refs/tags/" + e.Ref
+	}
+	return "refs/heads/" + e.Ref
+}
+
+// ParseRef splits a full git ref into a branch or tag name and its ref type. If ref is not a
+// branch or tag, ok is false.
+func ParseRef(ref string) (name string, typ gciwire.GitInfoRefType, ok bool) {
+	switch {
+	case strings.HasPrefix(ref, "refs/heads/"):
+		return ref[len("refs/heads/"):], gciwire.RefTypeBranch, true
+	case strings.HasPrefix(ref, "refs/tags/"):
+		return ref[len("refs/tags/"):], gciwire.RefTypeTag, true
+	}
+	return "", "", false
+}
+
+// ZeroSHA is the SHA webhooks send in place of a missing commit.
+const ZeroSHA = "0000000000000000000000000000000000000000"
+
+// IsZeroSHA returns true if sha is a commit SHA made up of only zeroes. Webhooks use these as the
+// after SHA of deleted refs and the before SHA of new refs.
+func IsZeroSHA(sha string) bool {
+	return sha != "" && strings.Trim(sha, "0") == ""
+}
+
+// Pipeline is a set of jobs created for an event.
+type Pipeline struct {
+	ID       int64
+	Project  int64
+	Event    *Event
+	Delivery int64 // The webhook delivery that created the pipeline, if any
+	Created  time.Time
+	// Changes are the paths of the files changed by the pipeline's event. If nil, the changes
+	// aren't known.
+	Changes []string
+	// Status is derived from the pipeline's jobs by PipelineStatus when the pipeline is read.
+	Status gciwire.JobState
+}
+
+func (p *Pipeline) CanCreate() error {
+	if p == nil || p.Event == nil {
+		return ErrNil
+	}
+	if p.ID != 0 {
+		return ErrHasID
+	}
+	if p.Project <= 0 {
+		return ErrNoID
+	}
+	return nil
+}
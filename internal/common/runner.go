@@ -14,6 +14,13 @@ var (
 	ErrNoID     = errors.New("resource ID is not set")
 	ErrNotFound = errors.New("resource not found")
 
+	// ErrRangeMismatch is returned when appending to a job trace at an offset other than the
+	// end of the trace.
+	ErrRangeMismatch = errors.New("range does not match resource length")
+
+	// ErrConflict is returned when a resource was modified concurrently.
+	ErrConflict = errors.New("resource was modified concurrently")
+
 	// ErrHasID is returned for resources that cannot be created because their IDs must be
 	// assigned by a database.
 	ErrHasID = errors.New("cannot preassign an ID to this resource")
@@ -27,6 +34,7 @@ type Runner struct {
 	RunUntagged bool
 	Locked      bool
 	MaxTimeout  time.Duration // <= 0 -> System limit
+	Features    Feature       // Features last advertised by the runner.
 	Active      bool
 	Deleted     bool
 	Created     time.Time
@@ -60,16 +68,103 @@ func ParseTags(tags string) []string {
 }
 
 type Job struct {
-	ID     int64
-	Runner int64
-	State  gciwire.JobState
-	Spec   *JobSpec
+	ID       int64
+	Runner   int64
+	Project  int64
+	Pipeline int64
+	State    gciwire.JobState
+	Features Feature // Features required of a runner to run the job.
+	Stuck    bool    // True if no runner has the features required by the job.
+	Tags     []string
+	Spec     *JobSpec
+	// TokenHash is the hash of the token issued to the job when it was claimed by a runner.
+	// It is empty if the job has not been claimed or has finished.
+	TokenHash     string
+	FailureReason gciwire.JobFailureReason
+	Created       time.Time
+	Finished      time.Time
+
+	// When and AllowFailure decide whether the job runs given the results of the jobs it
+	// depends on, and whether the job failing fails the jobs that depend on it.
+	When         JobWhen
+	AllowFailure bool
+	// DAG is true if the job depends on the jobs it needs rather than every job in earlier
+	// stages.
+	DAG bool
+	// Depends lists the jobs the job depends on. It is only used when creating the job, and is
+	// recorded in the job_depends table.
+	Depends []JobDependency
+
+	// Plan is true if the job is a plan job, which uploads a plan describing further jobs to
+	// add to its pipeline once it succeeds. PlanDepth is the number of plan jobs that the job
+	// was planned by.
+	Plan      bool
+	PlanDepth int
+
+	// Needs and Dependencies are only used by job templates. If Needs is not nil, the job
+	// depends on the jobs it names instead of every job in earlier stages. Dependencies names
+	// the jobs whose artifacts the job fetches. If nil, it fetches the artifacts of every job it
+	// depends on.
+	Needs        []JobNeed
+	Dependencies []string
+}
+
+func (j *Job) CanCreate() error {
+	if j == nil || j.Spec == nil {
+		return ErrNil
+	}
+	if j.ID != 0 {
+		return ErrHasID
+	}
+	return nil
 }
 
 type JobSpec struct {
 	GitLab gciwire.JobResponse `json:"gitlab,omitempty"`
 }
 
+// RequiredFeatures returns the runner features needed to run the job described by the spec.
+func (s *JobSpec) RequiredFeatures() (flags Feature) {
+	if s == nil {
+		return 0
+	}
+	job := &s.GitLab
+	if len(job.Variables) > 0 {
+		flags |= FeatureVariables
+	}
+	for _, v := range job.Variables {
+		if v.Masked {
+			flags |= FeatureMasking
+			break
+		}
+	}
+	if job.Image.Name != "" {
+		flags |= FeatureImage
+	}
+	if len(job.Services) > 0 {
+		flags |= FeatureServices
+	}
+	if len(job.Artifacts) > 0 {
+		flags |= FeatureArtifacts
+	}
+	if len(job.Artifacts) > 1 {
+		flags |= FeatureUploadMultipleArtifacts
+	}
+	for _, a := range job.Artifacts {
+		if a.Format == gciwire.ArtifactFormatRaw {
+			flags |= FeatureUploadRawArtifacts
+			break
+		}
+	}
+	if len(job.Cache) > 0 {
+		flags |= FeatureCache
+	}
+	if len(job.GitInfo.Refspecs) > 0 {
+		flags |= FeatureRefspecs
+	}
+	return flags
+}
+
 type Feature int64
 
 func (f Feature) IsSet(flags Feature) bool {
@@ -0,0 +1,63 @@
+package com
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ErrDuplicate is returned when recording a webhook delivery that was already handled.
+var ErrDuplicate = errors.New("webhook delivery is a duplicate")
+
+// WebhookResult is the outcome of handling a webhook delivery.
+type WebhookResult string
+
+const (
+	WebhookPending     WebhookResult = "pending"     // Not yet handled
+	WebhookCreated     WebhookResult = "created"     // Created one or more pipelines
+	WebhookIgnored     WebhookResult = "ignored"     // Valid, but not an event that creates pipelines
+	WebhookInvalid     WebhookResult = "invalid"     // Failed signature or token validation
+	WebhookMalformed   WebhookResult = "malformed"   // Could not be parsed
+	WebhookTooLarge    WebhookResult = "too_large"   // Payload exceeded the size limit
+	WebhookUnsupported WebhookResult = "unsupported" // An unsupported event type
+	WebhookError       WebhookResult = "error"       // Failed due to a server error
+)
+
+// WebhookDelivery is a webhook received from a source, such as GitHub.
+type WebhookDelivery struct {
+	ID         int64
+	Source     string // Such as "github"
+	DeliveryID string // The source's ID for the delivery, if it sends one
+	Event      string // The source's event type
+	Query      string // The webhook URL's raw query
+	Header     http.Header
+	Body       []byte
+	ReplayOf   int64 // If set, the delivery this is a replay of
+
+	Result       WebhookResult
+	ResponseCode int
+	Pipelines    []int64 // Pipelines created by the delivery
+
+	Created time.Time
+	Updated time.Time
+}
+
+// Handled returns whether the result of a delivery means that a duplicate of it should not be
+// handled again. Deliveries that failed validation or couldn't be handled can be redelivered.
+func (r WebhookResult) Handled() bool {
+	switch r {
+	case WebhookPending, WebhookCreated, WebhookIgnored:
+		return true
+	}
+	return false
+}
+
+func (d *WebhookDelivery) CanCreate() error {
+	if d == nil {
+		return ErrNil
+	}
+	if d.ID != 0 {
+		return ErrHasID
+	}
+	return nil
+}
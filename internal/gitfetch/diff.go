@@ -0,0 +1,104 @@
+package gitfetch
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ErrNoMergeBase is returned by MergeBase if no common ancestor of its commits was found in the
+// history it fetched.
+var ErrNoMergeBase = errors.New("no merge base found")
+
+// mergeBaseDepths are the depths of history fetched, in turn, to find a merge base. Most branches
+// are found in the first; the full history of a large repository is never fetched.
+var mergeBaseDepths = []int{50, 1000}
+
+// baseRef is the mirror ref that the refs a merge base is found for are fetched into.
+const baseRef = "refs/gribble/base"
+
+// Diff returns the paths of files that differ between the commits from and to of the repository at
+// url, fetching either of them if they aren't in its mirror. Renamed files are listed by both their
+// old and new paths.
+func (f *Fetcher) Diff(ctx context.Context, url, from, to string) ([]string, error) {
+	if !validSHA(from) || !validSHA(to) {
+		return nil, ErrInvalidSHA
+	}
+	dir, unlock, err := f.open(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	for _, sha := range []string{from, to} {
+		tree := &Tree{f: f, dir: dir, sha: sha}
+		if tree.hasCommit(ctx) {
+			continue
+		}
+		if _, err := f.run(ctx, dir, "fetch", "--quiet", "--no-tags", "--depth=1", "--", url, sha); err != nil {
+			return nil, err
+		}
+	}
+
+	out, err := f.run(ctx, dir, "diff", "--name-only", "-z", "--no-renames", from, to, "--")
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name != "" {
+			files = append(files, name)
+		}
+	}
+	return files, nil
+}
+
+// MergeBase returns the best common ancestor of the commit sha and the branch or ref ref of the
+// repository at url. History is fetched more deeply until a merge base is found; if none is found
+// in the deepest fetch, MergeBase returns ErrNoMergeBase.
+func (f *Fetcher) MergeBase(ctx context.Context, url, ref, sha string) (string, error) {
+	if !validSHA(sha) {
+		return "", ErrInvalidSHA
+	}
+	if ref == "" || strings.HasPrefix(ref, "-") || strings.Contains(ref, ":") {
+		return "", errors.New("invalid ref: " + strconv.Quote(ref))
+	}
+	dir, unlock, err := f.open(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	for _, depth := range mergeBaseDepths {
+		_, err := f.run(ctx, dir, "fetch", "--quiet", "--no-tags", "--depth="+strconv.Itoa(depth),
+			"--", url, "+"+ref+":"+baseRef, sha)
+		if err != nil {
+			return "", err
+		}
+		// merge-base exits with status 1 if there's no common ancestor.
+		if out, err := f.run(ctx, dir, "merge-base", baseRef, sha); err == nil {
+			return strings.TrimSpace(string(out)), nil
+		}
+	}
+	return "", ErrNoMergeBase
+}
+
+// DefaultBranch returns the name of the branch that the repository at url's HEAD points to.
+func (f *Fetcher) DefaultBranch(ctx context.Context, url string) (string, error) {
+	out, err := f.run(ctx, "", "ls-remote", "--symref", "--", url, "HEAD")
+	if err != nil {
+		return "", err
+	}
+	// The symref is listed as "ref: refs/heads/main\tHEAD".
+	for _, line := range strings.Split(string(out), "\n") {
+		if !strings.HasPrefix(line, "ref: ") {
+			continue
+		}
+		target := strings.TrimPrefix(strings.SplitN(line, "\t", 2)[0], "ref: ")
+		if strings.HasPrefix(target, "refs/heads/") {
+			return strings.TrimPrefix(target, "refs/heads/"), nil
+		}
+	}
+	return "", errors.New("repository has no default branch")
+}
@@ -0,0 +1,214 @@
+// Package gitfetch keeps local bare mirrors of repositories and reads files from their commits.
+//
+// Commits are fetched with shallow fetches of a single SHA, so that reading a pipeline's
+// configuration doesn't require cloning a repository's full history or making requests to its
+// host's API.
+package gitfetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidSHA is returned for SHAs that aren't full hexadecimal commit SHAs.
+var ErrInvalidSHA = errors.New("invalid commit SHA")
+
+// Fetcher keeps bare mirrors of repositories in a directory. Each clone URL has its own mirror,
+// which is created the first time a commit is fetched from it. Fetches to the same mirror are
+// serialized.
+type Fetcher struct {
+	dir string
+	git string
+
+	m     sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// New returns a Fetcher that keeps mirrors in dir. The directory is created on first fetch if it
+// does not exist.
+func New(dir string) *Fetcher {
+	return &Fetcher{dir: dir, git: "git", locks: map[string]*sync.Mutex{}}
+}
+
+// mirror returns the path of the mirror for a clone URL. Mirrors are named by a hash of their
+// URL, since URLs may contain credentials.
+func (f *Fetcher) mirror(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(f.dir, hex.EncodeToString(sum[:16])+".git")
+}
+
+func (f *Fetcher) lock(dir string) func() {
+	f.m.Lock()
+	l := f.locks[dir]
+	if l == nil {
+		l = new(sync.Mutex)
+		f.locks[dir] = l
+	}
+	f.m.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// Fetch fetches the commit sha from the repository at url into its mirror, if the mirror doesn't
+// already have it, and returns the commit's tree. Not every host allows fetching commits by SHA,
+// so if ref is not empty and fetching the SHA fails, the ref is fetched instead and must point
+// to sha or one of its descendants.
+func (f *Fetcher) Fetch(ctx context.Context, url, ref, sha string) (*Tree, error) {
+	if !validSHA(sha) {
+		return nil, ErrInvalidSHA
+	}
+	dir, unlock, err := f.open(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	tree := &Tree{f: f, dir: dir, sha: sha}
+	if tree.hasCommit(ctx) {
+		return tree, nil
+	}
+	_, err = f.run(ctx, dir, "fetch", "--quiet", "--no-tags", "--depth=1", "--", url, sha)
+	if err != nil && ref != "" && !strings.HasPrefix(ref, "-") {
+		// Fetch enough of the ref's history to find the SHA.
+		_, err = f.run(ctx, dir, "fetch", "--quiet", "--no-tags", "--depth=50", "--", url, ref)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !tree.hasCommit(ctx) {
+		return nil, fmt.Errorf("commit %s not found in %s", sha, ref)
+	}
+	return tree, nil
+}
+
+// open locks the mirror for a clone URL, creating it if it doesn't exist, and returns its path
+// and a function to unlock it.
+func (f *Fetcher) open(ctx context.Context, url string) (dir string, unlock func(), err error) {
+	dir = f.mirror(url)
+	unlock = f.lock(dir)
+	defer func() {
+		if err != nil {
+			unlock()
+		}
+	}()
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return dir, unlock, err
+	}
+	if err := os.MkdirAll(f.dir, 0700); err != nil {
+		return "", nil, err
+	}
+	// Initialize the mirror under a temporary name so that a failed init doesn't leave a broken
+	// mirror behind.
+	tmp := dir + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return "", nil, err
+	}
+	if _, err := f.run(ctx, "", "init", "--quiet", "--bare", tmp); err != nil {
+		return "", nil, err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return "", nil, err
+	}
+	return dir, unlock, nil
+}
+
+// run runs git in dir, or the current directory if dir is empty, and returns its output.
+func (f *Fetcher) run(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	name := args[0]
+	if dir != "" {
+		args = append([]string{"--git-dir", dir}, args...)
+	}
+	cmd := exec.CommandContext(ctx, f.git, args...)
+	// Never wait on a password prompt.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, &Error{Cmd: name, Stderr: strings.TrimSpace(stderr.String()), Err: err}
+	}
+	return stdout.Bytes(), nil
+}
+
+// Error is returned when a git command fails. Only the command's name is kept, since its
+// arguments may include a clone URL with credentials.
+type Error struct {
+	Cmd    string // Such as "fetch"
+	Stderr string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	msg := "git " + e.Cmd + ": " + e.Err.Error()
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func validSHA(sha string) bool {
+	if len(sha) != 40 && len(sha) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(sha)
+	return err == nil
+}
+
+// Tree is the tree of a commit in a mirror. It implements ciconfig.Source.
+type Tree struct {
+	f   *Fetcher
+	dir string
+	sha string
+}
+
+// SHA returns the SHA of the tree's commit.
+func (t *Tree) SHA() string {
+	return t.sha
+}
+
+func (t *Tree) hasCommit(ctx context.Context) bool {
+	_, err := t.f.run(ctx, t.dir, "cat-file", "-e", t.sha+"^{commit}")
+	return err == nil
+}
+
+// ReadFile returns the contents of a file in the tree. If the file doesn't exist or isn't a
+// regular file, it returns an error for which os.IsNotExist returns true.
+func (t *Tree) ReadFile(name string) ([]byte, error) {
+	ctx := context.Background()
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	obj := t.sha + ":" + name
+	typ, err := t.f.run(ctx, t.dir, "cat-file", "-t", obj)
+	if err != nil || string(bytes.TrimSpace(typ)) != "blob" {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return t.f.run(ctx, t.dir, "cat-file", "blob", obj)
+}
+
+// Files returns the paths of every file in the tree.
+func (t *Tree) Files() ([]string, error) {
+	out, err := t.f.run(context.Background(), t.dir, "ls-tree", "-r", "-z", "--name-only", t.sha)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name != "" {
+			files = append(files, name)
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,243 @@
+package gitfetch
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.spiff.io/gribble/internal/ciconfig"
+)
+
+var _ ciconfig.Source = (*Tree)(nil)
+
+// testRepo is a git repository to fetch from.
+type testRepo struct {
+	t   *testing.T
+	dir string
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "gribble-repo")
+	if err != nil {
+		t.Fatalf("Error creating repository directory: %v", err)
+	}
+	r := &testRepo{t: t, dir: dir}
+	r.git("init", "--quiet")
+	r.git("symbolic-ref", "HEAD", "refs/heads/main")
+	return r
+}
+
+func (r *testRepo) URL() string {
+	return "file://" + filepath.ToSlash(r.dir)
+}
+
+func (r *testRepo) git(args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commit writes files to the repository and commits them, returning the commit's SHA.
+func (r *testRepo) commit(files map[string]string) string {
+	for name, content := range files {
+		p := filepath.Join(r.dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			r.t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+			r.t.Fatal(err)
+		}
+	}
+	r.git("add", "-A")
+	r.git("commit", "--quiet", "--allow-empty", "-m", "commit")
+	return r.git("rev-parse", "HEAD")
+}
+
+func (r *testRepo) Close() {
+	os.RemoveAll(r.dir)
+}
+
+func newTestFetcher(t *testing.T) (*Fetcher, func()) {
+	dir, err := ioutil.TempDir("", "gribble-mirrors")
+	if err != nil {
+		t.Fatalf("Error creating mirror directory: %v", err)
+	}
+	return New(filepath.Join(dir, "mirrors")), func() { os.RemoveAll(dir) }
+}
+
+func TestFetch(t *testing.T) {
+	repo := newTestRepo(t)
+	defer repo.Close()
+	f, done := newTestFetcher(t)
+	defer done()
+	ctx := context.Background()
+
+	first := repo.commit(map[string]string{
+		".gitlab-ci.yml": "include: ci/test.yml\n",
+		"ci/test.yml":    "test:\n  script: make test\n",
+	})
+	second := repo.commit(map[string]string{"ci/test.yml": "test:\n  script: make check\n"})
+
+	tree, err := f.Fetch(ctx, repo.URL(), "refs/heads/main", first)
+	if err != nil {
+		t.Fatalf("Fetch(%s) = %v; want nil", first, err)
+	}
+	if p, err := tree.ReadFile("ci/test.yml"); err != nil || string(p) != "test:\n  script: make test\n" {
+		t.Errorf("ReadFile(ci/test.yml) = %q, %v; want first commit's file", p, err)
+	}
+	if p, err := tree.ReadFile("/ci/../ci/test.yml"); err != nil || len(p) == 0 {
+		t.Errorf("ReadFile(/ci/../ci/test.yml) = %q, %v; want file", p, err)
+	}
+	for _, name := range []string{"missing.yml", "ci", ""} {
+		if _, err := tree.ReadFile(name); !os.IsNotExist(err) {
+			t.Errorf("ReadFile(%q) = %v; want not exist", name, err)
+		}
+	}
+	files, err := tree.Files()
+	if want := []string{".gitlab-ci.yml", "ci/test.yml"}; err != nil || !reflect.DeepEqual(files, want) {
+		t.Errorf("Files() = %q, %v; want %q", files, err, want)
+	}
+
+	conf, err := ciconfig.Load(tree, ".gitlab-ci.yml")
+	if err != nil || len(conf.Jobs) != 1 || conf.Jobs[0].Name != "test" {
+		t.Fatalf("Load() = %+v, %v; want test job", conf, err)
+	}
+
+	tree, err = f.Fetch(ctx, repo.URL(), "", second)
+	if err != nil {
+		t.Fatalf("Fetch(%s) = %v; want nil", second, err)
+	}
+	if p, err := tree.ReadFile("ci/test.yml"); err != nil || string(p) != "test:\n  script: make check\n" {
+		t.Errorf("ReadFile(ci/test.yml) = %q, %v; want second commit's file", p, err)
+	}
+
+	// Commits already in the mirror are read without fetching.
+	repo.Close()
+	if _, err := f.Fetch(ctx, repo.URL(), "", first); err != nil {
+		t.Errorf("Fetch(%s) from mirror = %v; want nil", first, err)
+	}
+	if _, err := f.Fetch(ctx, repo.URL(), "", strings.Repeat("1", 40)); err == nil {
+		t.Error("Fetch(missing) from removed repository = nil; want error")
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	repo := newTestRepo(t)
+	defer repo.Close()
+	f, done := newTestFetcher(t)
+	defer done()
+	ctx := context.Background()
+	sha := repo.commit(nil)
+
+	for _, sha := range []string{"", "HEAD", "--upload-pack=true", sha[:12]} {
+		if _, err := f.Fetch(ctx, repo.URL(), "", sha); err != ErrInvalidSHA {
+			t.Errorf("Fetch(%q) = %v; want %v", sha, err, ErrInvalidSHA)
+		}
+	}
+
+	missing := strings.Repeat("1", 40)
+	if _, err := f.Fetch(ctx, repo.URL(), "refs/heads/main", missing); err == nil {
+		t.Errorf("Fetch(%s) = nil; want error", missing)
+	}
+	if _, err := f.Fetch(ctx, repo.URL()+"-missing", "", sha); err == nil {
+		t.Errorf("Fetch() from missing repository = nil; want error")
+	} else if _, ok := err.(*Error); !ok {
+		t.Errorf("Fetch() from missing repository = %T; want *Error", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	repo := newTestRepo(t)
+	defer repo.Close()
+	f, done := newTestFetcher(t)
+	defer done()
+	ctx := context.Background()
+
+	before := repo.commit(map[string]string{"README": "readme", "src/a.go": "a", "src/b.go": "b"})
+	repo.git("mv", "src/b.go", "src/c.go")
+	after := repo.commit(map[string]string{"README": "changed"})
+
+	files, err := f.Diff(ctx, repo.URL(), before, after)
+	if want := []string{"README", "src/b.go", "src/c.go"}; err != nil || !reflect.DeepEqual(files, want) {
+		t.Errorf("Diff() = %q, %v; want %q", files, err, want)
+	}
+	files, err = f.Diff(ctx, repo.URL(), after, after)
+	if err != nil || files == nil || len(files) != 0 {
+		t.Errorf("Diff(after, after) = %#v, %v; want empty list", files, err)
+	}
+	if _, err := f.Diff(ctx, repo.URL(), strings.Repeat("1", 40), after); err == nil {
+		t.Error("Diff() from missing commit = nil; want error")
+	}
+}
+
+func TestMergeBase(t *testing.T) {
+	repo := newTestRepo(t)
+	defer repo.Close()
+	f, done := newTestFetcher(t)
+	defer done()
+	ctx := context.Background()
+
+	repo.commit(map[string]string{"a": "1"})
+	base := repo.commit(map[string]string{"a": "2"})
+	repo.git("checkout", "--quiet", "-b", "feature")
+	repo.commit(map[string]string{"b": "1"})
+	head := repo.commit(map[string]string{"b": "2"})
+	repo.git("checkout", "--quiet", "main")
+	for i := 0; i < 3; i++ {
+		repo.commit(map[string]string{"a": strconv.Itoa(i + 3)})
+	}
+
+	// Only the head is in the mirror to begin with.
+	if _, err := f.Fetch(ctx, repo.URL(), "", head); err != nil {
+		t.Fatalf("Fetch(head) = %v; want nil", err)
+	}
+	got, err := f.MergeBase(ctx, repo.URL(), "refs/heads/main", head)
+	if err != nil || got != base {
+		t.Fatalf("MergeBase() = %q, %v; want %q", got, err, base)
+	}
+	files, err := f.Diff(ctx, repo.URL(), got, head)
+	if want := []string{"b"}; err != nil || !reflect.DeepEqual(files, want) {
+		t.Errorf("Diff(merge base, head) = %q, %v; want %q", files, err, want)
+	}
+
+	// Commits with unrelated histories have no merge base.
+	repo.git("checkout", "--quiet", "--orphan", "unrelated")
+	unrelated := repo.commit(map[string]string{"c": "1"})
+	if got, err := f.MergeBase(ctx, repo.URL(), "refs/heads/main", unrelated); err != ErrNoMergeBase {
+		t.Errorf("MergeBase(unrelated) = %q, %v; want %v", got, err, ErrNoMergeBase)
+	}
+	for _, ref := range []string{"", "--upload-pack=true", "main:refs/heads/x"} {
+		if _, err := f.MergeBase(ctx, repo.URL(), ref, head); err == nil {
+			t.Errorf("MergeBase(%q) = nil; want error", ref)
+		}
+	}
+}
+
+func TestDefaultBranch(t *testing.T) {
+	repo := newTestRepo(t)
+	defer repo.Close()
+	f, done := newTestFetcher(t)
+	defer done()
+	repo.commit(nil)
+
+	if got, err := f.DefaultBranch(context.Background(), repo.URL()); err != nil || got != "main" {
+		t.Errorf("DefaultBranch() = %q, %v; want main", got, err)
+	}
+}
@@ -0,0 +1,262 @@
+package sqlite
+
+import (
+	"context"
+	"time"
+
+	"crawshaw.io/sqlite"
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+	"go.spiff.io/gribble/internal/proc"
+)
+
+// CreateArtifact records an uploaded artifact. An existing artifact of the same type for the same
+// job is replaced.
+func (db *DB) CreateArtifact(ctx context.Context, artifact *com.Artifact) error {
+	if err := artifact.CanCreate(); err != nil {
+		return err
+	}
+
+	conn := db.get(ctx)
+	if conn == nil {
+		return ErrNoConnection
+	}
+	defer db.put(conn)
+
+	stmt := conn.Prep(`INSERT INTO
+		artifacts(job, type, format, filename, size, sha256, key, expire_in, expire_time, created_time)
+		VALUES($job, $type, $format, $filename, $size, $sha256, $key, $expire_in, $expire_time, $created_time)`)
+	defer stmt.Reset()
+
+	updated := *artifact
+	updated.Created = proc.Now(ctx)
+
+	stmt.SetInt64("$job", updated.Job)
+	stmt.SetText("$type", updated.Type)
+	stmt.SetText("$format", string(updated.Format))
+	stmt.SetText("$filename", updated.Filename)
+	stmt.SetInt64("$size", updated.Size)
+	stmt.SetText("$sha256", updated.SHA256)
+	stmt.SetText("$key", updated.Key)
+	stmt.SetText("$expire_in", updated.ExpireIn)
+	stmt.SetFloat("$expire_time", ToSecs(updated.Expires))
+	stmt.SetFloat("$created_time", ToSecs(updated.Created))
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+
+	updated.ID = conn.LastInsertRowID()
+	*artifact = updated
+	return nil
+}
+
+// artifactColumns is the list of columns read by readArtifact.
+const artifactColumns = `id, job, type, format, filename, size, sha256, key, expire_in, expire_time,
+	created_time`
+
+// readArtifact reads an artifact from the current row of a statement selecting artifactColumns.
+func readArtifact(stmt *sqlite.Stmt) *com.Artifact {
+	return &com.Artifact{
+		ID:       stmt.GetInt64("id"),
+		Job:      stmt.GetInt64("job"),
+		Type:     stmt.GetText("type"),
+		Format:   gciwire.ArtifactFormat(stmt.GetText("format")),
+		Filename: stmt.GetText("filename"),
+		Size:     stmt.GetInt64("size"),
+		SHA256:   stmt.GetText("sha256"),
+		Key:      stmt.GetText("key"),
+		ExpireIn: stmt.GetText("expire_in"),
+		Expires:  FromSecs(stmt.GetFloat("expire_time")),
+		Created:  FromSecs(stmt.GetFloat("created_time")),
+	}
+}
+
+// GetJobArtifacts returns the artifacts uploaded by a job.
+func (db *DB) GetJobArtifacts(ctx context.Context, job int64) ([]*com.Artifact, error) {
+	conn := db.get(ctx)
+	if conn == nil {
+		return nil, ErrNoConnection
+	}
+	defer db.put(conn)
+
+	get := conn.Prep(`SELECT ` + artifactColumns + ` FROM artifacts WHERE job = $job ORDER BY id`)
+	get.SetInt64("$job", job)
+
+	var artifacts []*com.Artifact
+	err := eachRow(ctx, get, func() error {
+		artifacts = append(artifacts, readArtifact(get))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return artifacts, nil
+}
+
+// GetArtifact returns a job's artifact of the given type.
+func (db *DB) GetArtifact(ctx context.Context, job int64, typ string) (*com.Artifact, error) {
+	conn := db.get(ctx)
+	if conn == nil {
+		return nil, ErrNoConnection
+	}
+	defer db.put(conn)
+
+	get := conn.Prep(`SELECT ` + artifactColumns + ` FROM artifacts WHERE job = $job AND type = $type`)
+	defer get.Reset()
+	get.SetInt64("$job", job)
+	get.SetText("$type", typ)
+	if haveRows, err := get.Step(); err != nil {
+		return nil, err
+	} else if !haveRows {
+		return nil, com.ErrNotFound
+	}
+	return readArtifact(get), nil
+}
+
+// GetArtifactDependencies returns the artifact archives of jobs that the given job depends on and
+// fetches artifacts from.
+func (db *DB) GetArtifactDependencies(ctx context.Context, job int64) ([]com.ArtifactDependency, error) {
+	conn := db.get(ctx)
+	if conn == nil {
+		return nil, ErrNoConnection
+	}
+	defer db.put(conn)
+
+	get := conn.Prep(`SELECT
+			job_depends.src AS src,
+			json_extract(jobs.spec, '$.gitlab.job_info.name') AS name,
+			artifacts.filename AS filename,
+			artifacts.size AS size
+		FROM job_depends
+		INNER JOIN jobs ON jobs.id = job_depends.src
+		INNER JOIN artifacts ON artifacts.job = job_depends.src AND artifacts.type = $type
+		WHERE job_depends.dest = $job AND job_depends.fetch_artifacts
+		ORDER BY job_depends.src`)
+	get.SetInt64("$job", job)
+	get.SetText("$type", com.ArtifactArchive)
+
+	var deps []com.ArtifactDependency
+	err := eachRow(ctx, get, func() error {
+		deps = append(deps, com.ArtifactDependency{
+			Job:      get.GetInt64("src"),
+			JobName:  get.GetText("name"),
+			Filename: get.GetText("filename"),
+			Size:     get.GetInt64("size"),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deps, nil
+}
+
+// CanFetchArtifacts returns true if the running job whose token hash is tokenHash depends on and
+// fetches artifacts from the job src.
+func (db *DB) CanFetchArtifacts(ctx context.Context, src int64, tokenHash string) (bool, error) {
+	if tokenHash == "" {
+		return false, nil
+	}
+
+	conn := db.get(ctx)
+	if conn == nil {
+		return false, ErrNoConnection
+	}
+	defer db.put(conn)
+
+	get := conn.Prep(`SELECT COUNT(*) AS found
+		FROM job_depends
+		INNER JOIN jobs ON jobs.id = job_depends.dest
+		WHERE job_depends.src = $src
+			AND job_depends.fetch_artifacts
+			AND jobs.token_hash = $token_hash
+			AND jobs.state = $running`)
+	defer get.Reset()
+	get.SetInt64("$src", src)
+	get.SetText("$token_hash", tokenHash)
+	get.SetText("$running", string(gciwire.Running))
+	if _, err := get.Step(); err != nil {
+		return false, err
+	}
+	return get.GetInt64("found") > 0, nil
+}
+
+// latestSuccessfulPipelines is a common table expression selecting the newest successful pipeline
+// of each project's refs. A pipeline is successful if its status, as derived by
+// com.PipelineStatus, is success: none of its jobs are unfinished other than optional manual jobs,
+// none failed without being allowed to, and not all of them were skipped. Its job states are bound
+// by setPipelineStates.
+const latestSuccessfulPipelines = `successful_pipelines AS (
+		SELECT pipelines.id AS id, pipelines.project AS project, pipelines.ref AS ref
+		FROM pipelines
+		INNER JOIN jobs ON jobs.pipeline = pipelines.id
+		GROUP BY pipelines.id
+		HAVING SUM(jobs.state IN ($created, $pending, $running)
+				OR jobs.state = $manual AND NOT jobs.allow_failure) = 0
+			AND SUM(jobs.state = $failed AND NOT jobs.allow_failure) = 0
+			AND SUM(jobs.state <> $skipped AND NOT (jobs.state = $manual AND jobs.allow_failure)) > 0
+	),
+	latest_pipelines AS (
+		SELECT MAX(id) AS id FROM successful_pipelines GROUP BY project, ref
+	)`
+
+// setPipelineStates binds the job states used by latestSuccessfulPipelines.
+func setPipelineStates(stmt *sqlite.Stmt) {
+	stmt.SetText("$created", string(com.JobCreated))
+	stmt.SetText("$pending", string(gciwire.Pending))
+	stmt.SetText("$running", string(gciwire.Running))
+	stmt.SetText("$manual", string(com.JobManual))
+	stmt.SetText("$failed", string(gciwire.Failed))
+	stmt.SetText("$skipped", string(com.JobSkipped))
+}
+
+// GetExpiredArtifacts returns artifacts that expired at or before the given time. If keepLatest is
+// true, artifacts belonging to the newest successful pipeline of each ref are not returned.
+func (db *DB) GetExpiredArtifacts(ctx context.Context, now time.Time, keepLatest bool) ([]*com.Artifact, error) {
+	conn := db.get(ctx)
+	if conn == nil {
+		return nil, ErrNoConnection
+	}
+	defer db.put(conn)
+
+	get := conn.Prep(`WITH ` + latestSuccessfulPipelines + `
+		SELECT ` + artifactColumns + ` FROM artifacts
+		WHERE expire_time > 0 AND expire_time <= $now
+			AND NOT ($keep_latest AND job IN (
+				SELECT jobs.id FROM jobs
+				INNER JOIN latest_pipelines ON latest_pipelines.id = jobs.pipeline
+			))
+		ORDER BY expire_time`)
+	get.SetFloat("$now", ToSecs(now))
+	get.SetInt64("$keep_latest", btoi(keepLatest))
+	setPipelineStates(get)
+
+	var artifacts []*com.Artifact
+	err := eachRow(ctx, get, func() error {
+		artifacts = append(artifacts, readArtifact(get))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return artifacts, nil
+}
+
+// DeleteArtifact removes an artifact's record. It does not delete the artifact's blob.
+func (db *DB) DeleteArtifact(ctx context.Context, artifact *com.Artifact) error {
+	if artifact.ID <= 0 {
+		return com.ErrNoID
+	}
+
+	conn := db.get(ctx)
+	if conn == nil {
+		return ErrNoConnection
+	}
+	defer db.put(conn)
+
+	del := conn.Prep(`DELETE FROM artifacts WHERE id = $id`)
+	defer del.Reset()
+	del.SetInt64("$id", artifact.ID)
+	_, err := del.Step()
+	return err
+}
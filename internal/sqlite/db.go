@@ -170,6 +170,29 @@ func (db *DB) SetRunnerUpdatedTime(ctx context.Context, runner *com.Runner, t ti
 	return nil
 }
 
+func (db *DB) SetRunnerFeatures(ctx context.Context, runner *com.Runner, features com.Feature) error {
+	if runner.ID <= 0 {
+		return com.ErrNoID
+	}
+
+	conn := db.get(ctx)
+	if conn == nil {
+		return ErrNoConnection
+	}
+	defer db.put(conn)
+
+	set := conn.Prep(`UPDATE runners SET features = $features WHERE id = $runner`)
+	defer set.Reset()
+	set.SetInt64("$features", int64(features))
+	set.SetInt64("$runner", runner.ID)
+	if _, err := set.Step(); err != nil {
+		return err
+	}
+
+	runner.Features = features
+	return nil
+}
+
 func (db *DB) GetRunnerByToken(ctx context.Context, token string, getDeleted bool) (*com.Runner, error) {
 	conn := db.get(ctx)
 	if conn == nil {
@@ -179,7 +202,7 @@ func (db *DB) GetRunnerByToken(ctx context.Context, token string, getDeleted boo
 
 	get := conn.Prep(
 		`SELECT
-			id, description, run_untagged, locked, active, max_timeout, deleted
+			id, description, run_untagged, locked, active, max_timeout, features, deleted
 		FROM runners
 		WHERE token = $token
 		LIMIT 1`)
@@ -207,6 +230,7 @@ func (db *DB) GetRunnerByToken(ctx context.Context, token string, getDeleted boo
 		Locked:      itob(get.GetInt64("locked")),
 		Active:      itob(get.GetInt64("active")),
 		MaxTimeout:  itod(get.GetInt64("max_timeout")),
+		Features:    com.Feature(get.GetInt64("features")),
 		Deleted:     deleted,
 		Created:     FromSecs(get.GetFloat("created_time")),
 		Updated:     FromSecs(get.GetFloat("updated_time")),
@@ -251,8 +275,8 @@ func (db *DB) GetRunnerTags(ctx context.Context, runner *com.Runner) error {
 
 func createRunner(ctx context.Context, conn *sqlite.Conn, runner *com.Runner) error {
 	stmt := conn.Prep(`INSERT INTO
-		runners(token, description, run_untagged, locked, max_timeout, active, created_time, updated_time)
-		VALUES($token, $description, $run_untagged, $locked, $max_timeout, $active, $created_time, $updated_time)`)
+		runners(token, description, run_untagged, locked, max_timeout, features, active, created_time, updated_time)
+		VALUES($token, $description, $run_untagged, $locked, $max_timeout, $features, $active, $created_time, $updated_time)`)
 	defer stmt.Reset()
 
 	t := proc.Now(ctx)
@@ -266,6 +290,7 @@ func createRunner(ctx context.Context, conn *sqlite.Conn, runner *com.Runner) er
 	stmt.SetInt64("$locked", btoi(updated.Locked))
 	stmt.SetInt64("$active", btoi(updated.Active))
 	stmt.SetInt64("$max_timeout", dtoi(updated.MaxTimeout))
+	stmt.SetInt64("$features", int64(updated.Features))
 	stmt.SetFloat("$created_time", ToSecs(updated.Created))
 	stmt.SetFloat("$updated_time", ToSecs(updated.Updated))
 	_, err := stmt.Step()
@@ -0,0 +1,226 @@
+package sqlite
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"crawshaw.io/sqlite"
+	com "go.spiff.io/gribble/internal/common"
+	"go.spiff.io/gribble/internal/proc"
+)
+
+// CreateWebhookDelivery records a pending webhook delivery. If the delivery has a delivery ID and
+// a delivery with the same source and ID was already handled, it returns com.ErrDuplicate.
+// Replays are never duplicates.
+func (db *DB) CreateWebhookDelivery(ctx context.Context, d *com.WebhookDelivery) error {
+	if err := d.CanCreate(); err != nil {
+		return err
+	}
+	header, err := json.Marshal(d.Header)
+	if err != nil {
+		return err
+	}
+
+	conn := db.get(ctx)
+	if conn == nil {
+		return ErrNoConnection
+	}
+	defer db.put(conn)
+
+	return db.savepoint(ctx, conn, func() error {
+		if d.DeliveryID != "" && d.ReplayOf == 0 {
+			find := conn.Prep(`SELECT result FROM webhook_deliveries
+				WHERE source = $source AND delivery_id = $delivery_id`)
+			find.SetText("$source", d.Source)
+			find.SetText("$delivery_id", d.DeliveryID)
+			duplicate := false
+			err := eachRow(ctx, find, func() error {
+				duplicate = duplicate || com.WebhookResult(find.GetText("result")).Handled()
+				return nil
+			})
+			if err != nil {
+				return err
+			} else if duplicate {
+				return com.ErrDuplicate
+			}
+		}
+
+		stmt := conn.Prep(`INSERT INTO
+			webhook_deliveries(source, delivery_id, event, query, headers, body, result, replay_of, created_time, updated_time)
+			VALUES ($source, $delivery_id, $event, $query, $headers, $body, $result, $replay_of, $created_time, $created_time)`)
+		defer stmt.Reset()
+
+		updated := *d
+		updated.Result = com.WebhookPending
+		updated.ResponseCode = 0
+		updated.Created = proc.Now(ctx)
+		updated.Updated = updated.Created
+
+		stmt.SetText("$source", updated.Source)
+		stmt.SetText("$delivery_id", updated.DeliveryID)
+		stmt.SetText("$event", updated.Event)
+		stmt.SetText("$query", updated.Query)
+		stmt.SetText("$headers", string(header))
+		stmt.SetBytes("$body", updated.Body)
+		stmt.SetText("$result", string(updated.Result))
+		if updated.ReplayOf == 0 {
+			stmt.SetNull("$replay_of")
+		} else {
+			stmt.SetInt64("$replay_of", updated.ReplayOf)
+		}
+		stmt.SetFloat("$created_time", ToSecs(updated.Created))
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+
+		updated.ID = conn.LastInsertRowID()
+		*d = updated
+		return nil
+	})
+}
+
+// SetWebhookDeliveryResult records the result of handling a webhook delivery and the response
+// code sent for it.
+func (db *DB) SetWebhookDeliveryResult(ctx context.Context, d *com.WebhookDelivery, result com.WebhookResult, code int) error {
+	if d == nil {
+		return com.ErrNil
+	} else if d.ID == 0 {
+		return com.ErrNoID
+	}
+
+	conn := db.get(ctx)
+	if conn == nil {
+		return ErrNoConnection
+	}
+	defer db.put(conn)
+
+	now := proc.Now(ctx)
+	stmt := conn.Prep(`UPDATE webhook_deliveries
+		SET result = $result, response_code = $response_code, updated_time = $updated_time
+		WHERE id = $id`)
+	defer stmt.Reset()
+	stmt.SetInt64("$id", d.ID)
+	stmt.SetText("$result", string(result))
+	stmt.SetInt64("$response_code", int64(code))
+	stmt.SetFloat("$updated_time", ToSecs(now))
+	if _, err := stmt.Step(); err != nil {
+		return err
+	} else if conn.Changes() == 0 {
+		return com.ErrNotFound
+	}
+
+	d.Result, d.ResponseCode, d.Updated = result, code, now
+	return nil
+}
+
+// TruncateWebhookDelivery discards all but the first size bytes of a webhook delivery's body.
+func (db *DB) TruncateWebhookDelivery(ctx context.Context, d *com.WebhookDelivery, size int) error {
+	if d == nil {
+		return com.ErrNil
+	} else if d.ID == 0 {
+		return com.ErrNoID
+	}
+
+	conn := db.get(ctx)
+	if conn == nil {
+		return ErrNoConnection
+	}
+	defer db.put(conn)
+
+	stmt := conn.Prep(`UPDATE webhook_deliveries SET body = substr(body, 1, $size)
+		WHERE id = $id AND length(body) > $size`)
+	defer stmt.Reset()
+	stmt.SetInt64("$id", d.ID)
+	stmt.SetInt64("$size", int64(size))
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+
+	if len(d.Body) > size {
+		d.Body = d.Body[:size]
+	}
+	return nil
+}
+
+// deliveryColumns is the list of columns read by readWebhookDelivery, other than body.
+const deliveryColumns = `id, source, delivery_id, event, query, headers, result, response_code,
+	replay_of, created_time, updated_time,
+	(SELECT json_group_array(p.id) FROM pipelines p WHERE p.delivery = webhook_deliveries.id) AS pipelines`
+
+// readWebhookDelivery reads a webhook delivery from the current row of a statement selecting
+// deliveryColumns. Its body is only read if withBody is true.
+func readWebhookDelivery(stmt *sqlite.Stmt, withBody bool) (*com.WebhookDelivery, error) {
+	d := &com.WebhookDelivery{
+		ID:           stmt.GetInt64("id"),
+		Source:       stmt.GetText("source"),
+		DeliveryID:   stmt.GetText("delivery_id"),
+		Event:        stmt.GetText("event"),
+		Query:        stmt.GetText("query"),
+		Header:       http.Header{},
+		ReplayOf:     stmt.GetInt64("replay_of"),
+		Result:       com.WebhookResult(stmt.GetText("result")),
+		ResponseCode: int(stmt.GetInt64("response_code")),
+		Created:      FromSecs(stmt.GetFloat("created_time")),
+		Updated:      FromSecs(stmt.GetFloat("updated_time")),
+	}
+	if withBody {
+		d.Body = make([]byte, stmt.GetLen("body"))
+		stmt.GetBytes("body", d.Body)
+	}
+	if err := json.Unmarshal([]byte(stmt.GetText("headers")), &d.Header); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(stmt.GetText("pipelines")), &d.Pipelines); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (db *DB) GetWebhookDelivery(ctx context.Context, id int64) (*com.WebhookDelivery, error) {
+	conn := db.get(ctx)
+	if conn == nil {
+		return nil, ErrNoConnection
+	}
+	defer db.put(conn)
+
+	get := conn.Prep(`SELECT ` + deliveryColumns + `, body FROM webhook_deliveries WHERE id = $id`)
+	defer get.Reset()
+	get.SetInt64("$id", id)
+	if haveRows, err := get.Step(); err != nil {
+		return nil, err
+	} else if !haveRows {
+		return nil, com.ErrNotFound
+	}
+	return readWebhookDelivery(get, true)
+}
+
+// GetWebhookDeliveries returns up to limit of the most recent webhook deliveries, newest first,
+// without their bodies. If source is not empty, only deliveries from that source are returned.
+func (db *DB) GetWebhookDeliveries(ctx context.Context, source string, limit int) ([]*com.WebhookDelivery, error) {
+	conn := db.get(ctx)
+	if conn == nil {
+		return nil, ErrNoConnection
+	}
+	defer db.put(conn)
+
+	stmt := conn.Prep(`SELECT ` + deliveryColumns + ` FROM webhook_deliveries
+		WHERE $source = '' OR source = $source
+		ORDER BY id DESC LIMIT $limit`)
+	stmt.SetText("$source", source)
+	stmt.SetInt64("$limit", int64(limit))
+
+	var deliveries []*com.WebhookDelivery
+	err := eachRow(ctx, stmt, func() error {
+		d, err := readWebhookDelivery(stmt, false)
+		if err != nil {
+			return err
+		}
+		deliveries = append(deliveries, d)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,676 @@
+package sqlite
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"crawshaw.io/sqlite"
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+	"go.spiff.io/gribble/internal/proc"
+)
+
+// CreateJob creates a job and records the jobs it depends on. Unless it's given a state, the job
+// is created waiting on the jobs it depends on and is released once they finish, which may be
+// immediately.
+func (db *DB) CreateJob(ctx context.Context, job *com.Job) error {
+	if err := job.CanCreate(); err != nil {
+		return err
+	}
+	conn := db.get(ctx)
+	if conn == nil {
+		return ErrNoConnection
+	}
+	defer db.put(conn)
+
+	updated := *job
+	err := db.savepoint(ctx, conn, func() error {
+		if err := createJob(ctx, conn, &updated); err != nil {
+			return err
+		}
+		return releaseCreated(ctx, conn, []*com.Job{&updated})
+	})
+	if err != nil {
+		return err
+	}
+	*job = updated
+	return nil
+}
+
+// createJobs creates jobs in order, resolving dependencies on jobs earlier in the list through
+// their Src. The jobs are added to the pipeline if it's non-zero. None of the jobs are released,
+// so that no job can run before the rest have been created. The created jobs are returned in the
+// same order as jobs, which are left unmodified.
+func createJobs(ctx context.Context, conn *sqlite.Conn, pipeline int64, jobs []*com.Job) ([]*com.Job, error) {
+	ids := make(map[*com.Job]int64, len(jobs))
+	created := make([]*com.Job, len(jobs))
+	for i, job := range jobs {
+		if err := job.CanCreate(); err != nil {
+			return nil, err
+		}
+		updated := *job
+		if pipeline != 0 {
+			updated.Pipeline = pipeline
+		}
+		updated.Depends = make([]com.JobDependency, len(job.Depends))
+		for j, dep := range job.Depends {
+			if dep.Src != nil {
+				id, ok := ids[dep.Src]
+				if !ok {
+					return nil, errors.New("job depends on a job not created before it")
+				}
+				dep.Job, dep.Src = id, nil
+			}
+			updated.Depends[j] = dep
+		}
+		if err := createJob(ctx, conn, &updated); err != nil {
+			return nil, err
+		}
+		ids[job] = updated.ID
+		created[i] = &updated
+	}
+	return created, nil
+}
+
+// releaseCreated releases jobs just created by createJob and reads back their state.
+func releaseCreated(ctx context.Context, conn *sqlite.Conn, jobs []*com.Job) error {
+	for _, job := range jobs {
+		if job.State != com.JobCreated {
+			continue
+		}
+		if err := releaseJob(ctx, conn, job.ID); err != nil {
+			return err
+		}
+	}
+
+	get := conn.Prep(`SELECT stuck, state, finished_time FROM jobs WHERE id = $job`)
+	defer get.Reset()
+	for _, job := range jobs {
+		get.SetInt64("$job", job.ID)
+		if _, err := get.Step(); err != nil {
+			return err
+		}
+		job.Stuck = itob(get.GetInt64("stuck"))
+		job.State = gciwire.JobState(get.GetText("state"))
+		job.Finished = FromSecs(get.GetFloat("finished_time"))
+		if err := get.Reset(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createJob(ctx context.Context, conn *sqlite.Conn, job *com.Job) error {
+	spec, err := json.Marshal(job.Spec)
+	if err != nil {
+		return err
+	}
+
+	stmt := conn.Prep(`INSERT INTO
+		jobs(project, pipeline, features, state, spec, run_when, allow_failure, dag, plan, plan_depth, created_time)
+		VALUES($project, $pipeline, $features, $state, $spec, $run_when, $allow_failure, $dag, $plan, $plan_depth,
+			$created_time)`)
+	defer stmt.Reset()
+
+	updated := *job
+	updated.Created = proc.Now(ctx)
+	updated.Features |= updated.Spec.RequiredFeatures()
+	if updated.State == "" {
+		updated.State = com.JobCreated
+	}
+	if updated.When == "" {
+		updated.When = com.WhenOnSuccess
+	}
+	updated.Depends = nil
+
+	stmt.SetInt64("$project", updated.Project)
+	if updated.Pipeline == 0 {
+		stmt.SetNull("$pipeline")
+	} else {
+		stmt.SetInt64("$pipeline", updated.Pipeline)
+	}
+	stmt.SetInt64("$features", int64(updated.Features))
+	stmt.SetText("$state", string(updated.State))
+	stmt.SetText("$spec", string(spec))
+	stmt.SetText("$run_when", string(updated.When))
+	stmt.SetInt64("$allow_failure", btoi(updated.AllowFailure))
+	stmt.SetInt64("$dag", btoi(updated.DAG))
+	stmt.SetInt64("$plan", btoi(updated.Plan))
+	stmt.SetInt64("$plan_depth", int64(updated.PlanDepth))
+	stmt.SetFloat("$created_time", ToSecs(updated.Created))
+	if _, err = stmt.Step(); err != nil {
+		return err
+	}
+
+	updated.ID = conn.LastInsertRowID()
+
+	link := conn.Prep(`INSERT OR IGNORE INTO job_tags(tag, job) VALUES ($tag, $job)`)
+	defer link.Reset()
+	for _, tag := range job.Tags {
+		id, err := ensureTag(conn, tag)
+		if err != nil {
+			return err
+		}
+		link.SetInt64("$job", updated.ID)
+		link.SetInt64("$tag", id)
+		if _, err = link.Step(); err != nil {
+			return err
+		}
+		link.Reset()
+	}
+
+	for _, dep := range job.Depends {
+		src := dep.Job
+		if dep.Src != nil {
+			src = dep.Src.ID
+		}
+		if err = addJobDependency(conn, updated.ID, src, dep.FetchArtifacts); err != nil {
+			return err
+		}
+	}
+	stuck := conn.Prep(`UPDATE jobs SET stuck = NOT ` + haveCapableRunner + ` WHERE id = $job`)
+	defer stuck.Reset()
+	stuck.SetInt64("$job", updated.ID)
+	if _, err = stuck.Step(); err != nil {
+		return err
+	}
+
+	*job = updated
+	return nil
+}
+
+// haveCapableRunner is an SQL expression that is true if there is an active runner with all of the
+// features required by the job in the current row of the jobs table.
+const haveCapableRunner = `EXISTS (
+	SELECT 1 FROM runners
+	WHERE runners.active AND NOT runners.deleted
+		AND (jobs.features & ~runners.features) = 0
+)`
+
+// UpdateStuckJobs marks pending jobs as stuck if there are no runners with the features they
+// require, and clears the stuck flag from jobs that can now run. It returns the IDs of jobs that
+// became stuck.
+func (db *DB) UpdateStuckJobs(ctx context.Context) (stuck []int64, err error) {
+	conn := db.get(ctx)
+	if conn == nil {
+		return nil, ErrNoConnection
+	}
+	defer db.put(conn)
+
+	err = db.savepoint(ctx, conn, func() error {
+		get := conn.Prep(`SELECT id FROM jobs WHERE state = $pending AND NOT stuck AND NOT ` + haveCapableRunner)
+		get.SetText("$pending", string(gciwire.Pending))
+		err := eachRow(ctx, get, func() error {
+			stuck = append(stuck, get.GetInt64("id"))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		set := conn.Prep(`UPDATE jobs SET stuck = NOT ` + haveCapableRunner + ` WHERE state = $pending`)
+		defer set.Reset()
+		set.SetText("$pending", string(gciwire.Pending))
+		_, err = set.Step()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stuck, nil
+}
+
+// ClaimJob assigns the oldest pending job the runner is able to run to the runner and marks it as
+// running. A job can be run by a runner if the runner has all of the job's tags and features.
+// Untagged jobs are only given to runners that run untagged jobs.
+//
+// The claimed job's token hash is set to tokenHash. If there are no jobs available to the runner,
+// ClaimJob returns com.ErrNotFound.
+func (db *DB) ClaimJob(ctx context.Context, runner *com.Runner, tokenHash string) (*com.Job, error) {
+	if runner.ID <= 0 {
+		return nil, com.ErrNoID
+	}
+
+	conn := db.get(ctx)
+	if conn == nil {
+		return nil, ErrNoConnection
+	}
+	defer db.put(conn)
+
+	var job *com.Job
+	err := db.savepoint(ctx, conn, func() (err error) {
+		job, err = claimJob(ctx, conn, runner, tokenHash)
+		return err
+	})
+	return job, err
+}
+
+func claimJob(ctx context.Context, conn *sqlite.Conn, runner *com.Runner, tokenHash string) (*com.Job, error) {
+	get := conn.Prep(`SELECT ` + jobColumns + `
+		FROM jobs
+		WHERE state = $pending
+			AND NOT EXISTS (
+				SELECT 1 FROM job_tags
+				WHERE job_tags.job = jobs.id
+					AND job_tags.tag NOT IN (SELECT tag FROM runner_tags WHERE runner = $runner)
+			)
+			AND ($run_untagged OR EXISTS (SELECT 1 FROM job_tags WHERE job_tags.job = jobs.id))
+			AND (features & ~$features) = 0
+		ORDER BY id
+		LIMIT 1`)
+	defer get.Reset()
+
+	get.SetText("$pending", string(gciwire.Pending))
+	get.SetInt64("$runner", runner.ID)
+	get.SetInt64("$run_untagged", btoi(runner.RunUntagged))
+	get.SetInt64("$features", int64(runner.Features))
+	if haveRows, err := get.Step(); err != nil {
+		return nil, err
+	} else if !haveRows {
+		return nil, com.ErrNotFound
+	}
+
+	job, err := readJob(get)
+	if err != nil {
+		return nil, err
+	}
+	if err := get.Reset(); err != nil {
+		return nil, err
+	}
+	job.Runner = runner.ID
+	job.State = gciwire.Running
+	job.Stuck = false
+	job.TokenHash = tokenHash
+
+	claim := conn.Prep(`UPDATE jobs
+		SET state = $running, runner = $runner, stuck = 0, token_hash = $token_hash
+		WHERE id = $job AND state = $pending`)
+	defer claim.Reset()
+	claim.SetText("$token_hash", tokenHash)
+	claim.SetText("$running", string(gciwire.Running))
+	claim.SetText("$pending", string(gciwire.Pending))
+	claim.SetInt64("$runner", runner.ID)
+	claim.SetInt64("$job", job.ID)
+	if _, err := claim.Step(); err != nil {
+		return nil, err
+	} else if conn.Changes() != 1 {
+		return nil, com.ErrNotFound
+	}
+
+	if err := getJobTags(ctx, conn, job); err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// jobColumns is the list of columns read by readJob.
+const jobColumns = `id, runner, project, pipeline, features, stuck, state, spec, token_hash, failure_reason,
+	run_when, allow_failure, dag, plan, plan_depth, created_time, finished_time`
+
+// readJob reads a job from the current row of a statement selecting jobColumns.
+func readJob(stmt *sqlite.Stmt) (*com.Job, error) {
+	job := &com.Job{
+		ID:            stmt.GetInt64("id"),
+		Runner:        stmt.GetInt64("runner"),
+		Project:       stmt.GetInt64("project"),
+		Pipeline:      stmt.GetInt64("pipeline"),
+		State:         gciwire.JobState(stmt.GetText("state")),
+		Features:      com.Feature(stmt.GetInt64("features")),
+		Stuck:         itob(stmt.GetInt64("stuck")),
+		Spec:          new(com.JobSpec),
+		TokenHash:     stmt.GetText("token_hash"),
+		FailureReason: gciwire.JobFailureReason(stmt.GetText("failure_reason")),
+		Created:       FromSecs(stmt.GetFloat("created_time")),
+		Finished:      FromSecs(stmt.GetFloat("finished_time")),
+		When:          com.JobWhen(stmt.GetText("run_when")),
+		AllowFailure:  itob(stmt.GetInt64("allow_failure")),
+		DAG:           itob(stmt.GetInt64("dag")),
+		Plan:          itob(stmt.GetInt64("plan")),
+		PlanDepth:     int(stmt.GetInt64("plan_depth")),
+	}
+	if spec := stmt.GetText("spec"); spec == "" {
+		// nop
+	} else if err := json.Unmarshal([]byte(spec), job.Spec); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (db *DB) GetJob(ctx context.Context, id int64) (*com.Job, error) {
+	conn := db.get(ctx)
+	if conn == nil {
+		return nil, ErrNoConnection
+	}
+	defer db.put(conn)
+	return getJob(ctx, conn, id)
+}
+
+func getJob(ctx context.Context, conn *sqlite.Conn, id int64) (*com.Job, error) {
+	get := conn.Prep(`SELECT ` + jobColumns + ` FROM jobs WHERE id = $job`)
+	defer get.Reset()
+	get.SetInt64("$job", id)
+	if haveRows, err := get.Step(); err != nil {
+		return nil, err
+	} else if !haveRows {
+		return nil, com.ErrNotFound
+	}
+
+	job, err := readJob(get)
+	if err != nil {
+		return nil, err
+	}
+	if err = get.Reset(); err != nil {
+		return nil, err
+	}
+	if err = getJobTags(ctx, conn, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// AddJobDependency records that the job dest depends on the job src. If fetchArtifacts is true,
+// dest is given src's artifacts when it runs. The src job must have been created before dest.
+func (db *DB) AddJobDependency(ctx context.Context, dest, src int64, fetchArtifacts bool) error {
+	if dest <= 0 || src <= 0 {
+		return com.ErrNoID
+	}
+
+	conn := db.get(ctx)
+	if conn == nil {
+		return ErrNoConnection
+	}
+	defer db.put(conn)
+	return addJobDependency(conn, dest, src, fetchArtifacts)
+}
+
+func addJobDependency(conn *sqlite.Conn, dest, src int64, fetchArtifacts bool) error {
+	link := conn.Prep(`INSERT INTO job_depends(dest, src, fetch_artifacts) VALUES ($dest, $src, $fetch_artifacts)
+		ON CONFLICT (src, dest) DO UPDATE SET fetch_artifacts = excluded.fetch_artifacts`)
+	defer link.Reset()
+	link.SetInt64("$dest", dest)
+	link.SetInt64("$src", src)
+	link.SetInt64("$fetch_artifacts", btoi(fetchArtifacts))
+	_, err := link.Step()
+	return err
+}
+
+// SetJobState moves the job from its current state to the given state and records the failure
+// reason. If the new state is a finished state, the job's finish time is set, its token is
+// cleared, and the jobs waiting on it are released. If the job's state in the database is no
+// longer job.State, SetJobState returns com.ErrConflict.
+func (db *DB) SetJobState(ctx context.Context, job *com.Job, state gciwire.JobState, reason gciwire.JobFailureReason) error {
+	if job.ID <= 0 {
+		return com.ErrNoID
+	}
+
+	conn := db.get(ctx)
+	if conn == nil {
+		return ErrNoConnection
+	}
+	defer db.put(conn)
+
+	updated := *job
+	updated.State = state
+	updated.FailureReason = reason
+	if com.IsFinished(state) {
+		updated.Finished = proc.Now(ctx)
+		updated.TokenHash = ""
+	}
+
+	err := db.savepoint(ctx, conn, func() error {
+		return setJobState(ctx, conn, job, &updated)
+	})
+	if err != nil {
+		return err
+	}
+
+	*job = updated
+	return nil
+}
+
+func setJobState(ctx context.Context, conn *sqlite.Conn, job, updated *com.Job) error {
+	set := conn.Prep(`UPDATE jobs
+		SET state = $state, failure_reason = $reason, finished_time = $finished_time, token_hash = $token_hash
+		WHERE id = $job AND state = $from`)
+	defer set.Reset()
+	set.SetText("$state", string(updated.State))
+	set.SetText("$from", string(job.State))
+	set.SetText("$reason", string(updated.FailureReason))
+	set.SetFloat("$finished_time", ToSecs(updated.Finished))
+	if updated.TokenHash == "" {
+		set.SetNull("$token_hash")
+	} else {
+		set.SetText("$token_hash", updated.TokenHash)
+	}
+	set.SetInt64("$job", job.ID)
+	if _, err := set.Step(); err != nil {
+		return err
+	} else if conn.Changes() != 1 {
+		return com.ErrConflict
+	}
+	if err := set.Reset(); err != nil {
+		return err
+	}
+
+	if com.IsFinished(updated.State) {
+		return releaseDependents(ctx, conn, job.ID)
+	}
+	return nil
+}
+
+// ExpandPlan adds the jobs planned by a plan job to the plan job's pipeline and moves the plan job
+// to success in one transaction. The planned jobs are created as they are by CreatePipelines.
+// Jobs waiting on the plan job also wait on every planned job, so that they don't run before the
+// plan does. If the plan job's state in the database is no longer job.State, ExpandPlan returns
+// com.ErrConflict.
+func (db *DB) ExpandPlan(ctx context.Context, job *com.Job, jobs []*com.Job) error {
+	if job.ID <= 0 {
+		return com.ErrNoID
+	}
+
+	conn := db.get(ctx)
+	if conn == nil {
+		return ErrNoConnection
+	}
+	defer db.put(conn)
+
+	updated := *job
+	updated.State = gciwire.Success
+	updated.FailureReason = gciwire.NoneFailure
+	updated.Finished = proc.Now(ctx)
+	updated.TokenHash = ""
+
+	var created []*com.Job
+	err := db.savepoint(ctx, conn, func() (err error) {
+		if created, err = createJobs(ctx, conn, job.Pipeline, jobs); err != nil {
+			return err
+		}
+
+		get := conn.Prep(`SELECT dest, fetch_artifacts FROM job_depends WHERE src = $src ORDER BY dest`)
+		get.SetInt64("$src", job.ID)
+		var dests []com.JobDependency
+		err = eachRow(ctx, get, func() error {
+			dests = append(dests, com.JobDependency{
+				Job:            get.GetInt64("dest"),
+				FetchArtifacts: itob(get.GetInt64("fetch_artifacts")),
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, dest := range dests {
+			for _, planned := range created {
+				if err = addJobDependency(conn, dest.Job, planned.ID, dest.FetchArtifacts); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err = setJobState(ctx, conn, job, &updated); err != nil {
+			return err
+		}
+		return releaseCreated(ctx, conn, created)
+	})
+	if err != nil {
+		return err
+	}
+
+	*job = updated
+	for i, planned := range created {
+		*jobs[i] = *planned
+	}
+	return nil
+}
+
+// releaseDependents releases the jobs waiting on src, which has finished or is a manual job
+// waiting to be played.
+func releaseDependents(ctx context.Context, conn *sqlite.Conn, src int64) error {
+	get := conn.Prep(`SELECT dest FROM job_depends
+		INNER JOIN jobs ON jobs.id = job_depends.dest
+		WHERE job_depends.src = $src AND jobs.state = $created
+		ORDER BY dest`)
+	get.SetInt64("$src", src)
+	get.SetText("$created", string(com.JobCreated))
+
+	var dests []int64
+	err := eachRow(ctx, get, func() error {
+		dests = append(dests, get.GetInt64("dest"))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, dest := range dests {
+		if err := releaseJob(ctx, conn, dest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseJob moves a created job to pending, or to manual if it's a manual job, once all of the
+// jobs it depends on have finished. Jobs ordered by stage don't wait on optional manual jobs. If
+// the job shouldn't run given the results of the jobs it depends on, it is skipped instead. Jobs
+// waiting on a skipped or manual job are released in turn.
+func releaseJob(ctx context.Context, conn *sqlite.Conn, id int64) error {
+	job := conn.Prep(`SELECT run_when, dag FROM jobs WHERE id = $job AND state = $created`)
+	job.SetInt64("$job", id)
+	job.SetText("$created", string(com.JobCreated))
+	haveRows, err := job.Step()
+	if err != nil {
+		return err
+	} else if !haveRows {
+		return job.Reset()
+	}
+	when, dag := com.JobWhen(job.GetText("run_when")), itob(job.GetInt64("dag"))
+	if err := job.Reset(); err != nil {
+		return err
+	}
+
+	get := conn.Prep(`SELECT jobs.state AS state, jobs.allow_failure AS allow_failure
+		FROM job_depends
+		INNER JOIN jobs ON jobs.id = job_depends.src
+		WHERE job_depends.dest = $job`)
+	get.SetInt64("$job", id)
+
+	var srcs []*com.Job
+	finished := true
+	err = eachRow(ctx, get, func() error {
+		src := &com.Job{
+			State:        gciwire.JobState(get.GetText("state")),
+			AllowFailure: itob(get.GetInt64("allow_failure")),
+		}
+		finished = finished && (com.IsFinished(src.State) || src.Optional() && !dag)
+		srcs = append(srcs, src)
+		return nil
+	})
+	if err != nil || !finished {
+		return err
+	}
+
+	state := gciwire.Pending
+	var finishedTime float64
+	if !when.Runs(com.Result(srcs), dag) {
+		state = com.JobSkipped
+		finishedTime = ToSecs(proc.Now(ctx))
+	} else if when == com.WhenManual {
+		state = com.JobManual
+	}
+
+	set := conn.Prep(`UPDATE jobs SET state = $state, finished_time = $finished_time WHERE id = $job`)
+	set.SetInt64("$job", id)
+	set.SetText("$state", string(state))
+	set.SetFloat("$finished_time", finishedTime)
+	if _, err := set.Step(); err != nil {
+		set.Reset()
+		return err
+	} else if err := set.Reset(); err != nil {
+		return err
+	}
+
+	if state != gciwire.Pending {
+		return releaseDependents(ctx, conn, id)
+	}
+	return nil
+}
+
+// PlayJob moves a manual job to pending so that it can be claimed by a runner. The given
+// variables are added to the job's spec after its own. If the job's state in the database is no
+// longer manual, PlayJob returns com.ErrConflict.
+func (db *DB) PlayJob(ctx context.Context, job *com.Job, variables gciwire.JobVariables) error {
+	if job.ID <= 0 {
+		return com.ErrNoID
+	} else if job.State != com.JobManual {
+		return com.ErrConflict
+	}
+
+	updated := *job
+	spec := *job.Spec
+	spec.GitLab.Variables = append(append(gciwire.JobVariables(nil), spec.GitLab.Variables...), variables...)
+	updated.Spec = &spec
+	updated.State = gciwire.Pending
+	p, err := json.Marshal(updated.Spec)
+	if err != nil {
+		return err
+	}
+
+	conn := db.get(ctx)
+	if conn == nil {
+		return ErrNoConnection
+	}
+	defer db.put(conn)
+
+	set := conn.Prep(`UPDATE jobs SET state = $state, spec = $spec WHERE id = $job AND state = $from`)
+	defer set.Reset()
+	set.SetText("$state", string(updated.State))
+	set.SetText("$from", string(job.State))
+	set.SetText("$spec", string(p))
+	set.SetInt64("$job", job.ID)
+	if _, err := set.Step(); err != nil {
+		return err
+	} else if conn.Changes() != 1 {
+		return com.ErrConflict
+	}
+
+	*job = updated
+	return nil
+}
+
+func getJobTags(ctx context.Context, conn *sqlite.Conn, job *com.Job) error {
+	get := conn.Prep(`SELECT tags.tag FROM job_tags INNER JOIN tags ON job_tags.tag = tags.id WHERE job = $job ORDER BY tags.tag`)
+	get.SetInt64("$job", job.ID)
+
+	var tags []string
+	err := eachRow(ctx, get, func() error {
+		tags = append(tags, get.GetText("tag"))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	job.Tags = tags
+	return nil
+}
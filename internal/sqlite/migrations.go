@@ -75,4 +75,150 @@ var systemPatches = PatchSet{
 			FOREIGN KEY(dest) REFERENCES jobs(id)
 		)`,
 	),
+
+	// Job tags and queue indices
+	StatementPatch("job-tags", "base-system", 2,
+		`CREATE TABLE job_tags(
+			tag INTEGER,
+			job INTEGER,
+
+			PRIMARY KEY(tag, job),
+			FOREIGN KEY(tag) REFERENCES tags(id),
+			FOREIGN KEY(job) REFERENCES jobs(id)
+		)`,
+		`CREATE INDEX job_tags_by_job ON job_tags (job)`,
+		`CREATE INDEX jobs_by_state ON jobs (state, id)`,
+	),
+
+	// Runner features and stuck jobs
+	StatementPatch("runner-features", "base-system", 3,
+		`ALTER TABLE runners ADD COLUMN features INTEGER DEFAULT 0`,
+		`ALTER TABLE jobs ADD COLUMN stuck BOOLEAN DEFAULT 0`,
+	),
+
+	// Job traces
+	StatementPatch("job-traces", "base-system", 4,
+		`CREATE TABLE job_trace_chunks(
+			job INTEGER,
+			offset INTEGER,
+			data BLOB,
+
+			PRIMARY KEY(job, offset),
+			FOREIGN KEY(job) REFERENCES jobs(id)
+		)`,
+	),
+
+	// Job tokens
+	StatementPatch("job-tokens", "base-system", 5,
+		`ALTER TABLE jobs ADD COLUMN token_hash TEXT`,
+	),
+
+	// Job failure reasons
+	StatementPatch("job-failure-reason", "base-system", 6,
+		`ALTER TABLE jobs ADD COLUMN failure_reason TEXT`,
+	),
+
+	// Job artifacts
+	StatementPatch("job-artifacts", "base-system", 7,
+		`CREATE TABLE artifacts(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			job INTEGER,
+			type TEXT,
+			format TEXT,
+			filename TEXT,
+			size INTEGER,
+			sha256 TEXT,
+			key TEXT,
+			expire_in TEXT,
+			created_time REALTIME,
+
+			UNIQUE(job, type) ON CONFLICT REPLACE,
+			FOREIGN KEY(job) REFERENCES jobs(id)
+		)`,
+	),
+
+	// Artifact expiry
+	StatementPatch("artifact-expiry", "base-system", 8,
+		`ALTER TABLE artifacts ADD COLUMN expire_time REALTIME DEFAULT 0`,
+		`CREATE INDEX artifacts_by_expire_time ON artifacts (expire_time)`,
+	),
+
+	// Pipelines
+	StatementPatch("pipelines", "base-system", 9,
+		`CREATE TABLE pipelines(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			project INTEGER,
+			source TEXT, -- common.EventKind
+			ref TEXT,
+			ref_type TEXT,
+			sha TEXT,
+			before_sha TEXT,
+			event JSON, -- common.Event
+			created_time REALTIME,
+
+			FOREIGN KEY(project) REFERENCES projects(id)
+		)`,
+		`CREATE INDEX pipelines_by_ref ON pipelines (project, ref, id)`,
+		`ALTER TABLE jobs ADD COLUMN pipeline INTEGER REFERENCES pipelines(id)`,
+		`CREATE INDEX jobs_by_pipeline ON jobs (pipeline)`,
+	),
+
+	// Webhook deliveries
+	StatementPatch("webhook-deliveries", "base-system", 10,
+		`CREATE TABLE webhook_deliveries(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			source TEXT,
+			delivery_id TEXT,
+			event TEXT,
+			query TEXT,
+			headers JSON, -- http.Header
+			body BLOB,
+			result TEXT, -- common.WebhookResult
+			response_code INTEGER DEFAULT 0,
+			replay_of INTEGER REFERENCES webhook_deliveries(id),
+			created_time REALTIME,
+			updated_time REALTIME
+		)`,
+		`CREATE INDEX webhook_deliveries_by_delivery_id ON webhook_deliveries (source, delivery_id)`,
+		`ALTER TABLE pipelines ADD COLUMN delivery INTEGER REFERENCES webhook_deliveries(id)`,
+		`CREATE INDEX pipelines_by_delivery ON pipelines (delivery)`,
+	),
+
+	// Job scheduling
+	StatementPatch("job-scheduling", "base-system", 11,
+		`ALTER TABLE jobs ADD COLUMN run_when TEXT DEFAULT 'on_success'`,
+		`ALTER TABLE jobs ADD COLUMN allow_failure BOOLEAN DEFAULT 0`,
+		`ALTER TABLE jobs ADD COLUMN dag BOOLEAN DEFAULT 0`,
+		`CREATE INDEX job_depends_by_dest ON job_depends (dest)`,
+	),
+
+	// Plan jobs
+	StatementPatch("plan-jobs", "base-system", 12,
+		`ALTER TABLE jobs ADD COLUMN plan BOOLEAN DEFAULT 0`,
+		`ALTER TABLE jobs ADD COLUMN plan_depth INTEGER DEFAULT 0`,
+	),
+
+	// Pipeline changes
+	StatementPatch("pipeline-changes", "base-system", 13,
+		`ALTER TABLE pipelines ADD COLUMN changes JSON`,
+	),
+
+	// Planned job dependencies
+	StatementPatch("plan-depends", "base-system", 14,
+		// Jobs waiting on a plan job also wait on the jobs it plans, which are created after them.
+		`CREATE TABLE job_depends_planned(
+			dest INTEGER,
+			src INTEGER CHECK(src <> dest),
+			fetch_artifacts BOOLEAN DEFAULT 0,
+
+			PRIMARY KEY(src, dest),
+			FOREIGN KEY(src) REFERENCES jobs(id),
+			FOREIGN KEY(dest) REFERENCES jobs(id)
+		)`,
+		`INSERT INTO job_depends_planned(dest, src, fetch_artifacts)
+			SELECT dest, src, fetch_artifacts FROM job_depends`,
+		`DROP TABLE job_depends`,
+		`ALTER TABLE job_depends_planned RENAME TO job_depends`,
+		`CREATE INDEX job_depends_by_dest ON job_depends (dest)`,
+	),
 }
@@ -88,6 +88,11 @@ func applyPatch(ctx context.Context, conn *sqlite.Conn, savepoint string, patch
 	}
 
 	found := getVersion.GetInt64("found")
+	// Reset the query before applying the patch, since tables can't be dropped while a
+	// statement is active.
+	if err = getVersion.Reset(); err != nil {
+		return err
+	}
 	if found > 0 {
 		return nil
 	}
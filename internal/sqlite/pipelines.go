@@ -0,0 +1,249 @@
+package sqlite
+
+import (
+	"context"
+	"encoding/json"
+
+	"crawshaw.io/sqlite"
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
+	"go.spiff.io/gribble/internal/proc"
+)
+
+func (db *DB) CreatePipeline(ctx context.Context, pipeline *com.Pipeline) error {
+	if err := pipeline.CanCreate(); err != nil {
+		return err
+	}
+	conn := db.get(ctx)
+	if conn == nil {
+		return ErrNoConnection
+	}
+	defer db.put(conn)
+	return createPipeline(ctx, conn, pipeline)
+}
+
+// CreatePipelines creates pipelines and their jobs in one transaction. The jobs of each pipeline
+// are returned by newJobs, which is called with the pipeline's index once the pipeline has an ID
+// and must not use the database. Jobs are created in order and may depend on jobs before them in
+// the same pipeline through their dependencies' Src. None of the jobs are released until all of
+// them have been created, and if any pipeline or job can't be created, none are. The created jobs
+// of each pipeline are returned.
+func (db *DB) CreatePipelines(ctx context.Context, pipelines []*com.Pipeline, newJobs func(i int, pipeline *com.Pipeline) []*com.Job) ([][]*com.Job, error) {
+	for _, pipeline := range pipelines {
+		if err := pipeline.CanCreate(); err != nil {
+			return nil, err
+		}
+	}
+	conn := db.get(ctx)
+	if conn == nil {
+		return nil, ErrNoConnection
+	}
+	defer db.put(conn)
+
+	updated := make([]com.Pipeline, len(pipelines))
+	created := make([][]*com.Job, len(pipelines))
+	err := db.savepoint(ctx, conn, func() (err error) {
+		for i, pipeline := range pipelines {
+			updated[i] = *pipeline
+			if err = createPipeline(ctx, conn, &updated[i]); err != nil {
+				return err
+			}
+			if created[i], err = createJobs(ctx, conn, updated[i].ID, newJobs(i, &updated[i])); err != nil {
+				return err
+			}
+		}
+		for _, jobs := range created {
+			if err = releaseCreated(ctx, conn, jobs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, pipeline := range pipelines {
+		*pipeline = updated[i]
+	}
+	return created, nil
+}
+
+func createPipeline(ctx context.Context, conn *sqlite.Conn, pipeline *com.Pipeline) error {
+	event, err := json.Marshal(pipeline.Event)
+	if err != nil {
+		return err
+	}
+	// Unknown changes are stored as NULL, to tell them apart from an empty list.
+	var changes []byte
+	if pipeline.Changes != nil {
+		if changes, err = json.Marshal(pipeline.Changes); err != nil {
+			return err
+		}
+	}
+
+	stmt := conn.Prep(`INSERT INTO
+		pipelines(project, source, ref, ref_type, sha, before_sha, event, delivery, changes, created_time)
+		VALUES ($project, $source, $ref, $ref_type, $sha, $before_sha, $event, $delivery, $changes, $created_time)`)
+	defer stmt.Reset()
+
+	updated := *pipeline
+	updated.Created = proc.Now(ctx)
+
+	ev := updated.Event
+	stmt.SetInt64("$project", updated.Project)
+	stmt.SetText("$source", string(ev.Kind))
+	stmt.SetText("$ref", ev.Ref)
+	stmt.SetText("$ref_type", string(ev.RefType))
+	stmt.SetText("$sha", ev.After)
+	stmt.SetText("$before_sha", ev.Before)
+	stmt.SetText("$event", string(event))
+	if updated.Delivery == 0 {
+		stmt.SetNull("$delivery")
+	} else {
+		stmt.SetInt64("$delivery", updated.Delivery)
+	}
+	if changes == nil {
+		stmt.SetNull("$changes")
+	} else {
+		stmt.SetText("$changes", string(changes))
+	}
+	stmt.SetFloat("$created_time", ToSecs(updated.Created))
+	if _, err = stmt.Step(); err != nil {
+		return err
+	}
+
+	updated.ID = conn.LastInsertRowID()
+	*pipeline = updated
+	return nil
+}
+
+// pipelineColumns is the list of columns read by readPipeline.
+const pipelineColumns = `id, project, event, delivery, changes, created_time`
+
+// readPipeline reads a pipeline from the current row of a statement selecting pipelineColumns.
+func readPipeline(stmt *sqlite.Stmt) (*com.Pipeline, error) {
+	pipeline := &com.Pipeline{
+		ID:       stmt.GetInt64("id"),
+		Project:  stmt.GetInt64("project"),
+		Event:    new(com.Event),
+		Delivery: stmt.GetInt64("delivery"),
+		Created:  FromSecs(stmt.GetFloat("created_time")),
+	}
+	if err := json.Unmarshal([]byte(stmt.GetText("event")), pipeline.Event); err != nil {
+		return nil, err
+	}
+	if changes := stmt.GetText("changes"); changes != "" {
+		if err := json.Unmarshal([]byte(changes), &pipeline.Changes); err != nil {
+			return nil, err
+		}
+	}
+	return pipeline, nil
+}
+
+func (db *DB) GetPipeline(ctx context.Context, id int64) (*com.Pipeline, error) {
+	conn := db.get(ctx)
+	if conn == nil {
+		return nil, ErrNoConnection
+	}
+	defer db.put(conn)
+
+	get := conn.Prep(`SELECT ` + pipelineColumns + ` FROM pipelines WHERE id = $id`)
+	defer get.Reset()
+	get.SetInt64("$id", id)
+	if haveRows, err := get.Step(); err != nil {
+		return nil, err
+	} else if !haveRows {
+		return nil, com.ErrNotFound
+	}
+	pipeline, err := readPipeline(get)
+	if err != nil {
+		return nil, err
+	}
+	if err = get.Reset(); err != nil {
+		return nil, err
+	}
+	if pipeline.Status, err = getPipelineStatus(ctx, conn, pipeline.ID); err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+// GetPullRequestSHA returns the head SHA of the newest pipeline of a project's pull request, where
+// the project is identified by its source and source ID. If the pull request has no pipelines,
+// GetPullRequestSHA returns com.ErrNotFound.
+func (db *DB) GetPullRequestSHA(ctx context.Context, project *com.Project, number int64) (string, error) {
+	conn := db.get(ctx)
+	if conn == nil {
+		return "", ErrNoConnection
+	}
+	defer db.put(conn)
+
+	get := conn.Prep(`SELECT pipelines.sha AS sha FROM pipelines
+		INNER JOIN projects ON projects.id = pipelines.project
+		WHERE projects.source = $source AND projects.source_id = $source_id
+			AND pipelines.source = $kind
+			AND json_extract(pipelines.event, '$.pull_request.number') = $number
+		ORDER BY pipelines.id DESC
+		LIMIT 1`)
+	defer get.Reset()
+	get.SetText("$source", project.Source)
+	get.SetText("$source_id", project.SourceID)
+	get.SetText("$kind", string(com.EventPullRequest))
+	get.SetInt64("$number", number)
+	if haveRows, err := get.Step(); err != nil {
+		return "", err
+	} else if !haveRows {
+		return "", com.ErrNotFound
+	}
+	return get.GetText("sha"), nil
+}
+
+// getPipelineStatus returns the status of a pipeline derived from the states of its jobs.
+func getPipelineStatus(ctx context.Context, conn *sqlite.Conn, pipeline int64) (gciwire.JobState, error) {
+	get := conn.Prep(`SELECT state, allow_failure FROM jobs WHERE pipeline = $pipeline`)
+	get.SetInt64("$pipeline", pipeline)
+
+	var jobs []*com.Job
+	err := eachRow(ctx, get, func() error {
+		jobs = append(jobs, &com.Job{
+			State:        gciwire.JobState(get.GetText("state")),
+			AllowFailure: itob(get.GetInt64("allow_failure")),
+		})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return com.PipelineStatus(jobs), nil
+}
+
+// GetPipelineJobs returns the jobs of a pipeline in the order they were created.
+func (db *DB) GetPipelineJobs(ctx context.Context, pipeline int64) ([]*com.Job, error) {
+	conn := db.get(ctx)
+	if conn == nil {
+		return nil, ErrNoConnection
+	}
+	defer db.put(conn)
+
+	get := conn.Prep(`SELECT ` + jobColumns + ` FROM jobs WHERE pipeline = $pipeline ORDER BY id`)
+	get.SetInt64("$pipeline", pipeline)
+
+	var jobs []*com.Job
+	err := eachRow(ctx, get, func() error {
+		job, err := readJob(get)
+		if err == nil {
+			jobs = append(jobs, job)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		if err := getJobTags(ctx, conn, job); err != nil {
+			return nil, err
+		}
+	}
+	return jobs, nil
+}
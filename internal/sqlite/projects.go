@@ -0,0 +1,88 @@
+package sqlite
+
+import (
+	"context"
+
+	"crawshaw.io/sqlite"
+	com "go.spiff.io/gribble/internal/common"
+)
+
+// UpsertProject creates the project if no project has the same source and source ID, or updates
+// the existing project otherwise. The project's ID is set to that of the stored project.
+func (db *DB) UpsertProject(ctx context.Context, project *com.Project) error {
+	if project == nil {
+		return com.ErrNil
+	}
+
+	conn := db.get(ctx)
+	if conn == nil {
+		return ErrNoConnection
+	}
+	defer db.put(conn)
+
+	return db.savepoint(ctx, conn, func() error {
+		find := conn.Prep(`SELECT id FROM projects WHERE source = $source AND source_id = $source_id`)
+		defer find.Reset()
+		find.SetText("$source", project.Source)
+		find.SetText("$source_id", project.SourceID)
+		haveRows, err := find.Step()
+		if err != nil {
+			return err
+		}
+
+		var id int64
+		var stmt *sqlite.Stmt
+		if haveRows {
+			id = find.GetInt64("id")
+			stmt = conn.Prep(`UPDATE projects
+				SET name = $name, path = $path, url = $url, clone_url = $clone_url
+				WHERE id = $id`)
+			stmt.SetInt64("$id", id)
+		} else {
+			stmt = conn.Prep(`INSERT INTO
+				projects(source, source_id, name, path, url, clone_url)
+				VALUES ($source, $source_id, $name, $path, $url, $clone_url)`)
+			stmt.SetText("$source", project.Source)
+			stmt.SetText("$source_id", project.SourceID)
+		}
+		defer stmt.Reset()
+		stmt.SetText("$name", project.Name)
+		stmt.SetText("$path", project.Path)
+		stmt.SetText("$url", project.URL)
+		stmt.SetText("$clone_url", project.CloneURL)
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+		if !haveRows {
+			id = conn.LastInsertRowID()
+		}
+		project.ID = id
+		return nil
+	})
+}
+
+func (db *DB) GetProject(ctx context.Context, id int64) (*com.Project, error) {
+	conn := db.get(ctx)
+	if conn == nil {
+		return nil, ErrNoConnection
+	}
+	defer db.put(conn)
+
+	get := conn.Prep(`SELECT id, source, source_id, name, path, url, clone_url FROM projects WHERE id = $id`)
+	defer get.Reset()
+	get.SetInt64("$id", id)
+	if haveRows, err := get.Step(); err != nil {
+		return nil, err
+	} else if !haveRows {
+		return nil, com.ErrNotFound
+	}
+	return &com.Project{
+		ID:       get.GetInt64("id"),
+		Source:   get.GetText("source"),
+		SourceID: get.GetText("source_id"),
+		Name:     get.GetText("name"),
+		Path:     get.GetText("path"),
+		URL:      get.GetText("url"),
+		CloneURL: get.GetText("clone_url"),
+	}, nil
+}
@@ -4,9 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"reflect"
 	"testing"
+	"time"
 
 	"crawshaw.io/sqlite"
+	com "go.spiff.io/gribble/internal/common"
+	gciwire "go.spiff.io/gribble/internal/gci-wire"
 )
 
 func TestVersions(t *testing.T) {
@@ -145,3 +149,580 @@ func TestMigrations(t *testing.T) {
 		}
 	}
 }
+
+func newMigratedDB(t *testing.T) (context.Context, *DB) {
+	ctx := context.Background()
+	db, err := NewMemoryDB(ctx, 1)
+	if err != nil {
+		panic(fmt.Errorf("Error opening DB pool: %v", err))
+	}
+	if err := db.Migrate(ctx); err != nil {
+		db.Close()
+		t.Fatalf("Migrate() = %v; want nil", err)
+	}
+	return ctx, db
+}
+
+func TestClaimJob(t *testing.T) {
+	ctx, db := newMigratedDB(t)
+	defer db.Close()
+
+	tagged := &com.Runner{Token: "tagged", Tags: []string{"docker", "linux"}, Active: true}
+	untagged := &com.Runner{Token: "untagged", RunUntagged: true, Active: true}
+	for _, r := range []*com.Runner{tagged, untagged} {
+		if err := db.CreateRunner(ctx, r); err != nil {
+			t.Fatalf("CreateRunner(%q) = %v; want nil", r.Token, err)
+		}
+	}
+
+	jobs := []*com.Job{
+		{Tags: []string{"windows"}, Spec: &com.JobSpec{}},
+		{Spec: &com.JobSpec{}},
+		{Tags: []string{"linux"}, Spec: &com.JobSpec{}},
+		{Tags: []string{"docker", "linux"}, Spec: &com.JobSpec{}},
+	}
+	for i, job := range jobs {
+		job.Spec.GitLab.JobInfo.Name = fmt.Sprint("job-", i)
+		if err := db.CreateJob(ctx, job); err != nil {
+			t.Fatalf("CreateJob(%d) = %v; want nil", i, err)
+		}
+	}
+
+	claims := []struct {
+		runner *com.Runner
+		want   *com.Job
+	}{
+		{tagged, jobs[2]},
+		{tagged, jobs[3]},
+		{tagged, nil},
+		{untagged, jobs[1]},
+		{untagged, nil},
+	}
+	for i, c := range claims {
+		job, err := db.ClaimJob(ctx, c.runner, "")
+		if c.want == nil {
+			if err != com.ErrNotFound {
+				t.Errorf("%d: ClaimJob(%q) = %v, %v; want nil, %v", i, c.runner.Token, job, err, com.ErrNotFound)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: ClaimJob(%q) = %v; want nil", i, c.runner.Token, err)
+		}
+		if job.ID != c.want.ID || job.Runner != c.runner.ID || job.State != gciwire.Running {
+			t.Errorf("%d: ClaimJob(%q) = %#v; want job %d running", i, c.runner.Token, job, c.want.ID)
+		}
+		if got, want := job.Spec.GitLab.JobInfo.Name, c.want.Spec.GitLab.JobInfo.Name; got != want {
+			t.Errorf("%d: job name = %q; want %q", i, got, want)
+		}
+	}
+}
+
+func TestClaimJobFeatures(t *testing.T) {
+	ctx, db := newMigratedDB(t)
+	defer db.Close()
+
+	runner := &com.Runner{Token: "runner", RunUntagged: true, Active: true}
+	if err := db.CreateRunner(ctx, runner); err != nil {
+		t.Fatalf("CreateRunner() = %v; want nil", err)
+	}
+	if err := db.SetRunnerFeatures(ctx, runner, com.FeatureVariables|com.FeatureImage); err != nil {
+		t.Fatalf("SetRunnerFeatures() = %v; want nil", err)
+	}
+
+	withCache := &com.Job{Spec: &com.JobSpec{}}
+	withCache.Spec.GitLab.Cache = gciwire.Caches{{Key: "deps"}}
+	withImage := &com.Job{Spec: &com.JobSpec{}}
+	withImage.Spec.GitLab.Image.Name = "alpine:3.9"
+	for _, job := range []*com.Job{withCache, withImage} {
+		if err := db.CreateJob(ctx, job); err != nil {
+			t.Fatalf("CreateJob() = %v; want nil", err)
+		}
+	}
+
+	if !withCache.Stuck || !withCache.Features.IsSet(com.FeatureCache) {
+		t.Errorf("cache job = %#v; want stuck with cache feature", withCache)
+	}
+	if withImage.Stuck {
+		t.Errorf("image job = %#v; want not stuck", withImage)
+	}
+
+	job, err := db.ClaimJob(ctx, runner, "")
+	if err != nil || job.ID != withImage.ID {
+		t.Fatalf("ClaimJob() = %#v, %v; want job %d", job, err, withImage.ID)
+	}
+	if job, err = db.ClaimJob(ctx, runner, ""); err != com.ErrNotFound {
+		t.Fatalf("ClaimJob() = %#v, %v; want nil, %v", job, err, com.ErrNotFound)
+	}
+
+	// Stuck jobs are unstuck once a capable runner appears
+	if stuck, err := db.UpdateStuckJobs(ctx); err != nil || len(stuck) != 0 {
+		t.Errorf("UpdateStuckJobs() = %v, %v; want [], nil", stuck, err)
+	}
+	if err := db.SetRunnerFeatures(ctx, runner, com.FeatureVariables|com.FeatureCache); err != nil {
+		t.Fatalf("SetRunnerFeatures() = %v; want nil", err)
+	}
+	if _, err := db.UpdateStuckJobs(ctx); err != nil {
+		t.Fatalf("UpdateStuckJobs() = %v; want nil", err)
+	}
+	if job, err = db.ClaimJob(ctx, runner, ""); err != nil || job.ID != withCache.ID {
+		t.Fatalf("ClaimJob() = %#v, %v; want job %d", job, err, withCache.ID)
+	}
+}
+
+func TestJobDependencies(t *testing.T) {
+	ctx, db := newMigratedDB(t)
+	defer db.Close()
+
+	project := &com.Project{Source: "github", Path: "owner/repo"}
+	if err := db.UpsertProject(ctx, project); err != nil {
+		t.Fatalf("UpsertProject() = %v; want nil", err)
+	}
+	pipeline := &com.Pipeline{Project: project.ID, Event: &com.Event{Kind: com.EventPush}}
+	if err := db.CreatePipeline(ctx, pipeline); err != nil {
+		t.Fatalf("CreatePipeline() = %v; want nil", err)
+	}
+
+	create := func(name string, job *com.Job, deps ...*com.Job) *com.Job {
+		job.Pipeline = pipeline.ID
+		job.Spec = &com.JobSpec{}
+		job.Spec.GitLab.JobInfo.Name = name
+		for _, dep := range deps {
+			job.Depends = append(job.Depends, com.JobDependency{Job: dep.ID})
+		}
+		if err := db.CreateJob(ctx, job); err != nil {
+			t.Fatalf("CreateJob(%q) = %v; want nil", name, err)
+		}
+		return job
+	}
+	build := create("build", &com.Job{})
+	lint := create("lint", &com.Job{AllowFailure: true})
+	test := create("test", &com.Job{}, build, lint)
+	deploy := create("deploy", &com.Job{DAG: true}, test)
+	publish := create("publish", &com.Job{DAG: true}, deploy)
+	report := create("report", &com.Job{When: com.WhenOnFailure}, build, lint, test)
+	cleanup := create("cleanup", &com.Job{When: com.WhenAlways}, build, lint, test)
+	jobs := []*com.Job{build, lint, test, deploy, publish, report, cleanup}
+
+	checkStates := func(step string, status gciwire.JobState, want ...gciwire.JobState) {
+		t.Helper()
+		for i, job := range jobs {
+			got, err := db.GetJob(ctx, job.ID)
+			if err != nil {
+				t.Fatalf("%s: GetJob(%d) = %v; want nil", step, job.ID, err)
+			}
+			if got.State != want[i] {
+				t.Errorf("%s: %s state = %q; want %q", step, job.Spec.GitLab.JobInfo.Name, got.State, want[i])
+			}
+		}
+		if got, err := db.GetPipeline(ctx, pipeline.ID); err != nil {
+			t.Fatalf("%s: GetPipeline() = %v; want nil", step, err)
+		} else if got.Status != status {
+			t.Errorf("%s: pipeline status = %q; want %q", step, got.Status, status)
+		}
+	}
+	finish := func(job *com.Job, state gciwire.JobState) {
+		t.Helper()
+		got, err := db.GetJob(ctx, job.ID)
+		if err != nil {
+			t.Fatalf("GetJob(%d) = %v; want nil", job.ID, err)
+		}
+		for _, state := range []gciwire.JobState{gciwire.Running, state} {
+			if err := db.SetJobState(ctx, got, state, ""); err != nil {
+				t.Fatalf("SetJobState(%d, %q) = %v; want nil", job.ID, state, err)
+			}
+		}
+	}
+
+	const (
+		created = com.JobCreated
+		pending = gciwire.Pending
+		success = gciwire.Success
+		failed  = gciwire.Failed
+		skipped = com.JobSkipped
+	)
+	if build.State != pending || test.State != created {
+		t.Errorf("created states = %q, %q; want %q, %q", build.State, test.State, pending, created)
+	}
+	checkStates("created", pending, pending, pending, created, created, created, created, created)
+
+	finish(build, success)
+	checkStates("build", gciwire.Running, success, pending, created, created, created, created, created)
+
+	// An allowed failure doesn't stop the jobs depending on it.
+	finish(lint, failed)
+	checkStates("lint", gciwire.Running, success, failed, pending, created, created, created, created)
+
+	// Failing test skips the jobs that need it, and the jobs that need those, but releases the
+	// jobs that run on failure or always.
+	finish(test, failed)
+	checkStates("test", gciwire.Running, success, failed, failed, skipped, skipped, pending, pending)
+
+	finish(report, success)
+	finish(cleanup, success)
+	checkStates("finished", failed, success, failed, failed, skipped, skipped, success, success)
+}
+
+func TestManualJobs(t *testing.T) {
+	ctx, db := newMigratedDB(t)
+	defer db.Close()
+
+	project := &com.Project{Source: "github", Path: "owner/repo"}
+	if err := db.UpsertProject(ctx, project); err != nil {
+		t.Fatalf("UpsertProject() = %v; want nil", err)
+	}
+	pipeline := &com.Pipeline{Project: project.ID, Event: &com.Event{Kind: com.EventPush}}
+	if err := db.CreatePipeline(ctx, pipeline); err != nil {
+		t.Fatalf("CreatePipeline() = %v; want nil", err)
+	}
+
+	create := func(name string, job *com.Job, deps ...*com.Job) *com.Job {
+		job.Pipeline = pipeline.ID
+		job.Spec = &com.JobSpec{}
+		job.Spec.GitLab.JobInfo.Name = name
+		for _, dep := range deps {
+			job.Depends = append(job.Depends, com.JobDependency{Job: dep.ID})
+		}
+		if err := db.CreateJob(ctx, job); err != nil {
+			t.Fatalf("CreateJob(%q) = %v; want nil", name, err)
+		}
+		return job
+	}
+	build := create("build", &com.Job{})
+	review := create("review", &com.Job{When: com.WhenManual, AllowFailure: true}, build)
+	deploy := create("deploy", &com.Job{When: com.WhenManual}, build)
+	verify := create("verify", &com.Job{}, build, review, deploy)
+	preview := create("preview", &com.Job{DAG: true}, review)
+	jobs := []*com.Job{build, review, deploy, verify, preview}
+
+	checkStates := func(step string, status gciwire.JobState, want ...gciwire.JobState) {
+		t.Helper()
+		for i, job := range jobs {
+			got, err := db.GetJob(ctx, job.ID)
+			if err != nil {
+				t.Fatalf("%s: GetJob(%d) = %v; want nil", step, job.ID, err)
+			}
+			if got.State != want[i] {
+				t.Errorf("%s: %s state = %q; want %q", step, job.Spec.GitLab.JobInfo.Name, got.State, want[i])
+			}
+		}
+		if got, err := db.GetPipeline(ctx, pipeline.ID); err != nil {
+			t.Fatalf("%s: GetPipeline() = %v; want nil", step, err)
+		} else if got.Status != status {
+			t.Errorf("%s: pipeline status = %q; want %q", step, got.Status, status)
+		}
+	}
+	finish := func(job *com.Job) {
+		t.Helper()
+		got, err := db.GetJob(ctx, job.ID)
+		if err != nil {
+			t.Fatalf("GetJob(%d) = %v; want nil", job.ID, err)
+		}
+		for _, state := range []gciwire.JobState{gciwire.Running, gciwire.Success} {
+			if err := db.SetJobState(ctx, got, state, ""); err != nil {
+				t.Fatalf("SetJobState(%d, %q) = %v; want nil", job.ID, state, err)
+			}
+		}
+	}
+	play := func(job *com.Job, vars ...gciwire.JobVariable) {
+		t.Helper()
+		got, err := db.GetJob(ctx, job.ID)
+		if err != nil {
+			t.Fatalf("GetJob(%d) = %v; want nil", job.ID, err)
+		}
+		if err := db.PlayJob(ctx, got, vars); err != nil {
+			t.Fatalf("PlayJob(%d) = %v; want nil", job.ID, err)
+		}
+		if err := db.PlayJob(ctx, got, vars); err != com.ErrConflict {
+			t.Errorf("PlayJob(%d) again = %v; want %v", job.ID, err, com.ErrConflict)
+		}
+	}
+
+	const (
+		created = com.JobCreated
+		pending = gciwire.Pending
+		success = gciwire.Success
+		manual  = com.JobManual
+	)
+	checkStates("created", pending, pending, created, created, created, created)
+
+	// The blocking manual job holds back the next stage, and the job needing the optional manual
+	// job waits for it to be played.
+	finish(build)
+	checkStates("build", manual, success, manual, manual, created, created)
+
+	play(deploy, gciwire.JobVariable{Key: "TARGET", Value: "production"})
+	checkStates("play deploy", gciwire.Running, success, manual, pending, created, created)
+	if got, err := db.GetJob(ctx, deploy.ID); err != nil || got.Spec.GitLab.Variables.Get("TARGET") != "production" {
+		t.Errorf("deploy TARGET = %v; want production", err)
+	}
+
+	// The next stage doesn't wait on the optional manual job.
+	finish(deploy)
+	checkStates("deploy", gciwire.Running, success, manual, success, pending, created)
+	finish(verify)
+	checkStates("verify", manual, success, manual, success, success, created)
+
+	play(review)
+	finish(review)
+	finish(preview)
+	checkStates("finished", success, success, success, success, success, success)
+}
+
+func TestGetExpiredArtifacts(t *testing.T) {
+	ctx, db := newMigratedDB(t)
+	defer db.Close()
+
+	project := &com.Project{Source: "github", Path: "owner/repo"}
+	if err := db.UpsertProject(ctx, project); err != nil {
+		t.Fatalf("UpsertProject() = %v; want nil", err)
+	}
+
+	now := time.Unix(1e9, 0)
+	pipelines := []struct {
+		ref, sha string
+		state    gciwire.JobState
+	}{
+		{"master", "a", gciwire.Success},
+		{"master", "b", gciwire.Success},
+		{"master", "c", gciwire.Failed},
+		{"feature", "d", gciwire.Success}, // Latest successful feature
+		{"master", "e", gciwire.Failed},
+		{"master", "e", gciwire.Success}, // Latest successful master, re-run after failing
+	}
+	artifacts := make([]*com.Artifact, len(pipelines))
+	for i, p := range pipelines {
+		pipeline := &com.Pipeline{
+			Project: project.ID,
+			Event:   &com.Event{Kind: com.EventPush, Ref: p.ref, After: p.sha},
+		}
+		if err := db.CreatePipeline(ctx, pipeline); err != nil {
+			t.Fatalf("CreatePipeline() = %v; want nil", err)
+		}
+		job := &com.Job{Project: project.ID, Pipeline: pipeline.ID, Spec: &com.JobSpec{}, State: p.state}
+		if err := db.CreateJob(ctx, job); err != nil {
+			t.Fatalf("CreateJob() = %v; want nil", err)
+		}
+		artifacts[i] = &com.Artifact{Job: job.ID, Type: com.ArtifactArchive, Expires: now.Add(-time.Second)}
+		if err := db.CreateArtifact(ctx, artifacts[i]); err != nil {
+			t.Fatalf("CreateArtifact() = %v; want nil", err)
+		}
+	}
+	unexpired := &com.Artifact{Job: artifacts[0].Job, Type: "junit", Expires: now.Add(time.Second)}
+	if err := db.CreateArtifact(ctx, unexpired); err != nil {
+		t.Fatalf("CreateArtifact() = %v; want nil", err)
+	}
+
+	ids := func(artifacts []*com.Artifact) (ids []int64) {
+		for _, a := range artifacts {
+			ids = append(ids, a.ID)
+		}
+		return ids
+	}
+
+	got, err := db.GetExpiredArtifacts(ctx, now, false)
+	if want := ids(artifacts); err != nil || !reflect.DeepEqual(ids(got), want) {
+		t.Errorf("GetExpiredArtifacts(keepLatest=false) = %v, %v; want %v", ids(got), err, want)
+	}
+
+	got, err = db.GetExpiredArtifacts(ctx, now, true)
+	if want := ids([]*com.Artifact{artifacts[0], artifacts[1], artifacts[2], artifacts[4]}); err != nil || !reflect.DeepEqual(ids(got), want) {
+		t.Errorf("GetExpiredArtifacts(keepLatest=true) = %v, %v; want %v", ids(got), err, want)
+	}
+
+	if err := db.DeleteArtifact(ctx, artifacts[0]); err != nil {
+		t.Fatalf("DeleteArtifact() = %v; want nil", err)
+	}
+	got, err = db.GetExpiredArtifacts(ctx, now, true)
+	if want := ids([]*com.Artifact{artifacts[1], artifacts[2], artifacts[4]}); err != nil || !reflect.DeepEqual(ids(got), want) {
+		t.Errorf("GetExpiredArtifacts() after delete = %v, %v; want %v", ids(got), err, want)
+	}
+}
+
+func TestUpsertProject(t *testing.T) {
+	ctx, db := newMigratedDB(t)
+	defer db.Close()
+
+	project := &com.Project{Source: "github", SourceID: "42", Path: "owner/repo"}
+	if err := db.UpsertProject(ctx, project); err != nil {
+		t.Fatalf("UpsertProject() = %v; want nil", err)
+	}
+	other := &com.Project{Source: "gitea", SourceID: "42", Path: "owner/repo"}
+	if err := db.UpsertProject(ctx, other); err != nil {
+		t.Fatalf("UpsertProject() = %v; want nil", err)
+	}
+	if other.ID == project.ID {
+		t.Errorf("projects from different sources share ID %d", project.ID)
+	}
+
+	renamed := &com.Project{Source: "github", SourceID: "42", Path: "owner/renamed"}
+	if err := db.UpsertProject(ctx, renamed); err != nil {
+		t.Fatalf("UpsertProject() = %v; want nil", err)
+	}
+	if renamed.ID != project.ID {
+		t.Errorf("renamed project ID = %d; want %d", renamed.ID, project.ID)
+	}
+	got, err := db.GetProject(ctx, project.ID)
+	if err != nil {
+		t.Fatalf("GetProject() = %v; want nil", err)
+	}
+	if !reflect.DeepEqual(got, renamed) {
+		t.Errorf("GetProject() = %+v; want %+v", got, renamed)
+	}
+}
+
+func TestPipelineChanges(t *testing.T) {
+	ctx, db := newMigratedDB(t)
+	defer db.Close()
+
+	project := &com.Project{Source: "github", Path: "owner/repo"}
+	if err := db.UpsertProject(ctx, project); err != nil {
+		t.Fatalf("UpsertProject() = %v; want nil", err)
+	}
+	// Unknown changes and no changes are kept apart.
+	for _, changes := range [][]string{nil, {}, {"README", "src/main.go"}} {
+		pipeline := &com.Pipeline{Project: project.ID, Event: &com.Event{Kind: com.EventPush}, Changes: changes}
+		if err := db.CreatePipeline(ctx, pipeline); err != nil {
+			t.Fatalf("CreatePipeline() = %v; want nil", err)
+		}
+		got, err := db.GetPipeline(ctx, pipeline.ID)
+		if err != nil || !reflect.DeepEqual(got.Changes, changes) {
+			t.Errorf("GetPipeline() changes = %#v, %v; want %#v", got.Changes, err, changes)
+		}
+	}
+}
+
+func TestCreatePipelines(t *testing.T) {
+	ctx, db := newMigratedDB(t)
+	defer db.Close()
+
+	project := &com.Project{Source: "github", Path: "owner/repo"}
+	if err := db.UpsertProject(ctx, project); err != nil {
+		t.Fatalf("UpsertProject() = %v; want nil", err)
+	}
+	newJobs := func() []*com.Job {
+		build := &com.Job{Project: project.ID, Spec: &com.JobSpec{}}
+		test := &com.Job{Project: project.ID, Spec: &com.JobSpec{}}
+		test.Depends = []com.JobDependency{{Src: build, FetchArtifacts: true}}
+		return []*com.Job{build, test}
+	}
+	count := func(table string) int64 {
+		conn := db.get(ctx)
+		if conn == nil {
+			t.Fatal("No connection available")
+		}
+		defer db.put(conn)
+		stmt := conn.Prep(`SELECT COUNT(*) AS n FROM ` + table)
+		defer stmt.Reset()
+		if _, err := stmt.Step(); err != nil {
+			t.Fatalf("Unable to count %s: %v", table, err)
+		}
+		return stmt.GetInt64("n")
+	}
+
+	// A job of the second pipeline that can't be created leaves neither pipeline behind.
+	first := &com.Pipeline{Project: project.ID, Event: &com.Event{Kind: com.EventPush}}
+	second := &com.Pipeline{Project: project.ID, Event: &com.Event{Kind: com.EventPush}}
+	jobs := [][]*com.Job{newJobs(), append(newJobs(), &com.Job{ID: 100, Spec: &com.JobSpec{}})}
+	_, err := db.CreatePipelines(ctx, []*com.Pipeline{first, second}, func(i int, _ *com.Pipeline) []*com.Job {
+		return jobs[i]
+	})
+	if err != com.ErrHasID {
+		t.Fatalf("CreatePipelines() = %v; want %v", err, com.ErrHasID)
+	}
+	if first.ID != 0 || second.ID != 0 || jobs[0][0].ID != 0 {
+		t.Errorf("CreatePipelines() set IDs %d, %d, %d; want 0, 0, 0", first.ID, second.ID, jobs[0][0].ID)
+	}
+	for _, table := range []string{"pipelines", "jobs", "job_depends"} {
+		if n := count(table); n != 0 {
+			t.Errorf("%s has %d rows; want 0", table, n)
+		}
+	}
+
+	// Jobs are built once the pipeline has an ID.
+	pipelineIDs := make([]int64, 2)
+	created, err := db.CreatePipelines(ctx, []*com.Pipeline{first, second}, func(i int, p *com.Pipeline) []*com.Job {
+		pipelineIDs[i] = p.ID
+		return newJobs()
+	})
+	if err != nil {
+		t.Fatalf("CreatePipelines() = %v; want nil", err)
+	}
+	if pipelineIDs[0] == 0 || pipelineIDs[0] != first.ID || pipelineIDs[1] != second.ID || first.ID == second.ID {
+		t.Errorf("newJobs() called with pipelines %d; want [%d %d]", pipelineIDs, first.ID, second.ID)
+	}
+	if len(created) != 2 || len(created[1]) != 2 || created[1][0].Pipeline != second.ID {
+		t.Errorf("CreatePipelines() created %d pipelines of jobs; want 2 with the second's jobs in pipeline %d", len(created), second.ID)
+	}
+	pipeline := first
+	build, test := created[0][0], created[0][1]
+	if pipeline.ID == 0 || build.Pipeline != pipeline.ID || test.Pipeline != pipeline.ID {
+		t.Errorf("Job pipelines = %d, %d; want %d", build.Pipeline, test.Pipeline, pipeline.ID)
+	}
+	if build.State != gciwire.Pending || test.State != com.JobCreated {
+		t.Errorf("Job states = %s, %s; want pending, created", build.State, test.State)
+	}
+	if err := db.SetJobState(ctx, build, gciwire.Success, gciwire.NoneFailure); err != nil {
+		t.Fatalf("SetJobState() = %v; want nil", err)
+	}
+	if got, err := db.GetJob(ctx, test.ID); err != nil || got.State != gciwire.Pending {
+		t.Errorf("GetJob(test) = %+v, %v; want pending", got, err)
+	}
+}
+
+func TestCreateWebhookDeliveryDuplicates(t *testing.T) {
+	ctx, db := newMigratedDB(t)
+	defer db.Close()
+
+	newDelivery := func() *com.WebhookDelivery {
+		return &com.WebhookDelivery{Source: "github", DeliveryID: "d1", Body: []byte("{}")}
+	}
+
+	d := newDelivery()
+	if err := db.CreateWebhookDelivery(ctx, d); err != nil {
+		t.Fatalf("CreateWebhookDelivery() = %v; want nil", err)
+	}
+	// Pending deliveries are duplicates so that concurrent redeliveries aren't handled twice.
+	if err := db.CreateWebhookDelivery(ctx, newDelivery()); err != com.ErrDuplicate {
+		t.Fatalf("CreateWebhookDelivery(pending duplicate) = %v; want %v", err, com.ErrDuplicate)
+	}
+
+	if err := db.SetWebhookDeliveryResult(ctx, d, com.WebhookError, 500); err != nil {
+		t.Fatalf("SetWebhookDeliveryResult() = %v; want nil", err)
+	}
+	retry := newDelivery()
+	if err := db.CreateWebhookDelivery(ctx, retry); err != nil {
+		t.Fatalf("CreateWebhookDelivery(after error) = %v; want nil", err)
+	}
+	if err := db.SetWebhookDeliveryResult(ctx, retry, com.WebhookCreated, 201); err != nil {
+		t.Fatalf("SetWebhookDeliveryResult() = %v; want nil", err)
+	}
+	if err := db.CreateWebhookDelivery(ctx, newDelivery()); err != com.ErrDuplicate {
+		t.Fatalf("CreateWebhookDelivery(handled duplicate) = %v; want %v", err, com.ErrDuplicate)
+	}
+
+	replay := newDelivery()
+	replay.ReplayOf = retry.ID
+	if err := db.CreateWebhookDelivery(ctx, replay); err != nil {
+		t.Fatalf("CreateWebhookDelivery(replay) = %v; want nil", err)
+	}
+	other := newDelivery()
+	other.Source = "gitea"
+	if err := db.CreateWebhookDelivery(ctx, other); err != nil {
+		t.Fatalf("CreateWebhookDelivery(other source) = %v; want nil", err)
+	}
+
+	got, err := db.GetWebhookDelivery(ctx, retry.ID)
+	if err != nil {
+		t.Fatalf("GetWebhookDelivery() = %v; want nil", err)
+	}
+	if got.Result != com.WebhookCreated || got.ResponseCode != 201 || string(got.Body) != "{}" {
+		t.Errorf("GetWebhookDelivery() = %+v; want a created delivery with its body", got)
+	}
+	all, err := db.GetWebhookDeliveries(ctx, "github", 10)
+	if err != nil {
+		t.Fatalf("GetWebhookDeliveries() = %v; want nil", err)
+	} else if len(all) != 3 || all[0].ID != replay.ID {
+		t.Errorf("GetWebhookDeliveries() returned %d deliveries; want 3, newest first", len(all))
+	}
+}
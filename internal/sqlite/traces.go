@@ -0,0 +1,113 @@
+package sqlite
+
+import (
+	"bytes"
+	"context"
+
+	"crawshaw.io/sqlite"
+	com "go.spiff.io/gribble/internal/common"
+)
+
+// AppendTrace appends p to the job's trace at the given offset and returns the new length of the
+// trace. If offset is negative, p is appended to the end of the trace.
+//
+// If offset is not the current length of the trace, AppendTrace returns the current length and
+// com.ErrRangeMismatch.
+func (db *DB) AppendTrace(ctx context.Context, job, offset int64, p []byte) (size int64, err error) {
+	if job <= 0 {
+		return 0, com.ErrNoID
+	}
+
+	conn := db.get(ctx)
+	if conn == nil {
+		return 0, ErrNoConnection
+	}
+	defer db.put(conn)
+
+	err = db.savepoint(ctx, conn, func() error {
+		if size, err = traceLength(conn, job); err != nil {
+			return err
+		}
+		if offset >= 0 && offset != size {
+			return com.ErrRangeMismatch
+		}
+		if err = appendTrace(conn, job, size, p); err != nil {
+			return err
+		}
+		size += int64(len(p))
+		return nil
+	})
+	return size, err
+}
+
+// SetTrace replaces the job's trace with p.
+func (db *DB) SetTrace(ctx context.Context, job int64, p []byte) error {
+	if job <= 0 {
+		return com.ErrNoID
+	}
+
+	conn := db.get(ctx)
+	if conn == nil {
+		return ErrNoConnection
+	}
+	defer db.put(conn)
+
+	return db.savepoint(ctx, conn, func() error {
+		clear := conn.Prep(`DELETE FROM job_trace_chunks WHERE job = $job`)
+		defer clear.Reset()
+		clear.SetInt64("$job", job)
+		if _, err := clear.Step(); err != nil {
+			return err
+		}
+		return appendTrace(conn, job, 0, p)
+	})
+}
+
+// GetTrace returns the job's trace.
+func (db *DB) GetTrace(ctx context.Context, job int64) ([]byte, error) {
+	if job <= 0 {
+		return nil, com.ErrNoID
+	}
+
+	conn := db.get(ctx)
+	if conn == nil {
+		return nil, ErrNoConnection
+	}
+	defer db.put(conn)
+
+	get := conn.Prep(`SELECT data FROM job_trace_chunks WHERE job = $job ORDER BY offset`)
+	get.SetInt64("$job", job)
+
+	var trace bytes.Buffer
+	err := eachRow(ctx, get, func() error {
+		_, err := trace.ReadFrom(get.GetReader("data"))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return trace.Bytes(), nil
+}
+
+func traceLength(conn *sqlite.Conn, job int64) (int64, error) {
+	get := conn.Prep(`SELECT COALESCE(MAX(offset + length(data)), 0) AS size FROM job_trace_chunks WHERE job = $job`)
+	defer get.Reset()
+	get.SetInt64("$job", job)
+	if _, err := get.Step(); err != nil {
+		return 0, err
+	}
+	return get.GetInt64("size"), nil
+}
+
+func appendTrace(conn *sqlite.Conn, job, offset int64, p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	insert := conn.Prep(`INSERT INTO job_trace_chunks(job, offset, data) VALUES ($job, $offset, $data)`)
+	defer insert.Reset()
+	insert.SetInt64("$job", job)
+	insert.SetInt64("$offset", offset)
+	insert.SetBytes("$data", p)
+	_, err := insert.Step()
+	return err
+}